@@ -0,0 +1,109 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//keppel-agent runs keppel-registry processes on a worker host on behalf of
+//keppel-api's "agents" orchestration driver. It is configured with the
+//following environment variables:
+//
+//  KEPPEL_AGENT_SECRET          - shared secret that keppel-api uses to authenticate (required)
+//  KEPPEL_AGENT_LISTEN_ADDRESS  - where to listen for requests from keppel-api (default ":8090")
+//  KEPPEL_AGENT_RUNTIME_DIR     - where to put configuration files for keppel-registry
+//                                 (default "$XDG_RUNTIME_DIR/keppel-agent" or "/run/keppel-agent")
+//  KEPPEL_AGENT_TLS_CERT        - path to a TLS certificate for serving HTTPS (required)
+//  KEPPEL_AGENT_TLS_KEY         - path to the private key for KEPPEL_AGENT_TLS_CERT (required)
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/agent"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func main() {
+	logg.Info("starting keppel-agent %s", keppel.Version)
+	if os.Getenv("KEPPEL_DEBUG") == "1" {
+		logg.ShowDebug = true
+	}
+
+	secret := os.Getenv("KEPPEL_AGENT_SECRET")
+	if secret == "" {
+		logg.Fatal("missing required environment variable: KEPPEL_AGENT_SECRET")
+	}
+	listenAddress := os.Getenv("KEPPEL_AGENT_LISTEN_ADDRESS")
+	if listenAddress == "" {
+		listenAddress = ":8090"
+	}
+	runtimeDir := os.Getenv("KEPPEL_AGENT_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join(chooseRuntimeDir(), "keppel-agent")
+	}
+
+	server := agent.NewServer(secret, agent.ProcessLauncher{RuntimeDir: runtimeDir})
+	httpServer := &http.Server{Addr: listenAddress, Handler: server}
+	go func() {
+		<-contextWithSIGINT(context.Background()).Done()
+		httpServer.Shutdown(context.Background())
+	}()
+
+	//keppel-api only talks to agents over HTTPS since it sends credentials to them
+	tlsCertPath := os.Getenv("KEPPEL_AGENT_TLS_CERT")
+	if tlsCertPath == "" {
+		logg.Fatal("missing required environment variable: KEPPEL_AGENT_TLS_CERT")
+	}
+	tlsKeyPath := os.Getenv("KEPPEL_AGENT_TLS_KEY")
+	if tlsKeyPath == "" {
+		logg.Fatal("missing required environment variable: KEPPEL_AGENT_TLS_KEY")
+	}
+
+	logg.Info("listening on " + listenAddress)
+	err := httpServer.ListenAndServeTLS(tlsCertPath, tlsKeyPath)
+	if err != nil && err != http.ErrServerClosed {
+		logg.Fatal("error returned from http.ListenAndServeTLS(): %s", err.Error())
+	}
+
+	//do not leave orphaned keppel-registry processes behind
+	server.Shutdown()
+}
+
+func chooseRuntimeDir() string {
+	if val := os.Getenv("XDG_RUNTIME_DIR"); val != "" {
+		return val
+	}
+	return "/run"
+}
+
+func contextWithSIGINT(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		close(signalChan)
+		cancel()
+	}()
+	return ctx
+}
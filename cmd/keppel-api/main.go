@@ -27,16 +27,22 @@ import (
 	"os/signal"
 	"regexp"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/logg"
 	authapi "github.com/sapcc/keppel/pkg/api/auth"
 	keppelv1api "github.com/sapcc/keppel/pkg/api/keppel"
 	registryv2api "github.com/sapcc/keppel/pkg/api/registry"
+	uiapi "github.com/sapcc/keppel/pkg/api/ui"
+	"github.com/sapcc/keppel/pkg/backup"
 	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/tasks"
 
+	_ "github.com/sapcc/keppel/pkg/drivers/agents"
 	_ "github.com/sapcc/keppel/pkg/drivers/local_processes"
 	_ "github.com/sapcc/keppel/pkg/drivers/openstack"
+	_ "github.com/sapcc/keppel/pkg/drivers/shared_db"
 )
 
 func main() {
@@ -59,8 +65,8 @@ func main() {
 		http.DefaultClient.Transport = http.DefaultTransport
 	}
 
-	if len(os.Args) != 2 {
-		logg.Fatal("usage: keppel-api <config-path>")
+	if len(os.Args) < 2 {
+		logg.Fatal("usage: keppel-api <config-path> [<subcommand> [<args>...]]")
 	}
 	cfgFile, err := os.Open(os.Args[1])
 	if err == nil {
@@ -73,11 +79,18 @@ func main() {
 		logg.Fatal(err.Error())
 	}
 
+	//run administrative subcommand instead of the server, if requested
+	if len(os.Args) > 2 {
+		runSubcommand(os.Args[2], os.Args[3:])
+		return
+	}
+
 	//wire up HTTP handlers
 	r := mux.NewRouter()
 	keppelv1api.AddTo(r)
 	authapi.AddTo(r)
 	registryv2api.AddTo(r)
+	uiapi.AddTo(r)
 	r.Methods("GET").Path("/health").HandlerFunc(handleHealthcheck)
 
 	//TODO Prometheus instrumentation
@@ -97,8 +110,113 @@ func main() {
 		}
 	}()
 
+	ctx := contextWithSIGINT(context.Background())
+
+	//start background jobs
+	go tasks.RunImageExpiry(ctx, 1*time.Hour)
+	go tasks.RunSBOMGeneration(ctx, 1*time.Minute)
+	go tasks.RunAccessLogCleanup(ctx, 1*time.Hour)
+	go tasks.RunAuditCheckpoints(ctx, 1*time.Hour)
+	go tasks.RunAccountExpiry(ctx, 1*time.Minute)
+	go tasks.RunAccountDeletion(ctx, 1*time.Minute)
+
 	//enter orchestrator main loop
-	ok := keppel.State.OrchestrationDriver.Run(contextWithSIGINT(context.Background()))
+	ok := keppel.State.OrchestrationDriver.Run(ctx)
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func runSubcommand(name string, args []string) {
+	//all subcommands except for these do not take arguments
+	expectedArgs := map[string]string{
+		"backup":                    "<target-dir>",
+		"restore":                   "<source-dir>",
+		"backfill-metadata-records": "<account>",
+		"rebuild-metadata":          "<account>",
+	}
+	if usage, exists := expectedArgs[name]; exists {
+		if len(args) != 1 {
+			logg.Fatal("usage: keppel-api <config-path> %s %s", name, usage)
+		}
+	} else if len(args) != 0 {
+		logg.Fatal("usage: keppel-api <config-path> %s", name)
+	}
+
+	switch name {
+	case "rewrap-secrets":
+		//to rotate the master key for secrets, put the new key in front of the
+		//secrets.master_keys list, run this, then remove the old key
+		count, err := keppel.State.DB.RewrapSecrets()
+		if err != nil {
+			logg.Fatal("rewrapping secrets failed after %d secrets: %s", count, err.Error())
+		}
+		logg.Info("rewrapped %d secrets with master key %q", count, keppel.State.SecretMasterKeys[0].ID)
+	case "verify-audit-log":
+		verifyAuditLog()
+	case "backup":
+		err := backup.Create(contextWithSIGINT(context.Background()), args[0])
+		if err != nil {
+			logg.Fatal("backup failed: %s", err.Error())
+		}
+		logg.Info("backup written to %s", args[0])
+	case "restore":
+		problems, err := backup.Restore(contextWithSIGINT(context.Background()), args[0])
+		if err != nil {
+			logg.Fatal("restore failed: %s", err.Error())
+		}
+		for _, problem := range problems {
+			logg.Error("verification: %s", problem)
+		}
+		if len(problems) > 0 {
+			logg.Fatal("backup restored from %s, but verification found %d problems", args[0], len(problems))
+		}
+		logg.Info("backup restored from %s and verified successfully", args[0])
+	case "backfill-metadata-records":
+		count, err := backup.BackfillAccountMetadataRecords(contextWithSIGINT(context.Background()), args[0])
+		if err != nil {
+			logg.Fatal("backfilling metadata records failed after %d files: %s", count, err.Error())
+		}
+		logg.Info("[account=%s] wrote metadata records for %d files", args[0], count)
+	case "rebuild-metadata":
+		//only for disaster recovery when no backup of the account database is
+		//available; keppel-registry should not be running for this account
+		count, err := backup.RebuildAccountMetadata(contextWithSIGINT(context.Background()), args[0])
+		if err != nil {
+			logg.Fatal("rebuilding metadata failed after %d files: %s", count, err.Error())
+		}
+		logg.Info("[account=%s] rebuilt metadata for %d files", args[0], count)
+	default:
+		logg.Fatal("unknown subcommand: %q (known subcommands: backfill-metadata-records, backup, rebuild-metadata, restore, rewrap-secrets, verify-audit-log)", name)
+	}
+}
+
+//verifyAuditLog checks the audit logs of all accounts (including deleted
+//accounts), and exits with non-zero status if any problems are found.
+func verifyAuditLog() {
+	var accountNames []string
+	//also look at the checkpoints, to detect when all events of an account were deleted
+	_, err := keppel.State.DB.Select(&accountNames, `
+		SELECT account_name FROM audit_events UNION SELECT account_name FROM audit_checkpoints ORDER BY account_name`)
+	if err != nil {
+		logg.Fatal("cannot enumerate audit logs: %s", err.Error())
+	}
+
+	ok := true
+	for _, accountName := range accountNames {
+		result, err := keppel.State.DB.VerifyAuditLog(accountName)
+		if err != nil {
+			logg.Fatal("cannot verify audit log of account %s: %s", accountName, err.Error())
+		}
+		for _, problem := range result.Problems {
+			logg.Error("[account=%s] %s", accountName, problem)
+		}
+		if result.IsValid() {
+			logg.Info("[account=%s] audit log is valid (%d events, %d checkpoints)", accountName, result.EventCount, result.CheckpointCount)
+		} else {
+			ok = false
+		}
+	}
 	if !ok {
 		os.Exit(1)
 	}
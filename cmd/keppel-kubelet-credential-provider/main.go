@@ -0,0 +1,256 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//keppel-kubelet-credential-provider implements the exec protocol for kubelet
+//image credential providers. Given an image reference on stdin, it obtains a
+//short-lived pull token for that repository from keppel-api's auth endpoint,
+//using the node's own credentials, and returns it to the kubelet. This way,
+//workloads can pull from Keppel without pull secrets in their namespaces.
+//
+//The node's credentials are read from the environment variables
+//KEPPEL_USERNAME and KEPPEL_PASSWORD (or KEPPEL_PASSWORD_FILE, which is
+//re-read on every invocation, so it can be rotated). If KEPPEL_CACHE_DIR is
+//set, tokens are cached in that directory until shortly before they expire.
+//
+//The returned credentials use the special user name "$token", which makes the
+//registry's token request exchange the pull token for a registry token
+//without ever exposing the node's credentials to the container runtime.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//CredentialProviderRequest is the format of stdin as defined by the kubelet.
+type CredentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+//CredentialProviderResponse is the format of stdout as defined by the kubelet.
+type CredentialProviderResponse struct {
+	APIVersion    string                `json:"apiVersion"`
+	Kind          string                `json:"kind"`
+	CacheKeyType  string                `json:"cacheKeyType"`
+	CacheDuration string                `json:"cacheDuration,omitempty"`
+	Auth          map[string]AuthConfig `json:"auth"`
+}
+
+//AuthConfig appears in CredentialProviderResponse.
+type AuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+//token is the part of keppel-api's token response that we need, plus the
+//expiry time which we compute upon receiving the response. (We do not import
+//package auth here since that would pull all of keppel-api into this binary.)
+type token struct {
+	Token     string    `json:"token"`
+	ExpiresIn uint64    `json:"expires_in"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+//tokenExchangeUserName is the same as auth.TokenExchangeUserName.
+const tokenExchangeUserName = "$token"
+
+//How long before the actual expiry a token is considered expired, so that
+//image pulls do not start with a token that expires halfway through.
+const expiryMargin = 5 * time.Minute
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keppel-kubelet-credential-provider: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var req CredentialProviderRequest
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		return fmt.Errorf("cannot decode CredentialProviderRequest: %s", err.Error())
+	}
+	if req.Kind != "CredentialProviderRequest" {
+		return fmt.Errorf("expected kind CredentialProviderRequest, got %q", req.Kind)
+	}
+
+	hostName, repoName, err := parseImageReference(req.Image)
+	if err != nil {
+		return err
+	}
+	t, err := getToken(hostName, repoName)
+	if err != nil {
+		return err
+	}
+
+	//the token only covers a single repository, so the kubelet must not use it
+	//for other images on the same registry
+	resp := CredentialProviderResponse{
+		APIVersion:    req.APIVersion,
+		Kind:          "CredentialProviderResponse",
+		CacheKeyType:  "Image",
+		CacheDuration: time.Until(t.ExpiresAt.Add(-expiryMargin)).Round(time.Second).String(),
+		Auth: map[string]AuthConfig{
+			hostName: {Username: tokenExchangeUserName, Password: t.Token},
+		},
+	}
+	return json.NewEncoder(os.Stdout).Encode(resp)
+}
+
+//parseImageReference splits an image reference like
+//"registry.example.org/account/repo:tag" into the registry hostname and the
+//repository name ("account/repo").
+func parseImageReference(image string) (hostName, repoName string, err error) {
+	fields := strings.SplitN(image, "/", 2)
+	if len(fields) != 2 || !strings.ContainsAny(fields[0], ".:") {
+		return "", "", fmt.Errorf("image reference %q does not contain a registry hostname", image)
+	}
+	hostName, repoName = fields[0], fields[1]
+
+	//strip digest and/or tag
+	if idx := strings.Index(repoName, "@"); idx >= 0 {
+		repoName = repoName[:idx]
+	}
+	if idx := strings.LastIndex(repoName, ":"); idx >= 0 {
+		repoName = repoName[:idx]
+	}
+	if !strings.Contains(repoName, "/") {
+		return "", "", fmt.Errorf("image reference %q does not contain an account name", image)
+	}
+	return hostName, repoName, nil
+}
+
+func getToken(hostName, repoName string) (*token, error) {
+	cachePath := ""
+	if cacheDir := os.Getenv("KEPPEL_CACHE_DIR"); cacheDir != "" {
+		sum := sha256.Sum256([]byte(hostName + "/" + repoName))
+		cachePath = filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".json")
+		t, err := readCachedToken(cachePath)
+		if err == nil && time.Now().Add(expiryMargin).Before(t.ExpiresAt) {
+			return t, nil
+		}
+	}
+
+	userName, password, err := getCredentials()
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{
+		Scheme: "https",
+		Host:   hostName,
+		Path:   "/keppel/v1/auth",
+		RawQuery: url.Values{
+			"service": {serviceName(hostName)},
+			"scope":   {fmt.Sprintf("repository:%s:pull", repoName)},
+		}.Encode(),
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(userName, password)
+
+	//take the time before sending the request, so that the computed expiry time
+	//errs on the early side
+	requestedAt := time.Now()
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %d: %s", u.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var t token
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode token response: %s", err.Error())
+	}
+	t.ExpiresAt = requestedAt.Add(time.Duration(t.ExpiresIn) * time.Second)
+
+	if cachePath != "" {
+		//failure to write the cache is not fatal; we will just ask again next time
+		buf, _ := json.Marshal(t)
+		err := ioutil.WriteFile(cachePath, buf, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "keppel-kubelet-credential-provider: cannot write token cache: "+err.Error())
+		}
+	}
+	return &t, nil
+}
+
+//serviceName returns the "service" argument for the token request, which is
+//the registry hostname without the port.
+func serviceName(hostName string) string {
+	host, _, err := net.SplitHostPort(hostName)
+	if err == nil {
+		return host
+	}
+	return hostName
+}
+
+func readCachedToken(path string) (*token, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t token
+	err = json.Unmarshal(buf, &t)
+	return &t, err
+}
+
+func getCredentials() (userName, password string, err error) {
+	userName = os.Getenv("KEPPEL_USERNAME")
+	if userName == "" {
+		return "", "", errors.New("missing environment variable: KEPPEL_USERNAME")
+	}
+	password = os.Getenv("KEPPEL_PASSWORD")
+	if password != "" {
+		return userName, password, nil
+	}
+	passwordFile := os.Getenv("KEPPEL_PASSWORD_FILE")
+	if passwordFile == "" {
+		return "", "", errors.New("missing environment variable: KEPPEL_PASSWORD or KEPPEL_PASSWORD_FILE")
+	}
+	buf, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return "", "", err
+	}
+	return userName, strings.TrimSpace(string(buf)), nil
+}
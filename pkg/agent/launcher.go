@@ -0,0 +1,189 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//How long ProcessLauncher waits for a keppel-registry to accept connections.
+const readinessTimeout = 30 * time.Second
+
+//ProcessLauncher is the Launcher used by keppel-agent. It runs keppel-registry
+//as a subprocess that listens on a random port on localhost.
+type ProcessLauncher struct {
+	//RuntimeDir is where the configuration files for keppel-registry are put.
+	RuntimeDir string
+}
+
+//Launch implements the Launcher interface.
+func (l ProcessLauncher) Launch(accountName string, spec RegistrySpec) (*Process, error) {
+	port, err := findFreePort()
+	if err != nil {
+		return nil, err
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+
+	err = os.MkdirAll(l.RuntimeDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	certPath := filepath.Join(l.RuntimeDir, "issuer-cert-bundle-"+accountName+".pem")
+	err = ioutil.WriteFile(certPath, []byte(spec.IssuerCertPEM), 0600)
+	if err != nil {
+		return nil, err
+	}
+	var tlsFiles *tlsFilePaths
+	if spec.TLS != nil {
+		tlsFiles, err = writeTLSFiles(l.RuntimeDir, accountName, *spec.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config, err := localizeConfig(spec.Config, address, certPath, tlsFiles)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse keppel-registry config: %s", err.Error())
+	}
+	//the file may contain credentials if the config template refers to .Storage
+	configPath := filepath.Join(l.RuntimeDir, "registry-"+accountName+".yaml")
+	err = ioutil.WriteFile(configPath, config, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("keppel-registry", "serve", configPath)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	//the registry config contains a log field with the account name that gets
+	//added to all log messages produced by the keppel-registry (it is therefore
+	//safe to send its log directly to our own stdout)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	proc := &Process{
+		Address: address,
+		Exited:  exited,
+		Stop:    func() { cmd.Process.Signal(os.Interrupt) },
+	}
+	err = waitUntilListening(address, exited)
+	if err != nil {
+		proc.Stop()
+		return nil, err
+	}
+	return proc, nil
+}
+
+type tlsFilePaths struct {
+	Certificate    string
+	Key            string
+	ClientCABundle string
+}
+
+//writeTLSFiles puts the server certificate and the CA certificate from the
+//RegistrySpec where keppel-registry can read them.
+func writeTLSFiles(runtimeDir, accountName string, t RegistryTLS) (*tlsFilePaths, error) {
+	paths := &tlsFilePaths{
+		Certificate:    filepath.Join(runtimeDir, "registry-"+accountName+"-cert.pem"),
+		Key:            filepath.Join(runtimeDir, "registry-"+accountName+"-key.pem"),
+		ClientCABundle: filepath.Join(runtimeDir, "internal-ca-"+accountName+".pem"),
+	}
+	err := ioutil.WriteFile(paths.Certificate, []byte(t.CertPEM), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(paths.Key, []byte(t.KeyPEM), 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(paths.ClientCABundle, []byte(t.CACertPEM), 0600)
+	}
+	return paths, err
+}
+
+//localizeConfig fills in the settings in the keppel-registry config that
+//depend on the host where the agent is running.
+func localizeConfig(config, address, certPath string, tlsFiles *tlsFilePaths) ([]byte, error) {
+	cfg := make(map[interface{}]interface{})
+	err := yaml.Unmarshal([]byte(config), &cfg)
+	if err != nil {
+		return nil, err
+	}
+	subsection(cfg, "http")["addr"] = address
+	subsection(subsection(cfg, "auth"), "token")["rootcertbundle"] = certPath
+	if tlsFiles != nil {
+		subsection(cfg, "http")["tls"] = map[interface{}]interface{}{
+			"certificate": tlsFiles.Certificate,
+			"key":         tlsFiles.Key,
+			"clientcas":   []interface{}{tlsFiles.ClientCABundle},
+		}
+	}
+	return yaml.Marshal(cfg)
+}
+
+//subsection returns the section with the given key, creating it if it does
+//not exist yet.
+func subsection(section map[interface{}]interface{}, key string) map[interface{}]interface{} {
+	sub, ok := section[key].(map[interface{}]interface{})
+	if !ok {
+		sub = make(map[interface{}]interface{})
+		section[key] = sub
+	}
+	return sub
+}
+
+func findFreePort() (uint16, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+//waitUntilListening polls the given address until it accepts connections.
+func waitUntilListening(address string, exited <-chan error) error {
+	deadline := time.Now().Add(readinessTimeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-exited:
+			return errors.New("keppel-registry exited during startup")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("keppel-registry did not start listening on %s within %s", address, readinessTimeout)
+}
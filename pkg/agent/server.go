@@ -0,0 +1,458 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package agent contains the implementation of keppel-agent, which runs
+//keppel-registry processes on behalf of the "agents" orchestration driver of
+//keppel-api.
+package agent
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/respondwith"
+)
+
+//SecretHeader is the request header that carries the shared secret which
+//keppel-api uses to authenticate itself to keppel-agent.
+const SecretHeader = "X-Keppel-Agent-Secret"
+
+//NotRunningHeader is set on the 404 responses that keppel-agent generates when
+//a request is proxied to a keppel-registry that the agent does not run. (This
+//distinguishes them from 404 responses generated by keppel-registry itself.)
+const NotRunningHeader = "X-Keppel-Agent-Not-Running"
+
+//How long keppel-agent waits before restarting a keppel-registry that exited
+//unexpectedly. (This is a variable for the sake of the unit tests.)
+var restartDelay = 5 * time.Second
+
+//RegistrySpec describes a keppel-registry process that an agent shall run.
+//It is the request body of `PUT /agent/v1/registries/:account`.
+type RegistrySpec struct {
+	//Config is the keppel-registry configuration file. The agent replaces the
+	//http.addr and auth.token.rootcertbundle settings in it, as well as
+	//http.tls if TLS is set.
+	Config string `json:"config"`
+	//Env contains additional environment variables for keppel-registry, in the
+	//form "KEY=value".
+	Env []string `json:"env"`
+	//IssuerCertPEM is the certificate that keppel-registry uses to validate the
+	//tokens issued by keppel-api.
+	IssuerCertPEM string `json:"issuer_cert"`
+	//TLS is set when keppel-registry shall only accept mutual TLS connections.
+	TLS *RegistryTLS `json:"tls,omitempty"`
+}
+
+//RegistryTLS contains the certificates for mutual TLS between keppel-agent and
+//keppel-registry. All certificates are issued by keppel-api's internal CA.
+type RegistryTLS struct {
+	//CACertPEM is the certificate of the internal CA. keppel-registry uses it to
+	//verify client certificates, and the agent uses it to verify the server
+	//certificate of keppel-registry.
+	CACertPEM string `json:"ca_cert"`
+	//CertPEM and KeyPEM are the server certificate of keppel-registry.
+	CertPEM string `json:"cert"`
+	KeyPEM  string `json:"key"`
+	//ServerName is the name in the server certificate of keppel-registry.
+	ServerName string `json:"server_name"`
+	//ClientCertPEM and ClientKeyPEM are the client certificate that the agent
+	//presents when forwarding requests to keppel-registry.
+	ClientCertPEM string `json:"client_cert"`
+	ClientKeyPEM  string `json:"client_key"`
+}
+
+//transport builds the http.RoundTripper that the agent uses to forward
+//requests to a keppel-registry with this TLS configuration.
+func (t RegistryTLS) transport() (http.RoundTripper, error) {
+	clientCert, err := tls.X509KeyPair([]byte(t.ClientCertPEM), []byte(t.ClientKeyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(t.CACertPEM)) {
+		return nil, errors.New("invalid CA certificate")
+	}
+	//same settings as http.DefaultTransport, except for TLS
+	d := http.DefaultTransport.(*http.Transport)
+	return &http.Transport{
+		Proxy:                 d.Proxy,
+		DialContext:           d.DialContext,
+		MaxIdleConns:          d.MaxIdleConns,
+		IdleConnTimeout:       d.IdleConnTimeout,
+		TLSHandshakeTimeout:   d.TLSHandshakeTimeout,
+		ExpectContinueTimeout: d.ExpectContinueTimeout,
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+			ServerName:   t.ServerName,
+		},
+	}, nil
+}
+
+//expiry returns when the first of the certificates in this TLS configuration
+//expires.
+func (t RegistryTLS) expiry() (time.Time, error) {
+	var result time.Time
+	for _, certPEM := range []string{t.CertPEM, t.ClientCertPEM} {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return time.Time{}, errors.New("certificate is not PEM-encoded")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if result.IsZero() || cert.NotAfter.Before(result) {
+			result = cert.NotAfter
+		}
+	}
+	return result, nil
+}
+
+//Launcher starts keppel-registry processes on behalf of a Server.
+type Launcher interface {
+	//Launch starts a keppel-registry for the given account. When it returns
+	//successfully, the process must be ready to accept HTTP requests.
+	Launch(accountName string, spec RegistrySpec) (*Process, error)
+}
+
+//Process is a keppel-registry process started by a Launcher.
+type Process struct {
+	//Address is the "host:port" where the process accepts HTTP requests.
+	Address string
+	//Exited receives exactly one value when the process has exited.
+	Exited <-chan error
+	//Stop asks the process to shut down.
+	Stop func()
+}
+
+//Server is the HTTP API of keppel-agent. It runs keppel-registry processes
+//when instructed by keppel-api, and forwards requests to them.
+type Server struct {
+	secret    string
+	launcher  Launcher
+	router    http.Handler
+	mutex     sync.Mutex
+	waitGroup sync.WaitGroup
+	//key = account name
+	registries map[string]*agentRegistry
+}
+
+type agentRegistry struct {
+	Spec RegistrySpec
+	//nil unless Spec.TLS is set
+	Transport http.RoundTripper
+	//when the certificates in Spec.TLS expire (zero unless Spec.TLS is set)
+	CertificatesExpireAt time.Time
+	//nil while the process is being started or restarted
+	Process *Process
+	//set when the registry shall not be restarted when its process exits
+	Stopped bool
+	//closed once the first launch of the process has completed (successfully
+	//or not)
+	Launched chan struct{}
+}
+
+//NewServer initializes a Server. Requests must carry the given secret in the
+//X-Keppel-Agent-Secret header.
+func NewServer(secret string, launcher Launcher) *Server {
+	s := &Server{
+		secret:     secret,
+		launcher:   launcher,
+		registries: make(map[string]*agentRegistry),
+	}
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/agent/v1/registries").HandlerFunc(s.handleListRegistries)
+	r.Methods("PUT").Path("/agent/v1/registries/{account}").HandlerFunc(s.handlePutRegistry)
+	r.Methods("DELETE").Path("/agent/v1/registries/{account}").HandlerFunc(s.handleDeleteRegistry)
+	r.PathPrefix("/agent/v1/registries/{account}/proxy/").HandlerFunc(s.handleProxy)
+	s.router = r
+	return s
+}
+
+//ServeHTTP implements the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(s.secret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+//Shutdown stops all keppel-registry processes and waits for them to exit.
+func (s *Server) Shutdown() {
+	s.mutex.Lock()
+	for accountName, reg := range s.registries {
+		s.stopRegistry(accountName, reg)
+	}
+	s.mutex.Unlock()
+	s.waitGroup.Wait()
+}
+
+func (s *Server) handleListRegistries(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	accountNames := make([]string, 0, len(s.registries))
+	certsExpireAt := make(map[string]time.Time)
+	for accountName, reg := range s.registries {
+		accountNames = append(accountNames, accountName)
+		if !reg.CertificatesExpireAt.IsZero() {
+			certsExpireAt[accountName] = reg.CertificatesExpireAt
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(accountNames)
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"registries":             accountNames,
+		"certificates_expire_at": certsExpireAt,
+	})
+}
+
+func (s *Server) handlePutRegistry(w http.ResponseWriter, r *http.Request) {
+	accountName := mux.Vars(r)["account"]
+	var spec RegistrySpec
+	err := json.NewDecoder(r.Body).Decode(&spec)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		transport     http.RoundTripper
+		certsExpireAt time.Time
+	)
+	if spec.TLS != nil {
+		transport, err = spec.TLS.transport()
+		if err == nil {
+			certsExpireAt, err = spec.TLS.expiry()
+		}
+		if err != nil {
+			http.Error(w, "invalid TLS configuration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	//this request is idempotent: if the requested registry is already running
+	//(or being started), there is nothing to do
+	reg := s.registries[accountName]
+	if reg != nil {
+		if reflect.DeepEqual(reg.Spec, spec) {
+			s.mutex.Unlock()
+			<-reg.Launched
+			if !s.isRunning(accountName, reg) {
+				http.Error(w, "keppel-registry could not be started, please retry", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.stopRegistry(accountName, reg)
+	}
+	//register the new registry before launching it, so that concurrent requests
+	//for the same spec do not launch it again
+	reg = &agentRegistry{
+		Spec:                 spec,
+		Transport:            transport,
+		CertificatesExpireAt: certsExpireAt,
+		Launched:             make(chan struct{}),
+	}
+	s.registries[accountName] = reg
+	s.waitGroup.Add(1)
+	s.mutex.Unlock()
+
+	//launching can take a while, so this happens without holding the mutex
+	logg.Info("[account=%s] starting keppel-registry", accountName)
+	proc, err := s.launcher.Launch(accountName, spec)
+	if err != nil {
+		s.mutex.Lock()
+		reg.Stopped = true
+		if s.registries[accountName] == reg {
+			delete(s.registries, accountName)
+		}
+		s.mutex.Unlock()
+		close(reg.Launched)
+		s.waitGroup.Done()
+		respondwith.ErrorText(w, err)
+		return
+	}
+	ok := s.setProcess(reg, proc)
+	go s.supervise(accountName, reg, proc)
+	close(reg.Launched)
+	if !ok {
+		http.Error(w, "keppel-registry was stopped while it was being started", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+//setProcess records the newly launched process of the given registry. If the
+//registry was stopped while the process was being launched, the process is
+//stopped right away and false is returned.
+func (s *Server) setProcess(reg *agentRegistry, proc *Process) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reg.Process = proc
+	if reg.Stopped {
+		proc.Stop()
+		return false
+	}
+	return true
+}
+
+//isRunning returns whether the given registry is still the one for the given
+//account, and its process is running.
+func (s *Server) isRunning(accountName string, reg *agentRegistry) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.registries[accountName] == reg && reg.Process != nil
+}
+
+func (s *Server) handleDeleteRegistry(w http.ResponseWriter, r *http.Request) {
+	accountName := mux.Vars(r)["account"]
+	s.mutex.Lock()
+	reg := s.registries[accountName]
+	if reg != nil {
+		s.stopRegistry(accountName, reg)
+	}
+	s.mutex.Unlock()
+
+	if reg == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//stopRegistry must be called with s.mutex held.
+func (s *Server) stopRegistry(accountName string, reg *agentRegistry) {
+	logg.Info("[account=%s] stopping keppel-registry", accountName)
+	reg.Stopped = true
+	if reg.Process != nil {
+		reg.Process.Stop()
+	}
+	delete(s.registries, accountName)
+}
+
+//supervise waits for the given keppel-registry process to exit, and restarts
+//it unless it was stopped on purpose.
+func (s *Server) supervise(accountName string, reg *agentRegistry, proc *Process) {
+	defer s.waitGroup.Done()
+	for {
+		err := <-proc.Exited
+		s.mutex.Lock()
+		reg.Process = nil
+		stopped := reg.Stopped
+		s.mutex.Unlock()
+		if stopped {
+			return
+		}
+		if err == nil {
+			logg.Error("[account=%s] keppel-registry exited unexpectedly", accountName)
+		} else {
+			logg.Error("[account=%s] keppel-registry exited with error: %s", accountName, err.Error())
+		}
+
+		for {
+			time.Sleep(restartDelay)
+			s.mutex.Lock()
+			stopped := reg.Stopped
+			s.mutex.Unlock()
+			if stopped {
+				return
+			}
+			//launching can take a while, so this happens without holding the mutex
+			//(reg.Spec is never changed, so it can be read without it)
+			logg.Info("[account=%s] restarting keppel-registry", accountName)
+			proc, err = s.launcher.Launch(accountName, reg.Spec)
+			if err == nil {
+				//if the registry was stopped in the meantime, the new process is
+				//stopped right away, and we return after it has exited
+				s.setProcess(reg, proc)
+				break
+			}
+			logg.Error("[account=%s] cannot restart keppel-registry: %s", accountName, err.Error())
+		}
+	}
+}
+
+func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
+	accountName := mux.Vars(r)["account"]
+	s.mutex.Lock()
+	reg := s.registries[accountName]
+	s.mutex.Unlock()
+	if reg != nil {
+		//if the registry is just being started, wait for it
+		<-reg.Launched
+	}
+
+	s.mutex.Lock()
+	var (
+		address   string
+		transport http.RoundTripper
+	)
+	if reg != nil && reg.Process != nil {
+		address = reg.Process.Address
+		transport = reg.Transport
+	}
+	s.mutex.Unlock()
+
+	if address == "" {
+		w.Header().Set(NotRunningHeader, "1")
+		http.Error(w, "keppel-registry is not running for account "+accountName, http.StatusNotFound)
+		return
+	}
+
+	pathPrefix := "/agent/v1/registries/" + accountName + "/proxy"
+	scheme := "http"
+	if transport != nil {
+		scheme = "https"
+	}
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(r *http.Request) {
+			r.URL.Scheme = scheme
+			r.URL.Host = address
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, pathPrefix)
+			r.URL.RawPath = ""
+			r.Header.Del(SecretHeader)
+		},
+	}
+	//the proxy is supposed to be transparent, so it shall pass on the
+	//X-Forwarded-For header set by keppel-api instead of adding our own address
+	//to it (ReverseProxy only does that when it knows the client address)
+	proxyRequest := *r
+	proxyRequest.RemoteAddr = ""
+	proxy.ServeHTTP(w, &proxyRequest)
+}
@@ -0,0 +1,331 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package agent_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/agent"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestServer(t *testing.T) {
+	agent.SetRestartDelay(10 * time.Millisecond)
+	launcher := test.NewAgentLauncher("agent1")
+	server := agent.NewServer("s3cr3t", launcher)
+	defer server.Shutdown()
+	header := map[string]string{agent.SecretHeader: "s3cr3t"}
+
+	//requests without the correct secret are rejected
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries",
+		ExpectStatus: http.StatusUnauthorized,
+	}.Check(t, server)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries",
+		Header:       map[string]string{agent.SecretHeader: "wrong"},
+		ExpectStatus: http.StatusUnauthorized,
+	}.Check(t, server)
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries",
+		Header:       header,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"registries":             []interface{}{},
+			"certificates_expire_at": assert.JSONObject{},
+		},
+	}.Check(t, server)
+
+	//proxying to a registry that is not running fails with a special marker
+	//that the orchestration driver recognizes
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries/first/proxy/v2/",
+		Header:       header,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("keppel-registry is not running for account first\n"),
+	}.Check(t, server)
+
+	spec := assert.JSONObject{
+		"config":      "version: 0.1\n",
+		"env":         []string{"REGISTRY_STORAGE=inmemory"},
+		"issuer_cert": test.UnitTestIssuerCert,
+	}
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/agent/v1/registries/first",
+		Header:       header,
+		Body:         spec,
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, server)
+	//starting the same registry again does nothing
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/agent/v1/registries/first",
+		Header:       header,
+		Body:         spec,
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, server)
+	assert.DeepEqual(t, "launches", launcher.Launches("first"), 1)
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries",
+		Header:       header,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"registries":             []string{"first"},
+			"certificates_expire_at": assert.JSONObject{},
+		},
+	}.Check(t, server)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries/first/proxy/v2/first/foo/manifests/latest",
+		Header:       header,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.StringData("first on agent1: GET /v2/first/foo/manifests/latest"),
+	}.Check(t, server)
+
+	//when the registry crashes, it is restarted
+	launcher.Crash("first")
+	for launcher.Launches("first") < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries/first/proxy/v2/",
+		Header:       header,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.StringData("first on agent1: GET /v2/"),
+	}.Check(t, server)
+
+	//stop the registry
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/agent/v1/registries/first",
+		Header:       header,
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, server)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/agent/v1/registries/first",
+		Header:       header,
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, server)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries/first/proxy/v2/",
+		Header:       header,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("keppel-registry is not running for account first\n"),
+	}.Check(t, server)
+}
+
+func TestServerWithTLS(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+		secrets:
+			master_keys:
+				- { id: first, key: 'MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=' }
+		trust:
+			registry_tls: true
+	`)
+	ca := keppel.State.InternalCA
+	serverCert, err := ca.IssueRegistryCertificate("first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	clientCert, err := ca.IssueClientCertificate("keppel-agent")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	launcher := test.NewAgentLauncher("agent1")
+	server := agent.NewServer("s3cr3t", launcher)
+	defer server.Shutdown()
+	header := map[string]string{agent.SecretHeader: "s3cr3t"}
+
+	tlsSpec := assert.JSONObject{
+		"ca_cert":     ca.CertPEM(),
+		"cert":        serverCert.CertPEM,
+		"key":         string(serverCert.KeyPEM),
+		"server_name": keppel.RegistryServerName("first"),
+		"client_cert": clientCert.CertPEM,
+		"client_key":  string(clientCert.KeyPEM),
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/agent/v1/registries/first",
+		Header: header,
+		Body: assert.JSONObject{
+			"config":      "version: 0.1\n",
+			"issuer_cert": test.UnitTestIssuerCert,
+			"tls":         tlsSpec,
+		},
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, server)
+
+	//requests are forwarded over mutual TLS
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries/first/proxy/v2/",
+		Header:       header,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.StringData("first on agent1: GET /v2/"),
+	}.Check(t, server)
+
+	//the agent reports when the certificates expire, so that keppel-api can
+	//renew them in time (the server certificate was issued first, so it expires
+	//first)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries",
+		Header:       header,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"registries":             []string{"first"},
+			"certificates_expire_at": assert.JSONObject{"first": serverCert.NotAfter},
+		},
+	}.Check(t, server)
+
+	//when the registry's certificate does not match the expected name, the
+	//request is not forwarded
+	tlsSpec["server_name"] = keppel.RegistryServerName("second")
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/agent/v1/registries/first",
+		Header: header,
+		Body: assert.JSONObject{
+			"config":      "version: 0.1\n",
+			"issuer_cert": test.UnitTestIssuerCert,
+			"tls":         tlsSpec,
+		},
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, server)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/agent/v1/registries/first/proxy/v2/",
+		Header:       header,
+		ExpectStatus: http.StatusBadGateway,
+	}.Check(t, server)
+
+	//malformed certificates are rejected
+	tlsSpec["client_key"] = "garbage"
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/agent/v1/registries/first",
+		Header: header,
+		Body: assert.JSONObject{
+			"config":      "version: 0.1\n",
+			"issuer_cert": test.UnitTestIssuerCert,
+			"tls":         tlsSpec,
+		},
+		ExpectStatus: http.StatusBadRequest,
+	}.Check(t, server)
+}
+
+//slowLauncher is an agent.Launcher whose launches block until Release is
+//closed.
+type slowLauncher struct {
+	agent.Launcher
+	Started chan struct{}
+	Release chan struct{}
+}
+
+func (l slowLauncher) Launch(accountName string, spec agent.RegistrySpec) (*agent.Process, error) {
+	l.Started <- struct{}{}
+	<-l.Release
+	return l.Launcher.Launch(accountName, spec)
+}
+
+func TestServerDoesNotBlockDuringLaunch(t *testing.T) {
+	launcher := slowLauncher{
+		Launcher: test.NewAgentLauncher("agent1"),
+		Started:  make(chan struct{}, 1),
+		Release:  make(chan struct{}),
+	}
+	server := agent.NewServer("s3cr3t", launcher)
+	defer server.Shutdown()
+
+	serve := func(method, path, body string) <-chan *httptest.ResponseRecorder {
+		result := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set(agent.SecretHeader, "s3cr3t")
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			result <- rec
+		}()
+		return result
+	}
+	expectPending := func(description string, result <-chan *httptest.ResponseRecorder) {
+		t.Helper()
+		select {
+		case rec := <-result:
+			t.Errorf("expected %s to wait for the launch, but got status %d", description, rec.Code)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	expectResponse := func(description string, result <-chan *httptest.ResponseRecorder, status int, body string) {
+		t.Helper()
+		select {
+		case rec := <-result:
+			assert.DeepEqual(t, "status of "+description, rec.Code, status)
+			assert.DeepEqual(t, "body of "+description, rec.Body.String(), body)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not complete", description)
+		}
+	}
+
+	spec := `{"config":"version: 0.1\n"}`
+	putResult := serve("PUT", "/agent/v1/registries/first", spec)
+	<-launcher.Started
+
+	//while the launch is in progress, unrelated requests are not blocked...
+	expectResponse("GET /agent/v1/registries", serve("GET", "/agent/v1/registries", ""),
+		http.StatusOK, `{"certificates_expire_at":{},"registries":["first"]}`)
+	expectResponse("proxy request for other account", serve("GET", "/agent/v1/registries/second/proxy/v2/", ""),
+		http.StatusNotFound, "keppel-registry is not running for account second\n")
+
+	//...but requests for the registry that is being launched wait for it
+	proxyResult := serve("GET", "/agent/v1/registries/first/proxy/v2/", "")
+	repeatedPutResult := serve("PUT", "/agent/v1/registries/first", spec)
+	expectPending("PUT", putResult)
+	expectPending("proxy request", proxyResult)
+	expectPending("repeated PUT", repeatedPutResult)
+
+	close(launcher.Release)
+	expectResponse("PUT", putResult, http.StatusCreated, "")
+	expectResponse("proxy request", proxyResult, http.StatusOK, "first on agent1: GET /v2/")
+	expectResponse("repeated PUT", repeatedPutResult, http.StatusNoContent, "")
+}
@@ -20,7 +20,10 @@
 package authapi
 
 import (
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/respondwith"
@@ -51,6 +54,11 @@ func handleGetAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.UserName == auth.TokenExchangeUserName {
+		handleTokenExchange(w, r, req)
+		return
+	}
+
 	//find account if scope requested
 	var account *keppel.Account
 	if req.Scope != nil && req.Scope.ResourceType == "repository" {
@@ -63,10 +71,28 @@ func handleGetAuth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//check user access
-	authz, err := keppel.State.AuthDriver.AuthenticateUser(req.UserName, req.Password)
-	if respondWithError(w, http.StatusUnauthorized, err) {
+	var (
+		authz keppel.Authorization
+		pat   *keppel.PersonalAccessToken
+		rerr  *keppel.RegistryV2Error
+	)
+	if strings.HasPrefix(req.Password, keppel.PersonalAccessTokenPrefix) {
+		authz, pat, rerr = authenticatePersonalAccessToken(req.Password)
+	} else {
+		authz, rerr = keppel.State.AuthDriver.AuthenticateUser(req.UserName, req.Password)
+	}
+	if rerr != nil {
+		respondWithError(w, http.StatusUnauthorized, rerr)
 		return
 	}
+	if pat != nil {
+		//the token is issued to the owner of the personal access token,
+		//regardless of which user name the client gave
+		req.UserName = pat.UserName
+		if pat.AccountName != nil && account != nil && account.Name != *pat.AccountName {
+			account = nil
+		}
+	}
 
 	//check requested scope and actions
 	if req.Scope != nil {
@@ -74,7 +100,7 @@ func handleGetAuth(w http.ResponseWriter, r *http.Request) {
 		case "registry":
 			if req.Scope.ResourceName == "catalog" {
 				req.Scope.Actions = []string{"*"}
-				req.CompiledScopes, err = compileCatalogAccess(authz)
+				req.CompiledScopes, err = compileCatalogAccess(authz, pat)
 				if respondWithError(w, http.StatusInternalServerError, err) {
 					return
 				}
@@ -92,13 +118,33 @@ func handleGetAuth(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	tokenInfo, err := req.ToToken().ToResponse()
+	token := req.ToToken()
+	err = bindToClient(token, r)
+	if respondWithError(w, http.StatusBadRequest, err) {
+		return
+	}
+	tokenInfo, err := token.ToResponse()
 	if respondWithError(w, http.StatusBadRequest, err) {
 		return
 	}
 	respondwith.JSON(w, http.StatusOK, tokenInfo)
 }
 
+//bindToClient binds the token to the network address of the client that
+//requested it, if token binding is enabled.
+func bindToClient(token *auth.Token, r *http.Request) error {
+	binding := keppel.State.Config.TokenBinding
+	if binding == nil {
+		return nil
+	}
+	addr := binding.ClientAddress(r)
+	if addr == nil {
+		return errors.New("cannot determine client address for token binding")
+	}
+	token.BoundNetwork = binding.BoundNetwork(addr)
+	return nil
+}
+
 func filterRepoActions(actions []string, authz keppel.Authorization, account keppel.Account) (result []string) {
 	for _, action := range actions {
 		if action == "pull" && authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
@@ -110,7 +156,7 @@ func filterRepoActions(actions []string, authz keppel.Authorization, account kep
 	return
 }
 
-func compileCatalogAccess(authz keppel.Authorization) ([]auth.Scope, error) {
+func compileCatalogAccess(authz keppel.Authorization, pat *keppel.PersonalAccessToken) ([]auth.Scope, error) {
 	var accounts []keppel.Account
 	_, err := keppel.State.DB.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
 	if err != nil {
@@ -119,6 +165,9 @@ func compileCatalogAccess(authz keppel.Authorization) ([]auth.Scope, error) {
 
 	var scopes []auth.Scope
 	for _, account := range accounts {
+		if pat != nil && pat.AccountName != nil && account.Name != *pat.AccountName {
+			continue
+		}
 		if authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
 			scopes = append(scopes, auth.Scope{
 				ResourceType: "keppel_account",
@@ -130,3 +179,75 @@ func compileCatalogAccess(authz keppel.Authorization) ([]auth.Scope, error) {
 
 	return scopes, nil
 }
+
+//authenticatePersonalAccessToken checks a personal access token that was
+//given in place of a password. The returned Authorization reflects the
+//current permissions of the token's owner, restricted to those granted to the
+//token.
+func authenticatePersonalAccessToken(secret string) (keppel.Authorization, *keppel.PersonalAccessToken, *keppel.RegistryV2Error) {
+	pat, err := keppel.State.DB.FindPersonalAccessToken(secret)
+	if err != nil {
+		return nil, nil, keppel.ErrUnauthorized.With("%s", err.Error())
+	}
+	if pat == nil {
+		return nil, nil, keppel.ErrUnauthorized.With("invalid personal access token")
+	}
+	now := time.Now()
+	if pat.IsExpired(now) {
+		return nil, nil, keppel.ErrUnauthorized.With("personal access token has expired")
+	}
+
+	authz, rerr := keppel.State.AuthDriver.AuthorizeUserIdentity(pat.UserIdentity)
+	if rerr != nil {
+		return nil, nil, rerr
+	}
+
+	_, err = keppel.State.DB.Exec(`UPDATE personal_access_tokens SET last_used_at = $1 WHERE id = $2`, now.UTC(), pat.ID)
+	if err != nil {
+		return nil, nil, keppel.ErrUnauthorized.With("%s", err.Error())
+	}
+	return pat.Restrict(authz), pat, nil
+}
+
+//handleTokenExchange issues a token for the requested scope to a client that
+//presents a previously issued token in place of a password.
+func handleTokenExchange(w http.ResponseWriter, r *http.Request, req auth.Request) {
+	oldToken, rerr := auth.ParseToken(req.Password)
+	if rerr == nil {
+		rerr = oldToken.CheckClientAddress(r)
+	}
+	if rerr != nil {
+		respondWithError(w, http.StatusUnauthorized, rerr)
+		return
+	}
+
+	//the new token can only cover what the old token covers
+	if req.Scope != nil {
+		var actions []string
+		for _, action := range req.Scope.Actions {
+			if oldToken.IncludesAccessTo(req.Scope.ResourceType, req.Scope.ResourceName, action) {
+				actions = append(actions, action)
+			}
+		}
+		req.Scope.Actions = actions
+	}
+	req.UserName = oldToken.UserName
+
+	//the new token is bound to the same network as the old token, and expires
+	//no later than the old token (otherwise a client could keep its access
+	//forever by exchanging its token over and over again)
+	token := req.ToToken()
+	token.BoundNetwork = oldToken.BoundNetwork
+	token.ExpiresAt = oldToken.ExpiresAt
+	if token.BoundNetwork == "" {
+		err := bindToClient(token, r)
+		if respondWithError(w, http.StatusBadRequest, err) {
+			return
+		}
+	}
+	tokenInfo, err := token.ToResponse()
+	if respondWithError(w, http.StatusBadRequest, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, tokenInfo)
+}
@@ -0,0 +1,354 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package authapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func getToken(t *testing.T, r http.Handler, userName, password, scope string) (int, string, *auth.Token) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/keppel/v1/auth?service=registry.example.org&scope="+scope, nil)
+	req.SetBasicAuth(userName, password)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, "", nil
+	}
+
+	var data auth.TokenResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	token, rerr := auth.ParseToken(data.Token)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	return rec.Code, data.Token, token
+}
+
+func TestTokenExchange(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	for _, account := range []keppel.Account{
+		{Name: "first", AuthTenantID: "tenant1"},
+		{Name: "second", AuthTenantID: "tenant1"},
+	} {
+		err := keppel.State.DB.Insert(&account)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//obtain a token for pulling from one repo using regular credentials
+	_, tokenStr, token := getToken(t, r, "alice", "view:tenant1,change:tenant1", "repository:first/foo:pull")
+	assert.DeepEqual(t, "original token", *token, auth.Token{
+		UserName: "alice",
+		Access: []auth.Scope{{
+			ResourceType: "repository",
+			ResourceName: "first/foo",
+			Actions:      []string{"pull"},
+		}},
+		ExpiresAt: token.ExpiresAt,
+	})
+	originalExpiresAt := token.ExpiresAt
+
+	//exchanging that token for the same scope yields an equivalent token with
+	//the original user name and expiry
+	_, _, token = getToken(t, r, auth.TokenExchangeUserName, tokenStr, "repository:first/foo:pull")
+	assert.DeepEqual(t, "exchanged token", *token, auth.Token{
+		UserName: "alice",
+		Access: []auth.Scope{{
+			ResourceType: "repository",
+			ResourceName: "first/foo",
+			Actions:      []string{"pull"},
+		}},
+		ExpiresAt: originalExpiresAt,
+	})
+
+	//exchanging a token does not extend its lifetime
+	shortLived, err := auth.Token{
+		UserName:  "alice",
+		Access:    token.Access,
+		ExpiresAt: time.Now().Add(5 * time.Minute),
+	}.ToResponse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if shortLived.ExpiresIn > 300 {
+		t.Errorf("expected short-lived token to expire within 300 seconds, but got expires_in = %d", shortLived.ExpiresIn)
+	}
+	shortLivedToken, rerr := auth.ParseToken(shortLived.Token)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	_, _, token = getToken(t, r, auth.TokenExchangeUserName, shortLived.Token, "repository:first/foo:pull")
+	assert.DeepEqual(t, "expiry of exchanged short-lived token", token.ExpiresAt, shortLivedToken.ExpiresAt)
+
+	//exchanging cannot extend access beyond the original token, even though
+	//alice would be allowed to obtain such access with the password
+	for _, scope := range []string{"repository:first/foo:pull,push", "repository:first/bar:pull", "repository:second/foo:pull", "registry:catalog:*"} {
+		_, _, token = getToken(t, r, auth.TokenExchangeUserName, tokenStr, scope)
+		expected := []auth.Scope(nil)
+		if scope == "repository:first/foo:pull,push" {
+			expected = []auth.Scope{{
+				ResourceType: "repository",
+				ResourceName: "first/foo",
+				Actions:      []string{"pull"},
+			}}
+		}
+		assert.DeepEqual(t, "access of exchanged token for "+scope, token.Access, expected)
+	}
+
+	//invalid tokens are rejected
+	code, _, _ := getToken(t, r, auth.TokenExchangeUserName, "not-a-token", "repository:first/foo:pull")
+	assert.DeepEqual(t, "status code for invalid token", code, http.StatusUnauthorized)
+}
+
+func TestWildcardScopes(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	err := keppel.State.DB.Insert(&keppel.Account{Name: "first", AuthTenantID: "tenant1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//wildcard scopes are granted based on the account-level permissions
+	_, tokenStr, token := getToken(t, r, "alice", "view:tenant1", "repository:first/*:pull,push")
+	assert.DeepEqual(t, "wildcard token", token.Access, []auth.Scope{{
+		ResourceType: "repository",
+		ResourceName: "first/*",
+		Actions:      []string{"pull"},
+	}})
+	_, _, token = getToken(t, r, "alice", "view:tenant2", "repository:first/*:pull")
+	assert.DeepEqual(t, "wildcard token for other tenant", token.Access, []auth.Scope(nil))
+
+	//a wildcard token can be exchanged for a token for a concrete repository
+	_, _, token = getToken(t, r, auth.TokenExchangeUserName, tokenStr, "repository:first/foo/bar:pull")
+	assert.DeepEqual(t, "exchanged token", token.Access, []auth.Scope{{
+		ResourceType: "repository",
+		ResourceName: "first/foo/bar",
+		Actions:      []string{"pull"},
+	}})
+
+	//wildcards are only allowed for whole accounts
+	for _, scope := range []string{"repository:first/foo/*:pull", "repository:*:pull", "repository:first/f*:pull"} {
+		code, _, _ := getToken(t, r, "alice", "view:tenant1", scope)
+		assert.DeepEqual(t, "status code for "+scope, code, http.StatusBadRequest)
+	}
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+	authDriver := keppel.State.AuthDriver.(*test.AuthDriver)
+
+	for _, account := range []keppel.Account{
+		{Name: "first", AuthTenantID: "tenant1"},
+		{Name: "second", AuthTenantID: "tenant1"},
+	} {
+		err := keppel.State.DB.Insert(&account)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	authDriver.UserPerms["alice"] = "view:tenant1,change:tenant1"
+
+	createToken := func(permissions string, accountName *string, expiresAt *time.Time) string {
+		t.Helper()
+		secret, secretHash, err := keppel.GeneratePersonalAccessToken()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = keppel.State.DB.Insert(&keppel.PersonalAccessToken{
+			UserName:     "alice",
+			UserIdentity: "alice",
+			Permissions:  permissions,
+			AccountName:  accountName,
+			SecretHash:   secretHash,
+			CreatedAt:    time.Now().UTC(),
+			ExpiresAt:    expiresAt,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return secret
+	}
+	firstAccountName := "first"
+	pastTime := time.Now().Add(-time.Hour).UTC()
+	pullToken := createToken("pull", nil, nil)
+	pushTokenForFirst := createToken("pull,push", &firstAccountName, nil)
+	expiredToken := createToken("pull,push", nil, &pastTime)
+
+	pullPushScope := func(repoName string) []auth.Scope {
+		return []auth.Scope{{ResourceType: "repository", ResourceName: repoName, Actions: []string{"pull", "push"}}}
+	}
+	pullScope := func(repoName string) []auth.Scope {
+		return []auth.Scope{{ResourceType: "repository", ResourceName: repoName, Actions: []string{"pull"}}}
+	}
+
+	//tokens are issued to the token's owner, regardless of the user name given
+	_, _, token := getToken(t, r, "whatever", pullToken, "repository:first/foo:pull,push")
+	assert.DeepEqual(t, "user name for pull token", token.UserName, "alice")
+	assert.DeepEqual(t, "access for pull token", token.Access, pullScope("first/foo"))
+	_, _, token = getToken(t, r, "alice", pushTokenForFirst, "repository:first/foo:pull,push")
+	assert.DeepEqual(t, "access for push token", token.Access, pullPushScope("first/foo"))
+	_, _, token = getToken(t, r, "alice", pushTokenForFirst, "repository:second/foo:pull,push")
+	assert.DeepEqual(t, "access for push token in other account", token.Access, []auth.Scope(nil))
+	_, _, token = getToken(t, r, "alice", pushTokenForFirst, "registry:catalog:*")
+	assert.DeepEqual(t, "catalog access for push token", token.Access, []auth.Scope{
+		{ResourceType: "registry", ResourceName: "catalog", Actions: []string{"*"}},
+		{ResourceType: "keppel_account", ResourceName: "first", Actions: []string{"view"}},
+	})
+
+	//the last use is recorded
+	pat, err := keppel.State.DB.FindPersonalAccessToken(pushTokenForFirst)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pat.LastUsedAt == nil {
+		t.Error("expected last_used_at to be set for used token")
+	}
+
+	//expired and unknown tokens are rejected
+	for _, secret := range []string{expiredToken, keppel.PersonalAccessTokenPrefix + "unknown"} {
+		code, _, _ := getToken(t, r, "alice", secret, "repository:first/foo:pull")
+		assert.DeepEqual(t, "status code for invalid token", code, http.StatusUnauthorized)
+	}
+
+	//each use is checked against the user's current permissions
+	authDriver.UserPerms["alice"] = "view:tenant1"
+	_, _, token = getToken(t, r, "alice", pushTokenForFirst, "repository:first/foo:pull,push")
+	assert.DeepEqual(t, "access for push token after permissions were reduced", token.Access, pullScope("first/foo"))
+	delete(authDriver.UserPerms, "alice")
+	code, _, _ := getToken(t, r, "alice", pullToken, "repository:first/foo:pull")
+	assert.DeepEqual(t, "status code for token of deleted user", code, http.StatusUnauthorized)
+}
+
+func TestTokenBinding(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+		token_binding:
+			enabled: true
+			trusted_proxies: [ '10.0.0.0/8' ]
+			exempt_networks: [ '198.51.100.0/24' ]
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+	err := keppel.State.DB.Insert(&keppel.Account{Name: "first", AuthTenantID: "tenant1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	getBoundToken := func(remoteAddr, forwardedFor, userName, password string) (int, string, *auth.Token) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/keppel/v1/auth?service=registry.example.org&scope=repository:first/foo:pull", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		req.SetBasicAuth(userName, password)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return rec.Code, "", nil
+		}
+		var data auth.TokenResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		token, rerr := auth.ParseToken(data.Token)
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+		return rec.Code, data.Token, token
+	}
+
+	//tokens are bound to the address of the client...
+	_, tokenStr, token := getBoundToken("192.0.2.1:1234", "", "alice", "view:tenant1")
+	assert.DeepEqual(t, "bound network", token.BoundNetwork, "192.0.2.1/32")
+	//...which is only taken from X-Forwarded-For if the request comes from a trusted proxy...
+	_, _, token = getBoundToken("192.0.2.1:1234", "203.0.113.5", "alice", "view:tenant1")
+	assert.DeepEqual(t, "bound network with untrusted X-Forwarded-For", token.BoundNetwork, "192.0.2.1/32")
+	_, _, token = getBoundToken("10.0.0.1:1234", "192.0.2.99, 203.0.113.5", "alice", "view:tenant1")
+	assert.DeepEqual(t, "bound network with trusted X-Forwarded-For", token.BoundNetwork, "203.0.113.5/32")
+	//...or to the whole network for clients in exempt networks
+	_, _, token = getBoundToken("10.0.0.1:1234", "198.51.100.7", "alice", "view:tenant1")
+	assert.DeepEqual(t, "bound network for exempt network", token.BoundNetwork, "198.51.100.0/24")
+
+	//the token is only accepted from the address that it is bound to
+	expectAccepted := func(remoteAddr, forwardedFor string, expected bool) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		_, rerr := auth.ParseTokenFromRequest(req)
+		assert.DeepEqual(t, "token accepted from "+remoteAddr+" for "+forwardedFor, rerr == nil, expected)
+	}
+	expectAccepted("192.0.2.1:4321", "", true)
+	expectAccepted("10.0.0.1:4321", "192.0.2.1", true)
+	expectAccepted("192.0.2.2:4321", "", false)
+	expectAccepted("192.0.2.2:4321", "192.0.2.1", false)
+
+	//token exchange is only possible from the same address, and the new token
+	//is bound to the same network
+	code, _, _ := getBoundToken("192.0.2.2:1234", "", auth.TokenExchangeUserName, tokenStr)
+	assert.DeepEqual(t, "status code for token exchange from different address", code, http.StatusUnauthorized)
+	_, _, token = getBoundToken("192.0.2.1:1234", "", auth.TokenExchangeUserName, tokenStr)
+	assert.DeepEqual(t, "bound network of exchanged token", token.BoundNetwork, "192.0.2.1/32")
+}
@@ -0,0 +1,139 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+const (
+	defaultAccessLogLimit = 100
+	maxAccessLogLimit     = 1000
+)
+
+func handleGetAccountAccessLog(w http.ResponseWriter, r *http.Request) {
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return
+	}
+
+	//get account from DB to find its AuthTenantID
+	accountName := mux.Vars(r)["account"]
+	account, err := keppel.State.DB.FindAccount(accountName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//this returns 404 even if the real reason is lack of authorization in order
+	//to not leak information about which accounts exist for other tenants
+	if account == nil || !authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+		http.Error(w, "no such account", 404)
+		return
+	}
+	//the access log contains information about other users, so it is only
+	//visible to the account's owners
+	if !authz.HasPermission(keppel.CanChangeAccount, account.AuthTenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := `SELECT * FROM access_log_entries WHERE account_name = $1`
+	args := []interface{}{account.Name}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		query += ` AND ` + condition + ` $` + strconv.Itoa(len(args))
+	}
+
+	q := r.URL.Query()
+	for _, filter := range []struct {
+		param  string
+		column string
+	}{
+		{"user", "user_name"},
+		{"repository", "repo_name"},
+		{"digest", "digest"},
+		{"method", "method"},
+		{"source_ip", "source_ip"},
+	} {
+		if value := q.Get(filter.param); value != "" {
+			addCondition(filter.column+" =", value)
+		}
+	}
+	if value := q.Get("status"); value != "" {
+		statusCode, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "malformed query parameter: status", http.StatusBadRequest)
+			return
+		}
+		addCondition("status_code =", statusCode)
+	}
+	for _, filter := range []struct {
+		param     string
+		condition string
+	}{
+		{"since", "created_at >="},
+		{"until", "created_at <"},
+	} {
+		if value := q.Get(filter.param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "malformed query parameter: "+filter.param, http.StatusBadRequest)
+				return
+			}
+			addCondition(filter.condition, t.UTC())
+		}
+	}
+	//for pagination: the ID of the last entry on the previous page
+	if value := q.Get("marker"); value != "" {
+		marker, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "malformed query parameter: marker", http.StatusBadRequest)
+			return
+		}
+		addCondition("id <", marker)
+	}
+	limit := defaultAccessLogLimit
+	if value := q.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "malformed query parameter: limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxAccessLogLimit {
+			limit = maxAccessLogLimit
+		}
+	}
+
+	var entries []keppel.AccessLogEntry
+	_, err = keppel.State.DB.Select(&entries, query+` ORDER BY id DESC LIMIT `+strconv.Itoa(limit), args...)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//ensure that this serializes as a list, not as null
+	if len(entries) == 0 {
+		entries = []keppel.AccessLogEntry{}
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
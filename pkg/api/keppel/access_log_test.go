@@ -0,0 +1,119 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestAccessLogAPI(t *testing.T) {
+	r, _ := setup(t)
+	err := keppel.State.DB.Insert(&keppel.Account{Name: "first", AuthTenantID: "tenant1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for _, entry := range []keppel.AccessLogEntry{
+		{CreatedAt: now.Add(-40 * 24 * time.Hour), UserName: "alice", Method: "GET", RepoName: "foo", StatusCode: 200},
+		{CreatedAt: now.Add(-2 * time.Hour), UserName: "alice", Method: "PUT", RepoName: "foo", Digest: digest, StatusCode: 201, Bytes: 1024},
+		{CreatedAt: now.Add(-1 * time.Hour), UserName: "bob", Method: "GET", RepoName: "foo", Digest: digest, StatusCode: 200, Bytes: 1024},
+		{CreatedAt: now, UserName: "", Method: "GET", RepoName: "bar", StatusCode: 401, Bytes: 150},
+	} {
+		entry.AccountName = "first"
+		entry.SourceIP = "192.0.2.1"
+		err := keppel.State.DB.Insert(&entry)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//only account owners can see the access log
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/access_log",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: 404,
+		ExpectBody:   assert.StringData("no such account\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/access_log",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+
+	//the retention period removes the oldest entry
+	count, err := keppel.State.DB.PruneAccessLog(now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of pruned entries", count, int64(1))
+
+	entry := func(id int64) assert.JSONObject {
+		result := map[int64]assert.JSONObject{
+			2: {"id": 2, "account": "first", "created_at": "2018-05-31T22:00:00Z", "user": "alice", "source_ip": "192.0.2.1", "method": "PUT", "repository": "foo", "digest": digest, "status": 201, "bytes": 1024},
+			3: {"id": 3, "account": "first", "created_at": "2018-05-31T23:00:00Z", "user": "bob", "source_ip": "192.0.2.1", "method": "GET", "repository": "foo", "digest": digest, "status": 200, "bytes": 1024},
+			4: {"id": 4, "account": "first", "created_at": "2018-06-01T00:00:00Z", "user": "", "source_ip": "192.0.2.1", "method": "GET", "repository": "bar", "status": 401, "bytes": 150},
+		}
+		return result[id]
+	}
+
+	for query, expectedIDs := range map[string][]int64{
+		"":                                 {4, 3, 2},
+		"?user=alice":                      {2},
+		"?repository=foo&method=GET":       {3},
+		"?status=401":                      {4},
+		"?digest=" + digest:                {3, 2},
+		"?since=2018-05-31T23:00:00Z":      {4, 3},
+		"?until=2018-05-31T23:00:00Z":      {2},
+		"?limit=2":                         {4, 3},
+		"?limit=2&marker=3":                {2},
+		"?source_ip=192.0.2.1&user=nobody": {},
+	} {
+		expectedEntries := []assert.JSONObject{}
+		for _, id := range expectedIDs {
+			expectedEntries = append(expectedEntries, entry(id))
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/first/access_log" + query,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+			ExpectStatus: 200,
+			ExpectBody:   assert.JSONObject{"entries": expectedEntries},
+		}.Check(t, r)
+	}
+
+	//malformed filters
+	for _, query := range []string{"?status=ok", "?since=yesterday", "?limit=0", "?marker=foo"} {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/first/access_log" + query,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+			ExpectStatus: 400,
+		}.Check(t, r)
+	}
+}
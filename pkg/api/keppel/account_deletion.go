@@ -0,0 +1,148 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//findChangeableAccount is like findViewableAccount, but also requires
+//permission to change the account. It also returns the name of the user
+//making the request, for use in audit events.
+func findChangeableAccount(w http.ResponseWriter, r *http.Request) (*keppel.Account, string) {
+	authz, userName, _, ok := identifyUser(w, r)
+	if !ok {
+		return nil, ""
+	}
+
+	accountName := mux.Vars(r)["account"]
+	account, err := keppel.State.DB.FindAccount(accountName)
+	if respondwith.ErrorText(w, err) {
+		return nil, ""
+	}
+	//this returns 404 even if the real reason is lack of authorization in order
+	//to not leak information about which accounts exist for other tenants
+	if account == nil || !authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+		http.Error(w, "no such account", http.StatusNotFound)
+		return nil, ""
+	}
+	if !authz.HasPermission(keppel.CanChangeAccount, account.AuthTenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, ""
+	}
+	return account, userName
+}
+
+//handleDeleteAccount puts the account into the "pending deletion" state. The
+//account is torn down by tasks.DeletePendingAccounts once the grace period
+//has passed.
+func handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	account, userName := findChangeableAccount(w, r)
+	if account == nil {
+		return
+	}
+	if account.DeletedAt != nil {
+		//nothing to do
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	//the account could not be torn down at the end of the grace period anyway
+	isHeld, err := isAccountHeld(account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if isHeld {
+		http.Error(w, "account cannot be deleted while it is under legal hold", http.StatusConflict)
+		return
+	}
+
+	err = requestAccountDeletion(*account, userName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//isAccountHeld returns whether any legal hold exists in the given account.
+func isAccountHeld(accountName string) (bool, error) {
+	holdCount, err := keppel.State.DB.SelectInt(
+		`SELECT COUNT(*) FROM legal_holds WHERE account_name = $1`, accountName)
+	return holdCount > 0, err
+}
+
+//requestAccountDeletion puts the given account into the "pending deletion"
+//state on behalf of the given user.
+func requestAccountDeletion(account keppel.Account, userName string) error {
+	now := time.Now().UTC()
+	_, err := keppel.State.DB.Exec(
+		`UPDATE accounts SET deleted_at = $1 WHERE name = $2`, now, account.Name)
+	if err != nil {
+		return err
+	}
+	return keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+		AccountName: account.Name,
+		Action:      "request_account_deletion",
+		UserName:    userName,
+		Details: fmt.Sprintf("account will be deleted at %s unless it is restored",
+			now.Add(keppel.State.Config.AccountDeletionGracePeriod).Format(time.RFC3339)),
+	})
+}
+
+func handlePostAccountRestore(w http.ResponseWriter, r *http.Request) {
+	account, userName := findChangeableAccount(w, r)
+	if account == nil {
+		return
+	}
+	if account.DeletedAt == nil {
+		http.Error(w, "account is not pending deletion", http.StatusConflict)
+		return
+	}
+	if !time.Now().Before(account.DeletedAt.Add(keppel.State.Config.AccountDeletionGracePeriod)) {
+		http.Error(w, "grace period has passed, account is being deleted", http.StatusConflict)
+		return
+	}
+
+	_, err := keppel.State.DB.Exec(
+		`UPDATE accounts SET deleted_at = NULL WHERE name = $1`, account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	err = keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+		AccountName: account.Name,
+		Action:      "restore_account",
+		UserName:    userName,
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	account.DeletedAt = nil
+	accountRendered, err := renderAccount(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
+}
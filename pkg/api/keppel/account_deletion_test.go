@@ -0,0 +1,161 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestAccountDeletionAPI(t *testing.T) {
+	r, _ := setup(t)
+	ownerHeader := map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1", "X-Test-User": "alice"}
+
+	//preparation: create an account
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, r)
+
+	//deletion requires permission to change the account
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1", "X-Test-User": "bob"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2,change:tenant2", "X-Test-User": "bob"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such account\n"),
+	}.Check(t, r)
+
+	//accounts that are not pending deletion cannot be restored
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account is not pending deletion\n"),
+	}.Check(t, r)
+
+	//delete the account (this request is executed twice to test idempotency)
+	for range []int{1, 2} {
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/keppel/v1/accounts/first",
+			Header:       ownerHeader,
+			ExpectStatus: http.StatusNoContent,
+		}.Check(t, r)
+	}
+	account, err := keppel.State.DB.FindAccount("first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.DeletedAt == nil {
+		t.Fatal("expected account to be pending deletion")
+	}
+	if account.IsUsable(time.Now()) {
+		t.Error("expected account to not be usable while pending deletion")
+	}
+
+	//the account cannot be updated while it is pending deletion
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account is pending deletion and needs to be restored first\n"),
+	}.Check(t, r)
+
+	//restore the account
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
+			},
+		},
+	}.Check(t, r)
+
+	//once the grace period has passed, the account cannot be restored anymore
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET deleted_at = $1 WHERE name = $2`,
+		time.Now().Add(-8*24*time.Hour), "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("grace period has passed, account is being deleted\n"),
+	}.Check(t, r)
+
+	//accounts under legal hold cannot be deleted
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/second",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, r)
+	err = keppel.State.DB.Insert(&keppel.LegalHold{
+		AccountName: "second",
+		RepoName:    "foo",
+		Reason:      "investigation",
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/second",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account cannot be deleted while it is under legal hold\n"),
+	}.Check(t, r)
+
+	//deletion and restore are recorded in the audit log
+	var actions []string
+	_, err = keppel.State.DB.Select(&actions, `SELECT action FROM audit_events ORDER BY id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "audit events", actions, []string{"request_account_deletion", "restore_account"})
+}
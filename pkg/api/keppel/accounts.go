@@ -20,10 +20,13 @@ package keppelv1api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/keppel/pkg/keppel"
 )
@@ -36,6 +39,31 @@ func AddTo(r *mux.Router) {
 	r.Methods("GET").Path("/keppel/v1/accounts").HandlerFunc(handleGetAccounts)
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(handleGetAccount)
 	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(handlePutAccount)
+	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(handleDeleteAccount)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/restore").HandlerFunc(handlePostAccountRestore)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/access_log").HandlerFunc(handleGetAccountAccessLog)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/events").HandlerFunc(handleGetAccountEvents)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/events/verification").HandlerFunc(handleGetAccountEventsVerification)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo:.+}/_manifests/{digest}/sbom").HandlerFunc(handleGetManifestSBOM)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/tag_snapshots").HandlerFunc(handleGetTagSnapshots)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/tag_snapshots/{snapshot:[a-z0-9][a-z0-9._-]{0,63}}").HandlerFunc(handleGetTagSnapshot)
+	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/tag_snapshots/{snapshot:[a-z0-9][a-z0-9._-]{0,63}}").HandlerFunc(handlePutTagSnapshot)
+	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/tag_snapshots/{snapshot:[a-z0-9][a-z0-9._-]{0,63}}").HandlerFunc(handleDeleteTagSnapshot)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/tag_snapshots/{snapshot:[a-z0-9][a-z0-9._-]{0,63}}/diff").HandlerFunc(handleGetTagSnapshotDiff)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/tag_snapshots/{snapshot:[a-z0-9][a-z0-9._-]{0,63}}/restore").HandlerFunc(handlePostTagSnapshotRestore)
+	r.Methods("POST").Path("/keppel/v1/apply").HandlerFunc(handlePostApply)
+
+	r.Methods("GET").Path("/keppel/v1/personal_access_tokens").HandlerFunc(handleGetPersonalAccessTokens)
+	r.Methods("POST").Path("/keppel/v1/personal_access_tokens").HandlerFunc(handlePostPersonalAccessToken)
+	r.Methods("DELETE").Path("/keppel/v1/personal_access_tokens/{id:[0-9]+}").HandlerFunc(handleDeletePersonalAccessToken)
+
+	r.Methods("GET").Path("/keppel/v1/tenants/{tenant_id}/defaults").HandlerFunc(handleGetTenantDefaults)
+	r.Methods("PUT").Path("/keppel/v1/tenants/{tenant_id}/defaults").HandlerFunc(handlePutTenantDefaults)
+
+	r.Methods("GET").Path("/keppel/v1/admin/legal_holds").HandlerFunc(handleGetLegalHolds)
+	r.Methods("POST").Path("/keppel/v1/admin/legal_holds").HandlerFunc(handlePostLegalHold)
+	r.Methods("DELETE").Path("/keppel/v1/admin/legal_holds/{id:[0-9]+}").HandlerFunc(handleDeleteLegalHold)
+	r.Methods("POST").Path("/keppel/v1/admin/rolling_upgrade").HandlerFunc(handlePostRollingUpgrade)
 }
 
 func respondWithAuthError(w http.ResponseWriter, err *keppel.RegistryV2Error) bool {
@@ -47,6 +75,37 @@ func respondWithAuthError(w http.ResponseWriter, err *keppel.RegistryV2Error) bo
 	return true
 }
 
+//accountRepr is the JSON representation of an account in the API.
+type accountRepr struct {
+	Name              string                 `json:"name"`
+	AuthTenantID      string                 `json:"auth_tenant_id"`
+	Policies          keppel.AccountPolicies `json:"policies"`
+	EffectivePolicies keppel.AccountPolicies `json:"effective_policies"`
+	ReadOnly          bool                   `json:"read_only,omitempty"`
+	ExpiresAt         *time.Time             `json:"expires_at,omitempty"`
+	DeletedAt         *time.Time             `json:"deleted_at,omitempty"`
+}
+
+func renderAccount(account keppel.Account) (accountRepr, error) {
+	explicitPolicies, err := account.ExplicitPolicies()
+	if err != nil {
+		return accountRepr{}, err
+	}
+	effectivePolicies, err := keppel.State.DB.GetEffectivePolicies(account)
+	if err != nil {
+		return accountRepr{}, err
+	}
+	return accountRepr{
+		Name:              account.Name,
+		AuthTenantID:      account.AuthTenantID,
+		Policies:          explicitPolicies,
+		EffectivePolicies: effectivePolicies,
+		ReadOnly:          account.ReadOnly,
+		ExpiresAt:         account.ExpiresAt,
+		DeletedAt:         account.DeletedAt,
+	}, nil
+}
+
 func handleGetAccounts(w http.ResponseWriter, r *http.Request) {
 	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
 	if respondWithAuthError(w, authErr) {
@@ -60,15 +119,19 @@ func handleGetAccounts(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//restrict accounts to those visible in the current scope
-	var accountsFiltered []keppel.Account
+	var accountsFiltered []accountRepr
 	for _, account := range accounts {
 		if authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
-			accountsFiltered = append(accountsFiltered, account)
+			accountRendered, err := renderAccount(account)
+			if respondwith.ErrorText(w, err) {
+				return
+			}
+			accountsFiltered = append(accountsFiltered, accountRendered)
 		}
 	}
 	//ensure that this serializes as a list, not as null
 	if len(accountsFiltered) == 0 {
-		accountsFiltered = []keppel.Account{}
+		accountsFiltered = []accountRepr{}
 	}
 
 	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"accounts": accountsFiltered})
@@ -99,14 +162,26 @@ func handleGetAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": account})
+	accountRendered, err := renderAccount(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
 }
 
+//The largest "ttl_seconds" that can be given for an ephemeral account (10
+//years).
+const maxAccountTTLSeconds = 10 * 365 * 24 * 60 * 60
+
 func handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	//decode request body
 	var req struct {
 		Account struct {
-			AuthTenantID string `json:"auth_tenant_id"`
+			AuthTenantID string                  `json:"auth_tenant_id"`
+			Policies     *keppel.AccountPolicies `json:"policies"`
+			//for ephemeral accounts: either an absolute time or a lifetime
+			ExpiresAt  *time.Time `json:"expires_at"`
+			TTLSeconds *int64     `json:"ttl_seconds"`
 		} `json:"account"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -118,17 +193,59 @@ func handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `malformed attribute "account.auth_tenant_id" in request body: `+err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
+	if req.Account.Policies != nil {
+		if err := req.Account.Policies.Validate(); err != nil {
+			http.Error(w, `malformed attribute "account.policies" in request body: `+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	switch {
+	case req.Account.ExpiresAt != nil && req.Account.TTLSeconds != nil:
+		http.Error(w, `request body may not contain both "account.expires_at" and "account.ttl_seconds"`, http.StatusUnprocessableEntity)
+		return
+	case req.Account.ExpiresAt != nil:
+		if !req.Account.ExpiresAt.After(now) {
+			http.Error(w, `attribute "account.expires_at" in request body must be in the future`, http.StatusUnprocessableEntity)
+			return
+		}
+		t := req.Account.ExpiresAt.UTC()
+		expiresAt = &t
+	case req.Account.TTLSeconds != nil:
+		if *req.Account.TTLSeconds <= 0 {
+			http.Error(w, `attribute "account.ttl_seconds" in request body must be positive`, http.StatusUnprocessableEntity)
+			return
+		}
+		//larger values would overflow time.Duration and yield an expiry time in
+		//the past, which would get the account deleted right away
+		if *req.Account.TTLSeconds > maxAccountTTLSeconds {
+			http.Error(w, fmt.Sprintf(`attribute "account.ttl_seconds" in request body may not be larger than %d`, maxAccountTTLSeconds), http.StatusUnprocessableEntity)
+			return
+		}
+		t := now.Add(time.Duration(*req.Account.TTLSeconds) * time.Second).UTC()
+		expiresAt = &t
+	}
 
 	//reserve identifiers for internal pseudo-accounts
 	accountName := mux.Vars(r)["account"]
-	if strings.HasPrefix(accountName, "keppel-") {
+	if isReservedAccountName(accountName) {
 		http.Error(w, `account names with the prefix "keppel-" are reserved for internal use`, http.StatusUnprocessableEntity)
 		return
 	}
 
+	//policies that are not given explicitly are inherited from the tenant defaults
+	var policies keppel.AccountPolicies
+	if req.Account.Policies != nil {
+		policies = *req.Account.Policies
+	}
+
 	accountToCreate := keppel.Account{
 		Name:         accountName,
 		AuthTenantID: req.Account.AuthTenantID,
+		PoliciesJSON: policies.ToJSON(),
+		ExpiresAt:    expiresAt,
 	}
 
 	//check permission to create account
@@ -150,31 +267,120 @@ func handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `account name already in use by a different tenant`, http.StatusConflict)
 		return
 	}
+	if account != nil && account.IsExpired(now) {
+		http.Error(w, `account has expired and is being deleted, please retry later`, http.StatusConflict)
+		return
+	}
+	if account != nil && account.DeletedAt != nil {
+		http.Error(w, `account is pending deletion and needs to be restored first`, http.StatusConflict)
+		return
+	}
+	//a permanent account shall not be scheduled for deletion by accident
+	if account != nil && account.ExpiresAt == nil && expiresAt != nil {
+		http.Error(w, `cannot set an expiry time on an account that was not created as ephemeral`, http.StatusConflict)
+		return
+	}
 
 	//create account if required
 	if account == nil {
-		tx, err := keppel.State.DB.Begin()
-		if respondwith.ErrorText(w, err) {
+		account = &accountToCreate
+		err = createAccount(*account, authz)
+		if err == keppel.ErrAccountNameClaimed {
+			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
-		defer keppel.RollbackUnlessCommitted(tx)
-
-		account = &accountToCreate
-		err = tx.Insert(account)
 		if respondwith.ErrorText(w, err) {
 			return
 		}
+	}
 
-		//before committing this, add the required role assignments
-		err = keppel.State.AuthDriver.SetupAccount(*account, authz)
+	//update explicit policies and expiry time if requested
+	needsUpdate := false
+	if req.Account.Policies != nil && account.PoliciesJSON != accountToCreate.PoliciesJSON {
+		account.PoliciesJSON = accountToCreate.PoliciesJSON
+		needsUpdate = true
+	}
+	if expiresAt != nil && !expiresAt.Equal(*account.ExpiresAt) {
+		//renewal of an ephemeral account
+		account.ExpiresAt = expiresAt
+		account.ExpiryWarningSent = false
+		needsUpdate = true
+	}
+	if needsUpdate {
+		//only touch the columns that this request manages, so that concurrent
+		//changes to the account (e.g. a deletion request, or a backup setting the
+		//account read-only) are not reverted
+		result, err := keppel.State.DB.Exec(`
+			UPDATE accounts SET policies_json = $1, expires_at = $2, expiry_warning_sent = $3
+			 WHERE name = $4 AND deleted_at IS NULL
+		`, account.PoliciesJSON, account.ExpiresAt, account.ExpiryWarningSent, account.Name)
 		if respondwith.ErrorText(w, err) {
 			return
 		}
-		err = tx.Commit()
+		rowsAffected, err := result.RowsAffected()
 		if respondwith.ErrorText(w, err) {
 			return
 		}
+		if rowsAffected == 0 {
+			http.Error(w, `account is pending deletion and needs to be restored first`, http.StatusConflict)
+			return
+		}
+	}
+
+	accountRendered, err := renderAccount(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
+}
+
+//isReservedAccountName returns true for account names that are reserved for
+//internal pseudo-accounts.
+func isReservedAccountName(name string) bool {
+	return strings.HasPrefix(name, "keppel-")
+}
+
+//createAccount claims the account name with the federation driver, inserts
+//the given account into the DB, and sets up its tenant using the given
+//Authorization of the user who requested the creation.
+func createAccount(account keppel.Account, authz keppel.Authorization) error {
+	err := keppel.State.FederationDriver.ClaimAccountName(account)
+	if err != nil {
+		return err
+	}
+
+	err = insertAccount(account, authz)
+	if err != nil {
+		//do not keep the name blocked in the federation when the account does not
+		//exist after all; but if the insert failed because a concurrent request
+		//created the same account, the claim belongs to that account now
+		existing, ferr := keppel.State.DB.FindAccount(account.Name)
+		if ferr == nil && existing == nil {
+			ferr = keppel.State.FederationDriver.ForfeitAccountName(account)
+		}
+		if ferr != nil {
+			logg.Error("cannot forfeit claim on account name %s after failed creation: %s", account.Name, ferr.Error())
+		}
 	}
+	return err
+}
 
-	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": account})
+func insertAccount(account keppel.Account, authz keppel.Authorization) error {
+	tx, err := keppel.State.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer keppel.RollbackUnlessCommitted(tx)
+
+	err = tx.Insert(&account)
+	if err != nil {
+		return err
+	}
+
+	//before committing this, add the required role assignments
+	err = keppel.State.AuthDriver.SetupAccount(account, authz)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
@@ -22,6 +22,7 @@ package keppelv1api
 import (
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/assert"
@@ -80,14 +81,16 @@ func TestAccountsAPI(t *testing.T) {
 			ExpectStatus: 200,
 			ExpectBody: assert.JSONObject{
 				"account": assert.JSONObject{
-					"name":           "first",
-					"auth_tenant_id": "tenant1",
+					"name":               "first",
+					"auth_tenant_id":     "tenant1",
+					"policies":           assert.JSONObject{},
+					"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
 				},
 			},
 		}.Check(t, r)
 		assert.DeepEqual(t, "authDriver.AccountsThatWereSetUp",
 			authDriver.AccountsThatWereSetUp,
-			[]keppel.Account{{Name: "first", AuthTenantID: "tenant1"}},
+			[]keppel.Account{{Name: "first", AuthTenantID: "tenant1", PoliciesJSON: "{}"}},
 		)
 	}
 
@@ -99,8 +102,10 @@ func TestAccountsAPI(t *testing.T) {
 		ExpectStatus: 200,
 		ExpectBody: assert.JSONObject{
 			"accounts": []assert.JSONObject{{
-				"name":           "first",
-				"auth_tenant_id": "tenant1",
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
 			}},
 		},
 	}.Check(t, r)
@@ -111,8 +116,10 @@ func TestAccountsAPI(t *testing.T) {
 		ExpectStatus: 200,
 		ExpectBody: assert.JSONObject{
 			"account": assert.JSONObject{
-				"name":           "first",
-				"auth_tenant_id": "tenant1",
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
 			},
 		},
 	}.Check(t, r)
@@ -164,8 +171,10 @@ func TestPutAccountErrorCases(t *testing.T) {
 		ExpectStatus: 200,
 		ExpectBody: assert.JSONObject{
 			"account": assert.JSONObject{
-				"name":           "first",
-				"auth_tenant_id": "tenant1",
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
 			},
 		},
 	}.Check(t, r)
@@ -244,3 +253,187 @@ func TestPutAccountErrorCases(t *testing.T) {
 		ExpectBody:   assert.StringData("Forbidden\n"),
 	}.Check(t, r)
 }
+
+func TestAccountNameClaims(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		federation: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+	fd := keppel.State.FederationDriver.(*test.FederationDriver)
+
+	//simulate an account that was created by a peer
+	fd.ClaimedNames["first"] = "tenant2"
+
+	//creating an account with the same name for a different tenant fails
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account name already in use by a different tenant\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.StringData("accounts:\n  - { name: first, auth_tenant_id: tenant1 }\n"),
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account name first already in use by a different tenant\n"),
+	}.Check(t, r)
+
+	//the same tenant can create the account (e.g. as a replica)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant2"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant2"}},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, r)
+
+	//new accounts are claimed before they are created
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/second",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, r)
+	assert.DeepEqual(t, "claimed names", fd.ClaimedNames, map[string]string{
+		"first":  "tenant2",
+		"second": "tenant1",
+	})
+
+	//when a concurrent request has created the same account already, the
+	//failed creation must not release that account's claim
+	err := createAccount(keppel.Account{Name: "second", AuthTenantID: "tenant1"}, nil)
+	if err == nil {
+		t.Error("expected creation of existing account to fail")
+	}
+	assert.DeepEqual(t, "claimed names", fd.ClaimedNames, map[string]string{
+		"first":  "tenant2",
+		"second": "tenant1",
+	})
+
+	//accounts that were created before the federation driver was configured
+	//are claimed on startup, and conflicts with other tenants are reported
+	err = keppel.State.DB.Insert(&keppel.Account{Name: "third", AuthTenantID: "tenant1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = keppel.ClaimExistingAccountNames()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "claimed names", fd.ClaimedNames, map[string]string{
+		"first":  "tenant2",
+		"second": "tenant1",
+		"third":  "tenant1",
+	})
+	fd.ClaimedNames["second"] = "tenant3"
+	fd.ClaimedNames["third"] = "tenant3"
+	err = keppel.ClaimExistingAccountNames()
+	expectedMessage := "names of existing accounts are claimed by a different tenant in the federation: second, third"
+	if err == nil || err.Error() != expectedMessage {
+		t.Errorf("expected error %q, got %v", expectedMessage, err)
+	}
+}
+
+func TestEphemeralAccounts(t *testing.T) {
+	r, _ := setup(t)
+
+	putAccount := func(name string, attrs assert.JSONObject, expectStatus int, expectBody assert.HTTPResponseBody) {
+		t.Helper()
+		attrs["auth_tenant_id"] = "tenant1"
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         "/keppel/v1/accounts/" + name,
+			Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body:         assert.JSONObject{"account": attrs},
+			ExpectStatus: expectStatus,
+			ExpectBody:   expectBody,
+		}.Check(t, r)
+	}
+	expectAccount := func(name, expiresAt string) assert.HTTPResponseBody {
+		return assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               name,
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
+				"expires_at":         expiresAt,
+			},
+		}
+	}
+
+	//test invalid inputs
+	putAccount("first", assert.JSONObject{"expires_at": "2099-01-01T00:00:00Z", "ttl_seconds": 3600}, http.StatusUnprocessableEntity,
+		assert.StringData("request body may not contain both \"account.expires_at\" and \"account.ttl_seconds\"\n"))
+	putAccount("first", assert.JSONObject{"expires_at": "2018-01-01T00:00:00Z"}, http.StatusUnprocessableEntity,
+		assert.StringData("attribute \"account.expires_at\" in request body must be in the future\n"))
+	putAccount("first", assert.JSONObject{"ttl_seconds": 0}, http.StatusUnprocessableEntity,
+		assert.StringData("attribute \"account.ttl_seconds\" in request body must be positive\n"))
+	//this would overflow time.Duration and put the expiry in the past
+	putAccount("first", assert.JSONObject{"ttl_seconds": 10000000000}, http.StatusUnprocessableEntity,
+		assert.StringData("attribute \"account.ttl_seconds\" in request body may not be larger than 315360000\n"))
+
+	//create an ephemeral account
+	putAccount("first", assert.JSONObject{"expires_at": "2099-01-01T00:00:00Z"}, http.StatusOK,
+		expectAccount("first", "2099-01-01T00:00:00Z"))
+	putAccount("second", assert.JSONObject{"ttl_seconds": 3600}, http.StatusOK, nil)
+	account, err := keppel.State.DB.FindAccount("second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.ExpiresAt == nil || time.Until(*account.ExpiresAt) > time.Hour || time.Until(*account.ExpiresAt) < 59*time.Minute {
+		t.Errorf("expected account to expire in one hour, but expires_at = %v", account.ExpiresAt)
+	}
+
+	//renewing the account resets the expiry warning
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET expiry_warning_sent = $1`, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	putAccount("first", assert.JSONObject{"expires_at": "2100-01-01T00:00:00Z"}, http.StatusOK,
+		expectAccount("first", "2100-01-01T00:00:00Z"))
+	account, err = keppel.State.DB.FindAccount("first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.ExpiryWarningSent {
+		t.Error("expected expiry warning to be reset by renewal")
+	}
+	//omitting the expiry time does not change it
+	putAccount("first", assert.JSONObject{}, http.StatusOK,
+		expectAccount("first", "2100-01-01T00:00:00Z"))
+
+	//permanent accounts cannot be made ephemeral
+	putAccount("permanent", assert.JSONObject{}, http.StatusOK, nil)
+	putAccount("permanent", assert.JSONObject{"ttl_seconds": 3600}, http.StatusConflict,
+		assert.StringData("cannot set an expiry time on an account that was not created as ephemeral\n"))
+
+	//renewing with an overlong TTL does not touch the account
+	putAccount("second", assert.JSONObject{"ttl_seconds": 10000000000}, http.StatusUnprocessableEntity,
+		assert.StringData("attribute \"account.ttl_seconds\" in request body may not be larger than 315360000\n"))
+	account, err = keppel.State.DB.FindAccount("second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.ExpiresAt == nil || !account.ExpiresAt.After(time.Now()) {
+		t.Errorf("expected account to remain unexpired, but expires_at = %v", account.ExpiresAt)
+	}
+
+	//expired accounts cannot be renewed anymore
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET expires_at = $1 WHERE name = $2`,
+		time.Now().Add(-time.Minute), "second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	putAccount("second", assert.JSONObject{"ttl_seconds": 3600}, http.StatusConflict,
+		assert.StringData("account has expired and is being deleted, please retry later\n"))
+}
@@ -0,0 +1,291 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//This must match the restriction on the {account} path variable in AddTo().
+var accountNameRx = regexp.MustCompile(`^[a-z0-9-]{1,48}$`)
+
+//declaredAccount is an account as it appears in the YAML document accepted by
+//POST /keppel/v1/apply.
+type declaredAccount struct {
+	Name         string                  `yaml:"name"`
+	AuthTenantID string                  `yaml:"auth_tenant_id"`
+	Policies     *keppel.AccountPolicies `yaml:"policies"`
+}
+
+//accountChange describes a single change computed by POST /keppel/v1/apply.
+type accountChange struct {
+	Action       string                  `json:"action"`
+	AccountName  string                  `json:"account"`
+	AuthTenantID string                  `json:"auth_tenant_id"`
+	OldPolicies  *keppel.AccountPolicies `json:"old_policies,omitempty"`
+	NewPolicies  *keppel.AccountPolicies `json:"new_policies,omitempty"`
+
+	//only set for Action == "delete"
+	account *keppel.Account
+}
+
+func handlePostApply(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	prune := r.URL.Query().Get("prune") == "true"
+
+	//decode request body
+	buf, err := ioutil.ReadAll(r.Body)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	var req struct {
+		Accounts []declaredAccount `yaml:"accounts"`
+	}
+	err = yaml.Unmarshal(buf, &req)
+	if err != nil {
+		http.Error(w, "request body is not valid YAML: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//validate declared accounts
+	isDeclared := make(map[string]bool)
+	for idx, decl := range req.Accounts {
+		if !accountNameRx.MatchString(decl.Name) {
+			http.Error(w, fmt.Sprintf(`malformed attribute "accounts[%d].name" in request body`, idx), http.StatusUnprocessableEntity)
+			return
+		}
+		if isReservedAccountName(decl.Name) {
+			http.Error(w, `account names with the prefix "keppel-" are reserved for internal use`, http.StatusUnprocessableEntity)
+			return
+		}
+		if isDeclared[decl.Name] {
+			http.Error(w, "duplicate declaration for account "+decl.Name, http.StatusUnprocessableEntity)
+			return
+		}
+		isDeclared[decl.Name] = true
+		if err := keppel.State.AuthDriver.ValidateTenantID(decl.AuthTenantID); err != nil {
+			http.Error(w, fmt.Sprintf(`malformed attribute "accounts[%d].auth_tenant_id" in request body: %s`, idx, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		if decl.Policies != nil {
+			if err := decl.Policies.Validate(); err != nil {
+				http.Error(w, fmt.Sprintf(`malformed attribute "accounts[%d].policies" in request body: %s`, idx, err.Error()), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+	}
+
+	//check permission to manage all declared accounts
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return
+	}
+	for _, decl := range req.Accounts {
+		if !authz.HasPermission(keppel.CanChangeAccount, decl.AuthTenantID) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	changes, err := computeAccountChanges(req.Accounts, authz, prune)
+	if err, ok := err.(applyConflictError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	if !dryRun {
+		//check that all changes can be applied before applying any of them
+		userName := ""
+		for _, change := range changes {
+			if change.Action != "delete" {
+				continue
+			}
+			isHeld, err := isAccountHeld(change.AccountName)
+			if respondwith.ErrorText(w, err) {
+				return
+			}
+			if isHeld {
+				http.Error(w, "cannot prune account "+change.AccountName+": account cannot be deleted while it is under legal hold", http.StatusConflict)
+				return
+			}
+			//deletions are recorded in the audit log, so we need to know who does them
+			if userName == "" {
+				userName, _, err = keppel.State.AuthDriver.UserIdentity(authz)
+				if err != nil {
+					http.Error(w, "cannot identify user: "+err.Error(), http.StatusForbidden)
+					return
+				}
+			}
+		}
+		for _, change := range changes {
+			err := applyAccountChange(change, authz, userName)
+			if err == keppel.ErrAccountNameClaimed {
+				http.Error(w, "account name "+change.AccountName+" already in use by a different tenant", http.StatusConflict)
+				return
+			}
+			if err, ok := err.(applyConflictError); ok {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if respondwith.ErrorText(w, err) {
+				return
+			}
+		}
+	}
+
+	//ensure that this serializes as a list, not as null
+	if len(changes) == 0 {
+		changes = []accountChange{}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"dry_run": dryRun,
+		"changes": changes,
+	})
+}
+
+type applyConflictError string
+
+func (e applyConflictError) Error() string {
+	return string(e)
+}
+
+//computeAccountChanges computes the difference between the declared accounts
+//and the live state in the DB. When `prune` is set, accounts that are not
+//declared are marked for deletion, but only if the user is allowed to change
+//them (accounts of other tenants are out of scope for the user's declaration)
+//and they are not pending deletion already.
+func computeAccountChanges(declared []declaredAccount, authz keppel.Authorization, prune bool) ([]accountChange, error) {
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	existingAccounts := make(map[string]*keppel.Account, len(accounts))
+	for idx, account := range accounts {
+		existingAccounts[account.Name] = &accounts[idx]
+	}
+
+	var changes []accountChange
+	isDeclared := make(map[string]bool, len(declared))
+	for _, decl := range declared {
+		isDeclared[decl.Name] = true
+
+		//undeclared policies are inherited from the tenant defaults
+		var newPolicies keppel.AccountPolicies
+		if decl.Policies != nil {
+			newPolicies = *decl.Policies
+		}
+
+		account := existingAccounts[decl.Name]
+		if account == nil {
+			changes = append(changes, accountChange{
+				Action:       "create",
+				AccountName:  decl.Name,
+				AuthTenantID: decl.AuthTenantID,
+				NewPolicies:  &newPolicies,
+			})
+			continue
+		}
+
+		if account.AuthTenantID != decl.AuthTenantID {
+			return nil, applyConflictError("account name " + decl.Name + " already in use by a different tenant")
+		}
+		if account.DeletedAt != nil {
+			return nil, applyConflictError("account " + decl.Name + " is pending deletion and needs to be restored first")
+		}
+		oldPolicies, err := account.ExplicitPolicies()
+		if err != nil {
+			return nil, err
+		}
+		if oldPolicies.ToJSON() != newPolicies.ToJSON() {
+			changes = append(changes, accountChange{
+				Action:       "update",
+				AccountName:  decl.Name,
+				AuthTenantID: decl.AuthTenantID,
+				OldPolicies:  &oldPolicies,
+				NewPolicies:  &newPolicies,
+			})
+		}
+	}
+
+	if prune {
+		for idx, account := range accounts {
+			if isDeclared[account.Name] || !authz.HasPermission(keppel.CanChangeAccount, account.AuthTenantID) {
+				continue
+			}
+			//accounts that are pending deletion already need no further change
+			if account.DeletedAt != nil {
+				continue
+			}
+			changes = append(changes, accountChange{
+				Action:       "delete",
+				AccountName:  account.Name,
+				AuthTenantID: account.AuthTenantID,
+				account:      &accounts[idx],
+			})
+		}
+	}
+
+	return changes, nil
+}
+
+//applyAccountChange applies a change computed by computeAccountChanges.
+//`userName` identifies the user in audit events; it is only required for
+//Action == "delete".
+func applyAccountChange(change accountChange, authz keppel.Authorization, userName string) error {
+	switch change.Action {
+	case "create":
+		return createAccount(keppel.Account{
+			Name:         change.AccountName,
+			AuthTenantID: change.AuthTenantID,
+			PoliciesJSON: change.NewPolicies.ToJSON(),
+		}, authz)
+	case "update":
+		//only touch the policies, so that changes made to the account since the
+		//diff was computed (e.g. a deletion request, or a backup setting the
+		//account read-only) are not reverted
+		result, err := keppel.State.DB.Exec(
+			`UPDATE accounts SET policies_json = $1 WHERE name = $2 AND deleted_at IS NULL`,
+			change.NewPolicies.ToJSON(), change.AccountName)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err == nil && rowsAffected == 0 {
+			err = applyConflictError("account " + change.AccountName + " is pending deletion and needs to be restored first")
+		}
+		return err
+	case "delete":
+		//like DELETE /keppel/v1/accounts/:account, this only starts the grace
+		//period after which the account is torn down
+		return requestAccountDeletion(*change.account, userName)
+	default:
+		return fmt.Errorf("cannot apply change with action %q", change.Action)
+	}
+}
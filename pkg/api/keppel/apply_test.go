@@ -0,0 +1,366 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestApplyAPI(t *testing.T) {
+	r, authDriver := setup(t)
+
+	//preparation: create an account that is not part of the declaration
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/legacy",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: 200,
+	}.Check(t, r)
+
+	declaration := assert.StringData(`
+accounts:
+  - name: first
+    auth_tenant_id: tenant1
+  - name: second
+    auth_tenant_id: tenant1
+    policies:
+      immutable_tags: true
+`)
+
+	//test invalid inputs and insufficient permissions
+	testCases := []struct {
+		Body         string
+		ExpectStatus int
+		ErrorText    string
+	}{
+		{
+			Body:         "accounts: [ { name: Foo, auth_tenant_id: tenant1 } ]",
+			ExpectStatus: 422,
+			ErrorText:    "malformed attribute \"accounts[0].name\" in request body\n",
+		},
+		{
+			Body:         "accounts: [ { name: keppel-foo, auth_tenant_id: tenant1 } ]",
+			ExpectStatus: 422,
+			ErrorText:    "account names with the prefix \"keppel-\" are reserved for internal use\n",
+		},
+		{
+			Body:         "accounts: [ { name: foo, auth_tenant_id: tenant1 }, { name: foo, auth_tenant_id: tenant1 } ]",
+			ExpectStatus: 422,
+			ErrorText:    "duplicate declaration for account foo\n",
+		},
+		{
+			Body:         "accounts: [ { name: foo, auth_tenant_id: invalid } ]",
+			ExpectStatus: 422,
+			ErrorText:    "malformed attribute \"accounts[0].auth_tenant_id\" in request body: must not be \"invalid\"\n",
+		},
+		{
+			Body:         "accounts: [ { name: foo, auth_tenant_id: tenant2 } ]",
+			ExpectStatus: 403,
+			ErrorText:    "Forbidden\n",
+		},
+		{
+			Body:         "accounts: [ { name: legacy, auth_tenant_id: tenant3 } ]",
+			ExpectStatus: 409,
+			ErrorText:    "account name legacy already in use by a different tenant\n",
+		},
+	}
+	for _, tc := range testCases {
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/apply",
+			Header:       map[string]string{"X-Test-Perms": "change:tenant1,change:tenant3"},
+			Body:         assert.StringData(tc.Body),
+			ExpectStatus: tc.ExpectStatus,
+			ExpectBody:   assert.StringData(tc.ErrorText),
+		}.Check(t, r)
+	}
+
+	//dry run shows the changes without applying them
+	expectedChanges := []assert.JSONObject{
+		{
+			"action":         "create",
+			"account":        "first",
+			"auth_tenant_id": "tenant1",
+			"new_policies":   assert.JSONObject{},
+		},
+		{
+			"action":         "create",
+			"account":        "second",
+			"auth_tenant_id": "tenant1",
+			"new_policies":   assert.JSONObject{"immutable_tags": true},
+		},
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?dry_run=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         declaration,
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"dry_run": true, "changes": expectedChanges},
+	}.Check(t, r)
+	assert.DeepEqual(t, "authDriver.AccountsThatWereSetUp",
+		len(authDriver.AccountsThatWereSetUp), 1,
+	)
+
+	//apply for real, then again to check idempotency
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         declaration,
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"dry_run": false, "changes": expectedChanges},
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         declaration,
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"dry_run": false, "changes": []interface{}{}},
+	}.Check(t, r)
+	assert.DeepEqual(t, "authDriver.AccountsThatWereSetUp",
+		authDriver.AccountsThatWereSetUp,
+		[]keppel.Account{
+			{Name: "legacy", AuthTenantID: "tenant1", PoliciesJSON: "{}"},
+			{Name: "first", AuthTenantID: "tenant1", PoliciesJSON: "{}"},
+			{Name: "second", AuthTenantID: "tenant1", PoliciesJSON: `{"immutable_tags":true}`},
+		},
+	)
+
+	//changing policies yields an update
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/apply",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.StringData(`
+accounts:
+  - name: first
+    auth_tenant_id: tenant1
+  - name: second
+    auth_tenant_id: tenant1
+`),
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"dry_run": false,
+			"changes": []assert.JSONObject{{
+				"action":         "update",
+				"account":        "second",
+				"auth_tenant_id": "tenant1",
+				"old_policies":   assert.JSONObject{"immutable_tags": true},
+				"new_policies":   assert.JSONObject{},
+			}},
+		},
+	}.Check(t, r)
+
+	//pruning is shown in dry run
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?dry_run=true&prune=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         declaration,
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"dry_run": true,
+			"changes": []assert.JSONObject{
+				{
+					"action":         "update",
+					"account":        "second",
+					"auth_tenant_id": "tenant1",
+					"old_policies":   assert.JSONObject{},
+					"new_policies":   assert.JSONObject{"immutable_tags": true},
+				},
+				{
+					"action":         "delete",
+					"account":        "legacy",
+					"auth_tenant_id": "tenant1",
+				},
+			},
+		},
+	}.Check(t, r)
+
+	//pruning is refused for accounts under legal hold
+	hold := keppel.LegalHold{AccountName: "legacy", RepoName: "foo", Reason: "x", Reference: "y", CreatedAt: time.Now()}
+	err := keppel.State.DB.Insert(&hold)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?prune=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1", "X-Test-User": "alice"},
+		Body:         declaration,
+		ExpectStatus: 409,
+		ExpectBody:   assert.StringData("cannot prune account legacy: account cannot be deleted while it is under legal hold\n"),
+	}.Check(t, r)
+	_, err = keppel.State.DB.Delete(&hold)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//pruning is recorded in the audit log, so the user must be identifiable
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?prune=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         declaration,
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("cannot identify user: cannot identify user without X-Test-User header\n"),
+	}.Check(t, r)
+
+	//pruning puts undeclared accounts into the "pending deletion" state
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?prune=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1", "X-Test-User": "alice"},
+		Body:         declaration,
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"dry_run": false,
+			"changes": []assert.JSONObject{
+				{
+					"action":         "update",
+					"account":        "second",
+					"auth_tenant_id": "tenant1",
+					"old_policies":   assert.JSONObject{},
+					"new_policies":   assert.JSONObject{"immutable_tags": true},
+				},
+				{
+					"action":         "delete",
+					"account":        "legacy",
+					"auth_tenant_id": "tenant1",
+				},
+			},
+		},
+	}.Check(t, r)
+	account, err := keppel.State.DB.FindAccount("legacy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if account == nil || account.DeletedAt == nil {
+		t.Error("expected account legacy to be pending deletion")
+	}
+	var actions []string
+	_, err = keppel.State.DB.Select(&actions, `SELECT action FROM audit_events WHERE account_name = $1 AND user_name = $2`, "legacy", "alice")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "audit event actions", actions, []string{"request_account_deletion"})
+
+	//accounts that are pending deletion are not pruned again, and cannot be
+	//declared until they have been restored
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?prune=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1", "X-Test-User": "alice"},
+		Body:         declaration,
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"dry_run": false, "changes": []interface{}{}},
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.StringData("accounts: [ { name: legacy, auth_tenant_id: tenant1 } ]"),
+		ExpectStatus: 409,
+		ExpectBody:   assert.StringData("account legacy is pending deletion and needs to be restored first\n"),
+	}.Check(t, r)
+
+	//pruning only considers accounts that the user can change
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/apply?dry_run=true&prune=true",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant2"},
+		Body:         assert.StringData("accounts: []"),
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"dry_run": true, "changes": []interface{}{}},
+	}.Check(t, r)
+}
+
+func TestApplyDoesNotRevertConcurrentChanges(t *testing.T) {
+	r, _ := setup(t)
+	for _, accountName := range []string{"first", "second"} {
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         "/keppel/v1/accounts/" + accountName,
+			Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+			ExpectStatus: 200,
+		}.Check(t, r)
+	}
+
+	//compute a diff that updates both accounts...
+	authz, rerr := keppel.State.AuthDriver.AuthenticateUser("alice", "change:tenant1")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	immutableTags := true
+	policies := keppel.AccountPolicies{ImmutableTags: &immutableTags}
+	changes, err := computeAccountChanges([]declaredAccount{
+		{Name: "first", AuthTenantID: "tenant1", Policies: &policies},
+		{Name: "second", AuthTenantID: "tenant1", Policies: &policies},
+	}, authz, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+
+	//...then change both accounts before the diff is applied
+	_, err = keppel.State.DB.SetAccountReadOnly("first", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET deleted_at = $1 WHERE name = $2`, time.Now(), "second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = applyAccountChange(changes[0], authz, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = applyAccountChange(changes[1], authz, "")
+	assert.DeepEqual(t, "error", err, error(applyConflictError("account second is pending deletion and needs to be restored first")))
+
+	first, err := keppel.State.DB.FindAccount("first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !first.ReadOnly {
+		t.Error("expected account first to still be read-only")
+	}
+	if first.PoliciesJSON != policies.ToJSON() {
+		t.Errorf("expected policies of account first to be updated, got %s", first.PoliciesJSON)
+	}
+	second, err := keppel.State.DB.FindAccount("second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if second.DeletedAt == nil {
+		t.Error("expected account second to still be pending deletion")
+	}
+}
@@ -0,0 +1,90 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//findViewableAccount returns the account from the request path, or writes an
+//error response and returns nil if the user cannot view it.
+func findViewableAccount(w http.ResponseWriter, r *http.Request) *keppel.Account {
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return nil
+	}
+
+	//get account from DB to find its AuthTenantID
+	accountName := mux.Vars(r)["account"]
+	account, err := keppel.State.DB.FindAccount(accountName)
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	//this returns 404 even if the real reason is lack of authorization in order
+	//to not leak information about which accounts exist for other tenants
+	if account == nil || !authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+		http.Error(w, "no such account", 404)
+		return nil
+	}
+	return account
+}
+
+func handleGetAccountEvents(w http.ResponseWriter, r *http.Request) {
+	account := findViewableAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	var events []keppel.AuditEvent
+	_, err := keppel.State.DB.Select(&events,
+		`SELECT * FROM audit_events WHERE account_name = $1 ORDER BY id`, account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//ensure that this serializes as a list, not as null
+	if len(events) == 0 {
+		events = []keppel.AuditEvent{}
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
+
+func handleGetAccountEventsVerification(w http.ResponseWriter, r *http.Request) {
+	account := findViewableAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	result, err := keppel.State.DB.VerifyAuditLog(account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"verification": map[string]interface{}{
+			"valid":       result.IsValid(),
+			"events":      result.EventCount,
+			"checkpoints": result.CheckpointCount,
+			"problems":    result.Problems,
+		},
+	})
+}
@@ -0,0 +1,136 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestAccountEventsAPI(t *testing.T) {
+	r, _ := setup(t)
+
+	//preparation: create an account
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": assert.JSONObject{"auth_tenant_id": "tenant1"}},
+		ExpectStatus: 200,
+	}.Check(t, r)
+
+	//no events right now
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/events",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"events": []interface{}{}},
+	}.Check(t, r)
+
+	//record an event
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	event := keppel.AuditEvent{
+		AccountName: "first",
+		Action:      "expire_manifest",
+		UserName:    "keppel-image-expiry",
+		RepoName:    "foo",
+		Digest:      digest,
+		Details:     "deleted tags: latest",
+		CreatedAt:   time.Unix(3600, 0).UTC(),
+	}
+	err := keppel.State.DB.RecordAuditEvent(event)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//this is the first event in the hash chain of this account
+	event.Sequence = 1
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/events",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"events": []assert.JSONObject{{
+				"id":         1,
+				"account":    "first",
+				"action":     "expire_manifest",
+				"user":       "keppel-image-expiry",
+				"repository": "foo",
+				"digest":     digest,
+				"details":    "deleted tags: latest",
+				"created_at": "1970-01-01T01:00:00Z",
+				"sequence":   1,
+				"hash":       event.ComputeHash(),
+			}},
+		},
+	}.Check(t, r)
+
+	//the audit log is intact
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/events/verification",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"verification": assert.JSONObject{
+				"valid":       true,
+				"events":      1,
+				"checkpoints": 0,
+				"problems":    []interface{}{},
+			},
+		},
+	}.Check(t, r)
+
+	//tamper with the event
+	_, err = keppel.State.DB.Exec(`UPDATE audit_events SET details = $1`, "deleted tags: nothing")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/events/verification",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"verification": assert.JSONObject{
+				"valid":       false,
+				"events":      1,
+				"checkpoints": 0,
+				"problems":    []string{"event 1 (sequence 1) was modified"},
+			},
+		},
+	}.Check(t, r)
+
+	//events are not visible to other tenants
+	for _, path := range []string{"/keppel/v1/accounts/first/events", "/keppel/v1/accounts/first/events/verification"} {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         path,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+			ExpectStatus: 404,
+			ExpectBody:   assert.StringData("no such account\n"),
+		}.Check(t, r)
+	}
+}
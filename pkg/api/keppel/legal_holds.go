@@ -0,0 +1,169 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//requireAdmin checks that the user making this request has the
+//CanAdministrateKeppel permission. If not, an error response is written and
+//false is returned.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return false
+	}
+	if !authz.HasPermission(keppel.CanAdministrateKeppel, "") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func handleGetLegalHolds(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	//the list can optionally be restricted to a single account and/or repository
+	query := `SELECT * FROM legal_holds WHERE TRUE`
+	var args []interface{}
+	if accountName := r.URL.Query().Get("account"); accountName != "" {
+		args = append(args, accountName)
+		query += ` AND account_name = $` + strconv.Itoa(len(args))
+	}
+	if repoName := r.URL.Query().Get("repository"); repoName != "" {
+		args = append(args, repoName)
+		query += ` AND repo_name = $` + strconv.Itoa(len(args))
+	}
+
+	var holds []keppel.LegalHold
+	_, err := keppel.State.DB.Select(&holds, query+` ORDER BY id`, args...)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//ensure that this serializes as a list, not as null
+	if len(holds) == 0 {
+		holds = []keppel.LegalHold{}
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"legal_holds": holds})
+}
+
+func handlePostLegalHold(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	//decode request body
+	var req struct {
+		LegalHold struct {
+			AccountName string `json:"account"`
+			RepoName    string `json:"repository"`
+			Digest      string `json:"digest"`
+			Reason      string `json:"reason"`
+			Reference   string `json:"reference"`
+		} `json:"legal_hold"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	in := req.LegalHold
+	if !auth.IsValidRepositoryName(in.RepoName) {
+		http.Error(w, `malformed attribute "legal_hold.repository" in request body`, http.StatusUnprocessableEntity)
+		return
+	}
+	if in.Digest != "" {
+		_, err := digest.ParseDigest(in.Digest)
+		if err != nil {
+			http.Error(w, `malformed attribute "legal_hold.digest" in request body: `+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if in.Reason == "" {
+		http.Error(w, `missing attribute "legal_hold.reason" in request body`, http.StatusUnprocessableEntity)
+		return
+	}
+	if in.Reference == "" {
+		http.Error(w, `missing attribute "legal_hold.reference" in request body`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	account, err := keppel.State.DB.FindAccount(in.AccountName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if account == nil {
+		http.Error(w, `no such account: `+in.AccountName, http.StatusUnprocessableEntity)
+		return
+	}
+
+	hold := keppel.LegalHold{
+		AccountName: account.Name,
+		RepoName:    in.RepoName,
+		Digest:      in.Digest,
+		Reason:      in.Reason,
+		Reference:   in.Reference,
+		CreatedAt:   time.Now().UTC(),
+	}
+	err = keppel.State.DB.Insert(&hold)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusCreated, map[string]interface{}{"legal_hold": hold})
+}
+
+func handleDeleteLegalHold(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "no such legal hold", http.StatusNotFound)
+		return
+	}
+	result, err := keppel.State.DB.Exec(`DELETE FROM legal_holds WHERE id = $1`, id)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	rowsDeleted, err := result.RowsAffected()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if rowsDeleted == 0 {
+		http.Error(w, "no such legal hold", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
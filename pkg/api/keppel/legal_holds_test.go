@@ -0,0 +1,205 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestLegalHoldsAPI(t *testing.T) {
+	r, _ := setup(t)
+
+	//preparation: create an account
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: 200,
+	}.Check(t, r)
+
+	//no legal holds right now
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/legal_holds",
+		Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"legal_holds": []interface{}{}},
+	}.Check(t, r)
+
+	//account owners are not allowed to manage legal holds
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/legal_holds",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/admin/legal_holds",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"legal_hold": assert.JSONObject{
+				"account":    "first",
+				"repository": "foo",
+				"reason":     "investigation",
+				"reference":  "CASE-42",
+			},
+		},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+
+	//test invalid inputs
+	testCases := []struct {
+		Hold      assert.JSONObject
+		ErrorText string
+	}{
+		{
+			Hold:      assert.JSONObject{"account": "first", "repository": "Foo", "reason": "x", "reference": "y"},
+			ErrorText: "malformed attribute \"legal_hold.repository\" in request body\n",
+		},
+		{
+			Hold:      assert.JSONObject{"account": "first", "repository": "foo", "digest": "sha256:abc", "reason": "x", "reference": "y"},
+			ErrorText: "malformed attribute \"legal_hold.digest\" in request body: invalid checksum digest length\n",
+		},
+		{
+			Hold:      assert.JSONObject{"account": "first", "repository": "foo", "reference": "y"},
+			ErrorText: "missing attribute \"legal_hold.reason\" in request body\n",
+		},
+		{
+			Hold:      assert.JSONObject{"account": "first", "repository": "foo", "reason": "x"},
+			ErrorText: "missing attribute \"legal_hold.reference\" in request body\n",
+		},
+		{
+			Hold:      assert.JSONObject{"account": "second", "repository": "foo", "reason": "x", "reference": "y"},
+			ErrorText: "no such account: second\n",
+		},
+	}
+	for _, tc := range testCases {
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/admin/legal_holds",
+			Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+			Body:         assert.JSONObject{"legal_hold": tc.Hold},
+			ExpectStatus: 422,
+			ExpectBody:   assert.StringData(tc.ErrorText),
+		}.Check(t, r)
+	}
+
+	//place a hold on a whole repository and one on a single manifest
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/admin/legal_holds",
+		Header: map[string]string{"X-Test-Perms": "keppeladmin:"},
+		Body: assert.JSONObject{
+			"legal_hold": assert.JSONObject{
+				"account":    "first",
+				"repository": "foo",
+				"reason":     "investigation",
+				"reference":  "CASE-42",
+			},
+		},
+		ExpectStatus: 201,
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/admin/legal_holds",
+		Header: map[string]string{"X-Test-Perms": "keppeladmin:"},
+		Body: assert.JSONObject{
+			"legal_hold": assert.JSONObject{
+				"account":    "first",
+				"repository": "bar/baz",
+				"digest":     digest,
+				"reason":     "audit",
+				"reference":  "CASE-43",
+			},
+		},
+		ExpectStatus: 201,
+	}.Check(t, r)
+
+	//check the holds' effect
+	expectHeld := func(repoName, digest string, expected bool) {
+		t.Helper()
+		isHeld, err := keppel.State.DB.IsManifestHeld("first", repoName, digest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if isHeld != expected {
+			t.Errorf("expected IsManifestHeld(%q, %q) = %t, but got %t", repoName, digest, expected, isHeld)
+		}
+	}
+	otherDigest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	expectHeld("foo", digest, true)
+	expectHeld("foo", otherDigest, true)
+	expectHeld("bar/baz", digest, true)
+	expectHeld("bar/baz", otherDigest, false)
+	expectHeld("bar", digest, false)
+
+	//make timestamps predictable for the following GET
+	_, err := keppel.State.DB.Exec(`UPDATE legal_holds SET created_at = $1`, time.Unix(3600, 0).UTC())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/legal_holds?repository=bar/baz",
+		Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"legal_holds": []assert.JSONObject{{
+				"id":         2,
+				"account":    "first",
+				"repository": "bar/baz",
+				"digest":     digest,
+				"reason":     "audit",
+				"reference":  "CASE-43",
+				"created_at": "1970-01-01T01:00:00Z",
+			}},
+		},
+	}.Check(t, r)
+
+	//release the first hold
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/legal_holds/1",
+		Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+		ExpectStatus: 204,
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/legal_holds/1",
+		Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+		ExpectStatus: 404,
+		ExpectBody:   assert.StringData("no such legal hold\n"),
+	}.Check(t, r)
+	expectHeld("foo", digest, false)
+	expectHeld("bar/baz", digest, true)
+}
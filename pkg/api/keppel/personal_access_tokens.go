@@ -0,0 +1,221 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//personalAccessTokenRepr is the JSON representation of a personal access
+//token in the API.
+type personalAccessTokenRepr struct {
+	ID          int64      `json:"id"`
+	UserName    string     `json:"user"`
+	Description string     `json:"description"`
+	Permissions []string   `json:"permissions"`
+	AccountName *string    `json:"account,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	//Secret is only shown once, when the token is created.
+	Secret string `json:"token,omitempty"`
+}
+
+func renderPersonalAccessToken(pat keppel.PersonalAccessToken) personalAccessTokenRepr {
+	return personalAccessTokenRepr{
+		ID:          pat.ID,
+		UserName:    pat.UserName,
+		Description: pat.Description,
+		Permissions: pat.PermissionList(),
+		AccountName: pat.AccountName,
+		CreatedAt:   pat.CreatedAt,
+		ExpiresAt:   pat.ExpiresAt,
+		LastUsedAt:  pat.LastUsedAt,
+	}
+}
+
+//identifyUser authenticates the user making this request and returns the
+//user's name and identity as reported by AuthDriver.UserIdentity. If this
+//fails, an error response is written and ok is false.
+func identifyUser(w http.ResponseWriter, r *http.Request) (authz keppel.Authorization, userName, identity string, ok bool) {
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return nil, "", "", false
+	}
+	userName, identity, err := keppel.State.AuthDriver.UserIdentity(authz)
+	if err != nil {
+		http.Error(w, "cannot identify user: "+err.Error(), http.StatusForbidden)
+		return nil, "", "", false
+	}
+	return authz, userName, identity, true
+}
+
+func handleGetPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	_, _, identity, ok := identifyUser(w, r)
+	if !ok {
+		return
+	}
+
+	var pats []keppel.PersonalAccessToken
+	_, err := keppel.State.DB.Select(&pats,
+		`SELECT * FROM personal_access_tokens WHERE user_identity = $1 ORDER BY id`, identity)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//ensure that this serializes as a list, not as null
+	result := []personalAccessTokenRepr{}
+	for _, pat := range pats {
+		result = append(result, renderPersonalAccessToken(pat))
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"personal_access_tokens": result})
+}
+
+func handlePostPersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	authz, userName, identity, ok := identifyUser(w, r)
+	if !ok {
+		return
+	}
+
+	//decode request body
+	var req struct {
+		PersonalAccessToken struct {
+			Description string     `json:"description"`
+			Permissions []string   `json:"permissions"`
+			AccountName string     `json:"account"`
+			ExpiresAt   *time.Time `json:"expires_at"`
+		} `json:"personal_access_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	in := req.PersonalAccessToken
+
+	if len(in.Permissions) == 0 {
+		http.Error(w, `missing attribute "personal_access_token.permissions" in request body`, http.StatusUnprocessableEntity)
+		return
+	}
+	isPermission := make(map[string]bool)
+	for _, perm := range keppel.PersonalAccessTokenPermissions {
+		isPermission[perm] = true
+	}
+	for _, perm := range in.Permissions {
+		if !isPermission[perm] {
+			http.Error(w, `invalid permission in attribute "personal_access_token.permissions" in request body: `+perm, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(now) {
+		http.Error(w, `attribute "personal_access_token.expires_at" in request body must be in the future`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	pat := keppel.PersonalAccessToken{
+		UserName:     userName,
+		UserIdentity: identity,
+		Description:  in.Description,
+		Permissions:  strings.Join(in.Permissions, ","),
+		CreatedAt:    now,
+	}
+	if in.ExpiresAt != nil {
+		expiresAt := in.ExpiresAt.UTC()
+		pat.ExpiresAt = &expiresAt
+	}
+
+	//when restricted to an account, the user must currently have the requested
+	//permissions in that account (otherwise, the permissions are checked when
+	//the token is used)
+	if in.AccountName != "" {
+		account, err := keppel.State.DB.FindAccount(in.AccountName)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		if account == nil || !authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+			http.Error(w, `no such account: `+in.AccountName, http.StatusUnprocessableEntity)
+			return
+		}
+		//these are the permissions that the auth API checks for pull and push
+		requiredPerms := map[string]keppel.Permission{
+			"pull": keppel.CanViewAccount,
+			"push": keppel.CanChangeAccount,
+		}
+		for _, perm := range in.Permissions {
+			if !authz.HasPermission(requiredPerms[perm], account.AuthTenantID) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		pat.AccountName = &account.Name
+	}
+
+	secret, secretHash, err := keppel.GeneratePersonalAccessToken()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	pat.SecretHash = secretHash
+	err = keppel.State.DB.Insert(&pat)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	result := renderPersonalAccessToken(pat)
+	result.Secret = secret
+	respondwith.JSON(w, http.StatusCreated, map[string]interface{}{"personal_access_token": result})
+}
+
+func handleDeletePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	_, _, identity, ok := identifyUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "no such personal access token", http.StatusNotFound)
+		return
+	}
+	//users can only delete their own tokens
+	result, err := keppel.State.DB.Exec(
+		`DELETE FROM personal_access_tokens WHERE id = $1 AND user_identity = $2`, id, identity)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	rowsDeleted, err := result.RowsAffected()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if rowsDeleted == 0 {
+		http.Error(w, "no such personal access token", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,188 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestPersonalAccessTokensAPI(t *testing.T) {
+	r, _ := setup(t)
+	err := keppel.State.DB.Insert(&keppel.Account{Name: "first", AuthTenantID: "tenant1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	aliceHeaders := map[string]string{"X-Test-Perms": "view:tenant1", "X-Test-User": "alice"}
+	bobHeaders := map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1", "X-Test-User": "bob"}
+
+	//no tokens right now
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/personal_access_tokens",
+		Header:       aliceHeaders,
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"personal_access_tokens": []interface{}{}},
+	}.Check(t, r)
+
+	//tokens can only be managed by identifiable users
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/personal_access_tokens",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("cannot identify user: cannot identify user without X-Test-User header\n"),
+	}.Check(t, r)
+
+	//test invalid inputs
+	testCases := []struct {
+		Token        assert.JSONObject
+		ExpectStatus int
+		ErrorText    string
+	}{
+		{
+			Token:        assert.JSONObject{"description": "no permissions"},
+			ExpectStatus: 422,
+			ErrorText:    "missing attribute \"personal_access_token.permissions\" in request body\n",
+		},
+		{
+			Token:        assert.JSONObject{"permissions": []string{"pull", "keppeladmin"}},
+			ExpectStatus: 422,
+			ErrorText:    "invalid permission in attribute \"personal_access_token.permissions\" in request body: keppeladmin\n",
+		},
+		{
+			Token:        assert.JSONObject{"permissions": []string{"pull"}, "expires_at": "2018-01-01T00:00:00Z"},
+			ExpectStatus: 422,
+			ErrorText:    "attribute \"personal_access_token.expires_at\" in request body must be in the future\n",
+		},
+		{
+			Token:        assert.JSONObject{"permissions": []string{"pull"}, "account": "second"},
+			ExpectStatus: 422,
+			ErrorText:    "no such account: second\n",
+		},
+		{
+			//alice cannot push to this account, so tokens with push access cannot be created for it
+			Token:        assert.JSONObject{"permissions": []string{"pull", "push"}, "account": "first"},
+			ExpectStatus: 403,
+			ErrorText:    "Forbidden\n",
+		},
+	}
+	for _, tc := range testCases {
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/personal_access_tokens",
+			Header:       aliceHeaders,
+			Body:         assert.JSONObject{"personal_access_token": tc.Token},
+			ExpectStatus: tc.ExpectStatus,
+			ExpectBody:   assert.StringData(tc.ErrorText),
+		}.Check(t, r)
+	}
+
+	//create a token (not using assert.HTTPRequest since the response contains
+	//a random secret)
+	createToken := func(headers map[string]string, body string) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/keppel/v1/personal_access_tokens", bytes.NewReader([]byte(body)))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var data struct {
+			Token map[string]interface{} `json:"personal_access_token"`
+		}
+		err := json.Unmarshal(rec.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return data.Token
+	}
+	created := createToken(aliceHeaders,
+		`{"personal_access_token":{"description":"CI","permissions":["pull"],"account":"first","expires_at":"2099-01-01T00:00:00Z"}}`)
+	secret, _ := created["token"].(string)
+	if !strings.HasPrefix(secret, keppel.PersonalAccessTokenPrefix) {
+		t.Errorf("expected token to have the personal access token prefix, but got %q", secret)
+	}
+	pat, err := keppel.State.DB.FindPersonalAccessToken(secret)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pat == nil {
+		t.Fatal("created token not found in DB")
+	}
+	createToken(bobHeaders, `{"personal_access_token":{"permissions":["pull","push"]}}`)
+
+	//make created_at deterministic for the listing below
+	_, err = keppel.State.DB.Exec(`UPDATE personal_access_tokens SET created_at = $1`,
+		time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//users only see their own tokens, and the secret is not shown again
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/personal_access_tokens",
+		Header:       aliceHeaders,
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{"personal_access_tokens": []assert.JSONObject{{
+			"id":          1,
+			"user":        "alice",
+			"description": "CI",
+			"permissions": []string{"pull"},
+			"account":     "first",
+			"created_at":  "2018-06-01T00:00:00Z",
+			"expires_at":  "2099-01-01T00:00:00Z",
+		}}},
+	}.Check(t, r)
+
+	//users can only delete their own tokens
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/personal_access_tokens/1",
+		Header:       bobHeaders,
+		ExpectStatus: 404,
+		ExpectBody:   assert.StringData("no such personal access token\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/personal_access_tokens/1",
+		Header:       aliceHeaders,
+		ExpectStatus: 204,
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/personal_access_tokens",
+		Header:       aliceHeaders,
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"personal_access_tokens": []interface{}{}},
+	}.Check(t, r)
+}
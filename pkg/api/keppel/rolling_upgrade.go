@@ -0,0 +1,45 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"net/http"
+
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func handlePostRollingUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	trigger, ok := keppel.State.OrchestrationDriver.(keppel.RollingUpgradeTrigger)
+	if !ok {
+		http.Error(w, "rolling upgrades are not supported by this orchestration driver", http.StatusNotImplemented)
+		return
+	}
+	err := trigger.TriggerRollingUpgrade()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//the upgrade runs in the background
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestRollingUpgradeAPI(t *testing.T) {
+	//the noop orchestration driver does not support rolling upgrades
+	r, _ := setup(t)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/admin/rolling_upgrade",
+		Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+		ExpectStatus: 501,
+		ExpectBody:   assert.StringData("rolling upgrades are not supported by this orchestration driver\n"),
+	}.Check(t, r)
+
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+	router := mux.NewRouter()
+	AddTo(router)
+	r = router
+	orch := keppel.State.OrchestrationDriver.(*test.OrchestrationDriver)
+
+	//only admins may trigger rolling upgrades
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/admin/rolling_upgrade",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+	assert.DeepEqual(t, "number of rolling upgrades", orch.RollingUpgrades, 0)
+
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/admin/rolling_upgrade",
+		Header:       map[string]string{"X-Test-Perms": "keppeladmin:"},
+		ExpectStatus: 202,
+	}.Check(t, r)
+	assert.DeepEqual(t, "number of rolling upgrades", orch.RollingUpgrades, 1)
+}
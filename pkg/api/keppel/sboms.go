@@ -0,0 +1,65 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/sbom"
+)
+
+func handleGetManifestSBOM(w http.ResponseWriter, r *http.Request) {
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return
+	}
+
+	//get account from DB to find its AuthTenantID
+	vars := mux.Vars(r)
+	account, err := keppel.State.DB.FindAccount(vars["account"])
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//this returns 404 even if the real reason is lack of authorization in order
+	//to not leak information about which accounts exist for other tenants
+	if account == nil || !authz.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+		http.Error(w, "no such account", 404)
+		return
+	}
+
+	s, err := keppel.State.DB.FindSBOM(account.Name, vars["repo"], vars["digest"])
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	switch {
+	case s == nil:
+		http.Error(w, "no SBOM available for this manifest", 404)
+	case s.Status == keppel.SBOMPending:
+		http.Error(w, "SBOM generation is in progress", http.StatusAccepted)
+	case s.Status == keppel.SBOMFailed:
+		http.Error(w, "SBOM generation failed: "+s.Message, 404)
+	default:
+		w.Header().Set("Content-Type", sbom.CycloneDXMediaType)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(s.Contents))
+	}
+}
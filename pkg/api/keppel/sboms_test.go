@@ -0,0 +1,106 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestManifestSBOMAPI(t *testing.T) {
+	r, _ := setup(t)
+	err := keppel.State.DB.Insert(&keppel.Account{Name: "first", AuthTenantID: "tenant1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	digest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	path := "/keppel/v1/accounts/first/repositories/library/foo/_manifests/" + digest + "/sbom"
+
+	//no SBOM yet
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 404,
+		ExpectBody:   assert.StringData("no SBOM available for this manifest\n"),
+	}.Check(t, r)
+
+	//SBOM is being generated
+	err = keppel.State.DB.EnqueueSBOM("first", "library/foo", digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 202,
+		ExpectBody:   assert.StringData("SBOM generation is in progress\n"),
+	}.Check(t, r)
+
+	//SBOM generation failed
+	s := keppel.SBOM{
+		AccountName: "first",
+		RepoName:    "library/foo",
+		Digest:      digest,
+		Status:      keppel.SBOMFailed,
+		Message:     "something went wrong",
+		UpdatedAt:   time.Now(),
+	}
+	_, err = keppel.State.DB.Update(&s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 404,
+		ExpectBody:   assert.StringData("SBOM generation failed: something went wrong\n"),
+	}.Check(t, r)
+
+	//SBOM is ready
+	s.Status = keppel.SBOMReady
+	s.Message = ""
+	s.Contents = `{"bomFormat":"CycloneDX"}`
+	_, err = keppel.State.DB.Update(&s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"bomFormat": "CycloneDX"},
+	}.Check(t, r)
+
+	//SBOMs are only visible to users who can view the account
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: 404,
+		ExpectBody:   assert.StringData("no such account\n"),
+	}.Check(t, r)
+}
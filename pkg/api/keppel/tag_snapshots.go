@@ -0,0 +1,431 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryclient"
+)
+
+//The diff endpoint only requires view permission, so it does not identify the
+//user. Its requests to keppel-registry are made under this name instead.
+const tagSnapshotDiffUserName = "keppel-tag-snapshot-diff"
+
+type tagSnapshotRepr struct {
+	keppel.TagSnapshot
+	TagCount int                       `json:"tag_count"`
+	Tags     []keppel.TagSnapshotEntry `json:"tags,omitempty"`
+}
+
+//tagSnapshotDiff describes how the current tags of an account differ from a
+//tag snapshot.
+type tagSnapshotDiff struct {
+	//tags that were created after the snapshot was taken
+	Added []keppel.TagSnapshotEntry `json:"added"`
+	//tags that were deleted after the snapshot was taken
+	Removed []keppel.TagSnapshotEntry `json:"removed"`
+	//tags that point to a different manifest than in the snapshot
+	Changed []changedTag `json:"changed"`
+}
+
+type changedTag struct {
+	RepoName       string `json:"repository"`
+	TagName        string `json:"tag"`
+	SnapshotDigest string `json:"snapshot_digest"`
+	CurrentDigest  string `json:"current_digest"`
+}
+
+type tagKey struct {
+	RepoName string
+	TagName  string
+}
+
+//findTagSnapshot returns the tag snapshot from the request path, or writes an
+//error response and returns nil if it does not exist.
+func findTagSnapshot(w http.ResponseWriter, r *http.Request, account keppel.Account) *keppel.TagSnapshot {
+	snapshot, err := keppel.State.DB.FindTagSnapshot(account.Name, mux.Vars(r)["snapshot"])
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	if snapshot == nil {
+		http.Error(w, "no such tag snapshot", http.StatusNotFound)
+		return nil
+	}
+	return snapshot
+}
+
+//requireUsableAccount writes an error response and returns false if the
+//account's keppel-registry cannot be talked to.
+func requireUsableAccount(w http.ResponseWriter, account keppel.Account) bool {
+	if !account.IsUsable(time.Now()) {
+		http.Error(w, "account has expired or is pending deletion", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func getTagSnapshotEntries(snapshot keppel.TagSnapshot) ([]keppel.TagSnapshotEntry, error) {
+	var entries []keppel.TagSnapshotEntry
+	_, err := keppel.State.DB.Select(&entries, `
+		SELECT * FROM tag_snapshot_entries WHERE account_name = $1 AND snapshot_name = $2
+		 ORDER BY repo_name, tag_name`,
+		snapshot.AccountName, snapshot.Name)
+	return entries, err
+}
+
+//listCurrentTags asks the account's keppel-registry for all tags and the
+//manifests they point to, sorted by repository and tag name.
+func listCurrentTags(client registryclient.Client) ([]keppel.TagSnapshotEntry, error) {
+	repoNames, err := client.ListRepositories()
+	if err != nil {
+		return nil, err
+	}
+	var result []keppel.TagSnapshotEntry
+	for _, repoName := range repoNames {
+		tagNames, err := client.ListTags(repoName)
+		if err != nil {
+			return nil, fmt.Errorf("in repository %s: %s", repoName, err.Error())
+		}
+		sort.Strings(tagNames)
+		for _, tagName := range tagNames {
+			manifest, err := client.GetManifest(repoName, tagName)
+			if err != nil {
+				return nil, fmt.Errorf("in repository %s: %s", repoName, err.Error())
+			}
+			result = append(result, keppel.TagSnapshotEntry{
+				AccountName: client.Account.Name,
+				RepoName:    repoName,
+				TagName:     tagName,
+				Digest:      manifest.Digest,
+			})
+		}
+	}
+	return result, nil
+}
+
+//diffTagSnapshot compares the entries of a tag snapshot with the current tags.
+//Both lists must be sorted by repository and tag name.
+func diffTagSnapshot(snapshotEntries, currentEntries []keppel.TagSnapshotEntry) tagSnapshotDiff {
+	//ensure that the lists serialize as lists, not as null
+	diff := tagSnapshotDiff{
+		Added:   []keppel.TagSnapshotEntry{},
+		Removed: []keppel.TagSnapshotEntry{},
+		Changed: []changedTag{},
+	}
+
+	currentDigests := make(map[tagKey]string, len(currentEntries))
+	for _, e := range currentEntries {
+		currentDigests[tagKey{e.RepoName, e.TagName}] = e.Digest
+	}
+	snapshotDigests := make(map[tagKey]string, len(snapshotEntries))
+	for _, e := range snapshotEntries {
+		key := tagKey{e.RepoName, e.TagName}
+		snapshotDigests[key] = e.Digest
+		currentDigest, exists := currentDigests[key]
+		switch {
+		case !exists:
+			diff.Removed = append(diff.Removed, e)
+		case currentDigest != e.Digest:
+			diff.Changed = append(diff.Changed, changedTag{e.RepoName, e.TagName, e.Digest, currentDigest})
+		}
+	}
+	for _, e := range currentEntries {
+		if _, exists := snapshotDigests[tagKey{e.RepoName, e.TagName}]; !exists {
+			diff.Added = append(diff.Added, e)
+		}
+	}
+	return diff
+}
+
+func handleGetTagSnapshots(w http.ResponseWriter, r *http.Request) {
+	account := findViewableAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	var snapshots []keppel.TagSnapshot
+	_, err := keppel.State.DB.Select(&snapshots,
+		`SELECT * FROM tag_snapshots WHERE account_name = $1 ORDER BY name`, account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	tagCounts := make(map[string]int)
+	rows, err := keppel.State.DB.Query(`
+		SELECT snapshot_name, COUNT(*) FROM tag_snapshot_entries
+		 WHERE account_name = $1 GROUP BY snapshot_name`, account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	for rows.Next() {
+		var (
+			name  string
+			count int
+		)
+		err := rows.Scan(&name, &count)
+		if respondwith.ErrorText(w, err) {
+			rows.Close()
+			return
+		}
+		tagCounts[name] = count
+	}
+	err = rows.Err()
+	rows.Close()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//ensure that this serializes as a list, not as null
+	result := []tagSnapshotRepr{}
+	for _, s := range snapshots {
+		result = append(result, tagSnapshotRepr{TagSnapshot: s, TagCount: tagCounts[s.Name]})
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"tag_snapshots": result})
+}
+
+func handleGetTagSnapshot(w http.ResponseWriter, r *http.Request) {
+	account := findViewableAccount(w, r)
+	if account == nil {
+		return
+	}
+	snapshot := findTagSnapshot(w, r, *account)
+	if snapshot == nil {
+		return
+	}
+
+	entries, err := getTagSnapshotEntries(*snapshot)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"tag_snapshot": tagSnapshotRepr{TagSnapshot: *snapshot, TagCount: len(entries), Tags: entries},
+	})
+}
+
+func handlePutTagSnapshot(w http.ResponseWriter, r *http.Request) {
+	account, userName := findChangeableAccount(w, r)
+	if account == nil || !requireUsableAccount(w, *account) {
+		return
+	}
+
+	snapshotName := mux.Vars(r)["snapshot"]
+	existing, err := keppel.State.DB.FindTagSnapshot(account.Name, snapshotName)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if existing != nil {
+		//snapshots are never updated, so that their meaning does not change
+		http.Error(w, "tag snapshot exists already", http.StatusConflict)
+		return
+	}
+
+	client := registryclient.Client{Account: *account, UserName: userName}
+	entries, err := listCurrentTags(client)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	snapshot := keppel.TagSnapshot{
+		AccountName: account.Name,
+		Name:        snapshotName,
+		UserName:    userName,
+		CreatedAt:   time.Now().UTC(),
+	}
+	tx, err := keppel.State.DB.Begin()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	defer keppel.RollbackUnlessCommitted(tx)
+	err = tx.Insert(&snapshot)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	for _, e := range entries {
+		e.SnapshotName = snapshot.Name
+		err := tx.Insert(&e)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+	}
+	err = tx.Commit()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	err = keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+		AccountName: account.Name,
+		Action:      "create_tag_snapshot",
+		UserName:    userName,
+		Details:     fmt.Sprintf("snapshot %s contains %d tags", snapshot.Name, len(entries)),
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusCreated, map[string]interface{}{
+		"tag_snapshot": tagSnapshotRepr{TagSnapshot: snapshot, TagCount: len(entries), Tags: entries},
+	})
+}
+
+func handleDeleteTagSnapshot(w http.ResponseWriter, r *http.Request) {
+	account, userName := findChangeableAccount(w, r)
+	if account == nil {
+		return
+	}
+	snapshot := findTagSnapshot(w, r, *account)
+	if snapshot == nil {
+		return
+	}
+
+	//the entries are deleted by ON DELETE CASCADE, which releases the pins on
+	//the manifests referenced by them
+	_, err := keppel.State.DB.Delete(snapshot)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	err = keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+		AccountName: account.Name,
+		Action:      "delete_tag_snapshot",
+		UserName:    userName,
+		Details:     "snapshot " + snapshot.Name,
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetTagSnapshotDiff(w http.ResponseWriter, r *http.Request) {
+	account := findViewableAccount(w, r)
+	if account == nil || !requireUsableAccount(w, *account) {
+		return
+	}
+	snapshot := findTagSnapshot(w, r, *account)
+	if snapshot == nil {
+		return
+	}
+
+	snapshotEntries, err := getTagSnapshotEntries(*snapshot)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	client := registryclient.Client{Account: *account, UserName: tagSnapshotDiffUserName}
+	currentEntries, err := listCurrentTags(client)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"diff": diffTagSnapshot(snapshotEntries, currentEntries),
+	})
+}
+
+//handlePostTagSnapshotRestore points all tags from the snapshot back to the
+//manifests that they pointed to when the snapshot was taken. Tags that were
+//created after the snapshot was taken are left alone. If the restore fails
+//halfway, it can just be retried since tags that are already restored are
+//skipped.
+func handlePostTagSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	account, userName := findChangeableAccount(w, r)
+	if account == nil || !requireUsableAccount(w, *account) {
+		return
+	}
+	if account.ReadOnly {
+		http.Error(w, "account is read-only", http.StatusConflict)
+		return
+	}
+	snapshot := findTagSnapshot(w, r, *account)
+	if snapshot == nil {
+		return
+	}
+
+	snapshotEntries, err := getTagSnapshotEntries(*snapshot)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	client := registryclient.Client{Account: *account, UserName: userName}
+	currentEntries, err := listCurrentTags(client)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	diff := diffTagSnapshot(snapshotEntries, currentEntries)
+
+	//the restore must not overwrite tags that users could not overwrite either
+	policies, err := keppel.State.DB.GetEffectivePolicies(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	var forbiddenTags []string
+	for _, c := range diff.Changed {
+		if *policies.ImmutableTags || policies.IsProtectedTag(c.TagName) {
+			forbiddenTags = append(forbiddenTags, c.RepoName+":"+c.TagName)
+		}
+	}
+	if len(forbiddenTags) > 0 {
+		http.Error(w, "cannot overwrite immutable or protected tags: "+strings.Join(forbiddenTags, ", "), http.StatusConflict)
+		return
+	}
+
+	//ensure that this serializes as a list, not as null
+	restoredEntries := append([]keppel.TagSnapshotEntry{}, diff.Removed...)
+	for _, c := range diff.Changed {
+		restoredEntries = append(restoredEntries, keppel.TagSnapshotEntry{
+			AccountName: account.Name,
+			RepoName:    c.RepoName,
+			TagName:     c.TagName,
+			Digest:      c.SnapshotDigest,
+		})
+	}
+	sort.Slice(restoredEntries, func(i, j int) bool {
+		a, b := restoredEntries[i], restoredEntries[j]
+		return a.RepoName < b.RepoName || (a.RepoName == b.RepoName && a.TagName < b.TagName)
+	})
+
+	var restoredTags []string
+	for _, e := range restoredEntries {
+		manifest, err := client.GetManifest(e.RepoName, e.Digest)
+		if err == nil {
+			err = client.PutManifest(e.RepoName, e.TagName, manifest)
+		}
+		if err != nil {
+			respondwith.ErrorText(w, fmt.Errorf("cannot restore tag %s:%s: %s", e.RepoName, e.TagName, err.Error()))
+			return
+		}
+		restoredTags = append(restoredTags, e.RepoName+":"+e.TagName)
+	}
+
+	if len(restoredTags) > 0 {
+		err = keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+			AccountName: account.Name,
+			Action:      "restore_tag_snapshot",
+			UserName:    userName,
+			Details:     fmt.Sprintf("snapshot %s, restored tags: %s", snapshot.Name, strings.Join(restoredTags, ", ")),
+		})
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"restored_tags": restoredEntries})
+}
@@ -0,0 +1,250 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestTagSnapshots(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+	ownerHeader := map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1", "X-Test-User": "alice"}
+	viewerHeader := map[string]string{"X-Test-Perms": "view:tenant1", "X-Test-User": "bob"}
+
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1"}
+	err := keppel.State.DB.Insert(&account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	registry := test.NewRegistry()
+	keppel.State.OrchestrationDriver.(*test.OrchestrationDriver).Registries["first"] = registry
+	digest1 := registry.AddImage("first/foo", map[string]interface{}{"version": 1}, "latest", "v1")
+	digest2 := registry.AddImage("first/bar", map[string]interface{}{"version": 2}, "latest")
+
+	expectPinned := func(repoName, digest string, expected bool) {
+		t.Helper()
+		isPinned, err := keppel.State.DB.IsManifestPinned("first", repoName, digest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if isPinned != expected {
+			t.Errorf("expected IsManifestPinned(%s@%s) = %t, got %t", repoName, digest, expected, isPinned)
+		}
+	}
+
+	//taking a snapshot requires permission to change the account
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+	expectPinned("foo", digest1, false)
+
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, r)
+	expectPinned("foo", digest1, true)
+	expectPinned("bar", digest2, true)
+	expectPinned("bar", digest1, false)
+
+	//snapshots cannot be overwritten
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("tag snapshot exists already\n"),
+	}.Check(t, r)
+
+	snapshot, err := keppel.State.DB.FindTagSnapshot("first", "before-cleanup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"tag_snapshots": []assert.JSONObject{{
+			"name":       "before-cleanup",
+			"created_by": "alice",
+			"created_at": snapshot.CreatedAt,
+			"tag_count":  3,
+		}}},
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"tag_snapshot": assert.JSONObject{
+			"name":       "before-cleanup",
+			"created_by": "alice",
+			"created_at": snapshot.CreatedAt,
+			"tag_count":  3,
+			"tags": []assert.JSONObject{
+				{"repository": "bar", "tag": "latest", "digest": digest2},
+				{"repository": "foo", "tag": "latest", "digest": digest1},
+				{"repository": "foo", "tag": "v1", "digest": digest1},
+			},
+		}},
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/unknown",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such tag snapshot\n"),
+	}.Check(t, r)
+
+	//change the tags behind the snapshot's back
+	digest3 := registry.AddImage("first/foo", map[string]interface{}{"version": 3}, "latest", "v3")
+	delete(registry.Repos["first/bar"].Tags, "latest")
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup/diff",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"diff": assert.JSONObject{
+			"added": []assert.JSONObject{
+				{"repository": "foo", "tag": "v3", "digest": digest3},
+			},
+			"removed": []assert.JSONObject{
+				{"repository": "bar", "tag": "latest", "digest": digest2},
+			},
+			"changed": []assert.JSONObject{
+				{"repository": "foo", "tag": "latest", "snapshot_digest": digest1, "current_digest": digest3},
+			},
+		}},
+	}.Check(t, r)
+
+	//restoring requires permission to change the account
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup/restore",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+
+	//restoring must not overwrite protected tags
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET policies_json = $1 WHERE name = $2`, `{"protected_tags":"latest"}`, "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("cannot overwrite immutable or protected tags: foo:latest\n"),
+	}.Check(t, r)
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET policies_json = $1 WHERE name = $2`, `{}`, "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//restoring does not work while the account is read-only
+	_, err = keppel.State.DB.SetAccountReadOnly("first", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account is read-only\n"),
+	}.Check(t, r)
+	_, err = keppel.State.DB.SetAccountReadOnly("first", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//restore the snapshot; tags that were created afterwards stay
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"restored_tags": []assert.JSONObject{
+			{"repository": "bar", "tag": "latest", "digest": digest2},
+			{"repository": "foo", "tag": "latest", "digest": digest1},
+		}},
+	}.Check(t, r)
+	assert.DeepEqual(t, "tags in first/foo", registry.Repos["first/foo"].Tags,
+		map[string]string{"latest": digest1, "v1": digest1, "v3": digest3})
+	assert.DeepEqual(t, "tags in first/bar", registry.Repos["first/bar"].Tags,
+		map[string]string{"latest": digest2})
+
+	//restoring again is a no-op
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup/restore",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"restored_tags": []assert.JSONObject{}},
+	}.Check(t, r)
+
+	//deleting the snapshot releases the pins
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots/before-cleanup",
+		Header:       ownerHeader,
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, r)
+	expectPinned("foo", digest1, false)
+	expectPinned("bar", digest2, false)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/tag_snapshots",
+		Header:       viewerHeader,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tag_snapshots": []assert.JSONObject{}},
+	}.Check(t, r)
+
+	//all changes are recorded in the audit log
+	var actions []string
+	_, err = keppel.State.DB.Select(&actions, `SELECT action FROM audit_events WHERE account_name = $1 ORDER BY id`, "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "audit event actions", actions,
+		[]string{"create_tag_snapshot", "restore_tag_snapshot", "delete_tag_snapshot"})
+}
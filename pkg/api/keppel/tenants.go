@@ -0,0 +1,93 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func handleGetTenantDefaults(w http.ResponseWriter, r *http.Request) {
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return
+	}
+	tenantID := mux.Vars(r)["tenant_id"]
+	if !authz.HasPermission(keppel.CanViewAccount, tenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	policies, err := keppel.State.DB.FindTenantDefaults(tenantID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"defaults": map[string]interface{}{"policies": policies},
+	})
+}
+
+func handlePutTenantDefaults(w http.ResponseWriter, r *http.Request) {
+	//decode request body
+	var req struct {
+		Defaults struct {
+			Policies keppel.AccountPolicies `json:"policies"`
+		} `json:"defaults"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Defaults.Policies.Validate(); err != nil {
+		http.Error(w, `malformed attribute "defaults.policies" in request body: `+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	tenantID := mux.Vars(r)["tenant_id"]
+	if err := keppel.State.AuthDriver.ValidateTenantID(tenantID); err != nil {
+		http.Error(w, `malformed tenant ID: `+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	//check permission to change tenant defaults
+	authz, authErr := keppel.State.AuthDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return
+	}
+	if !authz.HasPermission(keppel.CanChangeAccount, tenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	_, err = keppel.State.DB.Exec(`
+		INSERT INTO tenant_defaults (auth_tenant_id, policies_json) VALUES ($1, $2)
+			ON CONFLICT (auth_tenant_id) DO UPDATE SET policies_json = EXCLUDED.policies_json
+	`, tenantID, req.Defaults.Policies.ToJSON())
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"defaults": map[string]interface{}{"policies": req.Defaults.Policies},
+	})
+}
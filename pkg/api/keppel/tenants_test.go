@@ -0,0 +1,185 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1api
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestTenantDefaults(t *testing.T) {
+	r, _ := setup(t)
+
+	//no defaults right now
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/tenants/tenant1/defaults",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody:   assert.JSONObject{"defaults": assert.JSONObject{"policies": assert.JSONObject{}}},
+	}.Check(t, r)
+
+	//test invalid inputs and insufficient permissions
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/tenants/tenant1/defaults",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/tenants/tenant1/defaults",
+		Header: map[string]string{"X-Test-Perms": "view:tenant1"},
+		Body: assert.JSONObject{
+			"defaults": assert.JSONObject{"policies": assert.JSONObject{"immutable_tags": true}},
+		},
+		ExpectStatus: 403,
+		ExpectBody:   assert.StringData("Forbidden\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/tenants/invalid/defaults",
+		Header: map[string]string{"X-Test-Perms": "change:invalid"},
+		Body: assert.JSONObject{
+			"defaults": assert.JSONObject{"policies": assert.JSONObject{"immutable_tags": true}},
+		},
+		ExpectStatus: 422,
+		ExpectBody:   assert.StringData("malformed tenant ID: must not be \"invalid\"\n"),
+	}.Check(t, r)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/tenants/tenant1/defaults",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"defaults": assert.JSONObject{"policies": assert.JSONObject{"protected_tags": "v[0-9"}},
+		},
+		ExpectStatus: 422,
+		ExpectBody:   assert.StringData("malformed attribute \"defaults.policies\" in request body: protected_tags: error parsing regexp: missing closing ]: `[0-9`\n"),
+	}.Check(t, r)
+
+	//set defaults (this request is executed twice to test idempotency)
+	for range []int{1, 2} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/tenants/tenant1/defaults",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"defaults": assert.JSONObject{"policies": assert.JSONObject{"immutable_tags": true}},
+			},
+			ExpectStatus: 200,
+			ExpectBody: assert.JSONObject{
+				"defaults": assert.JSONObject{"policies": assert.JSONObject{"immutable_tags": true}},
+			},
+		}.Check(t, r)
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/tenants/tenant1/defaults",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"defaults": assert.JSONObject{"policies": assert.JSONObject{"immutable_tags": true}},
+		},
+	}.Check(t, r)
+
+	//new accounts inherit the tenant defaults...
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{"auth_tenant_id": "tenant1"},
+		},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": true, "protected_tags": ""},
+			},
+		},
+	}.Check(t, r)
+
+	//...unless they override them explicitly...
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"policies":       assert.JSONObject{"immutable_tags": false},
+			},
+		},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{"immutable_tags": false},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
+			},
+		},
+	}.Check(t, r)
+
+	//...and PUT without policies does not touch the explicit policies...
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{"auth_tenant_id": "tenant1"},
+		},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{"immutable_tags": false},
+				"effective_policies": assert.JSONObject{"immutable_tags": false, "protected_tags": ""},
+			},
+		},
+	}.Check(t, r)
+
+	//...but removing the override restores the tenant default
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"policies":       assert.JSONObject{},
+			},
+		},
+		ExpectStatus: 200,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"policies":           assert.JSONObject{},
+				"effective_policies": assert.JSONObject{"immutable_tags": true, "protected_tags": ""},
+			},
+		},
+	}.Check(t, r)
+}
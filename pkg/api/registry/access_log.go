@@ -0,0 +1,98 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2api
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//countingReader wraps an io.Reader and counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	BytesRead int64
+}
+
+//Read implements the io.Reader interface.
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.Reader.Read(buf)
+	c.BytesRead += int64(n)
+	return n, err
+}
+
+//matches the path of all repository-scoped endpoints; the capture groups are
+//the repository name (without the leading account name) and the endpoint
+var repoPathRx = regexp.MustCompile(`^/v2/[a-z0-9-]{1,48}/(.+)/(tags/list|manifests/[^/]+|blobs/uploads/.*|blobs/[^/]+)$`)
+
+//recordAccess writes an entry into the account's access log for a request
+//that was proxied to keppel-registry. Failure to do so is logged, but does not
+//fail the request.
+func recordAccess(account keppel.Account, r *http.Request, resp *http.Response, bytes int64, startedAt time.Time) {
+	match := repoPathRx.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return
+	}
+	repoName, endpoint := match[1], match[2]
+
+	//the digest is reported by keppel-registry for manifest and blob requests,
+	//but not for e.g. HEAD requests that fail
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" && strings.HasPrefix(endpoint, "blobs/") && !strings.HasPrefix(endpoint, "blobs/uploads/") {
+		digest = strings.TrimPrefix(endpoint, "blobs/")
+	}
+
+	userName := ""
+	token, rerr := auth.ParseTokenFromRequest(r)
+	if rerr == nil {
+		userName = token.UserName
+	}
+
+	//X-Forwarded-For can be forged by the client, so it is only believed as far
+	//as it was written by the trusted proxies from the token binding config
+	sourceIP := ""
+	binding := keppel.TokenBinding{}
+	if keppel.State.Config.TokenBinding != nil {
+		binding = *keppel.State.Config.TokenBinding
+	}
+	if addr := binding.ClientAddress(r); addr != nil {
+		sourceIP = addr.String()
+	}
+
+	err := keppel.State.DB.Insert(&keppel.AccessLogEntry{
+		AccountName: account.Name,
+		CreatedAt:   startedAt.UTC(),
+		UserName:    userName,
+		SourceIP:    sourceIP,
+		Method:      r.Method,
+		RepoName:    repoName,
+		Digest:      digest,
+		StatusCode:  resp.StatusCode,
+		Bytes:       bytes,
+	})
+	if err != nil {
+		logg.Error("cannot write access log entry for %s %s: %s", r.Method, r.URL.Path, err.Error())
+	}
+}
@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestAccessLog(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+		token_binding:
+			enabled: true
+			trusted_proxies: [ '10.0.0.0/8' ]
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1"}
+	err := keppel.State.DB.Insert(&account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	registry := test.NewRegistry()
+	keppel.State.OrchestrationDriver.(*test.OrchestrationDriver).Registries["first"] = registry
+	digest := registry.AddImage("first/foo", map[string]interface{}{}, "latest")
+	manifest := registry.Repos["first/foo"].Manifests[digest]
+
+	token, err := auth.Token{
+		UserName: "alice",
+		Access: []auth.Scope{{
+			ResourceType: "repository",
+			ResourceName: "first/foo",
+			Actions:      []string{"pull", "push"},
+		}},
+	}.ToResponse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	doRequest := func(method, path, remoteAddr string, body []byte, header map[string]string) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	withToken := map[string]string{"Authorization": "Bearer " + token.Token}
+
+	//pull by tag, push by tag, anonymous pull, pull from behind a trusted proxy,
+	//pull with a forged X-Forwarded-For header
+	doRequest("GET", "/v2/first/foo/manifests/latest", "192.0.2.1:12345", nil, withToken)
+	doRequest("PUT", "/v2/first/foo/manifests/other", "192.0.2.1:12345", manifest.Contents, map[string]string{
+		"Authorization": "Bearer " + token.Token,
+		"Content-Type":  manifest.MediaType,
+	})
+	doRequest("GET", "/v2/first/foo/manifests/latest", "192.0.2.1:12345", nil, nil)
+	doRequest("GET", "/v2/first/foo/tags/list", "10.0.0.2:12345", nil, map[string]string{
+		"Authorization":   "Bearer " + token.Token,
+		"X-Forwarded-For": "203.0.113.1, 198.51.100.1, 10.0.0.1",
+	})
+	doRequest("GET", "/v2/first/foo/tags/list", "192.0.2.1:12345", nil, map[string]string{
+		"Authorization":   "Bearer " + token.Token,
+		"X-Forwarded-For": "198.51.100.1",
+	})
+
+	var entries []keppel.AccessLogEntry
+	_, err = keppel.State.DB.Select(&entries, `SELECT * FROM access_log_entries ORDER BY id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for idx, entry := range entries {
+		if time.Since(entry.CreatedAt) > time.Minute {
+			t.Errorf("unexpected timestamp on access log entry %d: %s", entry.ID, entry.CreatedAt)
+		}
+		entries[idx].CreatedAt = time.Time{}
+	}
+	manifestSize := int64(len(manifest.Contents))
+	assert.DeepEqual(t, "access log entries", entries, []keppel.AccessLogEntry{
+		{ID: 1, AccountName: "first", UserName: "alice", SourceIP: "192.0.2.1", Method: "GET", RepoName: "foo", Digest: digest, StatusCode: http.StatusOK, Bytes: manifestSize},
+		{ID: 2, AccountName: "first", UserName: "alice", SourceIP: "192.0.2.1", Method: "PUT", RepoName: "foo", Digest: digest, StatusCode: http.StatusCreated, Bytes: manifestSize},
+		{ID: 3, AccountName: "first", UserName: "", SourceIP: "192.0.2.1", Method: "GET", RepoName: "foo", StatusCode: http.StatusUnauthorized, Bytes: entries[2].Bytes},
+		{ID: 4, AccountName: "first", UserName: "alice", SourceIP: "198.51.100.1", Method: "GET", RepoName: "foo", StatusCode: http.StatusOK, Bytes: entries[3].Bytes},
+		{ID: 5, AccountName: "first", UserName: "alice", SourceIP: "192.0.2.1", Method: "GET", RepoName: "foo", StatusCode: http.StatusOK, Bytes: entries[4].Bytes},
+	})
+}
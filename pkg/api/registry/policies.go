@@ -0,0 +1,73 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2api
+
+import (
+	"net/http"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryclient"
+)
+
+//checkTagPolicies returns an error if the given DELETE or PUT request on the
+//given manifest reference would delete a manifest or overwrite an existing tag
+//in a way that is forbidden by the account's "immutable_tags" or
+//"protected_tags" policies. `userName` is the user making the request.
+func checkTagPolicies(account keppel.Account, r *http.Request, userName, repoName, reference string) (*keppel.RegistryV2Error, error) {
+	policies, err := keppel.State.DB.GetEffectivePolicies(account)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "DELETE":
+		//deleting a manifest also deletes all tags pointing to it
+		if *policies.ImmutableTags {
+			return keppel.ErrDenied.With("cannot delete manifests in account with immutable tags"), nil
+		}
+	case "PUT":
+		//pushing by digest never overwrites a tag
+		if isDigest(reference) {
+			return nil, nil
+		}
+		isProtected := policies.IsProtectedTag(reference)
+		if !*policies.ImmutableTags && !isProtected {
+			return nil, nil
+		}
+		exists, err := tagExists(account, userName, repoName, reference)
+		if err != nil {
+			return nil, err
+		}
+		if exists && *policies.ImmutableTags {
+			return keppel.ErrDenied.With("cannot overwrite existing tag %s in account with immutable tags", reference), nil
+		}
+		if exists {
+			return keppel.ErrDenied.With("cannot overwrite protected tag %s", reference), nil
+		}
+	}
+	return nil, nil
+}
+
+//tagExists asks keppel-registry whether the given tag exists. This does not
+//use the credentials from the original request, since those may not include
+//the "pull" action.
+func tagExists(account keppel.Account, userName, repoName, tagName string) (bool, error) {
+	client := registryclient.Client{Account: account, UserName: userName}
+	return client.ManifestExists(repoName, tagName)
+}
@@ -0,0 +1,93 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestTagPolicies(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1", PoliciesJSON: `{"protected_tags":"v.*"}`}
+	err := keppel.State.DB.Insert(&account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	registry := test.NewRegistry()
+	digest := registry.AddImage("first/foo", map[string]interface{}{}, "latest", "v1")
+	keppel.State.OrchestrationDriver.(*test.OrchestrationDriver).Registries["first"] = registry
+	manifest := registry.Repos["first/foo"].Manifests[digest]
+
+	//this token cannot be used to find out whether a tag exists, so the policy
+	//check must not rely on it
+	token, err := auth.Token{
+		UserName: "alice",
+		Access: []auth.Scope{{
+			ResourceType: "repository",
+			ResourceName: "first/foo",
+			Actions:      []string{"push"},
+		}},
+	}.ToResponse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectPushStatus := func(tagName string, expected int) {
+		t.Helper()
+		req := httptest.NewRequest("PUT", "/v2/first/foo/manifests/"+tagName, bytes.NewReader(manifest.Contents))
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		req.Header.Set("Content-Type", manifest.MediaType)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("PUT %s: expected status %d, got %d: %s", tagName, expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	//protected tags can be created, but not overwritten
+	expectPushStatus("v1", http.StatusForbidden)
+	expectPushStatus("v2", http.StatusCreated)
+	expectPushStatus("v2", http.StatusForbidden)
+	//other tags can be overwritten
+	expectPushStatus("latest", http.StatusCreated)
+
+	//with immutable tags, no tag can be overwritten
+	_, err = keppel.State.DB.Exec(`UPDATE accounts SET policies_json = $1 WHERE name = $2`, `{"immutable_tags":true}`, "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectPushStatus("latest", http.StatusForbidden)
+	expectPushStatus("other", http.StatusCreated)
+}
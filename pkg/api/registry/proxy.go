@@ -20,8 +20,12 @@ package registryv2api
 
 import (
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/logg"
@@ -86,6 +90,11 @@ func handleProxyToAccount(w http.ResponseWriter, r *http.Request) {
 	if respondwith.ErrorText(w, err) {
 		return
 	}
+	//expired and deleted accounts are about to be torn down, and their
+	//keppel-registry must not be started again
+	if account != nil && !account.IsUsable(time.Now()) {
+		account = nil
+	}
 	if account == nil {
 		//TODO respond in the same way as the registry would on Unauthorized, to
 		//not leak information about which accounts exist to unauthorized users
@@ -97,6 +106,36 @@ func handleProxyToAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//keppel-registry does not know about token binding, so tokens that are
+	//presented from the wrong network need to be rejected here already
+	if rerr := checkTokenBinding(r); rerr != nil {
+		logg.Info("%s %s: %s", r.Method, r.URL.Path, rerr.Error())
+		//the challenge makes the client obtain a new token from its actual address
+		auth.Challenge{Scope: requiredRepoScope(*account, r)}.WriteTo(w.Header())
+		rerr.WriteAsRegistryV2ResponseTo(w)
+		return
+	}
+
+	//while the account is read-only (e.g. during a backup), only reads are
+	//allowed; this is enforced here since keppel-registry cannot be
+	//reconfigured without a restart
+	if account.ReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+		keppel.ErrUnsupported.With("account %s is read-only right now, please retry later", account.Name).WriteAsRegistryV2ResponseTo(w)
+		return
+	}
+
+	if r.Method == "DELETE" || r.Method == "PUT" {
+		rerr, err := checkManifestChange(*account, r)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		if rerr != nil {
+			rerr.WriteAsRegistryV2ResponseTo(w)
+			return
+		}
+	}
+
+	startedAt := time.Now()
 	proxyRequest := *r
 	proxyRequest.Close = false
 	proxyRequest.RequestURI = ""
@@ -104,6 +143,15 @@ func handleProxyToAccount(w http.ResponseWriter, r *http.Request) {
 		host, _, _ := net.SplitHostPort(proxyRequest.RemoteAddr)
 		proxyRequest.Header.Set("X-Forwarded-For", host)
 	}
+	err = expandWildcardScopes(*account, &proxyRequest)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	var requestBody *countingReader
+	if r.Body != nil {
+		requestBody = &countingReader{Reader: r.Body}
+		proxyRequest.Body = ioutil.NopCloser(requestBody)
+	}
 
 	resp, err := keppel.State.OrchestrationDriver.DoHTTPRequest(*account, &proxyRequest)
 	if respondwith.ErrorText(w, err) {
@@ -111,12 +159,154 @@ func handleProxyToAccount(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	if r.Method == "PUT" && resp.StatusCode == http.StatusCreated {
+		afterManifestPush(*account, r, resp)
+	}
+
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	bytesSent, err := io.Copy(w, resp.Body)
 	if err != nil {
 		logg.Error("error copying proxy response: " + err.Error())
 	}
+
+	bytes := bytesSent
+	if requestBody != nil {
+		bytes += requestBody.BytesRead
+	}
+	recordAccess(*account, &proxyRequest, resp, bytes, startedAt)
+}
+
+//checkTokenBinding returns an error if the request carries a valid token that
+//is bound to a network that the client is not in. Invalid tokens are not
+//reported since keppel-registry will reject them anyway.
+func checkTokenBinding(r *http.Request) *keppel.RegistryV2Error {
+	tokenStr := r.Header.Get("Authorization")
+	if !strings.HasPrefix(tokenStr, "Bearer ") {
+		return nil
+	}
+	token, rerr := auth.ParseToken(strings.TrimPrefix(tokenStr, "Bearer "))
+	if rerr != nil {
+		return nil
+	}
+	return token.CheckClientAddress(r)
+}
+
+//requiredRepoScope returns the scope that a token needs for the given
+//repository-scoped request, or nil if the request is not repository-scoped.
+func requiredRepoScope(account keppel.Account, r *http.Request) *auth.Scope {
+	match := repoPathRx.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return nil
+	}
+	scope := auth.Scope{
+		ResourceType: "repository",
+		ResourceName: account.Name + "/" + match[1],
+		Actions:      []string{"pull"},
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		scope.Actions = append(scope.Actions, "push")
+	}
+	return &scope
+}
+
+//matches the path of a manifest endpoint; the capture groups are the
+//repository name (without the leading account name) and the reference
+var manifestPathRx = regexp.MustCompile(`^/v2/[a-z0-9-]{1,48}/(.+)/manifests/([^/]+)$`)
+
+//checkManifestChange returns an error if the given DELETE or PUT request would
+//delete or overwrite a manifest or tag in a way that is forbidden by a legal
+//hold, by a tag snapshot or by the account's policies.
+func checkManifestChange(account keppel.Account, r *http.Request) (*keppel.RegistryV2Error, error) {
+	match := manifestPathRx.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return nil, nil
+	}
+	repoName, reference := match[1], match[2]
+
+	//only check for authenticated requests to not leak information about legal
+	//holds and policies to unauthorized users (unauthorized requests will be
+	//rejected by keppel-registry anyway)
+	token, rerr := auth.ParseTokenFromRequest(r)
+	if rerr != nil || !token.IncludesAccessTo("repository", account.Name+"/"+repoName, "push") {
+		return nil, nil
+	}
+
+	if r.Method == "DELETE" {
+		rerr, err := checkLegalHold(account, repoName, reference)
+		if rerr != nil || err != nil {
+			return rerr, err
+		}
+		rerr, err = checkTagSnapshots(account, repoName, reference)
+		if rerr != nil || err != nil {
+			return rerr, err
+		}
+	}
+	return checkTagPolicies(account, r, token.UserName, repoName, reference)
+}
+
+//checkLegalHold returns an error if deleting the given manifest reference
+//would delete a manifest that is under legal hold.
+func checkLegalHold(account keppel.Account, repoName, reference string) (*keppel.RegistryV2Error, error) {
+	var (
+		isHeld bool
+		err    error
+	)
+	if isDigest(reference) {
+		isHeld, err = keppel.State.DB.IsManifestHeld(account.Name, repoName, reference)
+	} else {
+		//we do not know which manifest the tag refers to, so refuse to delete
+		//tags from repositories that contain any held manifests
+		isHeld, err = keppel.State.DB.IsRepositoryHeld(account.Name, repoName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isHeld {
+		return keppel.ErrDenied.With("%s is under legal hold", reference), nil
+	}
+	return nil, nil
+}
+
+//checkTagSnapshots returns an error if deleting the given manifest reference
+//would delete a manifest that is referenced by a tag snapshot. (Deletion by
+//tag name is not checked since keppel-registry only deletes by digest.)
+func checkTagSnapshots(account keppel.Account, repoName, reference string) (*keppel.RegistryV2Error, error) {
+	if !isDigest(reference) {
+		return nil, nil
+	}
+	isPinned, err := keppel.State.DB.IsManifestPinned(account.Name, repoName, reference)
+	if err != nil {
+		return nil, err
+	}
+	if isPinned {
+		return keppel.ErrDenied.With("%s is referenced by a tag snapshot", reference), nil
+	}
+	return nil, nil
+}
+
+//isDigest distinguishes digest references (like "sha256:...") from tag names.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+//afterManifestPush records the push time of a manifest that was pushed
+//successfully (for image expiry), and requests SBOM generation for it. Failure
+//to do so is logged, but does not fail the push.
+func afterManifestPush(account keppel.Account, r *http.Request, resp *http.Response) {
+	match := manifestPathRx.FindStringSubmatch(r.URL.Path)
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if match == nil || digest == "" {
+		return
+	}
+	err := keppel.State.DB.RecordManifestPush(account.Name, match[1], digest, time.Now())
+	if err != nil {
+		logg.Error("cannot record push of %s/%s@%s: %s", account.Name, match[1], digest, err.Error())
+	}
+	err = keppel.State.DB.EnqueueSBOM(account.Name, match[1], digest)
+	if err != nil {
+		logg.Error("cannot enqueue SBOM generation for %s/%s@%s: %s", account.Name, match[1], digest, err.Error())
+	}
 }
@@ -0,0 +1,105 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestReadOnlyAccount(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1"}
+	err := keppel.State.DB.Insert(&account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	registry := test.NewRegistry()
+	digest := registry.AddImage("first/foo", map[string]interface{}{}, "latest")
+	keppel.State.OrchestrationDriver.(*test.OrchestrationDriver).Registries["first"] = registry
+
+	token, err := auth.Token{
+		UserName: "alice",
+		Access: []auth.Scope{{
+			ResourceType: "repository",
+			ResourceName: "first/foo",
+			Actions:      []string{"pull", "push", "*"},
+		}},
+	}.ToResponse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectStatus := func(method, path string, expected int) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("%s %s: expected status %d, got %d: %s", method, path, expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	//while the account is read-only, pulls still work, but pushes and deletes do not
+	changed, err := keppel.State.DB.SetAccountReadOnly("first", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !changed {
+		t.Error("expected SetAccountReadOnly to change the account")
+	}
+	expectStatus("GET", "/v2/first/foo/manifests/latest", http.StatusOK)
+	expectStatus("HEAD", "/v2/first/foo/manifests/latest", http.StatusOK)
+	expectStatus("DELETE", "/v2/first/foo/manifests/"+digest, http.StatusNotImplemented)
+	expectStatus("POST", "/v2/first/foo/blobs/uploads/", http.StatusNotImplemented)
+	if _, exists := registry.Repos["first/foo"].Manifests[digest]; !exists {
+		t.Error("manifest was deleted from read-only account")
+	}
+
+	//setting the flag again is not a change
+	changed, err = keppel.State.DB.SetAccountReadOnly("first", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if changed {
+		t.Error("expected SetAccountReadOnly to not change the account")
+	}
+
+	//once the account is writable again, the delete goes through
+	_, err = keppel.State.DB.SetAccountReadOnly("first", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectStatus("DELETE", "/v2/first/foo/manifests/"+digest, http.StatusAccepted)
+}
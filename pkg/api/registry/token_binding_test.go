@@ -0,0 +1,89 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestTokenBinding(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+		token_binding:
+			enabled: true
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1"}
+	err := keppel.State.DB.Insert(&account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	registry := test.NewRegistry()
+	registry.AddImage("first/foo", map[string]interface{}{}, "latest")
+	keppel.State.OrchestrationDriver.(*test.OrchestrationDriver).Registries["first"] = registry
+
+	token, err := auth.Token{
+		UserName:     "alice",
+		Access:       []auth.Scope{auth.MustParseScope("repository:first/foo:pull")},
+		BoundNetwork: "192.0.2.1/32",
+	}.ToResponse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, path := range []string{"/v2/", "/v2/first/foo/manifests/latest"} {
+		//the token works from the address that it is bound to...
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s from bound address: expected status 200, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+
+		//...but not from elsewhere, even though keppel-registry itself would accept it
+		req = httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "203.0.113.5:1234"
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s from other address: expected status 401, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		challenge := rec.Header().Get("Www-Authenticate")
+		if path != "/v2/" && !strings.Contains(challenge, `scope="repository:first/foo:pull"`) {
+			t.Errorf("GET %s from other address: expected challenge with scope, got %q", path, challenge)
+		}
+	}
+}
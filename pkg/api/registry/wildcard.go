@@ -0,0 +1,87 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2api
+
+import (
+	"net/http"
+
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//expandWildcardScopes prepares the given proxy request for keppel-registry if
+//the client's token grants access to the requested repository through a
+//wildcard scope like "repository:myaccount/*:pull". keppel-registry only
+//understands scopes for concrete repositories, so the token is replaced by one
+//that contains the same access for the requested repository (and, for
+//cross-repository blob mounts, the source repository) instead of the wildcard.
+func expandWildcardScopes(account keppel.Account, r *http.Request) error {
+	match := repoPathRx.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return nil
+	}
+	token, rerr := auth.ParseTokenFromRequest(r)
+	if rerr != nil {
+		//keppel-registry will reject the request
+		return nil
+	}
+
+	var access []auth.Scope
+	hasWildcard := false
+	for _, scope := range token.Access {
+		if scope.IsWildcard() && scope.AccountName() == account.Name {
+			hasWildcard = true
+		} else {
+			access = append(access, scope)
+		}
+	}
+	if !hasWildcard {
+		return nil
+	}
+
+	repoNames := []string{account.Name + "/" + match[1]}
+	if from := r.URL.Query().Get("from"); from != "" {
+		repoNames = append(repoNames, from)
+	}
+	for _, repoName := range repoNames {
+		scope := auth.Scope{ResourceType: "repository", ResourceName: repoName}
+		for _, action := range []string{"pull", "push"} {
+			if token.IncludesAccessTo("repository", repoName, action) {
+				scope.Actions = append(scope.Actions, action)
+			}
+		}
+		if len(scope.Actions) > 0 {
+			access = append(access, scope)
+		}
+	}
+
+	expanded, err := auth.Token{UserName: token.UserName, Access: access, BoundNetwork: token.BoundNetwork, ExpiresAt: token.ExpiresAt}.ToResponse()
+	if err != nil {
+		return err
+	}
+	//the header map is shared with the original request, so replace it instead
+	//of modifying it in place
+	header := make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	header.Set("Authorization", "Bearer "+expanded.Token)
+	r.Header = header
+	return nil
+}
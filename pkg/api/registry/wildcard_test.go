@@ -0,0 +1,88 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestWildcardScopes(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+	r := mux.NewRouter()
+	AddTo(r)
+
+	orch := keppel.State.OrchestrationDriver.(*test.OrchestrationDriver)
+	for _, account := range []keppel.Account{
+		{Name: "first", AuthTenantID: "tenant1"},
+		{Name: "second", AuthTenantID: "tenant1"},
+	} {
+		err := keppel.State.DB.Insert(&account)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		registry := test.NewRegistry()
+		registry.AddImage(account.Name+"/foo", map[string]interface{}{}, "latest")
+		registry.AddImage(account.Name+"/bar/baz", map[string]interface{}{}, "latest")
+		orch.Registries[account.Name] = registry
+	}
+
+	token, err := auth.Token{
+		UserName: "alice",
+		Access:   []auth.Scope{auth.MustParseScope("repository:first/*:pull")},
+	}.ToResponse()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Method       string
+		Path         string
+		ExpectStatus int
+	}{
+		//the wildcard scope covers all repositories in the account...
+		{"GET", "/v2/first/foo/manifests/latest", http.StatusOK},
+		{"GET", "/v2/first/bar/baz/manifests/latest", http.StatusOK},
+		{"GET", "/v2/first/foo/tags/list", http.StatusOK},
+		//...but not other accounts or actions
+		{"GET", "/v2/second/foo/manifests/latest", http.StatusForbidden},
+		{"DELETE", "/v2/first/foo/manifests/latest", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.Method, tc.Path, nil)
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tc.ExpectStatus {
+			t.Errorf("%s %s: expected status %d, got %d: %s", tc.Method, tc.Path, tc.ExpectStatus, rec.Code, rec.Body.String())
+		}
+	}
+}
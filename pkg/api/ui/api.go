@@ -0,0 +1,204 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package uiapi
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryclient"
+)
+
+//AddTo adds routes for the web UI to the given router.
+func AddTo(r *mux.Router) {
+	r.Methods("GET").Path("/ui").Handler(http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	r.Methods("GET").Path("/ui/").HandlerFunc(handleGetAccounts)
+	r.Methods("GET").Path("/ui/login").HandlerFunc(handleGetLogin)
+	r.Methods("POST").Path("/ui/login").HandlerFunc(handlePostLogin)
+	r.Methods("POST").Path("/ui/logout").HandlerFunc(handlePostLogout)
+	//see pkg/api/keppel/accounts.go for why account name format is limited
+	r.Methods("GET").Path("/ui/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(handleGetAccount)
+	r.Methods("GET").Path("/ui/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo:.+}").HandlerFunc(handleGetRepository)
+}
+
+//pageData contains the fields used by the "header" template.
+type pageData struct {
+	Title    string
+	UserName string
+}
+
+//requireSession returns the user's session. If there is no valid session, the
+//user is redirected to the login page and nil is returned.
+func requireSession(w http.ResponseWriter, r *http.Request) *session {
+	s := findSession(r)
+	if s == nil {
+		http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+	}
+	return s
+}
+
+func handleGetLogin(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, http.StatusOK, "login", struct {
+		pageData
+		LoginName string
+		Error     string
+	}{pageData: pageData{Title: "Log in"}})
+}
+
+func handlePostLogin(w http.ResponseWriter, r *http.Request) {
+	userName := r.PostFormValue("username")
+	authz, rerr := keppel.State.AuthDriver.AuthenticateUser(userName, r.PostFormValue("password"))
+	if rerr != nil {
+		renderTemplate(w, http.StatusUnauthorized, "login", struct {
+			pageData
+			LoginName string
+			Error     string
+		}{pageData{Title: "Log in"}, userName, "Login failed: " + rerr.Error()})
+		return
+	}
+
+	err := startSession(w, userName, authz)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	http.Redirect(w, r, "/ui/", http.StatusSeeOther)
+}
+
+func handlePostLogout(w http.ResponseWriter, r *http.Request) {
+	endSession(w, r)
+	http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+}
+
+func handleGetAccounts(w http.ResponseWriter, r *http.Request) {
+	s := requireSession(w, r)
+	if s == nil {
+		return
+	}
+
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//restrict accounts to those visible to the current user
+	var accountsFiltered []keppel.Account
+	for _, account := range accounts {
+		if s.Authorization.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+			accountsFiltered = append(accountsFiltered, account)
+		}
+	}
+
+	renderTemplate(w, http.StatusOK, "accounts", struct {
+		pageData
+		Accounts []keppel.Account
+	}{pageData{"Accounts", s.UserName}, accountsFiltered})
+}
+
+//findAccount returns the account from the request path, or writes a 404
+//response and returns nil if it does not exist or is not visible to the user.
+func findAccount(w http.ResponseWriter, r *http.Request, s *session) *keppel.Account {
+	account, err := keppel.State.DB.FindAccount(mux.Vars(r)["account"])
+	if respondwith.ErrorText(w, err) {
+		return nil
+	}
+	//this reports 404 even if the real reason is lack of authorization in order
+	//to not leak information about which accounts exist for other tenants
+	if account == nil || !s.Authorization.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+		http.Error(w, "no such account", http.StatusNotFound)
+		return nil
+	}
+	return account
+}
+
+func handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	s := requireSession(w, r)
+	if s == nil {
+		return
+	}
+	account := findAccount(w, r, s)
+	if account == nil {
+		return
+	}
+
+	client := registryclient.Client{Account: *account, UserName: s.UserName}
+	repoNames, err := client.ListRepositories()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	renderTemplate(w, http.StatusOK, "account", struct {
+		pageData
+		AccountName  string
+		Repositories []string
+	}{pageData{"Account " + account.Name, s.UserName}, account.Name, repoNames})
+}
+
+type tagInfo struct {
+	Name     string
+	Manifest registryclient.Manifest
+}
+
+func handleGetRepository(w http.ResponseWriter, r *http.Request) {
+	s := requireSession(w, r)
+	if s == nil {
+		return
+	}
+	account := findAccount(w, r, s)
+	if account == nil {
+		return
+	}
+	repoName := mux.Vars(r)["repo"]
+	if !auth.IsValidRepositoryName(repoName) {
+		http.Error(w, "no such repository", http.StatusNotFound)
+		return
+	}
+
+	client := registryclient.Client{Account: *account, UserName: s.UserName}
+	tagNames, err := client.ListTags(repoName)
+	if registryclient.IsNotFound(err) {
+		http.Error(w, "no such repository", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	tags := make([]tagInfo, len(tagNames))
+	for idx, tagName := range tagNames {
+		manifest, err := client.GetManifest(repoName, tagName)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		tags[idx] = tagInfo{tagName, manifest}
+	}
+
+	fullRepoName := account.Name + "/" + repoName
+	renderTemplate(w, http.StatusOK, "repository", struct {
+		pageData
+		ImagePrefix string
+		Tags        []tagInfo
+	}{
+		pageData{"Repository " + fullRepoName, s.UserName},
+		keppel.State.Config.APIPublicURL.Host + "/" + fullRepoName,
+		tags,
+	})
+}
@@ -0,0 +1,187 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package uiapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func setup(t *testing.T) (http.Handler, string) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+
+	//the account "first" contains some images, "second" does not
+	registry := test.NewRegistry()
+	digest := registry.AddManifest("first/foo", "application/vnd.docker.distribution.manifest.v2+json",
+		[]byte(`{"schemaVersion":2,"config":{"size":1024},"layers":[{"size":2048},{"size":1048576}]}`),
+		"latest",
+	)
+	registry.AddManifest("first/bar/baz", "application/vnd.docker.distribution.manifest.list.v2+json",
+		[]byte(`{"schemaVersion":2,"manifests":[]}`),
+		"latest",
+	)
+	orch := keppel.State.OrchestrationDriver.(*test.OrchestrationDriver)
+	orch.Registries["first"] = registry
+	orch.Registries["second"] = test.NewRegistry()
+
+	for _, account := range []keppel.Account{
+		{Name: "first", AuthTenantID: "tenant1", PoliciesJSON: "{}"},
+		{Name: "second", AuthTenantID: "tenant2", PoliciesJSON: "{}"},
+	} {
+		err := keppel.State.DB.Insert(&account)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	r := mux.NewRouter()
+	AddTo(r)
+	return r, digest
+}
+
+type pageRequest struct {
+	Method         string
+	Path           string
+	Cookie         *http.Cookie
+	Form           url.Values
+	ExpectStatus   int
+	ExpectLocation string
+	ExpectContents []string
+}
+
+func (p pageRequest) Check(t *testing.T, h http.Handler) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(p.Method, p.Path, strings.NewReader(p.Form.Encode()))
+	if p.Form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if p.Cookie != nil {
+		req.AddCookie(p.Cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != p.ExpectStatus {
+		t.Errorf("%s %s: expected status code %d, got %d", p.Method, p.Path, p.ExpectStatus, resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != p.ExpectLocation {
+		t.Errorf("%s %s: expected Location %q, got %q", p.Method, p.Path, p.ExpectLocation, location)
+	}
+	for _, str := range p.ExpectContents {
+		if !strings.Contains(string(body), str) {
+			t.Errorf("%s %s: expected response body to contain %q, but got: %s", p.Method, p.Path, str, string(body))
+		}
+	}
+	return resp
+}
+
+func TestWebUI(t *testing.T) {
+	h, digest := setup(t)
+
+	//without a session, everything redirects to the login page
+	pageRequest{Method: "GET", Path: "/ui/", ExpectStatus: 303, ExpectLocation: "/ui/login"}.Check(t, h)
+	pageRequest{Method: "GET", Path: "/ui/accounts/first", ExpectStatus: 303, ExpectLocation: "/ui/login"}.Check(t, h)
+	pageRequest{Method: "GET", Path: "/ui/login", ExpectStatus: 200, ExpectContents: []string{`<form method="POST" action="/ui/login">`}}.Check(t, h)
+
+	//failed login
+	pageRequest{
+		Method:         "POST",
+		Path:           "/ui/login",
+		Form:           url.Values{"username": {"alice"}, "password": {""}},
+		ExpectStatus:   401,
+		ExpectContents: []string{"Login failed: authentication required: wrong credentials", `value="alice"`},
+	}.Check(t, h)
+
+	//successful login (the unittest auth driver takes the permissions as password)
+	resp := pageRequest{
+		Method:         "POST",
+		Path:           "/ui/login",
+		Form:           url.Values{"username": {"alice"}, "password": {"view:tenant1"}},
+		ExpectStatus:   303,
+		ExpectLocation: "/ui/",
+	}.Check(t, h)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login did not set a session cookie")
+	}
+	if !cookie.HttpOnly || !cookie.Secure {
+		t.Errorf("expected session cookie to be HttpOnly and Secure, got %#v", cookie)
+	}
+
+	//only accounts visible to the user are shown
+	pageRequest{
+		Method:         "GET",
+		Path:           "/ui/",
+		Cookie:         cookie,
+		ExpectStatus:   200,
+		ExpectContents: []string{"logged in as alice", `<a href="/ui/accounts/first">first</a>`},
+	}.Check(t, h)
+	pageRequest{Method: "GET", Path: "/ui/accounts/second", Cookie: cookie, ExpectStatus: 404}.Check(t, h)
+	pageRequest{Method: "GET", Path: "/ui/accounts/third", Cookie: cookie, ExpectStatus: 404}.Check(t, h)
+
+	//browse into the account and its repositories
+	pageRequest{
+		Method:       "GET",
+		Path:         "/ui/accounts/first",
+		Cookie:       cookie,
+		ExpectStatus: 200,
+		ExpectContents: []string{
+			`<a href="/ui/accounts/first/repositories/bar/baz">bar/baz</a>`,
+			`<a href="/ui/accounts/first/repositories/foo">foo</a>`,
+		},
+	}.Check(t, h)
+	pageRequest{
+		Method:       "GET",
+		Path:         "/ui/accounts/first/repositories/foo",
+		Cookie:       cookie,
+		ExpectStatus: 200,
+		ExpectContents: []string{
+			"<td>latest</td>",
+			"<td>1.0 MiB</td>",
+			"docker pull registry.example.org/first/foo:latest",
+			"docker pull registry.example.org/first/foo@" + digest,
+		},
+	}.Check(t, h)
+	pageRequest{Method: "GET", Path: "/ui/accounts/first/repositories/qux", Cookie: cookie, ExpectStatus: 404}.Check(t, h)
+
+	//after logout, the session is not valid anymore
+	pageRequest{Method: "POST", Path: "/ui/logout", Cookie: cookie, ExpectStatus: 303, ExpectLocation: "/ui/login"}.Check(t, h)
+	pageRequest{Method: "GET", Path: "/ui/", Cookie: cookie, ExpectStatus: 303, ExpectLocation: "/ui/login"}.Check(t, h)
+}
@@ -0,0 +1,123 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package uiapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+const (
+	sessionCookieName = "keppel_ui_session"
+	sessionLifetime   = 8 * time.Hour
+)
+
+//session is a login session for the web UI. Sessions are only held in memory,
+//so users need to log in again when keppel-api restarts.
+type session struct {
+	UserName      string
+	Authorization keppel.Authorization
+	ExpiresAt     time.Time
+}
+
+var (
+	sessions      = make(map[string]session)
+	sessionsMutex sync.Mutex
+)
+
+//startSession creates a new session and sets the session cookie on the
+//response.
+func startSession(w http.ResponseWriter, userName string, authz keppel.Authorization) error {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return err
+	}
+	sessionID := hex.EncodeToString(buf)
+	now := time.Now()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	//this is a convenient place to garbage-collect expired sessions
+	for id, s := range sessions {
+		if s.ExpiresAt.Before(now) {
+			delete(sessions, id)
+		}
+	}
+	sessions[sessionID] = session{
+		UserName:      userName,
+		Authorization: authz,
+		ExpiresAt:     now.Add(sessionLifetime),
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/ui/",
+		Expires:  now.Add(sessionLifetime),
+		Secure:   keppel.State.Config.APIPublicURL.Scheme == "https",
+		HttpOnly: true,
+	})
+	return nil
+}
+
+//findSession returns the session identified by the request's session cookie,
+//or nil if there is no valid session.
+func findSession(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, exists := sessions[cookie.Value]
+	if !exists {
+		return nil
+	}
+	if s.ExpiresAt.Before(time.Now()) {
+		delete(sessions, cookie.Value)
+		return nil
+	}
+	return &s
+}
+
+//endSession removes the session identified by the request's session cookie
+//(if any), and clears the session cookie on the response.
+func endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		sessionsMutex.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMutex.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/ui/",
+		MaxAge:   -1,
+		Secure:   keppel.State.Config.APIPublicURL.Scheme == "https",
+		HttpOnly: true,
+	})
+}
@@ -0,0 +1,123 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package uiapi
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+//The templates are compiled into the binary, so that keppel-api does not need
+//any files besides its configuration at runtime.
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"formatSize": formatSize,
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{.Title}} - Keppel</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em auto; max-width: 60em; }
+    table { border-collapse: collapse; width: 100%; }
+    th, td { border-bottom: 1px solid #ccc; padding: 0.3em; text-align: left; }
+    code { background: #eee; padding: 0.1em 0.3em; }
+    .error { color: #c00; }
+    nav form { display: inline; }
+  </style>
+</head>
+<body>
+{{if .UserName}}<nav>
+  <a href="/ui/">Accounts</a> | logged in as {{.UserName}}
+  <form method="POST" action="/ui/logout"><button type="submit">Log out</button></form>
+</nav>{{end}}
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="POST" action="/ui/login">
+  <p><label>Username: <input type="text" name="username" value="{{.LoginName}}"></label></p>
+  <p><label>Password: <input type="password" name="password"></label></p>
+  <p><button type="submit">Log in</button></p>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "accounts"}}{{template "header" .}}
+{{if .Accounts}}<table>
+  <tr><th>Account</th><th>Tenant</th></tr>
+  {{range .Accounts}}<tr><td><a href="/ui/accounts/{{.Name}}">{{.Name}}</a></td><td>{{.AuthTenantID}}</td></tr>
+  {{end}}
+</table>{{else}}<p>No accounts are visible to you.</p>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "account"}}{{template "header" .}}
+{{if .Repositories}}<table>
+  <tr><th>Repository</th></tr>
+  {{range .Repositories}}<tr><td><a href="/ui/accounts/{{$.AccountName}}/repositories/{{.}}">{{.}}</a></td></tr>
+  {{end}}
+</table>{{else}}<p>This account does not contain any repositories.</p>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "repository"}}{{template "header" .}}
+{{if .Tags}}<table>
+  <tr><th>Tag</th><th>Digest</th><th>Size</th><th>Pull command</th></tr>
+  {{range .Tags}}<tr>
+    <td>{{.Name}}</td>
+    <td><code>{{.Manifest.Digest}}</code></td>
+    <td>{{if .Manifest.IsList}}multi-arch{{else}}{{formatSize .Manifest.Size}}{{end}}</td>
+    <td><code>docker pull {{$.ImagePrefix}}:{{.Name}}</code><br><code>docker pull {{$.ImagePrefix}}@{{.Manifest.Digest}}</code></td>
+  </tr>
+  {{end}}
+</table>{{else}}<p>This repository does not contain any tags.</p>{{end}}
+{{template "footer" .}}{{end}}
+`))
+
+//formatSize renders a size in bytes in a human-readable way.
+func formatSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	for _, prefix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit || prefix == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, prefix)
+		}
+	}
+	panic("unreachable")
+}
+
+func renderTemplate(w http.ResponseWriter, code int, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	err := templates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		//too late to send an error response, since the headers are already out
+		logg.Error("error rendering template %q: %s", name, err.Error())
+	}
+}
@@ -38,6 +38,7 @@ var (
 	errorScopeResourceUnsupported = errors.New("resource is unsupported")
 	errorScopeRepositoryTooLong   = errors.New("repository must be less than 256 characters long")
 	errorScopeRepositoryInvalid   = fmt.Errorf("repository name must match %q", repoNameRegexp.String())
+	errorScopeWildcardInvalid     = errors.New(`wildcards are only allowed for all repositories in an account, as in "<account>/*"`)
 	errorScopeActionUndefined     = errors.New("actions must not be empty")
 	errorScopeActionInvalid       = errors.New("actions contains invalid value")
 )
@@ -90,7 +91,14 @@ func ParseScope(input string) (Scope, error) {
 		if len(scope.ResourceName) > 256 {
 			return Scope{}, errorScopeRepositoryTooLong
 		}
-		if !repoNameRegexp.MatchString(scope.ResourceName) {
+		repoName := scope.ResourceName
+		if scope.IsWildcard() {
+			repoName = strings.TrimSuffix(repoName, "/*")
+			if strings.Contains(repoName, "/") {
+				return Scope{}, errorScopeWildcardInvalid
+			}
+		}
+		if !repoNameRegexp.MatchString(repoName) {
 			return Scope{}, errorScopeRepositoryInvalid
 		}
 		for _, action := range scope.Actions {
@@ -105,6 +113,12 @@ func ParseScope(input string) (Scope, error) {
 	return scope, nil
 }
 
+//IsValidRepositoryName checks whether the given string is a valid repository
+//name (either with or without the leading account name).
+func IsValidRepositoryName(name string) bool {
+	return len(name) <= 256 && repoNameRegexp.MatchString(name)
+}
+
 //MustParseScope is like ParseScope, but panics on error.
 func MustParseScope(input string) Scope {
 	s, err := ParseScope(input)
@@ -123,13 +137,28 @@ func (s Scope) AccountName() string {
 	return strings.SplitN(s.ResourceName, "/", 2)[0]
 }
 
-//Contains returns true if this scope is for the same resource as the other
-//scope, and if it contains all the actions that the other contains.
-func (s Scope) Contains(other Scope) bool {
-	if s.ResourceType != other.ResourceType {
+//IsWildcard returns true if this scope covers all repositories in an account,
+//as in "repository:myaccount/*:pull".
+func (s Scope) IsWildcard() bool {
+	return s.ResourceType == "repository" && strings.HasSuffix(s.ResourceName, "/*")
+}
+
+//Covers returns true if this scope is for the given resource. For wildcard
+//scopes, this is true for all repositories in the same account.
+func (s Scope) Covers(resourceType, resourceName string) bool {
+	if s.ResourceType != resourceType {
 		return false
 	}
-	if s.ResourceName != other.ResourceName {
+	if s.IsWildcard() {
+		return strings.HasPrefix(resourceName, strings.TrimSuffix(s.ResourceName, "*"))
+	}
+	return s.ResourceName == resourceName
+}
+
+//Contains returns true if this scope covers the resource of the other scope
+//(see Covers), and if it contains all the actions that the other contains.
+func (s Scope) Contains(other Scope) bool {
+	if !s.Covers(other.ResourceType, other.ResourceName) {
 		return false
 	}
 	actions := make(map[string]bool)
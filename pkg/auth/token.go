@@ -24,6 +24,7 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -44,6 +45,13 @@ type Token struct {
 	//ListableAccounts is only set when Access contains "registy:catalog:*", and
 	//identifies the accounts that may be listed by the user of this token.
 	ListableAccounts []string
+	//BoundNetwork is only set when token binding is enabled. It contains the
+	//network (in CIDR notation) from which this token may be used.
+	BoundNetwork string
+	//ExpiresAt is set when the token was parsed. When it is set on a token that
+	//is rendered with ToResponse(), the new token does not live longer than
+	//this, e.g. when a token is derived from an existing token.
+	ExpiresAt time.Time
 }
 
 //Contains returns true if the given token authorizes the user for this scope.
@@ -58,19 +66,38 @@ func (t Token) Contains(s Scope) bool {
 
 type tokenClaims struct {
 	jwt.StandardClaims
-	Access []Scope `json:"access"`
+	Access        []Scope `json:"access"`
+	ClientNetwork string  `json:"keppel_client_network,omitempty"`
 }
 
+//TokenExchangeUserName is a special user name for token requests. When it is
+//given, the password must be a token previously issued by keppel-api, and the
+//new token will only grant access that was also granted by the old token.
+//This allows clients to hand out short-lived credentials with restricted
+//access instead of the user's actual password.
+const TokenExchangeUserName = "$token"
+
 //ParseTokenFromRequest tries to parse the Bearer token supplied in the
-//request's Authorization header.
+//request's Authorization header. If the token is bound to a network, the
+//request must come from this network.
 func ParseTokenFromRequest(r *http.Request) (*Token, *keppel.RegistryV2Error) {
 	//read Authorization request header
 	tokenStr := r.Header.Get("Authorization")
 	if !strings.HasPrefix(tokenStr, "Bearer ") { //e.g. because it's missing
 		return nil, keppel.ErrUnauthorized.With("no bearer token found in request headers")
 	}
-	tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
+	token, rerr := ParseToken(strings.TrimPrefix(tokenStr, "Bearer "))
+	if rerr == nil {
+		rerr = token.CheckClientAddress(r)
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	return token, nil
+}
 
+//ParseToken parses and validates a token that was issued by keppel-api.
+func ParseToken(tokenStr string) (*Token, *keppel.RegistryV2Error) {
 	//parse JWT
 	var claims tokenClaims
 	token, err := jwt.ParseWithClaims(tokenStr, &claims, func(t *jwt.Token) (interface{}, error) {
@@ -110,16 +137,36 @@ func ParseTokenFromRequest(r *http.Request) (*Token, *keppel.RegistryV2Error) {
 	}
 
 	return &Token{
-		UserName: claims.StandardClaims.Subject,
-		Access:   claims.Access,
+		UserName:     claims.StandardClaims.Subject,
+		Access:       claims.Access,
+		BoundNetwork: claims.ClientNetwork,
+		ExpiresAt:    time.Unix(claims.StandardClaims.ExpiresAt, 0),
 	}, nil
 }
 
+//CheckClientAddress returns an error if this token is bound to a network that
+//does not contain the address of the client that sent the given request.
+func (t Token) CheckClientAddress(r *http.Request) *keppel.RegistryV2Error {
+	binding := keppel.State.Config.TokenBinding
+	if t.BoundNetwork == "" || binding == nil {
+		return nil
+	}
+	_, network, err := net.ParseCIDR(t.BoundNetwork)
+	if err != nil {
+		return keppel.ErrUnauthorized.With("token is bound to a malformed network: %s", err.Error())
+	}
+	addr := binding.ClientAddress(r)
+	if addr == nil || !network.Contains(addr) {
+		return keppel.ErrUnauthorized.With("token was issued to a client with a different network address")
+	}
+	return nil
+}
+
 //IncludesAccessTo checks if this token permits access to the given resource
 //with the given action.
 func (t Token) IncludesAccessTo(resourceType, resourceName, action string) bool {
 	for _, scope := range t.Access {
-		if scope.ResourceType == resourceType && scope.ResourceName == resourceName {
+		if scope.Covers(resourceType, resourceName) {
 			for _, a := range scope.Actions {
 				if a == action {
 					return true
@@ -144,6 +191,13 @@ func (t Token) ToResponse() (*TokenResponse, error) {
 	now := time.Now()
 	expiresIn := 1 * time.Hour //TODO make configurable?
 	expiry := now.Add(expiresIn)
+	if !t.ExpiresAt.IsZero() && t.ExpiresAt.Before(expiry) {
+		expiry = t.ExpiresAt
+		expiresIn = expiry.Sub(now)
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+	}
 
 	issuerKey := keppel.State.JWTIssuerKey
 	method := chooseSigningMethod(issuerKey)
@@ -161,7 +215,8 @@ func (t Token) ToResponse() (*TokenResponse, error) {
 			IssuedAt:  now.Unix(),
 		},
 		//access permissions granted to this token
-		Access: t.Access,
+		Access:        t.Access,
+		ClientNetwork: t.BoundNetwork,
 	})
 
 	var (
@@ -0,0 +1,344 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package backup takes consistent backups of the keppel-api database and the
+//metadata databases of all accounts, and restores them.
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//ManifestFileName is the name of the file in the backup directory that
+//describes the backup.
+const ManifestFileName = "manifest.json"
+
+//DrainPeriod is how long Create waits after putting the accounts into
+//read-only mode, so that writes which are already in progress can complete.
+var DrainPeriod = 30 * time.Second
+
+//Manifest describes the contents of a backup.
+type Manifest struct {
+	CreatedAt     time.Time `json:"created_at"`
+	KeppelVersion string    `json:"keppel_version"`
+	//The accounts that were put into read-only mode for the backup. Since the
+	//keppel-api database was dumped while they were read-only, Restore needs to
+	//make them writable again.
+	QuiescedAccounts []string   `json:"quiesced_accounts"`
+	Databases        []Database `json:"databases"`
+}
+
+//Database describes the dump of a single database within a backup.
+type Database struct {
+	//The name of the Postgres database.
+	Name string `json:"name"`
+	//Empty for the keppel-api database, otherwise the account whose metadata
+	//is stored in this database.
+	AccountName string `json:"account,omitempty"`
+	//The name of the dump file within the backup directory.
+	FileName string `json:"file"`
+	SHA256   string `json:"sha256"`
+	//The number of rows in each table at the time of the dump. This is used to
+	//verify the restored database.
+	RowCounts map[string]int64 `json:"row_counts"`
+}
+
+//Create takes a backup of the keppel-api database and the metadata databases
+//of all accounts, and writes it into the given directory. To make the account
+//databases consistent with each other, all accounts are read-only while the
+//backup is taken.
+func Create(ctx context.Context, targetDir string) (err error) {
+	err = os.MkdirAll(targetDir, 0700)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(targetDir, ManifestFileName))
+	if err == nil {
+		return fmt.Errorf("%s contains a backup already", targetDir)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	var accounts []keppel.Account
+	_, err = keppel.State.DB.Select(&accounts, `SELECT * FROM accounts ORDER BY name`)
+	if err != nil {
+		return err
+	}
+
+	manifest := Manifest{
+		CreatedAt:        time.Now().UTC(),
+		KeppelVersion:    keppel.Version,
+		QuiescedAccounts: []string{},
+	}
+
+	//make all accounts read-only; accounts that are read-only already shall
+	//stay that way after the backup
+	defer func() {
+		for _, accountName := range manifest.QuiescedAccounts {
+			_, err2 := keppel.State.DB.SetAccountReadOnly(accountName, false)
+			if err2 != nil {
+				logg.Error("[account=%s] cannot leave read-only mode: %s", accountName, err2.Error())
+				if err == nil {
+					err = err2
+				}
+			}
+		}
+	}()
+	for _, account := range accounts {
+		changed, err := keppel.State.DB.SetAccountReadOnly(account.Name, true)
+		if err != nil {
+			return fmt.Errorf("cannot make account %s read-only: %s", account.Name, err.Error())
+		}
+		if changed {
+			manifest.QuiescedAccounts = append(manifest.QuiescedAccounts, account.Name)
+		}
+	}
+	logg.Info("all accounts are read-only now, waiting %s for in-flight writes to complete", DrainPeriod)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(DrainPeriod):
+	}
+
+	//dump the keppel-api database
+	keppelDBURL := *keppel.State.Config.DatabaseURL
+	dbInfo, err := dumpDatabase(ctx, keppelDBURL, targetDir, "keppel.dump")
+	if err != nil {
+		return fmt.Errorf("cannot dump keppel-api database: %s", err.Error())
+	}
+	manifest.Databases = append(manifest.Databases, dbInfo)
+
+	//dump the account databases
+	for _, account := range accounts {
+		dbName := account.PostgresDatabaseName()
+		exists, err := databaseExists(dbName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			//the database is created when keppel-registry starts for the first time
+			logg.Info("[account=%s] skipping: database %s does not exist", account.Name, dbName)
+			continue
+		}
+
+		dbURL := keppelDBURL
+		dbURL.Path = "/" + dbName
+		dbInfo, err := dumpDatabase(ctx, dbURL, targetDir, filepath.Join("accounts", account.Name+".dump"))
+		if err != nil {
+			return fmt.Errorf("cannot dump database of account %s: %s", account.Name, err.Error())
+		}
+		dbInfo.AccountName = account.Name
+		manifest.Databases = append(manifest.Databases, dbInfo)
+		logg.Info("[account=%s] dumped database %s", account.Name, dbName)
+	}
+
+	//the manifest is written last, so that an incomplete backup cannot be
+	//mistaken for a complete one
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(targetDir, ManifestFileName), append(buf, '\n'), 0600)
+}
+
+//databaseExists checks whether a database with the given name exists on the
+//same Postgres server as the keppel-api database.
+func databaseExists(dbName string) (bool, error) {
+	count, err := keppel.State.DB.SelectInt(`SELECT COUNT(*) FROM pg_database WHERE datname = $1`, dbName)
+	return count > 0, err
+}
+
+//dumpDatabase writes a dump of the given database into a file in the backup
+//directory.
+func dumpDatabase(ctx context.Context, dbURL url.URL, targetDir, fileName string) (Database, error) {
+	result := Database{
+		Name:     filepath.Base(dbURL.Path),
+		FileName: fileName,
+	}
+	filePath := filepath.Join(targetDir, fileName)
+	err := os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return result, err
+	}
+
+	db, err := sql.Open("postgres", dbURL.String())
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+
+	//count the rows in the same snapshot that pg_dump will see
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+	var snapshotID string
+	err = tx.QueryRowContext(ctx, `SELECT pg_export_snapshot()`).Scan(&snapshotID)
+	if err != nil {
+		return result, err
+	}
+	result.RowCounts, err = countRows(ctx, tx)
+	if err != nil {
+		return result, err
+	}
+
+	err = runPostgresTool(ctx, "pg_dump", dbURL,
+		"--format=custom", "--snapshot="+snapshotID, "--file="+filePath)
+	if err != nil {
+		return result, err
+	}
+	result.SHA256, err = hashFile(filePath)
+	return result, err
+}
+
+//queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+//countRows returns the number of rows in each table of the given database.
+func countRows(ctx context.Context, db queryer) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT table_name FROM information_schema.tables
+		 WHERE table_schema = 'public' AND table_type = 'BASE TABLE'`)
+	if err != nil {
+		return nil, err
+	}
+	var tableNames []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tableNames = append(tableNames, name)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tableNames)
+
+	result := make(map[string]int64, len(tableNames))
+	for _, name := range tableNames {
+		var count int64
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+pq.QuoteIdentifier(name)).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = count
+	}
+	return result, nil
+}
+
+//runPostgresTool runs pg_dump or pg_restore against the given database. The
+//password is passed in the environment, so that it does not show up in the
+//process list.
+func runPostgresTool(ctx context.Context, tool string, dbURL url.URL, args ...string) error {
+	env := os.Environ()
+	if dbURL.User != nil {
+		if password, ok := dbURL.User.Password(); ok {
+			env = append(env, "PGPASSWORD="+password)
+			dbURL.User = url.User(dbURL.User.Username())
+		}
+	}
+	cmd := exec.CommandContext(ctx, tool, append(args, "--dbname="+dbURL.String())...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", tool, err.Error())
+	}
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//ReadManifest reads the manifest of the backup in the given directory, and
+//checks that all dump files are present and intact.
+func ReadManifest(sourceDir string) (Manifest, error) {
+	var manifest Manifest
+	buf, err := ioutil.ReadFile(filepath.Join(sourceDir, ManifestFileName))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(buf, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("cannot parse %s: %s", ManifestFileName, err.Error())
+	}
+	if len(manifest.Databases) == 0 || manifest.Databases[0].AccountName != "" {
+		return manifest, errors.New("backup does not contain the keppel-api database")
+	}
+
+	for _, dbInfo := range manifest.Databases {
+		if dbInfo.AccountName != "" && dbInfo.Name != (keppel.Account{Name: dbInfo.AccountName}).PostgresDatabaseName() {
+			return manifest, fmt.Errorf("unexpected database name %q for account %s", dbInfo.Name, dbInfo.AccountName)
+		}
+		//file names must not point outside of the backup directory
+		name := dbInfo.FileName
+		if filepath.IsAbs(name) || filepath.Clean(name) != name || strings.HasPrefix(name, "..") {
+			return manifest, fmt.Errorf("invalid file name %q for database %s", dbInfo.FileName, dbInfo.Name)
+		}
+		actualHash, err := hashFile(filepath.Join(sourceDir, dbInfo.FileName))
+		if err != nil {
+			return manifest, err
+		}
+		if actualHash != dbInfo.SHA256 {
+			return manifest, fmt.Errorf("%s is corrupted: expected SHA-256 %s, got %s", dbInfo.FileName, dbInfo.SHA256, actualHash)
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,138 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keppel-backup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, contents string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0600)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	writeManifest := func(m Manifest) {
+		t.Helper()
+		buf, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		writeFile(ManifestFileName, string(buf))
+	}
+	expectError := func(expected string) {
+		t.Helper()
+		_, err := ReadManifest(dir)
+		if err == nil {
+			t.Errorf("expected error %q, but ReadManifest succeeded", expected)
+		} else if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q, got %q", expected, err.Error())
+		}
+	}
+
+	writeFile("keppel.dump", "keppel-api database")
+	writeFile("accounts/first.dump", "database of first")
+	manifest := Manifest{
+		KeppelVersion:    "1.0",
+		QuiescedAccounts: []string{"first"},
+		Databases: []Database{
+			{
+				Name:      "keppel",
+				FileName:  "keppel.dump",
+				RowCounts: map[string]int64{"accounts": 1},
+			},
+			{
+				Name:        "keppel_first",
+				AccountName: "first",
+				FileName:    "accounts/first.dump",
+				RowCounts:   map[string]int64{"files": 10, "segments": 0},
+			},
+		},
+	}
+	manifest.Databases[0].SHA256, err = hashFile(filepath.Join(dir, "keppel.dump"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	manifest.Databases[1].SHA256, err = hashFile(filepath.Join(dir, "accounts/first.dump"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//happy case
+	writeManifest(manifest)
+	actual, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manifest", actual, manifest)
+
+	//corrupted dump file
+	writeFile("accounts/first.dump", "database of second")
+	expectError("accounts/first.dump is corrupted")
+	writeFile("accounts/first.dump", "database of first")
+
+	//file names must not point outside of the backup directory
+	manifest.Databases[1].FileName = "../first.dump"
+	writeManifest(manifest)
+	expectError(`invalid file name "../first.dump"`)
+	manifest.Databases[1].FileName = "accounts/first.dump"
+
+	//database names must match the account
+	manifest.Databases[1].Name = "keppel_second"
+	writeManifest(manifest)
+	expectError(`unexpected database name "keppel_second" for account first`)
+	manifest.Databases[1].Name = "keppel_first"
+
+	//the keppel-api database is required
+	manifest.Databases = manifest.Databases[1:]
+	writeManifest(manifest)
+	expectError("backup does not contain the keppel-api database")
+}
+
+func TestCompareRowCounts(t *testing.T) {
+	dbInfo := Database{
+		Name:      "keppel_first",
+		RowCounts: map[string]int64{"files": 10, "segments": 20, "schema_migrations": 1},
+	}
+	problems := compareRowCounts(dbInfo, map[string]int64{"files": 9, "schema_migrations": 1})
+	assert.DeepEqual(t, "problems", problems, []string{
+		"database keppel_first: expected 10 rows in table files, but found 9",
+		"database keppel_first: table segments is missing",
+	})
+}
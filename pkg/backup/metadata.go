@@ -0,0 +1,86 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+	swiftplus "github.com/sapcc/keppel/pkg/registry/swift-plus"
+)
+
+//errNoSwiftPlus is returned when an operation is only supported for the
+//swift-plus storage of keppel-registry.
+var errNoSwiftPlus = errors.New("this storage driver does not use swift-plus")
+
+//RebuildAccountMetadata rebuilds the metadata database of the given account
+//from the records that swift-plus keeps in Swift, e.g. when the database was
+//lost and no backup is available. The database must be empty. Returns how many
+//files were restored.
+func RebuildAccountMetadata(ctx context.Context, accountName string) (int, error) {
+	env, err := accountEnvironment(accountName)
+	if err != nil {
+		return 0, err
+	}
+	return swiftplus.RebuildMetadata(ctx, env)
+}
+
+//BackfillAccountMetadataRecords makes swift-plus write its records into Swift
+//for all files in the metadata database of the given account. This is only
+//required once for accounts with files that were written by older versions of
+//keppel-registry. Returns how many records were written.
+func BackfillAccountMetadataRecords(ctx context.Context, accountName string) (int, error) {
+	env, err := accountEnvironment(accountName)
+	if err != nil {
+		return 0, err
+	}
+	return swiftplus.BackfillFileRecords(ctx, env)
+}
+
+func accountEnvironment(accountName string) ([]string, error) {
+	account, err := keppel.State.DB.FindAccount(accountName)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, fmt.Errorf("no such account: %s", accountName)
+	}
+	dbURL := *keppel.State.Config.DatabaseURL
+	dbURL.Path = "/" + account.PostgresDatabaseName()
+	env, err := swiftPlusEnvironment(*account, dbURL.String())
+	if err == nil && env == nil {
+		err = errNoSwiftPlus
+	}
+	return env, err
+}
+
+//swiftPlusEnvironment returns the environment variables that configure the
+//swift-plus storage for the given account, or nil if the account's storage
+//does not use swift-plus.
+func swiftPlusEnvironment(account keppel.Account, dbURL string) ([]string, error) {
+	env, err := keppel.State.StorageDriver.GetEnvironment(account, keppel.State.AuthDriver)
+	if err != nil || !swiftplus.IsConfiguredIn(env) {
+		return nil, err
+	}
+	//cf. pkg/drivers/local_processes/process.go
+	return append(env, "REGISTRY_STORAGE_SWIFT-PLUS_POSTGRESURI="+dbURL), nil
+}
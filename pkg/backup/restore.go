@@ -0,0 +1,168 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/lib/pq"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+	swiftplus "github.com/sapcc/keppel/pkg/registry/swift-plus"
+)
+
+//Restore restores the backup in the given directory. Databases that do not
+//exist are created, existing databases are overwritten. keppel-api should not
+//be running while the backup is restored.
+//
+//Afterwards, the restored databases are verified against the backup and
+//against the storage backend. The returned list contains all problems that
+//were found during verification.
+func Restore(ctx context.Context, sourceDir string) ([]string, error) {
+	manifest, err := ReadManifest(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.KeppelVersion != keppel.Version {
+		logg.Info("backup was taken with keppel-api %s, but this is keppel-api %s", manifest.KeppelVersion, keppel.Version)
+	}
+
+	keppelDBURL := *keppel.State.Config.DatabaseURL
+	for _, dbInfo := range manifest.Databases {
+		dbURL := keppelDBURL
+		if dbInfo.AccountName != "" {
+			dbURL.Path = "/" + dbInfo.Name
+			exists, err := databaseExists(dbInfo.Name)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				_, err := keppel.State.DB.Exec(`CREATE DATABASE ` + pq.QuoteIdentifier(dbInfo.Name))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		err := runPostgresTool(ctx, "pg_restore", dbURL,
+			"--clean", "--if-exists", "--no-owner", "--single-transaction", "--exit-on-error",
+			filepath.Join(sourceDir, dbInfo.FileName))
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore database %s: %s", dbInfo.Name, err.Error())
+		}
+		logg.Info("restored database %s", dbInfo.Name)
+	}
+
+	//the accounts were only read-only for the duration of the backup
+	for _, accountName := range manifest.QuiescedAccounts {
+		_, err := keppel.State.DB.SetAccountReadOnly(accountName, false)
+		if err != nil {
+			return nil, fmt.Errorf("cannot make account %s writable: %s", accountName, err.Error())
+		}
+	}
+
+	return verify(ctx, manifest)
+}
+
+//verify checks the restored databases against the manifest, and the
+//restored account databases against the storage backend.
+func verify(ctx context.Context, manifest Manifest) ([]string, error) {
+	problems := []string{}
+	keppelDBURL := *keppel.State.Config.DatabaseURL
+
+	for _, dbInfo := range manifest.Databases {
+		dbURL := keppelDBURL
+		if dbInfo.AccountName != "" {
+			dbURL.Path = "/" + dbInfo.Name
+		}
+		db, err := sql.Open("postgres", dbURL.String())
+		if err != nil {
+			return nil, err
+		}
+		rowCounts, err := countRows(ctx, db)
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, compareRowCounts(dbInfo, rowCounts)...)
+
+		if dbInfo.AccountName == "" {
+			continue
+		}
+		account, err := keppel.State.DB.FindAccount(dbInfo.AccountName)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			problems = append(problems, fmt.Sprintf("database %s belongs to account %s, which does not exist", dbInfo.Name, dbInfo.AccountName))
+			continue
+		}
+		storageProblems, err := verifyStorage(ctx, *account, dbURL.String())
+		if err != nil {
+			return nil, fmt.Errorf("cannot verify storage of account %s: %s", account.Name, err.Error())
+		}
+		for _, problem := range storageProblems {
+			problems = append(problems, fmt.Sprintf("account %s: %s", account.Name, problem))
+		}
+	}
+
+	return problems, nil
+}
+
+//compareRowCounts reports tables whose row count differs from the backup.
+func compareRowCounts(dbInfo Database, actual map[string]int64) []string {
+	var tableNames []string
+	for name := range dbInfo.RowCounts {
+		tableNames = append(tableNames, name)
+	}
+	sort.Strings(tableNames)
+
+	var problems []string
+	for _, name := range tableNames {
+		expected := dbInfo.RowCounts[name]
+		count, exists := actual[name]
+		switch {
+		case !exists:
+			problems = append(problems, fmt.Sprintf("database %s: table %s is missing", dbInfo.Name, name))
+		case count != expected:
+			problems = append(problems, fmt.Sprintf("database %s: expected %d rows in table %s, but found %d", dbInfo.Name, expected, name, count))
+		}
+	}
+	return problems
+}
+
+//verifyStorage checks that all objects referenced by the account's metadata
+//database exist in the storage backend. This is only supported for the
+//swift-plus storage of keppel-registry.
+func verifyStorage(ctx context.Context, account keppel.Account, dbURL string) ([]string, error) {
+	env, err := swiftPlusEnvironment(account, dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		logg.Info("[account=%s] skipping storage verification: not supported by this storage driver", account.Name)
+		return nil, nil
+	}
+	return swiftplus.CheckStorage(ctx, env)
+}
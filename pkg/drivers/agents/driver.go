@@ -0,0 +1,194 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package agents provides the orchestration driver "agents", which distributes
+//keppel-registry processes across several hosts running keppel-agent.
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sapcc/keppel/pkg/agent"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryconfig"
+)
+
+//How often the driver checks the health of all agents.
+const healthCheckInterval = 10 * time.Second
+
+type driver struct {
+	agentURLs      []*url.URL
+	secret         string
+	configTemplate *template.Template
+	//the client for requests to agents (can be replaced in unit tests)
+	client *http.Client
+
+	mutex sync.Mutex
+	//key = agent URL
+	healthy map[string]bool
+	//key = account name, value = URL of the agent running its keppel-registry
+	placements map[string]string
+	//key = account name, value = when the certificates of its keppel-registry
+	//expire (as reported by the agent; only if the internal CA is enabled)
+	certExpiry map[string]time.Time
+	//serializes the placement of registries, so that concurrent requests do not
+	//start the same registry on multiple agents
+	placementMutex sync.Mutex
+}
+
+func init() {
+	keppel.RegisterOrchestrationDriver("agents", func() keppel.OrchestrationDriver {
+		return &driver{
+			client:     http.DefaultClient,
+			healthy:    make(map[string]bool),
+			placements: make(map[string]string),
+			certExpiry: make(map[string]time.Time),
+		}
+	})
+}
+
+//ReadConfig implements the keppel.OrchestrationDriver interface.
+func (d *driver) ReadConfig(unmarshal func(interface{}) error) error {
+	var cfg struct {
+		Agents                 []string `yaml:"agents"`
+		Secret                 string   `yaml:"secret"`
+		RegistryConfigTemplate string   `yaml:"registry_config_template"`
+	}
+	err := unmarshal(&cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Agents) == 0 {
+		return errors.New("missing orchestration.agents")
+	}
+	if cfg.Secret == "" {
+		return errors.New("missing orchestration.secret")
+	}
+	for _, agentURLStr := range cfg.Agents {
+		agentURL, err := url.Parse(strings.TrimSuffix(agentURLStr, "/"))
+		if err != nil {
+			return fmt.Errorf("malformed agent URL %q: %s", agentURLStr, err.Error())
+		}
+		//the requests to the agents carry credentials (the shared secret, and in
+		//the registry specs, the storage and database credentials of the account)
+		if agentURL.Scheme != "https" {
+			return fmt.Errorf("agent URL %q must use https", agentURLStr)
+		}
+		d.agentURLs = append(d.agentURLs, agentURL)
+		//until the first health check, assume that all agents are healthy
+		d.healthy[agentURL.String()] = true
+	}
+	d.secret = cfg.Secret
+
+	d.configTemplate, err = registryconfig.LoadTemplate(cfg.RegistryConfigTemplate)
+	return err
+}
+
+//DoHTTPRequest implements the keppel.OrchestrationDriver interface.
+func (d *driver) DoHTTPRequest(account keppel.Account, r *http.Request) (*http.Response, error) {
+	agentURL, err := d.getAgent(account)
+	if err != nil {
+		return nil, err
+	}
+
+	path := r.URL.Path
+	//the header map may be shared with the caller's request
+	r.Header = cloneHeader(r.Header)
+	r.Header.Set(agent.SecretHeader, d.secret)
+
+	resp, err := d.forwardRequest(agentURL, account.Name, path, r)
+	if err != nil {
+		return nil, err
+	}
+
+	//if the agent does not run this registry (e.g. because it was restarted), we
+	//need to place the registry again
+	if resp.StatusCode == http.StatusNotFound && resp.Header.Get(agent.NotRunningHeader) != "" {
+		resp.Body.Close()
+		d.forgetPlacement(account.Name, agentURL)
+		if !canRetry(r) {
+			return nil, fmt.Errorf("keppel-registry for account %s was not running on agent %s, please retry", account.Name, agentURL)
+		}
+		agentURL, err = d.getAgent(account)
+		if err != nil {
+			return nil, err
+		}
+		return d.forwardRequest(agentURL, account.Name, path, r)
+	}
+	return resp, nil
+}
+
+func (d *driver) forwardRequest(agentURL, accountName, path string, r *http.Request) (*http.Response, error) {
+	target, err := url.Parse(agentURL)
+	if err != nil {
+		return nil, err
+	}
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = target.Path + "/agent/v1/registries/" + accountName + "/proxy" + path
+	r.URL.RawPath = ""
+
+	resp, err := d.client.Do(r)
+	if err != nil && r.Context().Err() == nil {
+		d.markUnhealthy(agentURL, err)
+	}
+	return resp, err
+}
+
+func cloneHeader(in http.Header) http.Header {
+	out := make(http.Header, len(in))
+	for key, values := range in {
+		out[key] = append([]string(nil), values...)
+	}
+	return out
+}
+
+//canRetry returns whether the request can be sent again, i.e. whether it
+//does not have a body that was already consumed.
+func canRetry(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	return r.ContentLength == 0 && (r.Method == "GET" || r.Method == "HEAD")
+}
+
+//Run implements the keppel.OrchestrationDriver interface.
+func (d *driver) Run(ctx context.Context) (ok bool) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		d.checkAgents()
+		d.renewCertificates()
+		d.placeAllRegistries()
+		select {
+		case <-ctx.Done():
+			return true
+		case <-ticker.C:
+		}
+	}
+}
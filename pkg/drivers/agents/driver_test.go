@@ -0,0 +1,269 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package agents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/agent"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//flakyHandler simulates an agent that can fail and recover.
+type flakyHandler struct {
+	http.Handler
+	down int32
+}
+
+func (h *flakyHandler) SetDown(down bool) {
+	var val int32
+	if down {
+		val = 1
+	}
+	atomic.StoreInt32(&h.down, val)
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.down) != 0 {
+		http.Error(w, "agent is down", http.StatusServiceUnavailable)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func expectResponse(t *testing.T, d *driver, account keppel.Account, method, path, expected string) {
+	t.Helper()
+	req, err := http.NewRequest(method, "https://registry.example.org"+path, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := d.DoHTTPRequest(account, req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "response to "+method+" "+path, string(body), expected)
+}
+
+func expectPlacements(t *testing.T, d *driver, expected map[string]string) {
+	t.Helper()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	assert.DeepEqual(t, "placements", d.placements, expected)
+}
+
+func TestAgentsDriverRejectsInsecureAgentURLs(t *testing.T) {
+	d, err := keppel.NewOrchestrationDriver("agents")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = d.ReadConfig(func(cfg interface{}) error {
+		return yaml.Unmarshal([]byte(`{ agents: [ 'http://worker1.example.com:8090' ], secret: s3cr3t }`), cfg)
+	})
+	expectedError := `agent URL "http://worker1.example.com:8090" must use https`
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("expected error %q, but got %v", expectedError, err)
+	}
+}
+
+func TestAgentsDriver(t *testing.T) {
+	//run three agents on localhost
+	var (
+		handlers  []*flakyHandler
+		agentURLs []string
+		client    *http.Client
+	)
+	for idx := 1; idx <= 3; idx++ {
+		server := agent.NewServer("s3cr3t", test.NewAgentLauncher(fmt.Sprintf("agent%d", idx)))
+		defer server.Shutdown()
+		handler := &flakyHandler{Handler: server}
+		httpServer := httptest.NewTLSServer(handler)
+		defer httpServer.Close()
+		handlers = append(handlers, handler)
+		agentURLs = append(agentURLs, httpServer.URL)
+		//all test servers use the same certificate, so each server's client
+		//trusts all of them
+		client = httpServer.Client()
+	}
+
+	test.Setup(t, fmt.Sprintf(`
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: agents, agents: [ '%s' ], secret: s3cr3t }
+		storage: { driver: unittest }
+	`, strings.Join(agentURLs, "', '")))
+	d := keppel.State.OrchestrationDriver.(*driver)
+	d.client = client
+
+	accounts := make(map[string]keppel.Account)
+	for _, name := range []string{"first", "second", "third"} {
+		account := keppel.Account{Name: name, AuthTenantID: "tenant1"}
+		err := keppel.State.DB.Insert(&account)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		accounts[name] = account
+	}
+
+	//registries are spread evenly across the agents
+	d.checkAgents()
+	d.placeAllRegistries()
+	expectPlacements(t, d, map[string]string{
+		"first":  agentURLs[0],
+		"second": agentURLs[1],
+		"third":  agentURLs[2],
+	})
+	expectResponse(t, d, accounts["first"], "GET", "/v2/first/foo/manifests/latest",
+		"first on agent1: GET /v2/first/foo/manifests/latest")
+	expectResponse(t, d, accounts["second"], "HEAD", "/v2/second/foo/blobs/sha256:abc", "")
+	expectResponse(t, d, accounts["third"], "GET", "/v2/", "third on agent3: GET /v2/")
+
+	//when an agent fails, its registries are moved to the remaining agents
+	handlers[1].SetDown(true)
+	d.checkAgents()
+	d.placeAllRegistries()
+	expectPlacements(t, d, map[string]string{
+		"first":  agentURLs[0],
+		"second": agentURLs[0],
+		"third":  agentURLs[2],
+	})
+	expectResponse(t, d, accounts["second"], "GET", "/v2/", "second on agent1: GET /v2/")
+
+	//when the agent recovers, it stops the registries that were moved away
+	handlers[1].SetDown(false)
+	d.checkAgents()
+	accountNames, _, err := d.listRegistries(agentURLs[1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "registries on agent2", accountNames, []string{})
+
+	//when an agent loses track of a registry (e.g. because it was restarted),
+	//the registry is placed again on the next request
+	err = d.stopRegistry(agentURLs[2], "third")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectResponse(t, d, accounts["third"], "GET", "/v2/", "third on agent2: GET /v2/")
+	expectPlacements(t, d, map[string]string{
+		"first":  agentURLs[0],
+		"second": agentURLs[0],
+		"third":  agentURLs[1],
+	})
+
+	//requests with a body cannot be retried in this situation
+	err = d.stopRegistry(agentURLs[1], "third")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, _ := http.NewRequest("PUT", "https://registry.example.org/v2/third/foo/manifests/latest", strings.NewReader("{}"))
+	_, err = d.DoHTTPRequest(accounts["third"], req)
+	expectedError := fmt.Sprintf("keppel-registry for account third was not running on agent %s, please retry", agentURLs[1])
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("expected error %q, but got %v", expectedError, err)
+	}
+	expectResponse(t, d, accounts["third"], "GET", "/v2/", "third on agent2: GET /v2/")
+
+	//when all agents fail, requests fail
+	for _, handler := range handlers {
+		handler.SetDown(true)
+	}
+	d.checkAgents()
+	_, err = d.DoHTTPRequest(accounts["first"], req)
+	expectedError = "cannot start keppel-registry for account first: no healthy agents available"
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("expected error %q, but got %v", expectedError, err)
+	}
+}
+
+func TestAgentsDriverRenewsCertificates(t *testing.T) {
+	launcher := test.NewAgentLauncher("agent1")
+	server := agent.NewServer("s3cr3t", launcher)
+	defer server.Shutdown()
+	httpServer := httptest.NewTLSServer(server)
+	defer httpServer.Close()
+
+	test.Setup(t, fmt.Sprintf(`
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: agents, agents: [ '%s' ], secret: s3cr3t }
+		storage: { driver: unittest }
+		secrets:
+			master_keys:
+				- { id: first, key: 'MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=' }
+		trust:
+			registry_tls: true
+	`, httpServer.URL))
+	d := keppel.State.OrchestrationDriver.(*driver)
+	d.client = httpServer.Client()
+
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1"}
+	err := keppel.State.DB.Insert(&account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	d.checkAgents()
+	d.placeAllRegistries()
+	expectResponse(t, d, account, "GET", "/v2/", "first on agent1: GET /v2/")
+
+	//the agent reports when the certificates expire
+	d.checkAgents()
+	d.mutex.Lock()
+	expiresAt := d.certExpiry["first"]
+	d.mutex.Unlock()
+	if keppel.CertificateNeedsRenewal(expiresAt) {
+		t.Errorf("expected fresh certificates to be valid for a long time, but they expire at %s", expiresAt)
+	}
+
+	//fresh certificates are not renewed
+	d.renewCertificates()
+	assert.DeepEqual(t, "launches", launcher.Launches("first"), 1)
+
+	//when the certificates are about to expire, the registry is restarted with
+	//new certificates
+	d.mutex.Lock()
+	d.certExpiry["first"] = time.Now().Add(time.Hour)
+	d.mutex.Unlock()
+	d.renewCertificates()
+	assert.DeepEqual(t, "launches", launcher.Launches("first"), 2)
+	expectResponse(t, d, account, "GET", "/v2/", "first on agent1: GET /v2/")
+
+	d.checkAgents()
+	d.mutex.Lock()
+	expiresAt = d.certExpiry["first"]
+	d.mutex.Unlock()
+	if keppel.CertificateNeedsRenewal(expiresAt) {
+		t.Errorf("expected renewed certificates to be valid for a long time, but they expire at %s", expiresAt)
+	}
+}
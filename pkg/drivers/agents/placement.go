@@ -0,0 +1,424 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package agents
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/agent"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryconfig"
+)
+
+//getAgent returns the URL of the agent that runs the keppel-registry for the
+//given account. If no agent runs it yet, it is placed on one.
+func (d *driver) getAgent(account keppel.Account) (string, error) {
+	d.mutex.Lock()
+	agentURL, exists := d.placements[account.Name]
+	d.mutex.Unlock()
+	if exists {
+		return agentURL, nil
+	}
+
+	d.placementMutex.Lock()
+	defer d.placementMutex.Unlock()
+	//check again, maybe a concurrent call has placed the registry while we were
+	//waiting for placementMutex
+	d.mutex.Lock()
+	agentURL, exists = d.placements[account.Name]
+	d.mutex.Unlock()
+	if exists {
+		return agentURL, nil
+	}
+
+	spec, err := buildSpec(d.configTemplate, account)
+	if err != nil {
+		return "", err
+	}
+	for {
+		agentURL := d.chooseAgent()
+		if agentURL == "" {
+			return "", fmt.Errorf("cannot start keppel-registry for account %s: no healthy agents available", account.Name)
+		}
+		err := d.startRegistry(agentURL, account.Name, spec)
+		if err == nil {
+			logg.Info("[account=%s] keppel-registry is running on agent %s", account.Name, agentURL)
+			d.mutex.Lock()
+			d.placements[account.Name] = agentURL
+			d.mutex.Unlock()
+			return agentURL, nil
+		}
+		if _, isAgentError := err.(agentError); isAgentError {
+			//the agent is reachable, but could not start the registry; we do not
+			//try another agent since the same problem is likely to occur there
+			return "", err
+		}
+		//since the agent is not reachable, it is marked as unhealthy, so the next
+		//iteration will choose a different agent
+		d.markUnhealthy(agentURL, err)
+	}
+}
+
+//chooseAgent returns the healthy agent that runs the fewest registries, or ""
+//if no agents are healthy.
+func (d *driver) chooseAgent() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	load := make(map[string]int)
+	for _, agentURL := range d.placements {
+		load[agentURL]++
+	}
+	result := ""
+	for _, agentURL := range d.agentURLs {
+		urlStr := agentURL.String()
+		if d.healthy[urlStr] && (result == "" || load[urlStr] < load[result]) {
+			result = urlStr
+		}
+	}
+	return result
+}
+
+//markUnhealthy is called when an agent cannot be reached. All registries on
+//this agent will be placed on other agents.
+func (d *driver) markUnhealthy(agentURL string, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.healthy[agentURL] {
+		logg.Error("agent %s is unhealthy: %s", agentURL, err.Error())
+	}
+	d.healthy[agentURL] = false
+	for accountName, placedURL := range d.placements {
+		if placedURL == agentURL {
+			delete(d.placements, accountName)
+			delete(d.certExpiry, accountName)
+		}
+	}
+}
+
+func (d *driver) forgetPlacement(accountName, agentURL string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.placements[accountName] == agentURL {
+		delete(d.placements, accountName)
+		delete(d.certExpiry, accountName)
+	}
+}
+
+//checkAgents queries all agents for the registries that they are running,
+//and reconciles the result with our own placements.
+func (d *driver) checkAgents() {
+	for _, agentURL := range d.agentURLs {
+		urlStr := agentURL.String()
+		accountNames, certExpiry, err := d.listRegistries(urlStr)
+		if err != nil {
+			d.markUnhealthy(urlStr, err)
+			continue
+		}
+
+		var superfluous []string
+		d.mutex.Lock()
+		if !d.healthy[urlStr] {
+			logg.Info("agent %s is healthy again", urlStr)
+		}
+		d.healthy[urlStr] = true
+		isRunning := make(map[string]bool)
+		for _, accountName := range accountNames {
+			isRunning[accountName] = true
+			placedURL, exists := d.placements[accountName]
+			switch {
+			case !exists:
+				//adopt registries that were started before keppel-api was restarted
+				d.placements[accountName] = urlStr
+			case placedURL != urlStr:
+				//this agent recovered from a failure, but its registries have since
+				//been placed on other agents
+				superfluous = append(superfluous, accountName)
+				continue
+			}
+			if expiresAt, exists := certExpiry[accountName]; exists {
+				d.certExpiry[accountName] = expiresAt
+			} else {
+				delete(d.certExpiry, accountName)
+			}
+		}
+		//when the agent was restarted, it does not run our registries anymore;
+		//they will be placed again when they are needed
+		for accountName, placedURL := range d.placements {
+			if placedURL == urlStr && !isRunning[accountName] {
+				delete(d.placements, accountName)
+				delete(d.certExpiry, accountName)
+			}
+		}
+		d.mutex.Unlock()
+
+		for _, accountName := range superfluous {
+			err := d.stopRegistry(urlStr, accountName)
+			if err != nil {
+				logg.Error("[account=%s] cannot stop superfluous keppel-registry on agent %s: %s", accountName, urlStr, err.Error())
+			}
+		}
+	}
+}
+
+//renewCertificates sends new certificates to all agents whose registries have
+//certificates that are about to expire. The agent restarts the registry since
+//its spec has changed.
+func (d *driver) renewCertificates() {
+	if keppel.State.InternalCA == nil {
+		return
+	}
+
+	var accountNames []string
+	d.mutex.Lock()
+	for accountName, expiresAt := range d.certExpiry {
+		if keppel.CertificateNeedsRenewal(expiresAt) {
+			accountNames = append(accountNames, accountName)
+		}
+	}
+	d.mutex.Unlock()
+	sort.Strings(accountNames)
+
+	for _, accountName := range accountNames {
+		err := d.renewCertificatesFor(accountName)
+		if err != nil {
+			logg.Error("[account=%s] cannot renew certificates of keppel-registry: %s", accountName, err.Error())
+		}
+	}
+}
+
+func (d *driver) renewCertificatesFor(accountName string) error {
+	account, err := keppel.State.DB.FindAccount(accountName)
+	if err != nil {
+		return err
+	}
+	if account == nil || !account.IsUsable(time.Now()) {
+		//the account is about to be deleted
+		return nil
+	}
+
+	//hold placementMutex to not race against a concurrent getAgent() or
+	//StopRegistry()
+	d.placementMutex.Lock()
+	defer d.placementMutex.Unlock()
+	d.mutex.Lock()
+	agentURL, exists := d.placements[accountName]
+	d.mutex.Unlock()
+	if !exists {
+		//the registry will get fresh certificates when it is placed again
+		return nil
+	}
+
+	spec, err := buildSpec(d.configTemplate, *account)
+	if err != nil {
+		return err
+	}
+	err = d.startRegistry(agentURL, accountName, spec)
+	if err != nil {
+		if _, isAgentError := err.(agentError); !isAgentError {
+			d.markUnhealthy(agentURL, err)
+		}
+		return err
+	}
+	logg.Info("[account=%s] renewed certificates of keppel-registry on agent %s", accountName, agentURL)
+
+	//the new expiry date will be reported by the agent during the next
+	//checkAgents()
+	d.mutex.Lock()
+	delete(d.certExpiry, accountName)
+	d.mutex.Unlock()
+	return nil
+}
+
+//StopRegistry implements the keppel.RegistryStopper interface.
+func (d *driver) StopRegistry(account keppel.Account) error {
+	//hold placementMutex to not race against a concurrent getAgent()
+	d.placementMutex.Lock()
+	defer d.placementMutex.Unlock()
+	d.mutex.Lock()
+	agentURL, exists := d.placements[account.Name]
+	d.mutex.Unlock()
+	if !exists {
+		return nil
+	}
+
+	err := d.stopRegistry(agentURL, account.Name)
+	if err != nil {
+		return err
+	}
+	d.forgetPlacement(account.Name, agentURL)
+	return nil
+}
+
+//placeAllRegistries ensures that the registries of all accounts are running.
+//This moves the registries from failed agents to healthy agents even if
+//they do not receive any requests.
+func (d *driver) placeAllRegistries() {
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts, `SELECT * FROM accounts ORDER BY name`)
+	if err != nil {
+		logg.Error("failed to enumerate accounts: " + err.Error())
+		return
+	}
+	now := time.Now()
+	for _, account := range accounts {
+		if !account.IsUsable(now) {
+			//the account is about to be deleted
+			continue
+		}
+		_, err := d.getAgent(account)
+		if err != nil {
+			logg.Error("[account=%s] %s", account.Name, err.Error())
+		}
+	}
+}
+
+//buildSpec prepares the request body for starting the keppel-registry for
+//the given account on an agent.
+func buildSpec(tmpl *template.Template, account keppel.Account) (agent.RegistrySpec, error) {
+	storageEnv, err := keppel.State.StorageDriver.GetEnvironment(account, keppel.State.AuthDriver)
+	if err != nil {
+		return agent.RegistrySpec{}, err
+	}
+	//the port and the paths of the issuer cert bundle and TLS files are chosen
+	//by the agent
+	vars := registryconfig.NewVars(account, 0, storageEnv)
+	config, err := registryconfig.Render(tmpl, vars, registryconfig.Files{})
+	if err != nil {
+		return agent.RegistrySpec{}, fmt.Errorf("cannot render keppel-registry config: %s", err.Error())
+	}
+
+	env := storageEnv
+	if keppel.State.Config.DatabaseURL != nil { //is nil in unit tests
+		//the agent does not get keppel-api's own database credentials, only
+		//those for the account's metadata database
+		dbURL, err := keppel.State.DB.ProvisionAccountDatabase(account)
+		if err != nil {
+			return agent.RegistrySpec{}, err
+		}
+		env = append(env, "REGISTRY_STORAGE_SWIFT-PLUS_POSTGRESURI="+dbURL.String())
+	}
+	spec := agent.RegistrySpec{
+		Config:        string(config),
+		Env:           env,
+		IssuerCertPEM: keppel.State.JWTIssuerCertPEM,
+	}
+	if ca := keppel.State.InternalCA; ca != nil {
+		spec.TLS, err = buildTLSSpec(ca, account)
+		if err != nil {
+			return agent.RegistrySpec{}, fmt.Errorf("cannot issue certificates for keppel-registry: %s", err.Error())
+		}
+	}
+	return spec, nil
+}
+
+//buildTLSSpec issues the certificates for mutual TLS between the agent and
+//the keppel-registry for the given account.
+func buildTLSSpec(ca *keppel.InternalCA, account keppel.Account) (*agent.RegistryTLS, error) {
+	serverCert, err := ca.IssueRegistryCertificate(account.Name)
+	if err != nil {
+		return nil, err
+	}
+	clientCert, err := ca.IssueClientCertificate("keppel-agent")
+	if err != nil {
+		return nil, err
+	}
+	return &agent.RegistryTLS{
+		CACertPEM:     ca.CertPEM(),
+		CertPEM:       serverCert.CertPEM,
+		KeyPEM:        string(serverCert.KeyPEM),
+		ServerName:    keppel.RegistryServerName(account.Name),
+		ClientCertPEM: clientCert.CertPEM,
+		ClientKeyPEM:  string(clientCert.KeyPEM),
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// agent API client
+
+//agentError is returned by the agent API client when the agent returned an
+//error response (as opposed to when the agent could not be reached).
+type agentError struct {
+	Message string
+}
+
+func (e agentError) Error() string {
+	return e.Message
+}
+
+func (d *driver) startRegistry(agentURL, accountName string, spec agent.RegistrySpec) error {
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	_, err = d.agentRequest("PUT", agentURL+"/agent/v1/registries/"+accountName, buf)
+	return err
+}
+
+func (d *driver) stopRegistry(agentURL, accountName string) error {
+	_, err := d.agentRequest("DELETE", agentURL+"/agent/v1/registries/"+accountName, nil)
+	return err
+}
+
+func (d *driver) listRegistries(agentURL string) (accountNames []string, certExpiry map[string]time.Time, err error) {
+	buf, err := d.agentRequest("GET", agentURL+"/agent/v1/registries", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data struct {
+		Registries           []string             `json:"registries"`
+		CertificatesExpireAt map[string]time.Time `json:"certificates_expire_at"`
+	}
+	err = json.Unmarshal(buf, &data)
+	return data.Registries, data.CertificatesExpireAt, err
+}
+
+func (d *driver) agentRequest(method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(agent.SecretHeader, d.secret)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, agentError{fmt.Sprintf("%s %s returned %s: %s", method, url, resp.Status, string(respBody))}
+	}
+	return respBody, nil
+}
@@ -26,32 +26,77 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryconfig"
 )
 
 type driver struct {
 	getPortRequestChan chan getPortRequest
+	startRequestChan   chan startRequest
+	switchRequestChan  chan switchRequest
+	stopRequestChan    chan uint16
+	upgradeTriggerChan chan struct{}
+	stopAccountChan    chan stopAccountRequest
 	//the following fields are only accessed by Run(), so no locking is necessary^
-	listenPorts    map[string]uint16
+	listenPorts map[string]uint16
+	stopFuncs   map[uint16]context.CancelFunc //key = port
+	exitWaiters map[uint16]chan<- struct{}    //key = port, see StopRegistry()
+	//ports that are assigned to a keppel-registry process, from its start until
+	//it has exited (see allocatePort())
+	usedPorts      map[uint16]bool
 	nextListenPort uint16
+	//the range of ports that keppel-registry processes listen on
+	firstListenPort uint16
+	lastListenPort  uint16
+	//the template for the keppel-registry configuration files
+	configTemplate *template.Template
+	//number of requests per port that have not been completed yet (used for
+	//draining old processes during rolling upgrades)
+	inFlightRequests map[uint16]int
+	inFlightMutex    sync.Mutex
+	//starts a keppel-registry process (only replaced in unit tests)
+	launchRegistry func(pc *processContext, account keppel.Account, port uint16) (context.CancelFunc, error)
 }
 
 func init() {
 	keppel.RegisterOrchestrationDriver("local-processes", func() keppel.OrchestrationDriver {
 		return &driver{
 			getPortRequestChan: make(chan getPortRequest),
+			startRequestChan:   make(chan startRequest),
+			switchRequestChan:  make(chan switchRequest),
+			stopRequestChan:    make(chan uint16),
+			upgradeTriggerChan: make(chan struct{}, 1),
+			stopAccountChan:    make(chan stopAccountRequest),
 			listenPorts:        make(map[string]uint16),
-			nextListenPort:     10000, //TODO make configurable?
+			stopFuncs:          make(map[uint16]context.CancelFunc),
+			exitWaiters:        make(map[uint16]chan<- struct{}),
+			usedPorts:          make(map[uint16]bool),
+			nextListenPort:     10001,
+			firstListenPort:    10001, //TODO make configurable?
+			lastListenPort:     65535,
+			inFlightRequests:   make(map[uint16]int),
+			launchRegistry:     (*processContext).startRegistry,
 		}
 	})
 }
 
 //ReadConfig implements the keppel.OrchestrationDriver interface.
 func (d *driver) ReadConfig(unmarshal func(interface{}) error) error {
-	return nil
+	var cfg struct {
+		RegistryConfigTemplate string `yaml:"registry_config_template"`
+	}
+	err := unmarshal(&cfg)
+	if err != nil {
+		return err
+	}
+
+	d.configTemplate, err = registryconfig.LoadTemplate(cfg.RegistryConfigTemplate)
+	return err
 }
 
 type getPortRequest struct {
@@ -67,26 +112,51 @@ func (d *driver) DoHTTPRequest(account keppel.Account, r *http.Request) (*http.R
 		Result:  resultChan,
 	}
 
-	r.URL.Scheme = "http"
-	r.URL.Host = fmt.Sprintf("localhost:%d", <-resultChan)
-	return http.DefaultClient.Do(r)
+	//the main loop has already counted this request as in flight on this port
+	port := <-resultChan
+	scheme, client := registryClient(account.Name)
+	r.URL.Scheme = scheme
+	r.URL.Host = fmt.Sprintf("localhost:%d", port)
+
+	resp, err := client.Do(r)
+	if err != nil {
+		d.trackRequest(port, -1)
+		return nil, err
+	}
+	//the request is only complete once the response body has been consumed
+	resp.Body = &trackedBody{ReadCloser: resp.Body, OnClose: func() { d.trackRequest(port, -1) }}
+	return resp, nil
+}
+
+//registryClient returns the URL scheme and the HTTP client for requests to the
+//keppel-registry of the given account. When trust.registry_tls is enabled,
+//the client verifies the registry's certificate and presents keppel-api's
+//client certificate.
+func registryClient(accountName string) (string, *http.Client) {
+	if ca := keppel.State.InternalCA; ca != nil {
+		return "https", &http.Client{Transport: ca.Transport(accountName)}
+	}
+	return "http", http.DefaultClient
 }
 
 type processExitMessage struct {
 	AccountName string
+	Port        uint16
 }
 
 //Run implements the keppel.OrchestrationDriver interface.
 func (d *driver) Run(ctx context.Context) (ok bool) {
-	prepareBaseConfig()
 	prepareCertBundle()
 	go d.ensureAllRegistriesAreRunning()
+	go d.watchRegistryExecutable(ctx)
+	go d.runRollingUpgrades(ctx)
 
 	innerCtx, cancel := context.WithCancel(ctx)
 	processExitChan := make(chan processExitMessage)
 	pc := processContext{
 		Context:         innerCtx,
 		ProcessExitChan: processExitChan,
+		ConfigTemplate:  d.configTemplate,
 	}
 
 	//Overview of how this main loop works:
@@ -106,6 +176,10 @@ func (d *driver) Run(ctx context.Context) (ok bool) {
 	//   main loop uses to update its bookkeeping accordingly. The next request
 	//   for that Keppel account will launch a new keppel-registry process.
 	//
+	//4. During rolling upgrades, runRollingUpgrades() uses startRequest,
+	//   switchRequest and stopRequest to replace the keppel-registry process
+	//   for one account after the other (see there for details).
+	//
 	ok = true
 	for {
 		select {
@@ -118,29 +192,113 @@ func (d *driver) Run(ctx context.Context) (ok bool) {
 			return ok
 
 		case msg := <-processExitChan:
-			delete(d.listenPorts, msg.AccountName)
+			delete(d.usedPorts, msg.Port)
+			if stop, exists := d.stopFuncs[msg.Port]; exists {
+				stop() //releases the process context
+				delete(d.stopFuncs, msg.Port)
+			}
+			//if the process was replaced during a rolling upgrade, the account is
+			//already served by a different port
+			if d.listenPorts[msg.AccountName] == msg.Port {
+				delete(d.listenPorts, msg.AccountName)
+			}
+			if done, exists := d.exitWaiters[msg.Port]; exists {
+				close(done)
+				delete(d.exitWaiters, msg.Port)
+			}
 
 		case req := <-d.getPortRequestChan:
 			port, exists := d.listenPorts[req.Account.Name]
 			if !exists {
-				d.nextListenPort++
-				port = d.nextListenPort
-				err := pc.startRegistry(req.Account, port)
+				var (
+					stop context.CancelFunc
+					err  error
+				)
+				port, err = d.allocatePort()
+				if err == nil {
+					stop, err = d.launchRegistry(&pc, req.Account, port)
+				}
 				if err != nil {
 					logg.Error("[account=%s] failed to start keppel-registry: %s", req.Account.Name, err.Error())
 					//failure to start new keppel-registries is considered a fatal error
+					delete(d.usedPorts, port)
 					ok = false
 					cancel()
+				} else {
+					d.stopFuncs[port] = stop
 				}
 			}
 			d.listenPorts[req.Account.Name] = port
 			if req.Result != nil { //is nil when called from ensureAllRegistriesAreRunning()
+				//count the request as in flight before handing out the port, so that a
+				//rolling upgrade that switches to a new port right after this cannot
+				//consider the old port drained while the request is still using it
+				d.trackRequest(port, +1)
 				req.Result <- port
 			}
+
+		case req := <-d.startRequestChan:
+			//start an additional process, but do not send traffic to it yet
+			port, err := d.allocatePort()
+			if err == nil {
+				var stop context.CancelFunc
+				stop, err = d.launchRegistry(&pc, req.Account, port)
+				if err == nil {
+					d.stopFuncs[port] = stop
+				} else {
+					delete(d.usedPorts, port)
+				}
+			}
+			req.Result <- startResult{port, err}
+
+		case req := <-d.switchRequestChan:
+			req.Result <- d.listenPorts[req.AccountName]
+			d.listenPorts[req.AccountName] = req.Port
+
+		case port := <-d.stopRequestChan:
+			if stop, exists := d.stopFuncs[port]; exists {
+				stop()
+				delete(d.stopFuncs, port)
+			}
+
+		case req := <-d.stopAccountChan:
+			port := d.listenPorts[req.AccountName]
+			stop, exists := d.stopFuncs[port]
+			if !exists {
+				close(req.Done)
+				continue
+			}
+			delete(d.listenPorts, req.AccountName)
+			stop()
+			delete(d.stopFuncs, port)
+			d.exitWaiters[port] = req.Done
 		}
 	}
 }
 
+//allocatePort chooses the port for a new keppel-registry process. Ports are
+//handed out round-robin, so that ports are reused once their previous process
+//has exited, but not right away. This is only called by Run().
+func (d *driver) allocatePort() (uint16, error) {
+	portCount := int(d.lastListenPort) - int(d.firstListenPort) + 1
+	for i := 0; i < portCount; i++ {
+		if d.nextListenPort < d.firstListenPort || d.nextListenPort > d.lastListenPort {
+			d.nextListenPort = d.firstListenPort
+		}
+		port := d.nextListenPort
+		if port == d.lastListenPort {
+			d.nextListenPort = d.firstListenPort
+		} else {
+			d.nextListenPort++
+		}
+		if !d.usedPorts[port] {
+			d.usedPorts[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("all ports from %d to %d are in use by keppel-registry processes", d.firstListenPort, d.lastListenPort)
+}
+
 func (d *driver) ensureAllRegistriesAreRunning() {
 	for {
 		var accounts []keppel.Account
@@ -150,6 +308,10 @@ func (d *driver) ensureAllRegistriesAreRunning() {
 			accounts = nil
 		}
 		for _, account := range accounts {
+			if !account.IsUsable(time.Now()) {
+				//the account is about to be deleted
+				continue
+			}
 			//this starts the keppel-registry process for the account if not yet running
 			d.getPortRequestChan <- getPortRequest{Account: account}
 		}
@@ -158,3 +320,21 @@ func (d *driver) ensureAllRegistriesAreRunning() {
 		time.Sleep(1 * time.Minute)
 	}
 }
+
+type stopAccountRequest struct {
+	AccountName string
+	//closed once the keppel-registry process has exited
+	Done chan<- struct{}
+}
+
+//StopRegistry implements the keppel.RegistryStopper interface.
+func (d *driver) StopRegistry(account keppel.Account) error {
+	done := make(chan struct{})
+	d.stopAccountChan <- stopAccountRequest{account.Name, done}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(drainTimeout):
+		return fmt.Errorf("keppel-registry for account %s did not exit within %s", account.Name, drainTimeout)
+	}
+}
@@ -25,38 +25,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryconfig"
 )
 
-//The base configuration file for keppel-registry, which contains all values
-//that are shared among all keppel-registry processes.
-const baseConfig = `
-version: 0.1
-log:
-	accesslog:
-		disabled: true
-	level: info
-http:
-	addr: :10000
-	headers:
-		X-Content-Type-Options: [nosniff]
-health:
-	storagedriver:
-		enabled: true
-		interval: 10s
-		threshold: 3
-storage:
-	cache:
-		blobdescriptor: inmemory
-`
-
-var baseConfigPath = filepath.Join(chooseRuntimeDir(), "keppel/registry-base.yaml")
-var issuerCertBundlePath = filepath.Join(chooseRuntimeDir(), "keppel/issuer-cert-bundle.pem")
+var (
+	issuerCertBundlePath = filepath.Join(chooseRuntimeDir(), "keppel/issuer-cert-bundle.pem")
+	clientCABundlePath   = filepath.Join(chooseRuntimeDir(), "keppel/internal-ca.pem")
+)
 
 func chooseRuntimeDir() string {
 	if val := os.Getenv("XDG_RUNTIME_DIR"); val != "" {
@@ -65,22 +46,20 @@ func chooseRuntimeDir() string {
 	return "/run"
 }
 
-func prepareBaseConfig() {
-	cfg := strings.Replace(baseConfig, "\t", "    ", -1)
-
-	err := os.MkdirAll(filepath.Dir(baseConfigPath), 0700)
+func prepareCertBundle() {
+	err := os.MkdirAll(filepath.Dir(issuerCertBundlePath), 0700)
 	if err == nil {
-		err = ioutil.WriteFile(baseConfigPath, []byte(cfg), 0644)
+		err = ioutil.WriteFile(issuerCertBundlePath, []byte(keppel.State.JWTIssuerCertPEM), 0600)
 	}
 	if err != nil {
-		logg.Fatal(err.Error())
+		logg.Fatal("cannot write issuer certificate bundle: " + err.Error())
 	}
-}
 
-func prepareCertBundle() {
-	err := ioutil.WriteFile(issuerCertBundlePath, []byte(keppel.State.JWTIssuerCertPEM), 0600)
-	if err != nil {
-		logg.Fatal("cannot write issuer certificate bundle: " + err.Error())
+	if ca := keppel.State.InternalCA; ca != nil {
+		err := ioutil.WriteFile(clientCABundlePath, []byte(ca.CertPEM()), 0600)
+		if err != nil {
+			logg.Fatal("cannot write internal CA certificate: " + err.Error())
+		}
 	}
 }
 
@@ -89,33 +68,28 @@ type processContext struct {
 	Context         context.Context
 	WaitGroup       sync.WaitGroup
 	ProcessExitChan chan<- processExitMessage
+	ConfigTemplate  *template.Template
 }
 
-func (pc *processContext) startRegistry(account keppel.Account, port uint16) error {
+//startRegistry starts a keppel-registry process for the given account. The
+//returned function stops this process.
+func (pc *processContext) startRegistry(account keppel.Account, port uint16) (stop context.CancelFunc, err error) {
 	logg.Info("[account=%s] starting keppel-registry on port %d",
 		account.Name, port)
-	cmd := exec.Command("keppel-registry", "serve", baseConfigPath)
-	cmd.Env = os.Environ()
-
 	storageEnv, err := keppel.State.StorageDriver.GetEnvironment(account, keppel.State.AuthDriver)
 	if err != nil {
-		return err
-	}
-	cmd.Env = append(cmd.Env, storageEnv...)
-
-	publicURL := keppel.State.Config.APIPublicURL.String()
-	publicHost := keppel.State.Config.APIPublicHostname()
-	cmd.Env = append(cmd.Env,
-		fmt.Sprintf("REGISTRY_HTTP_ADDR=:%d", port),
-		"REGISTRY_LOG_FIELDS_KEPPEL.ACCOUNT="+account.Name,
-		fmt.Sprintf("REGISTRY_AUTH_TOKEN_REALM=%s/keppel/v1/auth", publicURL),
-		"REGISTRY_AUTH_TOKEN_SERVICE="+publicHost,
-		fmt.Sprintf("REGISTRY_AUTH_TOKEN_ISSUER=keppel-api@%s", publicHost),
-		"REGISTRY_AUTH_TOKEN_ROOTCERTBUNDLE="+issuerCertBundlePath,
-	)
-
-	//the REGISTRY_LOG_FIELDS_KEPPEL.ACCOUNT variable (see above) adds the account
-	//name to all log messages produced by the keppel-registry (it is therefore
+		return nil, err
+	}
+	configPath, err := pc.writeRegistryConfig(account, port, storageEnv)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write keppel-registry config: %s", err.Error())
+	}
+
+	cmd := exec.Command("keppel-registry", "serve", configPath)
+	cmd.Env = append(os.Environ(), storageEnv...)
+
+	//the registry config contains a log field with the account name that gets
+	//added to all log messages produced by the keppel-registry (it is therefore
 	//safe to send its log directly to our own stdout)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -126,7 +100,7 @@ func (pc *processContext) startRegistry(account keppel.Account, port uint16) err
 
 	err = cmd.Start()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//manage the process during its lifetime (see big comment in
@@ -137,12 +111,13 @@ func (pc *processContext) startRegistry(account keppel.Account, port uint16) err
 		defer pc.WaitGroup.Done()
 		processResult <- cmd.Wait()
 	}()
-	go pc.waitOnProcess(account.Name, cmd, processResult)
+	processCtx, stop := context.WithCancel(pc.Context)
+	go pc.waitOnProcess(processCtx, account.Name, port, cmd, processResult)
 
-	return nil
+	return stop, nil
 }
 
-func (pc *processContext) waitOnProcess(accountName string, cmd *exec.Cmd, processResult <-chan error) {
+func (pc *processContext) waitOnProcess(processCtx context.Context, accountName string, port uint16, cmd *exec.Cmd, processResult <-chan error) {
 	defer pc.WaitGroup.Done()
 	var err error
 	receivedProcessResult := false
@@ -151,10 +126,11 @@ func (pc *processContext) waitOnProcess(accountName string, cmd *exec.Cmd, proce
 	//1. Subprocess terminates abnormally. -> recv from processResult completes
 	//   before pc.Interrupt is fired.
 	//2. Subprocess does not terminate. -> At some point, pc.Context expires (to
-	//   start the shutdown of keppel-api itself). Send SIGINT to the subprocess,
-	//   then recv its processResult.
+	//   start the shutdown of keppel-api itself), or processCtx is cancelled
+	//   (because the process is replaced during a rolling upgrade). Send SIGINT
+	//   to the subprocess, then recv its processResult.
 	select {
-	case <-pc.Context.Done():
+	case <-processCtx.Done():
 		cmd.Process.Signal(os.Interrupt)
 	case err = <-processResult:
 		receivedProcessResult = true
@@ -169,8 +145,54 @@ func (pc *processContext) waitOnProcess(accountName string, cmd *exec.Cmd, proce
 	}
 	if pc.Context.Err() == nil {
 		//only send if someone is going to recv this
-		pc.ProcessExitChan <- processExitMessage{accountName}
+		pc.ProcessExitChan <- processExitMessage{accountName, port}
+	}
+}
+
+//writeRegistryConfig renders the keppel-registry configuration for the given
+//account, and returns the path to the resulting configuration file.
+func (pc *processContext) writeRegistryConfig(account keppel.Account, port uint16, storageEnv []string) (string, error) {
+	files := registryconfig.Files{IssuerCertBundle: issuerCertBundlePath}
+	if ca := keppel.State.InternalCA; ca != nil {
+		var err error
+		files, err = writeRegistryCertificate(ca, account, files)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	vars := registryconfig.NewVars(account, port, storageEnv)
+	buf, err := registryconfig.Render(pc.ConfigTemplate, vars, files)
+	if err != nil {
+		return "", err
+	}
+
+	//the file may contain credentials if the template refers to .Storage
+	path := filepath.Join(chooseRuntimeDir(), "keppel", "registry-"+account.Name+".yaml")
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, buf, 0600)
+	}
+	return path, err
+}
+
+//writeRegistryCertificate issues a fresh server certificate for the
+//keppel-registry of the given account, and adds the paths of the resulting
+//files to the given Files.
+func writeRegistryCertificate(ca *keppel.InternalCA, account keppel.Account, files registryconfig.Files) (registryconfig.Files, error) {
+	issued, err := ca.IssueRegistryCertificate(account.Name)
+	if err != nil {
+		return files, err
+	}
+	files.TLSCertificate = filepath.Join(chooseRuntimeDir(), "keppel", "registry-"+account.Name+"-cert.pem")
+	files.TLSKey = filepath.Join(chooseRuntimeDir(), "keppel", "registry-"+account.Name+"-key.pem")
+	files.ClientCABundle = clientCABundlePath
+
+	err = ioutil.WriteFile(files.TLSCertificate, []byte(issued.CertPEM), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(files.TLSKey, issued.KeyPEM, 0600)
 	}
+	return files, err
 }
 
 func isShutdownBecauseOfSIGINT(err error) bool {
@@ -0,0 +1,296 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package localprocesses
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+const (
+	//how often the keppel-registry executable is checked for changes
+	executableCheckInterval = 30 * time.Second
+	//how often the certificates of the keppel-registry processes are checked
+	//for impending expiry
+	certificateCheckInterval = time.Hour
+	//how long a new keppel-registry process may take to become ready
+	readinessTimeout = 30 * time.Second
+	//how long in-flight requests to an old keppel-registry process may take
+	//before the process is stopped anyway
+	drainTimeout = 5 * time.Minute
+)
+
+type startRequest struct {
+	Account keppel.Account
+	Result  chan<- startResult
+}
+
+type startResult struct {
+	Port uint16
+	Err  error
+}
+
+type switchRequest struct {
+	AccountName string
+	Port        uint16
+	//receives the port that was previously used for this account, or 0
+	Result chan<- uint16
+}
+
+//TriggerRollingUpgrade implements the keppel.RollingUpgradeTrigger interface.
+func (d *driver) TriggerRollingUpgrade() error {
+	select {
+	case d.upgradeTriggerChan <- struct{}{}:
+	default:
+		//an upgrade is already pending
+	}
+	return nil
+}
+
+//watchRegistryExecutable triggers a rolling upgrade whenever the
+//keppel-registry executable is replaced.
+func (d *driver) watchRegistryExecutable(ctx context.Context) {
+	lastFingerprint, err := registryExecutableFingerprint()
+	if err != nil {
+		logg.Error("cannot inspect keppel-registry executable: " + err.Error())
+	}
+
+	ticker := time.NewTicker(executableCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fingerprint, err := registryExecutableFingerprint()
+			if err != nil {
+				logg.Error("cannot inspect keppel-registry executable: " + err.Error())
+				continue
+			}
+			if lastFingerprint != "" && fingerprint != lastFingerprint {
+				logg.Info("keppel-registry executable has changed, starting rolling upgrade")
+				d.TriggerRollingUpgrade()
+			}
+			lastFingerprint = fingerprint
+		}
+	}
+}
+
+//registryExecutableFingerprint returns a string that changes whenever the
+//keppel-registry executable is replaced.
+func registryExecutableFingerprint() (string, error) {
+	path, err := exec.LookPath("keppel-registry")
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%d", path, fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+//runRollingUpgrades performs a rolling upgrade each time one is triggered.
+//
+//Rolling upgrades are also used to renew the server certificates of the
+//keppel-registry processes: Each process gets a fresh certificate when it is
+//started, so after a successful rolling upgrade, no certificate is older than
+//the start of that upgrade.
+func (d *driver) runRollingUpgrades(ctx context.Context) {
+	certsIssuedAfter := time.Now()
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if keppel.State.InternalCA == nil {
+				continue
+			}
+			if !keppel.CertificateNeedsRenewal(certsIssuedAfter.Add(keppel.IssuedCertificateValidity)) {
+				continue
+			}
+			logg.Info("certificates of keppel-registry processes are about to expire, starting rolling upgrade")
+		case <-d.upgradeTriggerChan:
+		}
+
+		startedAt := time.Now()
+		if d.performRollingUpgrade(ctx) {
+			certsIssuedAfter = startedAt
+		}
+	}
+}
+
+//performRollingUpgrade replaces the keppel-registry processes for all accounts
+//one after the other. Returns whether all processes were replaced.
+func (d *driver) performRollingUpgrade(ctx context.Context) bool {
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts, `SELECT * FROM accounts ORDER BY name`)
+	if err != nil {
+		logg.Error("rolling upgrade failed: cannot enumerate accounts: " + err.Error())
+		return false
+	}
+
+	failed := 0
+	for _, account := range accounts {
+		if ctx.Err() != nil {
+			return false
+		}
+		if !account.IsUsable(time.Now()) {
+			//the account is about to be deleted
+			continue
+		}
+		err := d.replaceRegistry(ctx, account)
+		if err != nil {
+			logg.Error("[account=%s] rolling upgrade of keppel-registry failed: %s", account.Name, err.Error())
+			failed++
+		}
+	}
+	logg.Info("rolling upgrade complete: replaced %d of %d keppel-registry processes", len(accounts)-failed, len(accounts))
+	return failed == 0
+}
+
+//replaceRegistry starts a new keppel-registry process for the given account,
+//waits until it is ready, switches traffic to it, and then drains and stops
+//the old process. If the new process does not become ready, the old process
+//keeps serving the account.
+func (d *driver) replaceRegistry(ctx context.Context, account keppel.Account) error {
+	//NOTE: All sends to the main loop in Run() are abandoned when ctx expires
+	//since the main loop does not receive anymore at that point. The main loop
+	//always sends its results immediately, so receiving those cannot block.
+	resultChan := make(chan startResult, 1)
+	select {
+	case d.startRequestChan <- startRequest{account, resultChan}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	result := <-resultChan
+	if result.Err != nil {
+		return result.Err
+	}
+
+	err := waitUntilReady(ctx, account.Name, result.Port)
+	if err != nil {
+		d.stopProcess(ctx, result.Port)
+		return err
+	}
+
+	oldPortChan := make(chan uint16, 1)
+	select {
+	case d.switchRequestChan <- switchRequest{account.Name, result.Port, oldPortChan}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	oldPort := <-oldPortChan
+	if oldPort == 0 {
+		//the account's process was not running (anymore)
+		return nil
+	}
+
+	d.waitUntilDrained(ctx, account.Name, oldPort)
+	d.stopProcess(ctx, oldPort)
+	return nil
+}
+
+func (d *driver) stopProcess(ctx context.Context, port uint16) {
+	select {
+	case d.stopRequestChan <- port:
+	case <-ctx.Done():
+		//all processes are being stopped anyway
+	}
+}
+
+//waitUntilReady waits until the keppel-registry on the given port responds to
+//HTTP requests.
+func waitUntilReady(ctx context.Context, accountName string, port uint16) error {
+	scheme, client := registryClient(accountName)
+	url := fmt.Sprintf("%s://localhost:%d/v2/", scheme, port)
+	deadline := time.Now().Add(readinessTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			//any response is fine; without a token, we expect 401
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return errors.New("new keppel-registry did not become ready in time")
+}
+
+//waitUntilDrained waits until all requests to the given port have completed,
+//or until drainTimeout has passed.
+func (d *driver) waitUntilDrained(ctx context.Context, accountName string, port uint16) {
+	deadline := time.Now().Add(drainTimeout)
+	for d.countRequests(port) > 0 {
+		if time.Now().After(deadline) {
+			logg.Info("[account=%s] stopping old keppel-registry with %d requests still in flight", accountName, d.countRequests(port))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (d *driver) trackRequest(port uint16, delta int) {
+	d.inFlightMutex.Lock()
+	defer d.inFlightMutex.Unlock()
+	d.inFlightRequests[port] += delta
+	if d.inFlightRequests[port] == 0 {
+		delete(d.inFlightRequests, port)
+	}
+}
+
+func (d *driver) countRequests(port uint16) int {
+	d.inFlightMutex.Lock()
+	defer d.inFlightMutex.Unlock()
+	return d.inFlightRequests[port]
+}
+
+//trackedBody wraps a response body and calls OnClose exactly once when the
+//body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	OnClose func()
+	once    sync.Once
+}
+
+//Close implements the io.Closer interface.
+func (b *trackedBody) Close() error {
+	b.once.Do(b.OnClose)
+	return b.ReadCloser.Close()
+}
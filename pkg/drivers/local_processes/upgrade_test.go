@@ -0,0 +1,287 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package localprocesses
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+//fakeLauncher replaces the keppel-registry processes in the local-processes
+//driver with HTTP servers on listeners that were opened in advance.
+type fakeLauncher struct {
+	Listeners map[uint16]net.Listener
+	//how long a new process takes until it answers requests
+	StartupDelay time.Duration
+
+	mutex  sync.Mutex
+	events []string
+}
+
+func (f *fakeLauncher) record(format string, args ...interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.events = append(f.events, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeLauncher) Events() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.events...)
+}
+
+func (f *fakeLauncher) Launch(pc *processContext, account keppel.Account, port uint16) (context.CancelFunc, error) {
+	listener, exists := f.Listeners[port]
+	if !exists {
+		return nil, fmt.Errorf("no listener for port %d", port)
+	}
+	f.record("start %d", port)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", port)
+	})}
+	//like a real process, the server exits when its context is cancelled
+	processCtx, stop := context.WithCancel(pc.Context)
+	pc.WaitGroup.Add(1)
+	go func() {
+		defer pc.WaitGroup.Done()
+		select {
+		case <-time.After(f.StartupDelay):
+			go server.Serve(listener)
+			<-processCtx.Done()
+		case <-processCtx.Done():
+		}
+		server.Close()
+		listener.Close()
+		f.record("stop %d", port)
+		if pc.Context.Err() == nil {
+			pc.ProcessExitChan <- processExitMessage{account.Name, port}
+		}
+	}()
+	return stop, nil
+}
+
+//listenOnConsecutivePorts opens listeners on two consecutive free ports,
+//since the driver assigns ports sequentially.
+func listenOnConsecutivePorts(t *testing.T) map[uint16]net.Listener {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		port := uint16(first.Addr().(*net.TCPAddr).Port)
+		second, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+1))
+		if err == nil {
+			return map[uint16]net.Listener{port: first, port + 1: second}
+		}
+		first.Close()
+	}
+	t.Fatal("cannot find two consecutive free ports")
+	return nil
+}
+
+//sendRequest sends a request to the keppel-registry of the given account, and
+//returns the response with the body still open, and the port that served it.
+func sendRequest(t *testing.T, d *driver, account keppel.Account) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", "/v2/", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp, err := d.DoHTTPRequest(account, req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//the handler writes a short body, so this does not wait for the close
+	buf := make([]byte, 16)
+	n, _ := resp.Body.Read(buf)
+	return resp, string(buf[:n])
+}
+
+func expectInFlightRequests(t *testing.T, d *driver, expected map[uint16]int) {
+	t.Helper()
+	d.inFlightMutex.Lock()
+	defer d.inFlightMutex.Unlock()
+	assert.DeepEqual(t, "in-flight requests", d.inFlightRequests, expected)
+}
+
+func TestReplaceRegistry(t *testing.T) {
+	runtimeDir, err := ioutil.TempDir("", "keppel-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(runtimeDir)
+	issuerCertBundlePath = filepath.Join(runtimeDir, "issuer-cert-bundle.pem")
+
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: local-processes }
+		storage: { driver: unittest }
+	`)
+	d := keppel.State.OrchestrationDriver.(*driver)
+	listeners := listenOnConsecutivePorts(t)
+	var oldPort, newPort uint16
+	for port := range listeners {
+		if oldPort == 0 || port < oldPort {
+			oldPort = port
+		}
+	}
+	newPort = oldPort + 1
+	launcher := &fakeLauncher{Listeners: listeners, StartupDelay: 300 * time.Millisecond}
+	d.launchRegistry = launcher.Launch
+	d.nextListenPort = oldPort
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(runDone)
+	}()
+	defer func() {
+		cancel()
+		<-runDone
+	}()
+
+	//the first request starts the old process
+	account := keppel.Account{Name: "first", AuthTenantID: "tenant1"}
+	oldResp, servedBy := sendRequest(t, d, account)
+	assert.DeepEqual(t, "port serving the first request", servedBy, fmt.Sprint(oldPort))
+	//the request is in flight until its response body is closed
+	expectInFlightRequests(t, d, map[uint16]int{oldPort: 1})
+
+	//requests are counted as in flight as soon as the main loop has assigned a
+	//port to them, so that the port cannot be drained in between
+	resultChan := make(chan uint16, 1)
+	d.getPortRequestChan <- getPortRequest{Account: account, Result: resultChan}
+	assert.DeepEqual(t, "assigned port", <-resultChan, oldPort)
+	expectInFlightRequests(t, d, map[uint16]int{oldPort: 2})
+	d.trackRequest(oldPort, -1)
+
+	replaceDone := make(chan error, 1)
+	go func() {
+		replaceDone <- d.replaceRegistry(ctx, account)
+	}()
+
+	//while the new process is starting, the old process keeps serving requests
+	resp, servedBy := sendRequest(t, d, account)
+	resp.Body.Close()
+	assert.DeepEqual(t, "port serving requests during startup", servedBy, fmt.Sprint(oldPort))
+	expectInFlightRequests(t, d, map[uint16]int{oldPort: 1})
+
+	//once the new process is ready, traffic switches over to it
+	deadline := time.Now().Add(5 * time.Second)
+	for servedBy != fmt.Sprint(newPort) {
+		if time.Now().After(deadline) {
+			t.Fatal("traffic was not switched to the new process")
+		}
+		time.Sleep(50 * time.Millisecond)
+		resp, servedBy = sendRequest(t, d, account)
+		resp.Body.Close()
+	}
+
+	//the old process is not stopped while it still has a request in flight
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-replaceDone:
+		t.Fatalf("replaceRegistry returned before the old process was drained: %v", err)
+	default:
+	}
+	assert.DeepEqual(t, "process events before draining", launcher.Events(), []string{
+		fmt.Sprintf("start %d", oldPort),
+		fmt.Sprintf("start %d", newPort),
+	})
+
+	//closing the body completes the request (closing it twice does not count
+	//it twice), after which the old process is stopped
+	oldResp.Body.Close()
+	oldResp.Body.Close()
+	expectInFlightRequests(t, d, map[uint16]int{})
+	select {
+	case err := <-replaceDone:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaceRegistry did not return after the old process was drained")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(launcher.Events()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.DeepEqual(t, "process events after draining", launcher.Events(), []string{
+		fmt.Sprintf("start %d", oldPort),
+		fmt.Sprintf("start %d", newPort),
+		fmt.Sprintf("stop %d", oldPort),
+	})
+
+	//the exit of the old process does not affect the new one
+	resp, servedBy = sendRequest(t, d, account)
+	resp.Body.Close()
+	assert.DeepEqual(t, "port serving requests after the upgrade", servedBy, fmt.Sprint(newPort))
+}
+
+func TestAllocatePort(t *testing.T) {
+	d := &driver{
+		usedPorts:       make(map[uint16]bool),
+		nextListenPort:  65533,
+		firstListenPort: 65533,
+		lastListenPort:  65535,
+	}
+	expectPort := func(expected uint16) {
+		t.Helper()
+		port, err := d.allocatePort()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "allocated port", port, expected)
+	}
+
+	//ports are handed out round-robin, and the end of the range (which is also
+	//the end of the uint16 range here) wraps around to the start
+	expectPort(65533)
+	expectPort(65534)
+	expectPort(65535)
+	_, err := d.allocatePort()
+	expectedMessage := "all ports from 65533 to 65535 are in use by keppel-registry processes"
+	if err == nil || err.Error() != expectedMessage {
+		t.Errorf("expected error %q, got %v", expectedMessage, err)
+	}
+
+	//ports are reused once their process has exited
+	delete(d.usedPorts, 65534)
+	expectPort(65534)
+	delete(d.usedPorts, 65533)
+	delete(d.usedPorts, 65535)
+	expectPort(65535)
+	expectPort(65533)
+}
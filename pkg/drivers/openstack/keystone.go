@@ -25,11 +25,15 @@
 package openstack
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"sync"
+	"time"
 
+	policy "github.com/databus23/goslo.policy"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/roles"
@@ -58,8 +62,16 @@ type keystoneDriver struct {
 	IdentityV3     *gophercloud.ServiceClient   `yaml:"-"`
 	TokenValidator *gopherpolicy.TokenValidator `yaml:"-"`
 	LocalRoleID    string                       `yaml:"-"`
+
+	//cache for getRoleNames()
+	roleNamesMutex     sync.Mutex
+	roleNames          map[string]string
+	roleNamesFetchedAt time.Time
 }
 
+//How long getRoleNames() caches the mapping from role IDs to role names.
+const roleNamesCacheDuration = 10 * time.Minute
+
 func init() {
 	keppel.RegisterAuthDriver("keystone", func() keppel.AuthDriver {
 		return &keystoneDriver{}
@@ -254,15 +266,138 @@ func (d *keystoneDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.Au
 	return keystoneAuthorization{t}, nil
 }
 
+//UserIdentity implements the keppel.AuthDriver interface. The user name has
+//the same format as for AuthenticateUser. The identity contains the IDs and
+//names of the user and the project that the user's token is scoped to, in the
+//same format as in the policy context.
+func (d *keystoneDriver) UserIdentity(an keppel.Authorization) (string, string, error) {
+	var t *gopherpolicy.Token
+	switch an := an.(type) {
+	case keystoneAuthorization:
+		t = an.t
+	case *keystoneAuthorization:
+		t = an.t
+	default:
+		return "", "", errors.New("given Authorization was not issued by the keystone driver")
+	}
+	auth := t.Context.Auth
+	userName := fmt.Sprintf("%s@%s/%s@%s",
+		auth["user_name"], auth["user_domain_name"], auth["project_name"], auth["project_domain_name"])
+	buf, err := json.Marshal(auth)
+	return userName, string(buf), err
+}
+
+//AuthorizeUserIdentity implements the keppel.AuthDriver interface. Since no
+//user token is available, the user's roles in the project are looked up with
+//the service user's token and then checked against the policy in the same
+//way as for a user token.
+func (d *keystoneDriver) AuthorizeUserIdentity(identity string) (keppel.Authorization, *keppel.RegistryV2Error) {
+	var authContext map[string]string
+	err := json.Unmarshal([]byte(identity), &authContext)
+	if err != nil || authContext["user_id"] == "" || authContext["project_id"] == "" {
+		return nil, keppel.ErrUnauthorized.With("malformed user identity")
+	}
+
+	//Keystone keeps the role assignments of disabled users, so we need to check
+	//that the user can still log in
+	userID := authContext["user_id"]
+	var data struct {
+		User struct {
+			Enabled bool `json:"enabled"`
+		} `json:"user"`
+	}
+	_, err = d.IdentityV3.Get(d.IdentityV3.ServiceURL("users", userID), &data, nil)
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return nil, keppel.ErrUnauthorized.With("user %s does not exist anymore", userID)
+	}
+	if err != nil {
+		return nil, keppel.ErrUnauthorized.With("cannot check user %s: %s", userID, err.Error())
+	}
+	if !data.User.Enabled {
+		return nil, keppel.ErrUnauthorized.With("user %s is disabled", userID)
+	}
+
+	effective := true
+	page, err := roles.ListAssignments(d.IdentityV3, roles.ListAssignmentsOpts{
+		UserID:         authContext["user_id"],
+		ScopeProjectID: authContext["project_id"],
+		Effective:      &effective,
+	}).AllPages()
+	if err != nil {
+		return nil, keppel.ErrUnauthorized.With("cannot list role assignments for user %s: %s", authContext["user_id"], err.Error())
+	}
+	assignments, err := roles.ExtractRoleAssignments(page)
+	if err != nil {
+		return nil, keppel.ErrUnauthorized.With("cannot list role assignments for user %s: %s", authContext["user_id"], err.Error())
+	}
+
+	t := &gopherpolicy.Token{
+		Enforcer: d.TokenValidator.Enforcer,
+		Context: policy.Context{
+			Auth:    authContext,
+			Request: map[string]string{},
+			Logger:  logg.Debug,
+		},
+	}
+	roleIDs := make([]string, len(assignments))
+	for idx, assignment := range assignments {
+		roleIDs[idx] = assignment.Role.ID
+	}
+	roleNames, err := d.getRoleNames(roleIDs)
+	if err != nil {
+		return nil, keppel.ErrUnauthorized.With("cannot list Keystone roles: %s", err.Error())
+	}
+	for _, roleID := range roleIDs {
+		t.Context.Roles = append(t.Context.Roles, roleNames[roleID])
+	}
+	return keystoneAuthorization{t}, nil
+}
+
+//getRoleNames returns a mapping from role IDs to role names. The mapping is
+//cached, and only fetched again when the cache is outdated or does not
+//contain one of the given role IDs (e.g. because the role was created
+//recently).
+func (d *keystoneDriver) getRoleNames(roleIDs []string) (map[string]string, error) {
+	d.roleNamesMutex.Lock()
+	defer d.roleNamesMutex.Unlock()
+
+	isCacheValid := d.roleNames != nil && time.Since(d.roleNamesFetchedAt) < roleNamesCacheDuration
+	for _, roleID := range roleIDs {
+		if _, exists := d.roleNames[roleID]; !exists {
+			isCacheValid = false
+		}
+	}
+	if isCacheValid {
+		return d.roleNames, nil
+	}
+
+	page, err := roles.List(d.IdentityV3, roles.ListOpts{}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	list, err := roles.ExtractRoles(page)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(list))
+	for _, role := range list {
+		result[role.ID] = role.Name
+	}
+	d.roleNames = result
+	d.roleNamesFetchedAt = time.Now()
+	return result, nil
+}
+
 type keystoneAuthorization struct {
 	t *gopherpolicy.Token
 }
 
 var ruleForPerm = map[keppel.Permission]string{
-	keppel.CanViewAccount:     "account:show",
-	keppel.CanPullFromAccount: "account:pull",
-	keppel.CanPushToAccount:   "account:push",
-	keppel.CanChangeAccount:   "account:edit",
+	keppel.CanViewAccount:        "account:show",
+	keppel.CanPullFromAccount:    "account:pull",
+	keppel.CanPushToAccount:      "account:push",
+	keppel.CanChangeAccount:      "account:edit",
+	keppel.CanAdministrateKeppel: "keppel:admin",
 }
 
 //HasPermission implements the keppel.Authorization interface.
@@ -0,0 +1,151 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package shareddb contains a FederationDriver that keeps account name claims
+//in a Postgres database that is shared by all keppel-api instances in the
+//federation.
+package shareddb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/sapcc/go-bits/postlite"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//Each account name is claimed by exactly one tenant, but may be held by
+//multiple keppel-api instances (e.g. when an account is replicated). The claim
+//is removed when the last holder forfeits it.
+var sqlMigrations = map[string]string{
+	"001_initial.up.sql": `
+		CREATE TABLE account_name_claims (
+			account_name   TEXT NOT NULL PRIMARY KEY,
+			auth_tenant_id TEXT NOT NULL
+		);
+		CREATE TABLE account_name_holders (
+			account_name TEXT NOT NULL REFERENCES account_name_claims ON DELETE CASCADE,
+			holder_id    TEXT NOT NULL,
+			PRIMARY KEY (account_name, holder_id)
+		);
+	`,
+	"001_initial.down.sql": `
+		DROP TABLE account_name_holders;
+		DROP TABLE account_name_claims;
+	`,
+}
+
+type federationDriver struct {
+	Config struct {
+		DatabaseURL string `yaml:"db_url"`
+		//defaults to the hostname of api.public_url
+		HolderID string `yaml:"holder_id"`
+	}
+	db *sql.DB
+}
+
+func init() {
+	keppel.RegisterFederationDriver("shared-db", func() keppel.FederationDriver {
+		return &federationDriver{}
+	})
+}
+
+//ReadConfig implements the keppel.FederationDriver interface.
+func (d *federationDriver) ReadConfig(unmarshal func(interface{}) error) error {
+	err := unmarshal(&d.Config)
+	if err != nil {
+		return err
+	}
+	if d.Config.DatabaseURL == "" && !keppel.TestMode {
+		return errors.New("missing federation.db_url")
+	}
+	return nil
+}
+
+//Connect implements the keppel.FederationDriver interface.
+func (d *federationDriver) Connect() error {
+	var dbURL *url.URL
+	if !keppel.TestMode {
+		var err error
+		dbURL, err = url.Parse(d.Config.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("malformed federation.db_url: %s", err.Error())
+		}
+	}
+
+	var err error
+	d.db, err = postlite.Connect(postlite.Configuration{
+		PostgresURL: dbURL, //NOTE: is nil for keppel.TestMode == true
+		Migrations:  sqlMigrations,
+	})
+	return err
+}
+
+func (d *federationDriver) holderID() string {
+	if d.Config.HolderID != "" {
+		return d.Config.HolderID
+	}
+	return keppel.State.Config.APIPublicHostname()
+}
+
+//ClaimAccountName implements the keppel.FederationDriver interface.
+func (d *federationDriver) ClaimAccountName(account keppel.Account) error {
+	_, err := d.db.Exec(
+		`INSERT INTO account_name_claims (account_name, auth_tenant_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		account.Name, account.AuthTenantID)
+	if err != nil {
+		return err
+	}
+
+	var tenantID string
+	err = d.db.QueryRow(
+		`SELECT auth_tenant_id FROM account_name_claims WHERE account_name = $1`,
+		account.Name).Scan(&tenantID)
+	if err != nil {
+		//this includes sql.ErrNoRows if the claim was forfeited concurrently by
+		//its last holder; the user can just retry in that case
+		return err
+	}
+	if tenantID != account.AuthTenantID {
+		return keppel.ErrAccountNameClaimed
+	}
+
+	_, err = d.db.Exec(
+		`INSERT INTO account_name_holders (account_name, holder_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		account.Name, d.holderID())
+	return err
+}
+
+//ForfeitAccountName implements the keppel.FederationDriver interface.
+func (d *federationDriver) ForfeitAccountName(account keppel.Account) error {
+	_, err := d.db.Exec(
+		`DELETE FROM account_name_holders WHERE account_name = $1 AND holder_id = $2`,
+		account.Name, d.holderID())
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(
+		`DELETE FROM account_name_claims WHERE account_name = $1 AND NOT EXISTS (
+			SELECT 1 FROM account_name_holders WHERE account_name = $1
+		)`,
+		account.Name)
+	return err
+}
@@ -0,0 +1,65 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package shareddb
+
+import (
+	"testing"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+func TestAccountNameClaims(t *testing.T) {
+	keppel.TestMode = true
+	first := &federationDriver{}
+	first.Config.HolderID = "first"
+	err := first.Connect()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//both peers use the same DB
+	second := &federationDriver{db: first.db}
+	second.Config.HolderID = "second"
+
+	expect := func(err error, expected error) {
+		t.Helper()
+		if err != expected {
+			t.Errorf("expected error %v, got %v", expected, err)
+		}
+	}
+	account := keppel.Account{Name: "foo", AuthTenantID: "tenant1"}
+	otherAccount := keppel.Account{Name: "foo", AuthTenantID: "tenant2"}
+
+	//claiming a new name works, and claiming it again for the same tenant
+	//(e.g. when replicating the account to the second peer) works as well
+	expect(first.ClaimAccountName(account), nil)
+	expect(first.ClaimAccountName(account), nil)
+	expect(second.ClaimAccountName(account), nil)
+
+	//other tenants cannot claim the same name on any peer
+	expect(first.ClaimAccountName(otherAccount), keppel.ErrAccountNameClaimed)
+	expect(second.ClaimAccountName(otherAccount), keppel.ErrAccountNameClaimed)
+
+	//the name stays claimed until all holders have forfeited it
+	expect(first.ForfeitAccountName(account), nil)
+	expect(second.ClaimAccountName(otherAccount), keppel.ErrAccountNameClaimed)
+	expect(second.ForfeitAccountName(account), nil)
+	expect(second.ClaimAccountName(otherAccount), nil)
+	expect(first.ClaimAccountName(account), keppel.ErrAccountNameClaimed)
+}
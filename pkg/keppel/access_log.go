@@ -0,0 +1,53 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import "time"
+
+//AccessLogEntry contains a record from the `access_log_entries` table. An
+//entry is recorded for each request that keppel-api proxies to the
+//keppel-registry of an account. Entries are deleted after the retention
+//period configured in `access_log.retention_days`.
+type AccessLogEntry struct {
+	ID          int64     `db:"id" json:"id"`
+	AccountName string    `db:"account_name" json:"account"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	//UserName is empty for anonymous requests or requests with invalid tokens.
+	UserName string `db:"user_name" json:"user"`
+	SourceIP string `db:"source_ip" json:"source_ip"`
+	Method   string `db:"method" json:"method"`
+	RepoName string `db:"repo_name" json:"repository"`
+	Digest   string `db:"digest" json:"digest,omitempty"`
+	//StatusCode is the HTTP status code returned by keppel-registry.
+	StatusCode int `db:"status_code" json:"status"`
+	//Bytes counts both the request body and the response body.
+	Bytes int64 `db:"bytes" json:"bytes"`
+}
+
+//PruneAccessLog deletes all access log entries that are older than the
+//configured retention period. Returns how many entries were deleted.
+func (db *DB) PruneAccessLog(now time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM access_log_entries WHERE created_at < $1`,
+		now.Add(-State.Config.AccessLogRetention).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
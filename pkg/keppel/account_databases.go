@@ -0,0 +1,204 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+
+	"github.com/lib/pq"
+)
+
+//accountDatabasePasswordSecretName returns the name of the secret that holds
+//the password of the database role of the given account.
+func accountDatabasePasswordSecretName(account Account) string {
+	return "postgres-password/" + account.Name
+}
+
+//ProvisionAccountDatabase prepares the metadata database of the given account
+//(see Account.PostgresDatabaseName) for use by a keppel-registry that does not
+//run on the same host as keppel-api, and returns the connection URL for it.
+//
+//Instead of keppel-api's own credentials, the URL contains the credentials of
+//a role that only has access to this one database. The role has the same name
+//as the database, and its password is kept in the secret storage. (The caller
+//is responsible for checking that State.Config.DatabaseURL is not nil.)
+func (db *DB) ProvisionAccountDatabase(account Account) (*url.URL, error) {
+	name := account.PostgresDatabaseName()
+	ident := pq.QuoteIdentifier(name)
+
+	password, err := db.loadAccountDatabasePassword(account)
+	if err != nil {
+		return nil, fmt.Errorf("cannot store database password for account %s: %s", account.Name, err.Error())
+	}
+
+	//create the role, or reset its password in case the stored one has been
+	//replaced by a concurrent keppel-api (the password is hex-encoded, so it
+	//can be put into the statement without escaping)
+	count, err := db.SelectInt(`SELECT COUNT(*) FROM pg_roles WHERE rolname = $1`, name)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		_, err = db.Exec(`CREATE ROLE ` + ident)
+		if err != nil && !isPostgresError(err, "duplicate_object") {
+			return nil, fmt.Errorf("cannot create database role %s: %s", name, err.Error())
+		}
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER ROLE %s LOGIN PASSWORD '%s'`, ident, string(password)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot set password of database role %s: %s", name, err.Error())
+	}
+	//keppel-api needs to be a member of the role to hand over the database to it
+	//(and it keeps access to the database that way, e.g. for backups)
+	_, err = db.Exec(`GRANT ` + ident + ` TO CURRENT_USER`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot grant database role %s to keppel-api: %s", name, err.Error())
+	}
+
+	//create the database, or hand it over to the role if it was created by
+	//keppel-api or keppel-registry with keppel-api's own credentials
+	count, err = db.SelectInt(`SELECT COUNT(*) FROM pg_database WHERE datname = $1`, name)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		_, err = db.Exec(`CREATE DATABASE ` + ident + ` OWNER ` + ident)
+		if err != nil && !isPostgresError(err, "duplicate_database") {
+			return nil, fmt.Errorf("cannot create database %s: %s", name, err.Error())
+		}
+	}
+	_, err = db.Exec(`ALTER DATABASE ` + ident + ` OWNER TO ` + ident)
+	if err == nil {
+		_, err = db.Exec(`REVOKE ALL ON DATABASE ` + ident + ` FROM PUBLIC`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot restrict access to database %s: %s", name, err.Error())
+	}
+
+	dbURL := *State.Config.DatabaseURL
+	dbURL.Path = "/" + name
+	err = reassignAccountDatabaseTables(dbURL, name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot hand over tables in database %s: %s", name, err.Error())
+	}
+
+	dbURL.User = url.UserPassword(name, string(password))
+	return &dbURL, nil
+}
+
+//loadAccountDatabasePassword returns the password of the database role of the
+//given account, and generates one if none exists yet.
+func (db *DB) loadAccountDatabasePassword(account Account) (Secret, error) {
+	secretName := accountDatabasePasswordSecretName(account)
+	password, err := db.LoadSecret(secretName)
+	if err != nil || password != nil {
+		return password, err
+	}
+
+	buf := make([]byte, 32)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	//when multiple keppel-api instances get here concurrently, only the first
+	//password is stored, and all instances continue with that one
+	err = db.StoreSecretUnlessExists(secretName, Secret(hex.EncodeToString(buf)))
+	if err != nil {
+		return nil, err
+	}
+	return db.LoadSecret(secretName)
+}
+
+//reassignAccountDatabaseTables hands over the tables that keppel-registry
+//created in the given account database with keppel-api's own credentials to
+//the account's database role. (Sequences owned by these tables follow along.)
+func reassignAccountDatabaseTables(dbURL url.URL, roleName string) error {
+	accountDB, err := sql.Open("postgres", dbURL.String())
+	if err != nil {
+		return err
+	}
+	defer accountDB.Close()
+
+	rows, err := accountDB.Query(`
+		SELECT c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		 WHERE n.nspname = 'public' AND c.relkind = 'r' AND pg_get_userbyid(c.relowner) = current_user
+	`)
+	if err != nil {
+		return err
+	}
+	var tableNames []string
+	for rows.Next() {
+		var tableName string
+		err := rows.Scan(&tableName)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tableNames = append(tableNames, tableName)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, tableName := range tableNames {
+		_, err := accountDB.Exec(`ALTER TABLE ` + pq.QuoteIdentifier(tableName) + ` OWNER TO ` + pq.QuoteIdentifier(roleName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//DropAccountDatabase drops the metadata database of the given account, as
+//well as the database role and its password if the account database was
+//provisioned with ProvisionAccountDatabase.
+func (db *DB) DropAccountDatabase(account Account) error {
+	name := account.PostgresDatabaseName()
+	_, err := db.Exec(`DROP DATABASE IF EXISTS ` + pq.QuoteIdentifier(name))
+	if err != nil {
+		return fmt.Errorf("cannot drop metadata database: %s", err.Error())
+	}
+	//only touch the role if it exists, since dropping roles requires the
+	//CREATEROLE privilege even with IF EXISTS
+	count, err := db.SelectInt(`SELECT COUNT(*) FROM pg_roles WHERE rolname = $1`, name)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		_, err = db.Exec(`DROP ROLE ` + pq.QuoteIdentifier(name))
+		if err != nil {
+			return fmt.Errorf("cannot drop database role: %s", err.Error())
+		}
+	}
+	return db.DeleteSecret(accountDatabasePasswordSecretName(account))
+}
+
+//isPostgresError checks whether the given error is a Postgres error with the
+//given condition name (e.g. "duplicate_object").
+func isPostgresError(err error, conditionName string) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code.Name() == conditionName
+}
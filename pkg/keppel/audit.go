@@ -0,0 +1,304 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//AuditEvent contains a record from the `audit_events` table. Audit events are
+//not tied to the lifetime of their account, so that they remain available
+//after the account has been deleted.
+//
+//The events of each account form a hash chain: Each event contains the hash
+//of its predecessor, so that modifications of past events can be detected.
+//Events that were recorded before the hash chain was introduced have
+//Sequence = 0 and no hashes.
+type AuditEvent struct {
+	ID          int64  `db:"id" json:"id"`
+	AccountName string `db:"account_name" json:"account"`
+	//Action identifies the type of event, e.g. "expire_manifest".
+	Action string `db:"action" json:"action"`
+	//UserName identifies the user who caused the event. For events caused by
+	//keppel-api itself, this is a pseudo-user name starting with "keppel-".
+	UserName  string    `db:"user_name" json:"user"`
+	RepoName  string    `db:"repo_name" json:"repository,omitempty"`
+	Digest    string    `db:"digest" json:"digest,omitempty"`
+	Details   string    `db:"details" json:"details,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	//Sequence counts the events of each account, starting at 1.
+	Sequence int64  `db:"sequence" json:"sequence,omitempty"`
+	PrevHash string `db:"prev_hash" json:"prev_hash,omitempty"`
+	Hash     string `db:"hash" json:"hash,omitempty"`
+}
+
+//How often RecordAuditEvent tries to append to the hash chain when concurrent
+//writers append to the same chain.
+const auditChainAttempts = 5
+
+//RecordAuditEvent appends the given audit event to the hash chain of its
+//account. If the event does not have a CreatedAt timestamp, the current time
+//is used.
+func (db *DB) RecordAuditEvent(e AuditEvent) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	//the DB stores timestamps with microsecond precision, so the hash must not
+	//cover anything more precise than that
+	e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Microsecond)
+
+	//when a concurrent writer takes the same sequence number, the unique index
+	//on (account_name, sequence) makes the insert fail, and we try again (all
+	//other errors are returned immediately)
+	var err error
+	for attempt := 0; attempt < auditChainAttempts; attempt++ {
+		err = db.appendAuditEvent(e)
+		if err == nil || !isAuditSequenceConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+//isAuditSequenceConflict returns whether the given error was caused by the
+//unique index on (account_name, sequence) in the audit_events table.
+func isAuditSequenceConflict(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code.Name() == "unique_violation" && pqErr.Constraint == "audit_events_account_name_sequence_idx"
+	}
+	//SQLite (which is used in unit tests) does not report the name of the index
+	return strings.Contains(err.Error(), "UNIQUE constraint failed: audit_events.account_name, audit_events.sequence")
+}
+
+func (db *DB) appendAuditEvent(e AuditEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer RollbackUnlessCommitted(tx)
+
+	var last AuditEvent
+	err = tx.SelectOne(&last, `
+		SELECT * FROM audit_events WHERE account_name = $1 AND sequence > 0
+		 ORDER BY sequence DESC LIMIT 1`, e.AccountName)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	e.Sequence = last.Sequence + 1
+	e.PrevHash = last.Hash
+	e.Hash = e.ComputeHash()
+	err = tx.Insert(&e)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//ComputeHash returns the hash of this event. It covers all fields except for
+//the ID (which is assigned by the DB) and the hash itself. Since the hash of
+//the previous event is included, each hash covers the entire chain up to this
+//event.
+func (e AuditEvent) ComputeHash() string {
+	buf, _ := json.Marshal([]interface{}{ //cannot fail for strings and integers
+		e.AccountName, e.Sequence, e.Action, e.UserName, e.RepoName, e.Digest,
+		e.Details, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.PrevHash,
+	})
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// checkpoints
+
+//AuditCheckpoint contains a record from the `audit_checkpoints` table. A
+//checkpoint is a signed statement about the hash of an account's latest audit
+//event. Since the hash covers the entire chain up to this event, an attacker
+//who modifies or deletes events cannot repair the chain without the key that
+//signs the checkpoints.
+type AuditCheckpoint struct {
+	ID          int64     `db:"id" json:"id"`
+	AccountName string    `db:"account_name" json:"account"`
+	Sequence    int64     `db:"sequence" json:"sequence"`
+	Hash        string    `db:"hash" json:"hash"`
+	Algorithm   string    `db:"algorithm" json:"algorithm"`
+	Signature   string    `db:"signature" json:"signature"` //base64-encoded
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+//signedPayload returns the message that is signed by this checkpoint.
+func (c AuditCheckpoint) signedPayload() []byte {
+	return []byte(fmt.Sprintf("keppel-audit-checkpoint\n%s\n%d\n%s\n%s\n",
+		c.AccountName, c.Sequence, c.Hash, c.CreatedAt.UTC().Format(time.RFC3339Nano)))
+}
+
+//CreateAuditCheckpoints creates a signed checkpoint for each account whose
+//audit events have advanced since its last checkpoint. Returns how many
+//checkpoints were created.
+func (db *DB) CreateAuditCheckpoints(now time.Time) (int, error) {
+	var heads []AuditEvent
+	_, err := db.Select(&heads, `
+		SELECT e.* FROM audit_events e
+		 WHERE e.sequence = (SELECT MAX(sequence) FROM audit_events WHERE account_name = e.account_name)
+		   AND e.sequence > 0
+		   AND e.sequence > (SELECT COALESCE(MAX(sequence), 0) FROM audit_checkpoints WHERE account_name = e.account_name)
+		 ORDER BY e.account_name`)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, head := range heads {
+		c := AuditCheckpoint{
+			AccountName: head.AccountName,
+			Sequence:    head.Sequence,
+			Hash:        head.Hash,
+			CreatedAt:   now.UTC().Truncate(time.Microsecond),
+		}
+		sig, alg, err := State.AuditKey.Sign(bytes.NewReader(c.signedPayload()), crypto.SHA256)
+		if err != nil {
+			return idx, err
+		}
+		c.Algorithm = alg
+		c.Signature = base64.StdEncoding.EncodeToString(sig)
+		err = db.Insert(&c)
+		if err != nil {
+			return idx, err
+		}
+	}
+	return len(heads), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// verification
+
+//AuditVerification is the result of VerifyAuditLog.
+type AuditVerification struct {
+	AccountName     string   `json:"account"`
+	EventCount      int      `json:"events"`
+	CheckpointCount int      `json:"checkpoints"`
+	Problems        []string `json:"problems"`
+}
+
+//IsValid returns whether no problems were found.
+func (v AuditVerification) IsValid() bool {
+	return len(v.Problems) == 0
+}
+
+func (v *AuditVerification) addProblem(msg string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(msg, args...))
+}
+
+//VerifyAuditLog checks the hash chain and the checkpoints of the given
+//account's audit events, and reports all gaps and modifications that were
+//found.
+func (db *DB) VerifyAuditLog(accountName string) (AuditVerification, error) {
+	result := AuditVerification{AccountName: accountName, Problems: []string{}}
+
+	var events []AuditEvent
+	_, err := db.Select(&events,
+		`SELECT * FROM audit_events WHERE account_name = $1 ORDER BY sequence, id`, accountName)
+	if err != nil {
+		return result, err
+	}
+	var checkpoints []AuditCheckpoint
+	_, err = db.Select(&checkpoints,
+		`SELECT * FROM audit_checkpoints WHERE account_name = $1 ORDER BY sequence, id`, accountName)
+	if err != nil {
+		return result, err
+	}
+	result.EventCount = len(events)
+	result.CheckpointCount = len(checkpoints)
+
+	//events without sequence number predate the hash chain, so they must not
+	//appear after the first chained event
+	var firstChainedID int64
+	for _, e := range events {
+		if e.Sequence > 0 && (firstChainedID == 0 || e.ID < firstChainedID) {
+			firstChainedID = e.ID
+		}
+	}
+
+	//check the hash chain
+	hashBySequence := make(map[int64]string)
+	var (
+		lastSequence int64
+		lastHash     string
+	)
+	for _, e := range events {
+		if e.Sequence == 0 {
+			if firstChainedID != 0 && e.ID > firstChainedID {
+				result.addProblem("event %d was inserted outside of the hash chain", e.ID)
+			}
+			continue
+		}
+
+		switch {
+		case e.Sequence == lastSequence+2:
+			result.addProblem("event with sequence number %d is missing", lastSequence+1)
+		case e.Sequence > lastSequence+2:
+			result.addProblem("events with sequence numbers %d to %d are missing", lastSequence+1, e.Sequence-1)
+		case e.PrevHash != lastHash:
+			result.addProblem("event %d (sequence %d) does not refer to the hash of its predecessor", e.ID, e.Sequence)
+		}
+		if e.ComputeHash() != e.Hash {
+			result.addProblem("event %d (sequence %d) was modified", e.ID, e.Sequence)
+		}
+		hashBySequence[e.Sequence] = e.Hash
+		lastSequence = e.Sequence
+		lastHash = e.Hash
+	}
+
+	//check the checkpoints
+	publicKey := State.AuditKey.PublicKey()
+	for _, c := range checkpoints {
+		sig, err := base64.StdEncoding.DecodeString(c.Signature)
+		if err == nil {
+			err = publicKey.Verify(bytes.NewReader(c.signedPayload()), c.Algorithm, sig)
+		}
+		if err != nil {
+			result.addProblem("checkpoint %d has an invalid signature", c.ID)
+			continue
+		}
+
+		hash, exists := hashBySequence[c.Sequence]
+		switch {
+		case c.Sequence > lastSequence:
+			result.addProblem("events after sequence number %d were deleted (checkpoint %d covers sequence number %d)",
+				lastSequence, c.ID, c.Sequence)
+		case !exists:
+			//already reported as a gap in the chain
+		case hash != c.Hash:
+			result.addProblem("events up to sequence number %d do not match checkpoint %d", c.Sequence, c.ID)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,174 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestAuditLogVerification(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+	`)
+	db := keppel.State.DB
+
+	expectProblems := func(expected ...string) {
+		t.Helper()
+		result, err := db.VerifyAuditLog("first")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if expected == nil {
+			expected = []string{}
+		}
+		assert.DeepEqual(t, "verification problems", result.Problems, expected)
+	}
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		_, err := db.Exec(query, args...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//record some events in two accounts
+	for idx := 1; idx <= 5; idx++ {
+		for _, accountName := range []string{"first", "second"} {
+			err := db.RecordAuditEvent(keppel.AuditEvent{
+				AccountName: accountName,
+				Action:      "expire_manifest",
+				UserName:    "keppel-image-expiry",
+				RepoName:    "foo",
+				Details:     fmt.Sprintf("event %d", idx),
+				CreatedAt:   time.Unix(int64(3600*idx), 0),
+			})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	//each account has its own hash chain
+	var events []keppel.AuditEvent
+	_, err := db.Select(&events, `SELECT * FROM audit_events WHERE account_name = $1 ORDER BY sequence`, "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for idx, e := range events {
+		if e.Sequence != int64(idx+1) {
+			t.Errorf("expected event %d to have sequence %d, but got %d", e.ID, idx+1, e.Sequence)
+		}
+		if idx > 0 && e.PrevHash != events[idx-1].Hash {
+			t.Errorf("expected event %d to refer to the hash of event %d", e.ID, events[idx-1].ID)
+		}
+	}
+	expectProblems()
+
+	//checkpoints are only created for accounts with new events
+	count, err := db.CreateAuditCheckpoints(time.Unix(86400, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "checkpoint count", count, 2)
+	count, err = db.CreateAuditCheckpoints(time.Unix(90000, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "checkpoint count", count, 0)
+	expectProblems()
+
+	//modifying an event is detected (event 5 is sequence 3 of account "first")
+	exec(`UPDATE audit_events SET details = $1 WHERE id = $2`, "nothing to see here", 5)
+	expectProblems(
+		"event 5 (sequence 3) was modified",
+	)
+	exec(`UPDATE audit_events SET details = $1 WHERE id = $2`, "event 3", 5)
+	expectProblems()
+
+	//recomputing the hashes after the modification is detected by the checkpoint
+	exec(`UPDATE audit_events SET details = $1 WHERE id = $2`, "nothing to see here", 5)
+	events = nil
+	_, err = db.Select(&events, `SELECT * FROM audit_events WHERE account_name = $1 ORDER BY sequence`, "first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	originalHashes := make([]string, len(events))
+	prevHash := ""
+	for idx, e := range events {
+		originalHashes[idx] = e.Hash
+		e.PrevHash = prevHash
+		e.Hash = e.ComputeHash()
+		prevHash = e.Hash
+		exec(`UPDATE audit_events SET prev_hash = $1, hash = $2 WHERE id = $3`, e.PrevHash, e.Hash, e.ID)
+	}
+	expectProblems(
+		"events up to sequence number 5 do not match checkpoint 1",
+	)
+
+	//forging the checkpoint is detected as well
+	exec(`UPDATE audit_checkpoints SET hash = $1 WHERE id = $2`, prevHash, 1)
+	expectProblems(
+		"checkpoint 1 has an invalid signature",
+	)
+
+	//restore the original state
+	exec(`UPDATE audit_events SET details = $1 WHERE id = $2`, "event 3", 5)
+	exec(`UPDATE audit_checkpoints SET hash = $1 WHERE id = $2`, originalHashes[4], 1)
+	prevHash = ""
+	for idx, e := range events {
+		exec(`UPDATE audit_events SET prev_hash = $1, hash = $2 WHERE id = $3`, prevHash, originalHashes[idx], e.ID)
+		prevHash = originalHashes[idx]
+	}
+	expectProblems()
+
+	//deleting an event in the middle of the chain is detected
+	exec(`DELETE FROM audit_events WHERE id = $1`, 5)
+	expectProblems(
+		"event with sequence number 3 is missing",
+	)
+
+	//deleting the latest events is detected by the checkpoint
+	exec(`DELETE FROM audit_events WHERE id = $1`, 9)
+	expectProblems(
+		"event with sequence number 3 is missing",
+		"events after sequence number 4 were deleted (checkpoint 1 covers sequence number 5)",
+	)
+
+	//the other account is unaffected
+	result, err := db.VerifyAuditLog("second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "verification of account \"second\"", result, keppel.AuditVerification{
+		AccountName:     "second",
+		EventCount:      5,
+		CheckpointCount: 1,
+		Problems:        []string{},
+	})
+}
@@ -36,6 +36,10 @@ const (
 	CanPushToAccount = "push"
 	//CanChangeAccount is the permission for creating and updating accounts.
 	CanChangeAccount = "change"
+	//CanAdministrateKeppel is the permission for cloud-wide administrative
+	//operations like placing legal holds. When checking for this permission,
+	//the tenant ID is ignored and shall be given as the empty string.
+	CanAdministrateKeppel = "keppeladmin"
 )
 
 //Authorization describes the access rights for a user. It is returned by
@@ -81,6 +85,19 @@ type AuthDriver interface {
 	//header, whereas an OpenStack auth driver would look for a Keystone token in the
 	//X-Auth-Token header.
 	AuthenticateUserFromRequest(r *http.Request) (Authorization, *RegistryV2Error)
+
+	//UserIdentity identifies the user behind the given Authorization (which was
+	//obtained from one of the AuthenticateUserXXX methods of the same
+	//instance). The user name is a human-readable name that is suitable for
+	//audit logs. The format of the identity string is up to the driver, but it
+	//must contain everything that AuthorizeUserIdentity needs.
+	UserIdentity(an Authorization) (userName, identity string, err error)
+	//AuthorizeUserIdentity returns the current access rights of the user
+	//identified by the given string (as returned by UserIdentity). This is used
+	//to re-check the user's permissions when the user's credentials are not
+	//available, e.g. for personal access tokens. The returned Authorization
+	//shall not be given to SetupAccount.
+	AuthorizeUserIdentity(identity string) (Authorization, *RegistryV2Error)
 }
 
 var authDriverFactories = make(map[string]func() AuthDriver)
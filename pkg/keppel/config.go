@@ -27,6 +27,7 @@ import (
 	"net"
 	"net/url"
 	"regexp"
+	"time"
 
 	"github.com/docker/libtrust"
 	yaml "gopkg.in/yaml.v2"
@@ -44,8 +45,17 @@ type StateStruct struct {
 	AuthDriver          AuthDriver
 	OrchestrationDriver OrchestrationDriver
 	StorageDriver       StorageDriver
+	FederationDriver    FederationDriver
 	JWTIssuerKey        libtrust.PrivateKey
 	JWTIssuerCertPEM    string
+	//AuditKey signs the checkpoints of the audit log. This is the same as
+	//JWTIssuerKey unless trust.audit_key is configured.
+	AuditKey libtrust.PrivateKey
+	//The first key is used for storing new secrets, the others are only used
+	//for reading existing secrets.
+	SecretMasterKeys []MasterKey
+	//InternalCA is nil unless trust.registry_tls is enabled.
+	InternalCA *InternalCA
 }
 
 //Configuration contains some configuration values that are not compiled during
@@ -54,6 +64,13 @@ type Configuration struct {
 	APIListenAddress string
 	APIPublicURL     url.URL
 	DatabaseURL      *url.URL //is nil in unit tests
+	//AccessLogRetention is how long entries in the access log are kept.
+	AccessLogRetention time.Duration
+	//AccountDeletionGracePeriod is how long deleted accounts can be restored
+	//before their storage is deleted.
+	AccountDeletionGracePeriod time.Duration
+	//TokenBinding is nil unless token_binding.enabled is set.
+	TokenBinding *TokenBinding
 }
 
 //APIPublicHostname returns the hostname from the APIPublicURL.
@@ -77,10 +94,28 @@ type configuration struct {
 	Auth    authDriverSection          `yaml:"auth"`
 	Orch    orchestrationDriverSection `yaml:"orchestration"`
 	Storage storageDriverSection       `yaml:"storage"`
+	Fed     federationDriverSection    `yaml:"federation"`
 	Trust   struct {
 		IssuerKeyIn  string `yaml:"issuer_key"`
 		IssuerCertIn string `yaml:"issuer_cert"`
+		RegistryTLS  bool   `yaml:"registry_tls"`
+		AuditKeyIn   string `yaml:"audit_key"`
 	} `yaml:"trust"`
+	Secrets struct {
+		MasterKeys []masterKeyConfig `yaml:"master_keys"`
+	} `yaml:"secrets"`
+	AccessLog struct {
+		RetentionDays uint `yaml:"retention_days"`
+	} `yaml:"access_log"`
+	AccountDeletion struct {
+		GracePeriodDays uint `yaml:"grace_period_days"`
+	} `yaml:"account_deletion"`
+	TokenBinding tokenBindingConfig `yaml:"token_binding"`
+}
+
+type masterKeyConfig struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"`
 }
 
 //This is a separate type because of its UnmarshalYAML implementation.
@@ -146,6 +181,27 @@ func (s *storageDriverSection) UnmarshalYAML(unmarshal func(interface{}) error)
 	return s.Driver.ReadConfig(unmarshal)
 }
 
+//This is a separate type because of its UnmarshalYAML implementation.
+type federationDriverSection struct {
+	Driver FederationDriver
+}
+
+//UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (f *federationDriverSection) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var data struct {
+		DriverName string `yaml:"driver"`
+	}
+	err := unmarshal(&data)
+	if err != nil {
+		return err
+	}
+	f.Driver, err = NewFederationDriver(data.DriverName)
+	if err != nil {
+		return err
+	}
+	return f.Driver.ReadConfig(unmarshal)
+}
+
 //ReadConfig parses the given configuration file and fills the Config package
 //variable.
 func ReadConfig(file io.Reader) error {
@@ -164,6 +220,15 @@ func ReadConfig(file io.Reader) error {
 	if cfg.API.ListenAddress == "" {
 		cfg.API.ListenAddress = ":8080"
 	}
+	if cfg.AccessLog.RetentionDays == 0 {
+		cfg.AccessLog.RetentionDays = 30
+	}
+	if cfg.AccountDeletion.GracePeriodDays == 0 {
+		cfg.AccountDeletion.GracePeriodDays = 7
+	}
+	if cfg.Fed.Driver == nil {
+		cfg.Fed.Driver, _ = NewFederationDriver("trivial")
+	}
 
 	//check for required values
 	if cfg.API.PublicURL == "" {
@@ -200,33 +265,83 @@ func ReadConfig(file io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if dbURL != nil {
+		err = checkDatabasePrivileges(db)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = cfg.Auth.Driver.Connect()
 	if err != nil {
 		return err
 	}
+	err = cfg.Fed.Driver.Connect()
+	if err != nil {
+		return err
+	}
 
-	issuerKey, err := getIssuerKey(cfg.Trust.IssuerKeyIn)
+	issuerKey, err := getPrivateKey(cfg.Trust.IssuerKeyIn, "trust.issuer_key")
 	if err != nil {
 		return err
 	}
+	auditKey := issuerKey
+	if cfg.Trust.AuditKeyIn != "" {
+		auditKey, err = getPrivateKey(cfg.Trust.AuditKeyIn, "trust.audit_key")
+		if err != nil {
+			return err
+		}
+	}
 	issuerCertPEM, err := getIssuerCertPEM(cfg.Trust.IssuerCertIn)
 	if err != nil {
 		return err
 	}
+	masterKeys, err := parseMasterKeys(cfg.Secrets.MasterKeys)
+	if err != nil {
+		return err
+	}
+	tokenBinding, err := parseTokenBinding(cfg.TokenBinding)
+	if err != nil {
+		return err
+	}
+	if cfg.Trust.RegistryTLS && len(masterKeys) == 0 {
+		return errors.New("trust.registry_tls requires secrets.master_keys (for storing the internal CA)")
+	}
 
 	State = &StateStruct{
 		Config: Configuration{
-			APIListenAddress: cfg.API.ListenAddress,
-			APIPublicURL:     *publicURL,
-			DatabaseURL:      dbURL,
+			APIListenAddress:           cfg.API.ListenAddress,
+			APIPublicURL:               *publicURL,
+			DatabaseURL:                dbURL,
+			AccessLogRetention:         time.Duration(cfg.AccessLog.RetentionDays) * 24 * time.Hour,
+			AccountDeletionGracePeriod: time.Duration(cfg.AccountDeletion.GracePeriodDays) * 24 * time.Hour,
+			TokenBinding:               tokenBinding,
 		},
 		DB:                  db,
 		AuthDriver:          cfg.Auth.Driver,
 		OrchestrationDriver: cfg.Orch.Driver,
 		StorageDriver:       cfg.Storage.Driver,
+		FederationDriver:    cfg.Fed.Driver,
 		JWTIssuerKey:        issuerKey,
 		JWTIssuerCertPEM:    issuerCertPEM,
+		AuditKey:            auditKey,
+		SecretMasterKeys:    masterKeys,
+	}
+
+	//this needs to happen after State has been filled, since the federation
+	//driver may need to know our own identity
+	err = ClaimExistingAccountNames()
+	if err != nil {
+		return err
+	}
+
+	//this needs to happen after State has been filled, since the internal CA is
+	//kept in the secret storage
+	if cfg.Trust.RegistryTLS {
+		State.InternalCA, err = loadInternalCA(db)
+		if err != nil {
+			return fmt.Errorf("cannot initialize internal CA for trust.registry_tls: %s", err.Error())
+		}
 	}
 	return nil
 }
@@ -237,9 +352,9 @@ var (
 	stripWhitespaceRx = regexp.MustCompile(`(?m)^\s*|\s*$`)
 )
 
-func getIssuerKey(in string) (libtrust.PrivateKey, error) {
+func getPrivateKey(in, configKey string) (libtrust.PrivateKey, error) {
 	if in == "" {
-		return nil, errors.New("missing trust.issuer_key")
+		return nil, errors.New("missing " + configKey)
 	}
 
 	//if it looks like PEM, it's probably PEM; otherwise it's a filename
@@ -257,7 +372,7 @@ func getIssuerKey(in string) (libtrust.PrivateKey, error) {
 
 	key, err := libtrust.UnmarshalPrivateKeyPEM(buf)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read trust.issuer_key: " + err.Error())
+		return nil, fmt.Errorf("failed to read " + configKey + ": " + err.Error())
 	}
 	return key, nil
 }
@@ -21,6 +21,8 @@ package keppel
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/url"
 
 	"github.com/sapcc/go-bits/logg"
@@ -38,6 +40,188 @@ var sqlMigrations = map[string]string{
 	"001_initial.down.sql": `
 		DROP TABLE accounts;
 	`,
+	"002_add_legal_holds.up.sql": `
+		CREATE TABLE legal_holds (
+			id           BIGSERIAL NOT NULL PRIMARY KEY,
+			account_name TEXT      NOT NULL REFERENCES accounts ON DELETE RESTRICT,
+			repo_name    TEXT      NOT NULL,
+			digest       TEXT      NOT NULL DEFAULT '',
+			reason       TEXT      NOT NULL,
+			reference    TEXT      NOT NULL,
+			created_at   TIMESTAMP NOT NULL
+		);
+	`,
+	"002_add_legal_holds.down.sql": `
+		DROP TABLE legal_holds;
+	`,
+	"003_add_policies.up.sql": `
+		ALTER TABLE accounts ADD COLUMN policies_json TEXT NOT NULL DEFAULT '{}';
+		CREATE TABLE tenant_defaults (
+			auth_tenant_id TEXT NOT NULL PRIMARY KEY,
+			policies_json  TEXT NOT NULL DEFAULT '{}'
+		);
+	`,
+	"003_add_policies.down.sql": `
+		DROP TABLE tenant_defaults;
+		ALTER TABLE accounts DROP COLUMN policies_json;
+	`,
+	"004_add_audit_events.up.sql": `
+		CREATE TABLE audit_events (
+			id           BIGSERIAL NOT NULL PRIMARY KEY,
+			account_name TEXT      NOT NULL,
+			action       TEXT      NOT NULL,
+			user_name    TEXT      NOT NULL,
+			repo_name    TEXT      NOT NULL DEFAULT '',
+			digest       TEXT      NOT NULL DEFAULT '',
+			details      TEXT      NOT NULL DEFAULT '',
+			created_at   TIMESTAMP NOT NULL
+		);
+		CREATE INDEX audit_events_account_name_idx ON audit_events (account_name);
+	`,
+	"004_add_audit_events.down.sql": `
+		DROP TABLE audit_events;
+	`,
+	"005_add_secrets.up.sql": `
+		CREATE TABLE secrets (
+			name          TEXT      NOT NULL PRIMARY KEY,
+			master_key_id TEXT      NOT NULL,
+			wrapped_key   TEXT      NOT NULL,
+			ciphertext    TEXT      NOT NULL,
+			updated_at    TIMESTAMP NOT NULL
+		);
+	`,
+	"005_add_secrets.down.sql": `
+		DROP TABLE secrets;
+	`,
+	"006_add_sboms.up.sql": `
+		CREATE TABLE sboms (
+			account_name TEXT      NOT NULL REFERENCES accounts ON DELETE CASCADE,
+			repo_name    TEXT      NOT NULL,
+			digest       TEXT      NOT NULL,
+			status       TEXT      NOT NULL,
+			message      TEXT      NOT NULL DEFAULT '',
+			contents     TEXT      NOT NULL DEFAULT '',
+			updated_at   TIMESTAMP NOT NULL,
+			PRIMARY KEY (account_name, repo_name, digest)
+		);
+	`,
+	"006_add_sboms.down.sql": `
+		DROP TABLE sboms;
+	`,
+	"007_add_access_log.up.sql": `
+		CREATE TABLE access_log_entries (
+			id           BIGSERIAL NOT NULL PRIMARY KEY,
+			account_name TEXT      NOT NULL REFERENCES accounts ON DELETE CASCADE,
+			created_at   TIMESTAMP NOT NULL,
+			user_name    TEXT      NOT NULL,
+			source_ip    TEXT      NOT NULL,
+			method       TEXT      NOT NULL,
+			repo_name    TEXT      NOT NULL,
+			digest       TEXT      NOT NULL DEFAULT '',
+			status_code  INTEGER   NOT NULL,
+			bytes        BIGINT    NOT NULL
+		);
+		CREATE INDEX access_log_entries_account_name_created_at_idx ON access_log_entries (account_name, created_at);
+	`,
+	"007_add_access_log.down.sql": `
+		DROP TABLE access_log_entries;
+	`,
+	"008_add_personal_access_tokens.up.sql": `
+		CREATE TABLE personal_access_tokens (
+			id            BIGSERIAL NOT NULL PRIMARY KEY,
+			user_name     TEXT      NOT NULL,
+			user_identity TEXT      NOT NULL,
+			description   TEXT      NOT NULL DEFAULT '',
+			permissions   TEXT      NOT NULL,
+			account_name  TEXT      DEFAULT NULL REFERENCES accounts ON DELETE CASCADE,
+			secret_hash   TEXT      NOT NULL UNIQUE,
+			created_at    TIMESTAMP NOT NULL,
+			expires_at    TIMESTAMP DEFAULT NULL,
+			last_used_at  TIMESTAMP DEFAULT NULL
+		);
+		CREATE INDEX personal_access_tokens_user_identity_idx ON personal_access_tokens (user_identity);
+	`,
+	"008_add_personal_access_tokens.down.sql": `
+		DROP TABLE personal_access_tokens;
+	`,
+	"009_add_audit_hash_chain.up.sql": `
+		ALTER TABLE audit_events ADD COLUMN sequence BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE audit_events ADD COLUMN prev_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE audit_events ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+		CREATE UNIQUE INDEX audit_events_account_name_sequence_idx ON audit_events (account_name, sequence) WHERE sequence > 0;
+		CREATE TABLE audit_checkpoints (
+			id           BIGSERIAL NOT NULL PRIMARY KEY,
+			account_name TEXT      NOT NULL,
+			sequence     BIGINT    NOT NULL,
+			hash         TEXT      NOT NULL,
+			algorithm    TEXT      NOT NULL,
+			signature    TEXT      NOT NULL,
+			created_at   TIMESTAMP NOT NULL
+		);
+		CREATE INDEX audit_checkpoints_account_name_idx ON audit_checkpoints (account_name);
+	`,
+	"009_add_audit_hash_chain.down.sql": `
+		DROP TABLE audit_checkpoints;
+		DROP INDEX audit_events_account_name_sequence_idx;
+		ALTER TABLE audit_events DROP COLUMN hash;
+		ALTER TABLE audit_events DROP COLUMN prev_hash;
+		ALTER TABLE audit_events DROP COLUMN sequence;
+	`,
+	"010_add_accounts_read_only.up.sql": `
+		ALTER TABLE accounts ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"010_add_accounts_read_only.down.sql": `
+		ALTER TABLE accounts DROP COLUMN read_only;
+	`,
+	"011_add_accounts_expires_at.up.sql": `
+		ALTER TABLE accounts ADD COLUMN expires_at TIMESTAMP DEFAULT NULL;
+		ALTER TABLE accounts ADD COLUMN expiry_warning_sent BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"011_add_accounts_expires_at.down.sql": `
+		ALTER TABLE accounts DROP COLUMN expiry_warning_sent;
+		ALTER TABLE accounts DROP COLUMN expires_at;
+	`,
+	"012_add_accounts_deleted_at.up.sql": `
+		ALTER TABLE accounts ADD COLUMN deleted_at TIMESTAMP DEFAULT NULL;
+	`,
+	"012_add_accounts_deleted_at.down.sql": `
+		ALTER TABLE accounts DROP COLUMN deleted_at;
+	`,
+	"013_add_tag_snapshots.up.sql": `
+		CREATE TABLE tag_snapshots (
+			account_name TEXT      NOT NULL REFERENCES accounts ON DELETE CASCADE,
+			name         TEXT      NOT NULL,
+			user_name    TEXT      NOT NULL,
+			created_at   TIMESTAMP NOT NULL,
+			PRIMARY KEY (account_name, name)
+		);
+		CREATE TABLE tag_snapshot_entries (
+			account_name  TEXT NOT NULL,
+			snapshot_name TEXT NOT NULL,
+			repo_name     TEXT NOT NULL,
+			tag_name      TEXT NOT NULL,
+			digest        TEXT NOT NULL,
+			PRIMARY KEY (account_name, snapshot_name, repo_name, tag_name),
+			FOREIGN KEY (account_name, snapshot_name) REFERENCES tag_snapshots ON DELETE CASCADE
+		);
+		CREATE INDEX tag_snapshot_entries_digest_idx ON tag_snapshot_entries (account_name, repo_name, digest);
+	`,
+	"013_add_tag_snapshots.down.sql": `
+		DROP TABLE tag_snapshot_entries;
+		DROP TABLE tag_snapshots;
+	`,
+	"014_add_manifest_pushes.up.sql": `
+		CREATE TABLE manifest_pushes (
+			account_name TEXT      NOT NULL REFERENCES accounts ON DELETE CASCADE,
+			repo_name    TEXT      NOT NULL,
+			digest       TEXT      NOT NULL,
+			pushed_at    TIMESTAMP NOT NULL,
+			PRIMARY KEY (account_name, repo_name, digest)
+		);
+	`,
+	"014_add_manifest_pushes.down.sql": `
+		DROP TABLE manifest_pushes;
+	`,
 }
 
 //DB adds convenience functions on top of gorp.DbMap.
@@ -62,6 +246,23 @@ func initDB(dbURL *url.URL) (*DB, error) {
 	return result, nil
 }
 
+//checkDatabasePrivileges checks that keppel-api's database user may create
+//and drop databases. keppel-api and keppel-registry keep the metadata of each
+//account in a separate database (see Account.PostgresDatabaseName) on the same
+//Postgres server as keppel-api's own database, and keppel-api drops this
+//database when the account is deleted.
+func checkDatabasePrivileges(db *DB) error {
+	count, err := db.SelectInt(
+		`SELECT COUNT(*) FROM pg_roles WHERE rolname = current_user AND (rolsuper OR rolcreatedb)`)
+	if err != nil {
+		return fmt.Errorf("cannot check privileges of database user: %s", err.Error())
+	}
+	if count == 0 {
+		return errors.New("the database user in db.url needs the CREATEDB privilege to manage the metadata databases of accounts")
+	}
+	return nil
+}
+
 //RollbackUnlessCommitted calls Rollback() on a transaction if it hasn't been
 //committed or rolled back yet. Use this with the defer keyword to make sure
 //that a transaction is automatically rolled back when a function fails.
@@ -0,0 +1,30 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import "time"
+
+//ExpireClientCertificate allows the tests in package keppel_test to simulate
+//that keppel-api's client certificate is about to expire.
+func (ca *InternalCA) ExpireClientCertificate() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.clientCertNotAfter = time.Now()
+}
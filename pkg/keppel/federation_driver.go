@@ -0,0 +1,139 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//FederationDriver is the abstract interface for a mechanism that coordinates
+//account names between multiple keppel-api instances (e.g. in different
+//regions), so that an account name can only be used by the same tenant
+//everywhere. This is a prerequisite for replicating accounts between regions.
+type FederationDriver interface {
+	//ReadConfig unmarshals the configuration for this driver type into this
+	//driver instance. The `unmarshal` function works exactly like in
+	//UnmarshalYAML. This method shall only fail if the input data is malformed.
+	//It shall not make any network requests; use Connect for that.
+	ReadConfig(unmarshal func(interface{}) error) error
+	//Connect prepares this driver instance for usage. This is called *after*
+	//ReadConfig and *before* any other methods are called.
+	Connect() error
+	//ClaimAccountName is called before an account is created. It reserves the
+	//account name for the account's tenant across all peers. If the name is
+	//already claimed by a different tenant, ErrAccountNameClaimed shall be
+	//returned. Claiming a name that is already claimed by the same tenant
+	//(e.g. by a peer that holds a replica of the account) shall succeed.
+	ClaimAccountName(account Account) error
+	//ForfeitAccountName is called after an account has been deleted (or when
+	//its creation failed after the name was claimed). It releases this
+	//instance's claim on the name. Once all peers holding the name have
+	//forfeited it, the name can be claimed by a different tenant.
+	ForfeitAccountName(account Account) error
+}
+
+//Error types used by FederationDriver.
+var (
+	ErrAccountNameClaimed = errors.New("account name already in use by a different tenant")
+)
+
+//ClaimExistingAccountNames claims the names of all existing accounts with
+//State.FederationDriver. This runs on startup, so that accounts that were
+//created before the federation driver was configured are protected as well.
+//If any name is already claimed by a different tenant, an error is returned,
+//since this conflict needs to be resolved by an operator.
+func ClaimExistingAccountNames() error {
+	var accounts []Account
+	_, err := State.DB.Select(&accounts, `SELECT * FROM accounts ORDER BY name`)
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+	for _, account := range accounts {
+		err := State.FederationDriver.ClaimAccountName(account)
+		switch err {
+		case nil:
+			continue
+		case ErrAccountNameClaimed:
+			conflicts = append(conflicts, account.Name)
+		default:
+			return fmt.Errorf("cannot claim name of account %s: %s", account.Name, err.Error())
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("names of existing accounts are claimed by a different tenant in the federation: %s",
+			strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+var federationDriverFactories = make(map[string]func() FederationDriver)
+
+//NewFederationDriver creates a new FederationDriver using one of the factory
+//functions registered with RegisterFederationDriver().
+func NewFederationDriver(name string) (FederationDriver, error) {
+	factory := federationDriverFactories[name]
+	if factory != nil {
+		return factory(), nil
+	}
+	return nil, errors.New("no such federation driver: " + name)
+}
+
+//RegisterFederationDriver registers a FederationDriver. Call this from func
+//init() of the package defining the FederationDriver.
+func RegisterFederationDriver(name string, factory func() FederationDriver) {
+	if _, exists := federationDriverFactories[name]; exists {
+		panic("attempted to register multiple federation drivers with name = " + name)
+	}
+	federationDriverFactories[name] = factory
+}
+
+//trivialFederationDriver (driver ID "trivial") is the default
+//FederationDriver. It is suitable for keppel-api instances that do not
+//coordinate with any peers: All claims succeed, since the accounts table
+//already ensures that an account name is only used once.
+type trivialFederationDriver struct{}
+
+func init() {
+	RegisterFederationDriver("trivial", func() FederationDriver { return trivialFederationDriver{} })
+}
+
+//ReadConfig implements the FederationDriver interface.
+func (trivialFederationDriver) ReadConfig(unmarshal func(interface{}) error) error {
+	return nil
+}
+
+//Connect implements the FederationDriver interface.
+func (trivialFederationDriver) Connect() error {
+	return nil
+}
+
+//ClaimAccountName implements the FederationDriver interface.
+func (trivialFederationDriver) ClaimAccountName(account Account) error {
+	return nil
+}
+
+//ForfeitAccountName implements the FederationDriver interface.
+func (trivialFederationDriver) ForfeitAccountName(account Account) error {
+	return nil
+}
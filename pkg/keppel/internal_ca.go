@@ -0,0 +1,303 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//The name of the secret that holds the certificate and private key of the
+//internal CA.
+const internalCASecretName = "internal-ca"
+
+const (
+	internalCAValidity = 10 * 365 * 24 * time.Hour
+	//IssuedCertificateValidity is how long the certificates issued by the
+	//InternalCA are valid.
+	IssuedCertificateValidity = 365 * 24 * time.Hour
+	//certificates are renewed this long before they expire (see
+	//CertificateNeedsRenewal)
+	certificateRenewalPeriod = 30 * 24 * time.Hour
+	registryServerDomain     = "registry.keppel.internal"
+)
+
+//InternalCA is the certificate authority that keppel-api uses to secure the
+//connections to keppel-registry processes with mutual TLS. Each
+//keppel-registry gets a server certificate for its account, and only accepts
+//connections from clients with a certificate from this CA.
+//
+//The CA is created on first use and stored in the secret storage, so that it
+//stays the same across restarts of keppel-api.
+type InternalCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+
+	mutex sync.Mutex
+	//the client certificate that keppel-api presents to keppel-registry (see
+	//clientCertificate())
+	clientCert         tls.Certificate
+	clientCertNotAfter time.Time
+	//key = account name
+	transports map[string]*http.Transport
+}
+
+//IssuedCertificate is a certificate and private key issued by the InternalCA.
+type IssuedCertificate struct {
+	CertPEM  string
+	KeyPEM   Secret
+	NotAfter time.Time
+}
+
+//CertificateNeedsRenewal returns whether a certificate issued by the
+//InternalCA that expires at the given time shall be replaced by a new one.
+func CertificateNeedsRenewal(notAfter time.Time) bool {
+	return time.Until(notAfter) < certificateRenewalPeriod
+}
+
+//RegistryServerName returns the DNS name that appears in the server
+//certificate of the keppel-registry for the given account. This name does not
+//need to resolve; keppel-api only uses it to verify the registry's identity.
+func RegistryServerName(accountName string) string {
+	return accountName + "." + registryServerDomain
+}
+
+//loadInternalCA restores the internal CA from the secret storage, or creates
+//it if it does not exist yet.
+func loadInternalCA(db *DB) (*InternalCA, error) {
+	stored, err := db.LoadSecret(internalCASecretName)
+	if err != nil {
+		return nil, err
+	}
+
+	if stored == nil {
+		//when multiple keppel-api instances start at the same time, only the CA
+		//generated by the first one is stored, and all of them use that one
+		var generated InternalCA
+		err = generated.generate()
+		if err == nil {
+			err = db.StoreSecretUnlessExists(internalCASecretName, generated.marshal())
+		}
+		if err == nil {
+			stored, err = db.LoadSecret(internalCASecretName)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ca := &InternalCA{transports: make(map[string]*http.Transport)}
+	err = ca.unmarshal(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	//issue the first client certificate right away to fail early on problems
+	_, err = ca.clientCertificate()
+	return ca, err
+}
+
+//clientCertificate returns the client certificate that keppel-api presents to
+//keppel-registry. A new certificate is issued when the previous one is about
+//to expire.
+func (ca *InternalCA) clientCertificate() (*tls.Certificate, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if !CertificateNeedsRenewal(ca.clientCertNotAfter) {
+		return &ca.clientCert, nil
+	}
+
+	issued, err := ca.IssueClientCertificate("keppel-api")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(issued.CertPEM), issued.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	ca.clientCert = cert
+	ca.clientCertNotAfter = issued.NotAfter
+	return &ca.clientCert, nil
+}
+
+func (ca *InternalCA) generate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "keppel internal CA"},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(internalCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	ca.cert, err = x509.ParseCertificate(der)
+	ca.key = key
+	ca.certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return err
+}
+
+//marshal serializes the CA certificate and key for the secret storage.
+func (ca *InternalCA) marshal() Secret {
+	keyDER, _ := x509.MarshalECPrivateKey(ca.key) //cannot fail for P-256 keys
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return Secret(ca.certPEM + string(keyPEM))
+}
+
+//unmarshal reverses marshal.
+func (ca *InternalCA) unmarshal(buf Secret) error {
+	certBlock, rest := pem.Decode(buf)
+	if certBlock == nil {
+		return errors.New("cannot parse internal CA: missing certificate")
+	}
+	keyBlock, _ := pem.Decode(rest)
+	if keyBlock == nil {
+		return errors.New("cannot parse internal CA: missing private key")
+	}
+
+	var err error
+	ca.cert, err = x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	ca.key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	ca.certPEM = string(pem.EncodeToMemory(certBlock))
+	return nil
+}
+
+//CertPEM returns the CA certificate in PEM format. This is what
+//keppel-registry uses to verify client certificates.
+func (ca *InternalCA) CertPEM() string {
+	return ca.certPEM
+}
+
+//IssueRegistryCertificate issues a server certificate for the
+//keppel-registry of the given account.
+func (ca *InternalCA) IssueRegistryCertificate(accountName string) (IssuedCertificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: RegistryServerName(accountName)},
+		DNSNames:    []string{RegistryServerName(accountName)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+//IssueClientCertificate issues a client certificate that is accepted by all
+//keppel-registry processes. Only keppel-api itself, and the keppel-agents
+//that forward its requests, shall receive such a certificate.
+func (ca *InternalCA) IssueClientCertificate(commonName string) (IssuedCertificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func (ca *InternalCA) issue(tmpl *x509.Certificate) (IssuedCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	tmpl.SerialNumber, err = randomSerialNumber()
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	now := time.Now()
+	tmpl.NotBefore = now.Add(-5 * time.Minute)
+	//certificates store timestamps with second precision only
+	tmpl.NotAfter = now.Add(IssuedCertificateValidity).UTC().Truncate(time.Second)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	return IssuedCertificate{
+		CertPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:   Secret(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		NotAfter: tmpl.NotAfter,
+	}, nil
+}
+
+//Transport returns a http.RoundTripper for requests to the keppel-registry of
+//the given account. It presents keppel-api's client certificate (which is
+//renewed automatically), and only accepts the server certificate issued for
+//this account.
+func (ca *InternalCA) Transport(accountName string) http.RoundTripper {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	t, exists := ca.transports[accountName]
+	if !exists {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		//same settings as http.DefaultTransport, except for TLS
+		d := http.DefaultTransport.(*http.Transport)
+		t = &http.Transport{
+			Proxy:                 d.Proxy,
+			DialContext:           d.DialContext,
+			MaxIdleConns:          d.MaxIdleConns,
+			IdleConnTimeout:       d.IdleConnTimeout,
+			TLSHandshakeTimeout:   d.TLSHandshakeTimeout,
+			ExpectContinueTimeout: d.ExpectContinueTimeout,
+			TLSClientConfig: &tls.Config{
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return ca.clientCertificate()
+				},
+				RootCAs:    pool,
+				ServerName: RegistryServerName(accountName),
+			},
+		}
+		ca.transports[accountName] = t
+	}
+	return t
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
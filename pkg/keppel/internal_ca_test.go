@@ -0,0 +1,141 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestInternalCA(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+		secrets:
+			master_keys:
+				- { id: first, key: 'MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=' }
+		trust:
+			registry_tls: true
+	`)
+	ca := keppel.State.InternalCA
+	if ca == nil {
+		t.Fatal("internal CA was not initialized")
+	}
+
+	//the CA is kept in the secret storage
+	stored, err := keppel.State.DB.LoadSecret("internal-ca")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(stored) == 0 {
+		t.Error("internal CA was not stored in the secret storage")
+	}
+
+	//simulate a keppel-registry for account "first" that requires client
+	//certificates from the internal CA
+	serverCert, err := ca.IssueRegistryCertificate("first")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyPair, err := tls.X509KeyPair([]byte(serverCert.CertPEM), serverCert.KeyPEM)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(ca.CertPEM()))
+	var lastClientCert *x509.Certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastClientCert = r.TLS.PeerCertificates[0]
+		//force a new TLS handshake for each request
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	expectSuccess := func(client *http.Client, desc string) {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Errorf("expected %s to succeed, but got error: %s", desc, err.Error())
+			return
+		}
+		resp.Body.Close()
+	}
+	expectFailure := func(client *http.Client, desc string) {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("expected %s to fail, but it succeeded", desc)
+		}
+	}
+
+	//keppel-api can talk to the registry of the right account
+	client := &http.Client{Transport: ca.Transport("first")}
+	expectSuccess(client, "request with keppel-api's client certificate")
+	firstClientCert := lastClientCert
+
+	//keppel-api's client certificate is renewed before it expires
+	expectSuccess(client, "request with keppel-api's client certificate")
+	if lastClientCert == nil || !lastClientCert.Equal(firstClientCert) {
+		t.Error("expected client certificate to be reused while it is still valid")
+	}
+	ca.ExpireClientCertificate()
+	expectSuccess(client, "request with keppel-api's renewed client certificate")
+	if lastClientCert == nil || lastClientCert.Equal(firstClientCert) {
+		t.Error("expected client certificate to be renewed before it expires")
+	} else if keppel.CertificateNeedsRenewal(lastClientCert.NotAfter) {
+		t.Errorf("expected renewed client certificate to be valid for a long time, but it expires at %s", lastClientCert.NotAfter)
+	}
+
+	//keppel-api does not accept the certificate of a different account's registry
+	expectFailure(&http.Client{Transport: ca.Transport("second")}, "request with mismatching server name")
+
+	//the registry does not accept clients without a certificate from the internal CA
+	expectFailure(&http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    pool,
+			ServerName: keppel.RegistryServerName("first"),
+		},
+	}}, "request without client certificate")
+
+	//server certificates cannot be used as client certificates
+	expectFailure(&http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{keyPair},
+			RootCAs:      pool,
+			ServerName:   keppel.RegistryServerName("first"),
+		},
+	}}, "request with a registry certificate as client certificate")
+}
@@ -0,0 +1,53 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import "time"
+
+//RecordManifestPush records that the given manifest was pushed at the given
+//time. When a manifest is pushed multiple times, the latest push counts.
+//`repoName` is the repository name without the leading account name.
+func (db *DB) RecordManifestPush(accountName, repoName, digest string, pushedAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO manifest_pushes (account_name, repo_name, digest, pushed_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (account_name, repo_name, digest) DO UPDATE SET pushed_at = EXCLUDED.pushed_at
+	`, accountName, repoName, digest, pushedAt.UTC())
+	return err
+}
+
+//GetManifestPushTime returns when the given manifest was last pushed. For
+//manifests that were pushed before push times were recorded, `now` is
+//recorded and returned, so that their push time is approximated by the first
+//time that this function is called for them. `repoName` is the repository
+//name without the leading account name.
+func (db *DB) GetManifestPushTime(accountName, repoName, digest string, now time.Time) (time.Time, error) {
+	_, err := db.Exec(`
+		INSERT INTO manifest_pushes (account_name, repo_name, digest, pushed_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (account_name, repo_name, digest) DO NOTHING
+	`, accountName, repoName, digest, now.UTC())
+	if err != nil {
+		return time.Time{}, err
+	}
+	var pushedAt time.Time
+	err = db.QueryRow(
+		`SELECT pushed_at FROM manifest_pushes WHERE account_name = $1 AND repo_name = $2 AND digest = $3`,
+		accountName, repoName, digest).Scan(&pushedAt)
+	return pushedAt, err
+}
@@ -22,6 +22,7 @@ package keppel
 import (
 	"database/sql"
 	"strings"
+	"time"
 
 	gorp "gopkg.in/gorp.v2"
 )
@@ -30,6 +31,33 @@ import (
 type Account struct {
 	Name         string `db:"name" json:"name"`
 	AuthTenantID string `db:"auth_tenant_id" json:"auth_tenant_id"`
+	//see type AccountPolicies
+	PoliciesJSON string `db:"policies_json" json:"-"`
+	//ReadOnly is set while writes to this account are suspended, e.g. while a
+	//backup is being taken.
+	ReadOnly bool `db:"read_only" json:"read_only"`
+	//ExpiresAt is set for ephemeral accounts. Once it has passed, the account
+	//cannot be used anymore, and it is deleted by the account expiry task.
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	//ExpiryWarningSent is set once the account expiry task has recorded an
+	//audit event to warn about the upcoming expiry.
+	ExpiryWarningSent bool `db:"expiry_warning_sent" json:"-"`
+	//DeletedAt is set while the account is pending deletion. Until the grace
+	//period has passed, the deletion can be reverted.
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+}
+
+//IsExpired returns whether this is an ephemeral account whose lifetime has
+//ended at the given time.
+func (a Account) IsExpired(now time.Time) bool {
+	return a.ExpiresAt != nil && !now.Before(*a.ExpiresAt)
+}
+
+//IsUsable returns false if the account has expired or is pending deletion at
+//the given time. The keppel-registry of an account that is not usable shall
+//not be running.
+func (a Account) IsUsable(now time.Time) bool {
+	return a.DeletedAt == nil && !a.IsExpired(now)
 }
 
 //SwiftContainerName returns the name of the Swift container backing this
@@ -39,7 +67,8 @@ func (a Account) SwiftContainerName() string {
 }
 
 //PostgresDatabaseName returns the name of the Postgres database which contains this
-//Keppel account's metadata.
+//Keppel account's metadata. This database lives on the same Postgres server as
+//keppel-api's own database.
 func (a Account) PostgresDatabaseName() string {
 	return "keppel_" + strings.Replace(a.Name, "-", "_", -1)
 }
@@ -56,6 +85,64 @@ func (db *DB) FindAccount(name string) (*Account, error) {
 	return &account, err
 }
 
+//SetAccountReadOnly sets or clears the read-only flag of the given account.
+//Returns whether the flag was changed, i.e. false if it already had the
+//requested value.
+func (db *DB) SetAccountReadOnly(name string, readOnly bool) (bool, error) {
+	result, err := db.Exec(
+		`UPDATE accounts SET read_only = $1 WHERE name = $2 AND read_only = $3`,
+		readOnly, name, !readOnly)
+	if err != nil {
+		return false, err
+	}
+	rowCount, err := result.RowsAffected()
+	return rowCount > 0, err
+}
+
+//LegalHold contains a record from the `legal_holds` table. A legal hold
+//protects either a single manifest (if Digest is set) or all manifests in a
+//repository (if Digest is empty) from being deleted.
+type LegalHold struct {
+	ID          int64     `db:"id" json:"id"`
+	AccountName string    `db:"account_name" json:"account"`
+	RepoName    string    `db:"repo_name" json:"repository"`
+	Digest      string    `db:"digest" json:"digest,omitempty"`
+	Reason      string    `db:"reason" json:"reason"`
+	Reference   string    `db:"reference" json:"reference"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+//IsManifestHeld returns whether a legal hold prevents the deletion of the
+//given manifest. `repoName` is the repository name without the leading
+//account name.
+func (db *DB) IsManifestHeld(accountName, repoName, digest string) (bool, error) {
+	count, err := db.SelectInt(`
+		SELECT COUNT(*) FROM legal_holds
+		 WHERE account_name = $1 AND repo_name = $2 AND (digest = '' OR digest = $3)`,
+		accountName, repoName, digest)
+	return count > 0, err
+}
+
+//IsRepositoryHeld returns whether any legal hold exists for any manifest in
+//the given repository. `repoName` is the repository name without the leading
+//account name.
+func (db *DB) IsRepositoryHeld(accountName, repoName string) (bool, error) {
+	count, err := db.SelectInt(`
+		SELECT COUNT(*) FROM legal_holds WHERE account_name = $1 AND repo_name = $2`,
+		accountName, repoName)
+	return count > 0, err
+}
+
 func initModels(db *gorp.DbMap) {
 	db.AddTableWithName(Account{}, "accounts").SetKeys(false, "name")
+	db.AddTableWithName(LegalHold{}, "legal_holds").SetKeys(true, "id")
+	db.AddTableWithName(TenantDefaults{}, "tenant_defaults").SetKeys(false, "auth_tenant_id")
+	db.AddTableWithName(AuditEvent{}, "audit_events").SetKeys(true, "id")
+	db.AddTableWithName(AuditCheckpoint{}, "audit_checkpoints").SetKeys(true, "id")
+	db.AddTableWithName(StoredSecret{}, "secrets").SetKeys(false, "name")
+	db.AddTableWithName(AccessLogEntry{}, "access_log_entries").SetKeys(true, "id")
+	db.AddTableWithName(SBOM{}, "sboms").SetKeys(false, "account_name", "repo_name", "digest")
+	db.AddTableWithName(PersonalAccessToken{}, "personal_access_tokens").SetKeys(true, "id")
+	db.AddTableWithName(TagSnapshot{}, "tag_snapshots").SetKeys(false, "account_name", "name")
+	db.AddTableWithName(TagSnapshotEntry{}, "tag_snapshot_entries").SetKeys(false, "account_name", "snapshot_name", "repo_name", "tag_name")
 }
@@ -44,6 +44,26 @@ type OrchestrationDriver interface {
 	Run(ctx context.Context) (ok bool)
 }
 
+//RollingUpgradeTrigger is an optional interface for OrchestrationDriver
+//implementations that can replace running keppel-registry processes without
+//downtime, e.g. after the keppel-registry executable has been updated.
+type RollingUpgradeTrigger interface {
+	//TriggerRollingUpgrade starts replacing all keppel-registry processes, one
+	//account at a time. It shall not block until the upgrade is complete.
+	TriggerRollingUpgrade() error
+}
+
+//RegistryStopper is an optional interface for OrchestrationDriver
+//implementations that can stop the keppel-registry for an account on request,
+//e.g. before the account is deleted.
+type RegistryStopper interface {
+	//StopRegistry stops the keppel-registry for the given account if it is
+	//running. If possible, it should block until the process has exited. The
+	//caller must ensure that no further requests for this account are made,
+	//since those would start the keppel-registry again.
+	StopRegistry(account Account) error
+}
+
 var orchestrationDriverFactories = make(map[string]func() OrchestrationDriver)
 
 //NewOrchestrationDriver creates a new OrchestrationDriver using one of the
@@ -0,0 +1,145 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+//PersonalAccessTokenPrefix is the prefix of all personal access tokens. It
+//allows the auth API to recognize them when they are given as a password.
+const PersonalAccessTokenPrefix = "keppel_pat_"
+
+//PersonalAccessTokenPermissions are the permissions that can be granted to
+//personal access tokens. "pull" grants the user's CanViewAccount and
+//CanPullFromAccount permissions, "push" grants the user's CanPushToAccount and
+//CanChangeAccount permissions.
+var PersonalAccessTokenPermissions = []string{"pull", "push"}
+
+//PersonalAccessToken contains a record from the `personal_access_tokens`
+//table. A personal access token can be used instead of the user's password
+//when requesting tokens from the auth API. It grants a subset of the
+//permissions that the user has at the time when it is used.
+type PersonalAccessToken struct {
+	ID int64 `db:"id"`
+	//UserName and UserIdentity are as returned by AuthDriver.UserIdentity.
+	UserName     string `db:"user_name"`
+	UserIdentity string `db:"user_identity"`
+	Description  string `db:"description"`
+	//Permissions is a comma-separated list of elements from
+	//PersonalAccessTokenPermissions.
+	Permissions string `db:"permissions"`
+	//AccountName is nil if the token is not restricted to a single account.
+	AccountName *string `db:"account_name"`
+	//SecretHash is the SHA-256 hash of the token in hex encoding. The token
+	//itself is only shown to the user once, when the token is created.
+	SecretHash string     `db:"secret_hash"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+//GeneratePersonalAccessToken generates a new random token, and returns the
+//token as well as its hash for PersonalAccessToken.SecretHash.
+func GeneratePersonalAccessToken() (secret, secretHash string, err error) {
+	buf := make([]byte, 32)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", "", err
+	}
+	secret = PersonalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return secret, hashPersonalAccessToken(secret), nil
+}
+
+func hashPersonalAccessToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+//FindPersonalAccessToken finds the personal access token that was generated
+//with the given secret. If there is none, nil is returned.
+func (db *DB) FindPersonalAccessToken(secret string) (*PersonalAccessToken, error) {
+	var pat PersonalAccessToken
+	err := db.SelectOne(&pat, `SELECT * FROM personal_access_tokens WHERE secret_hash = $1`,
+		hashPersonalAccessToken(secret))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &pat, err
+}
+
+//IsExpired checks whether this token has expired at the given time.
+func (pat PersonalAccessToken) IsExpired(now time.Time) bool {
+	return pat.ExpiresAt != nil && !now.Before(*pat.ExpiresAt)
+}
+
+//PermissionList returns the Permissions field as a list.
+func (pat PersonalAccessToken) PermissionList() []string {
+	if pat.Permissions == "" {
+		return []string{}
+	}
+	return strings.Split(pat.Permissions, ",")
+}
+
+//Restrict returns an Authorization that grants the permissions from the given
+//Authorization only as far as they are granted by this token.
+func (pat PersonalAccessToken) Restrict(an Authorization) Authorization {
+	result := restrictedAuthorization{inner: an}
+	for _, perm := range pat.PermissionList() {
+		switch perm {
+		case "pull":
+			result.canPull = true
+		case "push":
+			result.canPush = true
+		}
+	}
+	return result
+}
+
+type restrictedAuthorization struct {
+	inner   Authorization
+	canPull bool
+	canPush bool
+}
+
+//HasPermission implements the Authorization interface.
+func (a restrictedAuthorization) HasPermission(perm Permission, tenantID string) bool {
+	switch perm {
+	case CanViewAccount, CanPullFromAccount:
+		if !a.canPull {
+			return false
+		}
+	case CanPushToAccount, CanChangeAccount:
+		if !a.canPush {
+			return false
+		}
+	default:
+		//in particular, CanAdministrateKeppel is never granted to personal access
+		//tokens
+		return false
+	}
+	return a.inner.HasPermission(perm, tenantID)
+}
@@ -0,0 +1,159 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+//AccountPolicies contains the policy settings for an account. Each field is a
+//pointer: nil means that the setting is not set explicitly, in which case the
+//tenant's default applies (or, if the tenant has no default for it, the value
+//from BuiltinPolicyDefaults).
+//
+//The same type is used for the tenant defaults, and for the effective
+//policies of an account (where all fields are non-nil).
+type AccountPolicies struct {
+	//If true, existing tags cannot be overwritten, and manifests cannot be
+	//deleted.
+	ImmutableTags *bool `json:"immutable_tags,omitempty" yaml:"immutable_tags,omitempty"`
+	//A regex (without the leading ^ and trailing $ anchors) for tag names that
+	//cannot be overwritten, and whose images are not deleted by image expiry.
+	//The empty string matches no tags.
+	ProtectedTags *string `json:"protected_tags,omitempty" yaml:"protected_tags,omitempty"`
+}
+
+func boolPtr(val bool) *bool {
+	return &val
+}
+
+func stringPtr(val string) *string {
+	return &val
+}
+
+//BuiltinPolicyDefaults contains the values that apply for all settings which
+//are neither set on the account nor on the tenant.
+var BuiltinPolicyDefaults = AccountPolicies{
+	ImmutableTags: boolPtr(false),
+	ProtectedTags: stringPtr(""),
+}
+
+//Merge returns a copy of `p` where all unset fields are filled with the
+//values from `defaults`.
+func (p AccountPolicies) Merge(defaults AccountPolicies) AccountPolicies {
+	if p.ImmutableTags == nil {
+		p.ImmutableTags = defaults.ImmutableTags
+	}
+	if p.ProtectedTags == nil {
+		p.ProtectedTags = defaults.ProtectedTags
+	}
+	return p
+}
+
+//Validate returns an error if any of the given settings is malformed.
+func (p AccountPolicies) Validate() error {
+	if p.ProtectedTags != nil {
+		_, err := regexp.Compile(*p.ProtectedTags)
+		if err != nil {
+			return fmt.Errorf("protected_tags: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+//IsProtectedTag returns whether the given tag name matches the ProtectedTags
+//setting. This may only be called on effective policies that were validated.
+func (p AccountPolicies) IsProtectedTag(tagName string) bool {
+	if p.ProtectedTags == nil || *p.ProtectedTags == "" {
+		return false
+	}
+	rx := regexp.MustCompile(`^(?:` + *p.ProtectedTags + `)$`)
+	return rx.MatchString(tagName)
+}
+
+//parsePoliciesJSON parses the contents of a `policies_json` column.
+func parsePoliciesJSON(in string) (AccountPolicies, error) {
+	var p AccountPolicies
+	if in == "" {
+		return p, nil
+	}
+	err := json.Unmarshal([]byte(in), &p)
+	return p, err
+}
+
+//ToJSON serializes these policies into the format used in the `policies_json`
+//columns.
+func (p AccountPolicies) ToJSON() string {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		//cannot happen since all fields are plain values
+		panic(err.Error())
+	}
+	return string(buf)
+}
+
+//TenantDefaults contains a record from the `tenant_defaults` table.
+type TenantDefaults struct {
+	AuthTenantID string `db:"auth_tenant_id"`
+	PoliciesJSON string `db:"policies_json"`
+}
+
+//Policies returns the default policies stored in this record.
+func (d TenantDefaults) Policies() (AccountPolicies, error) {
+	return parsePoliciesJSON(d.PoliciesJSON)
+}
+
+//ExplicitPolicies returns the policies that are set explicitly on this
+//account (i.e. not inherited from the tenant defaults).
+func (a Account) ExplicitPolicies() (AccountPolicies, error) {
+	return parsePoliciesJSON(a.PoliciesJSON)
+}
+
+//FindTenantDefaults returns the default policies for the given tenant. If no
+//defaults have been configured for it, an empty set of policies is returned.
+func (db *DB) FindTenantDefaults(authTenantID string) (AccountPolicies, error) {
+	var d TenantDefaults
+	err := db.SelectOne(&d,
+		"SELECT * FROM tenant_defaults WHERE auth_tenant_id = $1", authTenantID)
+	if err == sql.ErrNoRows {
+		return AccountPolicies{}, nil
+	}
+	if err != nil {
+		return AccountPolicies{}, err
+	}
+	return d.Policies()
+}
+
+//GetEffectivePolicies computes the policies that apply to the given account,
+//taking into account the defaults of its tenant.
+func (db *DB) GetEffectivePolicies(account Account) (AccountPolicies, error) {
+	explicit, err := account.ExplicitPolicies()
+	if err != nil {
+		return AccountPolicies{}, err
+	}
+	defaults, err := db.FindTenantDefaults(account.AuthTenantID)
+	if err != nil {
+		return AccountPolicies{}, err
+	}
+	return explicit.Merge(defaults).Merge(BuiltinPolicyDefaults), nil
+}
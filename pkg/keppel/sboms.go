@@ -0,0 +1,77 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"database/sql"
+	"time"
+)
+
+//SBOMStatus is the status of an SBOM record.
+type SBOMStatus string
+
+//Possible values for SBOMStatus.
+const (
+	SBOMPending SBOMStatus = "pending"
+	SBOMReady   SBOMStatus = "ready"
+	SBOMFailed  SBOMStatus = "failed"
+)
+
+//SBOM contains a record from the `sboms` table. A record is created with
+//status "pending" when a manifest is pushed, and the SBOM is then generated
+//asynchronously by keppel-api.
+type SBOM struct {
+	AccountName string     `db:"account_name"`
+	RepoName    string     `db:"repo_name"`
+	Digest      string     `db:"digest"`
+	Status      SBOMStatus `db:"status"`
+	//Message explains the failure when Status is SBOMFailed.
+	Message string `db:"message"`
+	//Contents is the SBOM in CycloneDX JSON format when Status is SBOMReady.
+	Contents  string    `db:"contents"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+//EnqueueSBOM requests the generation of an SBOM for the given manifest, unless
+//an SBOM has already been generated (or is being generated) for it. If a
+//previous generation failed, it is retried. `repoName` is the repository name
+//without the leading account name.
+func (db *DB) EnqueueSBOM(accountName, repoName, digest string) error {
+	_, err := db.Exec(`
+		INSERT INTO sboms (account_name, repo_name, digest, status, updated_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (account_name, repo_name, digest) DO UPDATE SET
+				status = EXCLUDED.status, message = '', updated_at = EXCLUDED.updated_at
+			WHERE sboms.status = $6
+	`, accountName, repoName, digest, SBOMPending, time.Now().UTC(), SBOMFailed)
+	return err
+}
+
+//FindSBOM returns the SBOM record for the given manifest, or nil if there is
+//none. `repoName` is the repository name without the leading account name.
+func (db *DB) FindSBOM(accountName, repoName, digest string) (*SBOM, error) {
+	var s SBOM
+	err := db.SelectOne(&s,
+		`SELECT * FROM sboms WHERE account_name = $1 AND repo_name = $2 AND digest = $3`,
+		accountName, repoName, digest)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &s, err
+}
@@ -0,0 +1,290 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//Secret is a byte string containing sensitive data like a password. It does
+//not reveal its contents when printed or serialized, so it cannot accidentally
+//end up in logs or API responses. To access the contents, convert it into a
+//[]byte or string explicitly.
+type Secret []byte
+
+const redacted = "<redacted>"
+
+//String implements the fmt.Stringer interface.
+func (s Secret) String() string {
+	return redacted
+}
+
+//GoString implements the fmt.GoStringer interface.
+func (s Secret) GoString() string {
+	return redacted
+}
+
+//MarshalJSON implements the json.Marshaler interface.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+//MarshalYAML implements the yaml.Marshaler interface.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return redacted, nil
+}
+
+//MasterKey is a key-encryption key for the secrets stored in the DB. Master
+//keys are configured in the "secrets" section of the configuration file.
+type MasterKey struct {
+	ID  string
+	Key Secret
+}
+
+//StoredSecret contains a record from the `secrets` table.
+//
+//Secrets are stored with envelope encryption: The payload is encrypted with a
+//random data key that is unique to this record, and the data key is in turn
+//encrypted ("wrapped") with a master key. Rotating the master key therefore
+//only requires re-wrapping the data keys (see RewrapSecrets).
+type StoredSecret struct {
+	Name        string    `db:"name"`
+	MasterKeyID string    `db:"master_key_id"`
+	WrappedKey  string    `db:"wrapped_key"` //base64-encoded
+	Ciphertext  string    `db:"ciphertext"`  //base64-encoded
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+//ErrNoMasterKeys is returned by the secret storage functions when no master
+//keys are configured.
+var ErrNoMasterKeys = errors.New("cannot store secrets: no master keys configured in secrets.master_keys")
+
+func activeMasterKey() (MasterKey, error) {
+	if len(State.SecretMasterKeys) == 0 {
+		return MasterKey{}, ErrNoMasterKeys
+	}
+	return State.SecretMasterKeys[0], nil
+}
+
+func findMasterKey(id string) (MasterKey, error) {
+	for _, mk := range State.SecretMasterKeys {
+		if mk.ID == id {
+			return mk, nil
+		}
+	}
+	return MasterKey{}, fmt.Errorf("master key %q is not configured in secrets.master_keys", id)
+}
+
+//StoreSecret encrypts the given secret with a fresh data key and stores it in
+//the DB under the given name, replacing any previous secret with that name.
+func (db *DB) StoreSecret(name string, plaintext Secret) error {
+	return db.storeSecret(name, plaintext, `
+		ON CONFLICT (name) DO UPDATE SET
+			master_key_id = EXCLUDED.master_key_id, wrapped_key = EXCLUDED.wrapped_key,
+			ciphertext = EXCLUDED.ciphertext, updated_at = EXCLUDED.updated_at
+	`)
+}
+
+//StoreSecretUnlessExists is like StoreSecret, but keeps the previous secret
+//if one exists with that name already. When multiple keppel-api instances
+//generate the same secret concurrently, they can agree on one by calling this
+//and then LoadSecret.
+func (db *DB) StoreSecretUnlessExists(name string, plaintext Secret) error {
+	return db.storeSecret(name, plaintext, `ON CONFLICT (name) DO NOTHING`)
+}
+
+func (db *DB) storeSecret(name string, plaintext Secret, onConflict string) error {
+	mk, err := activeMasterKey()
+	if err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, 32)
+	_, err = rand.Read(dataKey)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := seal(dataKey, plaintext, name)
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := seal(mk.Key, dataKey, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO secrets (name, master_key_id, wrapped_key, ciphertext, updated_at) VALUES ($1, $2, $3, $4, $5)
+	`+onConflict, name, mk.ID, wrappedKey, ciphertext, time.Now().UTC())
+	return err
+}
+
+//LoadSecret retrieves and decrypts the secret with the given name. If no such
+//secret exists, nil is returned.
+func (db *DB) LoadSecret(name string) (Secret, error) {
+	var s StoredSecret
+	err := db.SelectOne(&s, `SELECT * FROM secrets WHERE name = $1`, name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.unwrapDataKey()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(dataKey, s.Ciphertext, s.Name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt secret %q: %s", s.Name, err.Error())
+	}
+	return Secret(plaintext), nil
+}
+
+//DeleteSecret deletes the secret with the given name, if it exists.
+func (db *DB) DeleteSecret(name string) error {
+	_, err := db.Exec(`DELETE FROM secrets WHERE name = $1`, name)
+	return err
+}
+
+//RewrapSecrets re-wraps the data keys of all secrets that are not wrapped with
+//the active (i.e. first) master key. The encrypted payloads are not touched.
+//After this has completed successfully, the old master keys can be removed
+//from the configuration. Returns how many secrets were re-wrapped.
+func (db *DB) RewrapSecrets() (int, error) {
+	mk, err := activeMasterKey()
+	if err != nil {
+		return 0, err
+	}
+
+	var secrets []StoredSecret
+	_, err = db.Select(&secrets, `SELECT * FROM secrets WHERE master_key_id != $1 ORDER BY name`, mk.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, s := range secrets {
+		dataKey, err := s.unwrapDataKey()
+		if err != nil {
+			return idx, err
+		}
+		wrappedKey, err := seal(mk.Key, dataKey, s.Name)
+		if err != nil {
+			return idx, err
+		}
+		//the WHERE clause makes sure that we do not overwrite a concurrent update
+		_, err = db.Exec(`
+			UPDATE secrets SET master_key_id = $1, wrapped_key = $2
+			 WHERE name = $3 AND master_key_id = $4 AND wrapped_key = $5`,
+			mk.ID, wrappedKey, s.Name, s.MasterKeyID, s.WrappedKey)
+		if err != nil {
+			return idx, err
+		}
+	}
+	return len(secrets), nil
+}
+
+func (s StoredSecret) unwrapDataKey() ([]byte, error) {
+	mk, err := findMasterKey(s.MasterKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt secret %q: %s", s.Name, err.Error())
+	}
+	dataKey, err := open(mk.Key, s.WrappedKey, s.Name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key for secret %q: %s", s.Name, err.Error())
+	}
+	return dataKey, nil
+}
+
+//seal encrypts the plaintext with AES-256-GCM, and returns the nonce and
+//ciphertext in base64 encoding. The secret's name is used as additional data
+//to prevent ciphertexts from being swapped between records.
+func seal(key, plaintext []byte, name string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+//open reverses seal.
+func open(key []byte, sealedStr, name string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(sealedStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(name))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//parseMasterKeys validates the "secrets.master_keys" section of the
+//configuration.
+func parseMasterKeys(in []masterKeyConfig) ([]MasterKey, error) {
+	result := make([]MasterKey, len(in))
+	isID := make(map[string]bool)
+	for idx, cfg := range in {
+		if cfg.ID == "" {
+			return nil, fmt.Errorf("missing secrets.master_keys[%d].id", idx)
+		}
+		if isID[cfg.ID] {
+			return nil, fmt.Errorf("duplicate master key ID in secrets.master_keys: %q", cfg.ID)
+		}
+		isID[cfg.ID] = true
+
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("malformed secrets.master_keys[%d].key: %s", idx, err.Error())
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("malformed secrets.master_keys[%d].key: expected 32 bytes, got %d bytes", idx, len(key))
+		}
+		result[idx] = MasterKey{ID: cfg.ID, Key: Secret(key)}
+	}
+	return result, nil
+}
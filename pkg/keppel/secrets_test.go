@@ -0,0 +1,145 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestSecretStorage(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: noop }
+		storage: { driver: noop }
+		secrets:
+			master_keys:
+				- { id: old, key: 'MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=' }
+	`)
+	db := keppel.State.DB
+
+	//secrets do not reveal their contents when printed or serialized
+	secret := keppel.Secret("swordfish")
+	buf, _ := json.Marshal(map[string]interface{}{"password": secret})
+	for _, str := range []string{fmt.Sprintf("%s %v %#v %q", secret, secret, secret, secret), string(buf)} {
+		if strings.Contains(str, "swordfish") {
+			t.Errorf("secret was revealed: %s", str)
+		}
+	}
+
+	//store and load
+	err := db.StoreSecret("webhook/first", secret)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = db.StoreSecret("webhook/second", keppel.Secret("hunter2"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSecret := func(name, expected string) {
+		t.Helper()
+		actual, err := db.LoadSecret(name)
+		if err != nil {
+			t.Error(err.Error())
+		} else if string(actual) != expected {
+			t.Errorf("expected secret %q to contain %q, but got %q", name, expected, string(actual))
+		}
+	}
+	expectSecret("webhook/first", "swordfish")
+	expectSecret("webhook/second", "hunter2")
+	expectSecret("webhook/third", "")
+
+	//StoreSecretUnlessExists does not replace existing secrets
+	err = db.StoreSecretUnlessExists("webhook/first", keppel.Secret("other"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSecret("webhook/first", "swordfish")
+	err = db.StoreSecretUnlessExists("webhook/third", keppel.Secret("correcthorse"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSecret("webhook/third", "correcthorse")
+	err = db.DeleteSecret("webhook/third")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the plaintext does not appear in the DB
+	var stored []keppel.StoredSecret
+	_, err = db.Select(&stored, `SELECT * FROM secrets ORDER BY name`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, s := range stored {
+		if strings.Contains(fmt.Sprintf("%#v", s), "swordfish") || strings.Contains(fmt.Sprintf("%#v", s), "hunter2") {
+			t.Errorf("plaintext found in DB record: %#v", s)
+		}
+	}
+
+	//ciphertexts cannot be moved to a different record
+	_, err = db.Exec(`UPDATE secrets SET wrapped_key = $1, ciphertext = $2 WHERE name = $3`,
+		stored[0].WrappedKey, stored[0].Ciphertext, "webhook/second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = db.LoadSecret("webhook/second")
+	if err == nil {
+		t.Error("expected LoadSecret to fail on swapped ciphertext, but got no error")
+	}
+	err = db.DeleteSecret("webhook/second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectSecret("webhook/second", "")
+
+	//rotate master key
+	oldKey := keppel.State.SecretMasterKeys[0]
+	newKey := keppel.MasterKey{ID: "new", Key: keppel.Secret("fedcba9876543210fedcba9876543210")}
+	keppel.State.SecretMasterKeys = []keppel.MasterKey{newKey, oldKey}
+	count, err := db.RewrapSecrets()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of rewrapped secrets", count, 1)
+	count, err = db.RewrapSecrets()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of rewrapped secrets", count, 0)
+
+	//after rewrapping, the old master key is not needed anymore
+	keppel.State.SecretMasterKeys = []keppel.MasterKey{newKey}
+	expectSecret("webhook/first", "swordfish")
+
+	//without the new master key, the secret cannot be decrypted anymore
+	keppel.State.SecretMasterKeys = []keppel.MasterKey{oldKey}
+	_, err = db.LoadSecret("webhook/first")
+	if err == nil {
+		t.Error("expected LoadSecret to fail without the correct master key, but got no error")
+	}
+}
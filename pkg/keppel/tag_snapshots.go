@@ -0,0 +1,71 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"database/sql"
+	"time"
+)
+
+//TagSnapshot contains a record from the `tag_snapshots` table. A tag snapshot
+//records which manifest each tag in an account pointed to at a certain point
+//in time (see TagSnapshotEntry). As long as the snapshot exists, the
+//manifests referenced by it cannot be deleted, so that the snapshot can
+//always be restored.
+type TagSnapshot struct {
+	AccountName string    `db:"account_name" json:"-"`
+	Name        string    `db:"name" json:"name"`
+	UserName    string    `db:"user_name" json:"created_by"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+//TagSnapshotEntry contains a record from the `tag_snapshot_entries` table.
+//`RepoName` is the repository name without the leading account name.
+type TagSnapshotEntry struct {
+	AccountName  string `db:"account_name" json:"-"`
+	SnapshotName string `db:"snapshot_name" json:"-"`
+	RepoName     string `db:"repo_name" json:"repository"`
+	TagName      string `db:"tag_name" json:"tag"`
+	Digest       string `db:"digest" json:"digest"`
+}
+
+//FindTagSnapshot works similar to db.SelectOne(), but returns nil instead of
+//sql.ErrNoRows if no tag snapshot exists with this name.
+func (db *DB) FindTagSnapshot(accountName, name string) (*TagSnapshot, error) {
+	var s TagSnapshot
+	err := db.SelectOne(&s,
+		`SELECT * FROM tag_snapshots WHERE account_name = $1 AND name = $2`,
+		accountName, name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &s, err
+}
+
+//IsManifestPinned returns whether any tag snapshot references the given
+//manifest, which prevents its deletion. `repoName` is the repository name
+//without the leading account name.
+func (db *DB) IsManifestPinned(accountName, repoName, digest string) (bool, error) {
+	count, err := db.SelectInt(`
+		SELECT COUNT(*) FROM tag_snapshot_entries
+		 WHERE account_name = $1 AND repo_name = $2 AND digest = $3`,
+		accountName, repoName, digest)
+	return count > 0, err
+}
@@ -0,0 +1,128 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//TokenBinding contains the configuration for binding tokens to the network
+//address of the client that requested them. When it is enabled, a token that
+//is presented from a different address is rejected, so that leaked tokens
+//cannot be replayed from elsewhere.
+type TokenBinding struct {
+	//Requests from these networks may supply the client address in the
+	//X-Forwarded-For header (e.g. because they come from a load balancer).
+	TrustedProxies []*net.IPNet
+	//Tokens issued to clients in these networks are bound to the whole network
+	//instead of the client's address. This is for clients behind NAT gateways
+	//that may use a different public address for each connection.
+	ExemptNetworks []*net.IPNet
+}
+
+type tokenBindingConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	ExemptNetworks []string `yaml:"exempt_networks"`
+}
+
+//parseTokenBinding validates the "token_binding" section of the
+//configuration. Returns nil if token binding is not enabled.
+func parseTokenBinding(cfg tokenBindingConfig) (*TokenBinding, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	trustedProxies, err := parseNetworks(cfg.TrustedProxies, "token_binding.trusted_proxies")
+	if err != nil {
+		return nil, err
+	}
+	exemptNetworks, err := parseNetworks(cfg.ExemptNetworks, "token_binding.exempt_networks")
+	if err != nil {
+		return nil, err
+	}
+	return &TokenBinding{trustedProxies, exemptNetworks}, nil
+}
+
+func parseNetworks(in []string, key string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, len(in))
+	for idx, str := range in {
+		_, network, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s[%d]: %s", key, idx, err.Error())
+		}
+		result[idx] = network
+	}
+	return result, nil
+}
+
+//ClientAddress returns the address of the client that sent the given request.
+//X-Forwarded-For is only considered if the request was sent by a trusted
+//proxy. Returns nil if the address cannot be determined.
+func (b TokenBinding) ClientAddress(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return nil
+	}
+
+	//walk the X-Forwarded-For chain from the right; each entry was added by the
+	//proxy to its right, so it can only be believed if that proxy is trusted
+	var forwardedFor []string
+	for _, value := range r.Header["X-Forwarded-For"] {
+		forwardedFor = append(forwardedFor, strings.Split(value, ",")...)
+	}
+	for idx := len(forwardedFor) - 1; idx >= 0 && containsAddress(b.TrustedProxies, addr); idx-- {
+		next := net.ParseIP(strings.TrimSpace(forwardedFor[idx]))
+		if next == nil {
+			break
+		}
+		addr = next
+	}
+	return addr
+}
+
+//BoundNetwork returns the network (in CIDR notation) that a token for a client
+//with the given address is bound to.
+func (b TokenBinding) BoundNetwork(addr net.IP) string {
+	for _, network := range b.ExemptNetworks {
+		if network.Contains(addr) {
+			return network.String()
+		}
+	}
+	if addr.To4() != nil {
+		return addr.String() + "/32"
+	}
+	return addr.String() + "/128"
+}
+
+func containsAddress(networks []*net.IPNet, addr net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
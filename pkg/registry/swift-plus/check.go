@@ -0,0 +1,150 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package swiftplus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/majewsky/schwift"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//IsConfiguredIn returns whether the given environment variables (in the
+//"key=value" format) configure the swift-plus storage driver.
+func IsConfiguredIn(env []string) bool {
+	return len(parametersFromEnvironment(env)) > 0
+}
+
+//parametersFromEnvironment converts environment variables like
+//"REGISTRY_STORAGE_SWIFT-PLUS_CONTAINER=foo" into the parameter map for
+//FromParameters, like keppel-registry's configuration parser does.
+func parametersFromEnvironment(env []string) map[string]interface{} {
+	prefix := "REGISTRY_STORAGE_" + strings.ToUpper(plusDriverName) + "_"
+	result := make(map[string]interface{})
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(kv, prefix), "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		//the configuration parser decodes values as YAML, so booleans and numbers
+		//need to be converted; everything else is taken verbatim
+		var value interface{} = fields[1]
+		var decoded interface{}
+		if yaml.Unmarshal([]byte(fields[1]), &decoded) == nil {
+			switch decoded.(type) {
+			case bool, int:
+				value = decoded
+			}
+		}
+		result[strings.ToLower(fields[0])] = value
+	}
+	return result
+}
+
+//CheckStorage compares the metadata in the Postgres database of a swift-plus
+//storage with the objects in its Swift container, and returns a description
+//of each object that is referenced by the metadata, but missing in Swift. The
+//storage is configured by environment variables as for keppel-registry (see
+//IsConfiguredIn).
+func CheckStorage(ctx context.Context, env []string) ([]string, error) {
+	params, err := parseParameters(parametersFromEnvironment(env))
+	if err != nil {
+		return nil, err
+	}
+	si, err := newSwiftInterface(params)
+	if err != nil {
+		return nil, err
+	}
+	//not connectToPostgres() since a missing database shall not be created here
+	db, err := sql.Open("postgres", params.PostgresURI)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	//collect the names of all objects in Swift
+	existing := make(map[string]bool)
+	iter := si.Container.Objects()
+	iter.Prefix = prependPrefix(params.ObjectPrefix, "")
+	iter.Options = &schwift.RequestOptions{Context: ctx}
+	err = iter.Foreach(func(o *schwift.Object) error {
+		existing[o.Name()] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	filePathsByLocation := make(map[string]string)
+	rows, err := db.QueryContext(ctx, `SELECT dirname, basename, location FROM files WHERE location <> '' ORDER BY dirname, basename`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var fi fileInfo
+		err := rows.Scan(&fi.DirName, &fi.BaseName, &fi.Location)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		filePathsByLocation[fi.Location] = fi.Path()
+		objectPath := prependPrefix(params.ObjectPrefix, fi.ObjectPath())
+		if !existing[objectPath] {
+			problems = append(problems, fmt.Sprintf("content of %s is missing in Swift (expected at %s)", fi.Path(), objectPath))
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT location, number FROM segments ORDER BY location, number`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		segment := plusSegment{Prefix: params.ObjectPrefix}
+		err := rows.Scan(&segment.Location, &segment.Number)
+		if err != nil {
+			return nil, err
+		}
+		if existing[segment.ObjectPath()] {
+			continue
+		}
+		//segments of unfinished uploads do not have a file yet
+		filePath, exists := filePathsByLocation[segment.Location]
+		if !exists {
+			filePath = path.Join("<upload>", segment.Location)
+		}
+		problems = append(problems, fmt.Sprintf("segment %d of %s is missing in Swift (expected at %s)",
+			segment.Number, filePath, segment.ObjectPath()))
+	}
+	return problems, rows.Err()
+}
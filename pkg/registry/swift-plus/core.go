@@ -305,6 +305,33 @@ func (s plusSegment) ObjectPath() string {
 	return fmt.Sprintf("%s/%016d", prependPrefix(s.Prefix, s.Location), int(s.Number))
 }
 
+//Swift limits the number of segments in a single SLO manifest (through the
+//max_manifest_segments setting, which defaults to 1000). Files with more
+//segments are stored as nested SLOs: The segments are grouped into
+//intermediate manifests, which are referenced by the manifest at
+//fileInfo.ObjectPath().
+const maxSegmentsPerManifest = 1000
+
+//subManifestObjectPath returns where the intermediate manifest with the given
+//index on the given nesting level is stored in Swift.
+func subManifestObjectPath(prefix, location string, level, index int) string {
+	return fmt.Sprintf("%s/manifest-%d-%06d", prependPrefix(prefix, location), level, index)
+}
+
+//subManifestObjectPaths returns the paths of all intermediate manifests that
+//exist for a file with the given number of segments.
+func subManifestObjectPaths(prefix, location string, segmentCount int) []string {
+	var result []string
+	count := segmentCount
+	for level := 1; count > maxSegmentsPerManifest; level++ {
+		count = (count + maxSegmentsPerManifest - 1) / maxSegmentsPerManifest
+		for idx := 0; idx < count; idx++ {
+			result = append(result, subManifestObjectPath(prefix, location, level, idx))
+		}
+	}
+	return result
+}
+
 func (p *plusDriver) readSegmentInfo(ctx context.Context, location string) (result []plusSegment, err error) {
 	if location == "" {
 		return nil, nil
@@ -381,10 +408,11 @@ func (p *plusDriver) PutContent(ctx dcontext.Context, fullPath string, contents
 
 	//insert file into database
 	fi = fileInfo{
-		DirName:   path.Dir(fullPath),
-		BaseName:  path.Base(fullPath),
-		SizeBytes: int64(len(contents)),
-		Contents:  contents,
+		DirName:    path.Dir(fullPath),
+		BaseName:   path.Base(fullPath),
+		SizeBytes:  int64(len(contents)),
+		ModifiedAt: time.Now(),
+		Contents:   contents,
 	}
 	uploadToSwift := len(contents) > maxInlineSizeBytes
 	if uploadToSwift {
@@ -401,12 +429,13 @@ func (p *plusDriver) PutContent(ctx dcontext.Context, fullPath string, contents
 	}
 
 	//upload file to Swift
-	if !uploadToSwift {
-		return nil
+	if uploadToSwift {
+		_, err = p.swift.Write(ctx, prependPrefix(p.swift.ObjectPrefix, fi.ObjectPath()), contents)
+		if err != nil {
+			return setReportedPath(err, fullPath)
+		}
 	}
-
-	_, err = p.swift.Write(ctx, prependPrefix(p.swift.ObjectPrefix, fi.ObjectPath()), contents)
-	return setReportedPath(err, fullPath)
+	return p.writeFileRecord(ctx, fi, nil)
 }
 
 //Reader implements the storagedriver.StorageDriver interface.
@@ -527,7 +556,25 @@ func (p *plusDriver) Move(ctx dcontext.Context, sourcePath string, destPath stri
 	}
 
 	//create missing directories above target
-	return p.mkdirAll(ctx, path.Dir(destPath))
+	err = p.mkdirAll(ctx, path.Dir(destPath))
+	if err != nil || fi1.IsDir() {
+		return err
+	}
+
+	//move the file's record in Swift (the record at the target path was
+	//removed by deleteDownwards above)
+	segments, err := p.readSegmentInfo(ctx, fi1.Location)
+	if err != nil {
+		return err
+	}
+	oldRecordPath := recordObjectPath(p.swift.ObjectPrefix, fi1.Path())
+	fi1.DirName = path.Dir(destPath)
+	fi1.BaseName = path.Base(destPath)
+	err = p.writeFileRecord(ctx, fi1, segments)
+	if err != nil {
+		return err
+	}
+	return p.swift.BulkDelete(ctx, []string{oldRecordPath})
 }
 
 //Delete implements the storagedriver.StorageDriver interface.
@@ -543,40 +590,117 @@ func (p *plusDriver) Delete(ctx dcontext.Context, fullPath string) error {
 	return p.deleteDownwards(ctx, fi)
 }
 
-//deleteDownwards removes all files and directories below `fi` from the DB
+//deleteDownwards removes `fi` and all files and directories below it from the
+//DB, and all blobs and segments associated with them from Swift. The entire
+//subtree is selected with a single query, and all Swift objects are removed
+//with bulk deletes instead of one container listing per file.
 func (p *plusDriver) deleteDownwards(ctx context.Context, fi fileInfo) error {
-	//if file has content and/or segments in Swift, remove them as well
-	err := p.deleteBlobs(ctx, fi)
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback() //no-op if the transaction was committed
+
+	//this condition matches `fi` itself, its direct children, and everything
+	//further below
+	subtreeCondition := `((dirname = $1 AND basename = $2) OR dirname = $3 OR dirname LIKE $4)`
+	subtreeArgs := []interface{}{
+		fi.DirName, fi.BaseName, fi.Path(), escapeLikePattern(fi.Path()) + "/%",
+	}
 
-	//for directories, recurse into children
-	if fi.IsDir() {
-		rows, err := p.db.QueryContext(ctx, `
-			SELECT basename, size_bytes, mtime, content, location FROM files WHERE dirname = $1
-		`, fi.Path())
+	//collect the Swift objects for all files in the subtree (i.e. the object
+	//at fi.ObjectPath() plus all segments)
+	rows, err := tx.QueryContext(ctx, `
+		SELECT f.location, s.number FROM files f LEFT OUTER JOIN segments s ON s.location = f.location
+		 WHERE f.location != '' AND `+subtreeCondition,
+		subtreeArgs...)
+	if err != nil {
+		return err
+	}
+	var (
+		objectNames   []string
+		isLocation    = make(map[string]bool)
+		segmentCounts = make(map[string]int)
+	)
+	for rows.Next() {
+		var (
+			location string
+			number   sql.NullInt64
+		)
+		err := rows.Scan(&location, &number)
 		if err != nil {
+			rows.Close()
 			return err
 		}
-		defer rows.Close()
+		if !isLocation[location] {
+			isLocation[location] = true
+			fiSub := fileInfo{Location: location}
+			objectNames = append(objectNames, prependPrefix(p.swift.ObjectPrefix, fiSub.ObjectPath()))
+		}
+		if number.Valid {
+			s := plusSegment{Prefix: p.swift.ObjectPrefix, Location: location, Number: uint64(number.Int64)}
+			objectNames = append(objectNames, s.ObjectPath())
+			segmentCounts[location]++
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for location, count := range segmentCounts {
+		objectNames = append(objectNames, subManifestObjectPaths(p.swift.ObjectPrefix, location, count)...)
+	}
 
-		fiSub := fileInfo{DirName: fi.Path()}
-		for rows.Next() {
-			err = rows.Scan(&fiSub.BaseName, &fiSub.SizeBytes, &fiSub.ModifiedAt, &fiSub.Contents, &fiSub.Location)
-			if err != nil {
-				return err
-			}
-			err = p.deleteDownwards(ctx, fiSub)
-			if err != nil {
-				return err
-			}
+	//collect the records of all files in the subtree
+	rows, err = tx.QueryContext(ctx,
+		`SELECT dirname, basename FROM files WHERE size_bytes >= 0 AND `+subtreeCondition,
+		subtreeArgs...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var fiSub fileInfo
+		err := rows.Scan(&fiSub.DirName, &fiSub.BaseName)
+		if err != nil {
+			rows.Close()
+			return err
 		}
+		objectNames = append(objectNames, recordObjectPath(p.swift.ObjectPrefix, fiSub.Path()))
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
 	}
 
-	//delete DB entry for this file/directory
-	_, err = p.db.ExecContext(ctx, `DELETE FROM files WHERE dirname = $1 AND basename = $2`, fi.DirName, fi.BaseName)
-	return err
+	//remove blobs, segments and records from Swift
+	err = p.swift.BulkDelete(ctx, objectNames)
+	if err != nil {
+		return err
+	}
+
+	//delete DB entries for all files/directories and their segments
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM segments WHERE location IN (
+			SELECT location FROM files WHERE location != '' AND `+subtreeCondition+`
+		)`, subtreeArgs...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM files WHERE `+subtreeCondition, subtreeArgs...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+//escapeLikePattern escapes all characters in `in` that have special meaning
+//in the pattern of a LIKE operator.
+func escapeLikePattern(in string) string {
+	return likePatternEscaper.Replace(in)
 }
 
 //deleteBlobs removes all blobs and segments from Swift that are associated with this file.
@@ -732,14 +856,15 @@ func (w *plusWriter) Commit() error {
 	}
 
 	fi := fileInfo{
-		DirName:   path.Dir(w.fullPath),
-		BaseName:  path.Base(w.fullPath),
-		SizeBytes: w.Size(),
-		Location:  w.location,
+		DirName:    path.Dir(w.fullPath),
+		BaseName:   path.Base(w.fullPath),
+		SizeBytes:  w.Size(),
+		ModifiedAt: time.Now(),
+		Location:   w.location,
 	}
 
 	//save large file in Swift and in the DB
-	err := w.p.swift.WriteSLO(w.ctx, prependPrefix(w.p.swift.ObjectPrefix, fi.ObjectPath()), w.segments)
+	err := w.p.swift.WriteSLO(w.ctx, prependPrefix(w.p.swift.ObjectPrefix, fi.ObjectPath()), w.location, w.segments)
 	if err != nil {
 		return err
 	}
@@ -747,6 +872,10 @@ func (w *plusWriter) Commit() error {
 	if err != nil {
 		return err
 	}
+	err = w.p.writeFileRecord(w.ctx, fi, w.segments)
+	if err != nil {
+		return err
+	}
 	w.committed = true
 	return nil
 }
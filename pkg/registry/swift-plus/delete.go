@@ -0,0 +1,70 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package swiftplus
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/majewsky/schwift"
+)
+
+//DeleteStorage deletes all objects of a swift-plus storage from Swift, e.g.
+//when the Keppel account using it is deleted. If the storage occupies the
+//whole container (i.e. no object prefix is configured), the container is
+//deleted as well. The metadata database is not touched. The storage is
+//configured by environment variables as for keppel-registry (see
+//IsConfiguredIn).
+func DeleteStorage(ctx context.Context, env []string) error {
+	params, err := parseParameters(parametersFromEnvironment(env))
+	if err != nil {
+		return err
+	}
+	si, err := newSwiftInterface(params)
+	if err != nil {
+		return err
+	}
+
+	iter := si.Container.Objects()
+	iter.Prefix = prependPrefix(params.ObjectPrefix, "")
+	iter.Options = &schwift.RequestOptions{Context: ctx}
+	objects, err := iter.Collect()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(objects))
+	for idx, obj := range objects {
+		names[idx] = obj.Name()
+	}
+	err = si.BulkDelete(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	if params.ObjectPrefix != "" {
+		//the container may be shared with other storages
+		return nil
+	}
+	err = si.Container.Delete(&schwift.RequestOptions{Context: ctx})
+	if schwift.Is(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
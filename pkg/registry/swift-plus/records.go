@@ -0,0 +1,241 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package swiftplus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+//Since the file paths are only stored in Postgres, the objects in Swift would
+//be useless if the database was lost. Therefore, a fileRecord is stored in
+//Swift next to each file, from which the database can be rebuilt (see
+//RebuildMetadata).
+type fileRecord struct {
+	Path       string    `json:"path"`
+	SizeBytes  int64     `json:"size_bytes"`
+	ModifiedAt time.Time `json:"mtime"`
+	//for files stored in the DB
+	Contents []byte `json:"content,omitempty"`
+	//for files stored in Swift
+	Location string          `json:"location,omitempty"`
+	Segments []segmentRecord `json:"segments,omitempty"`
+}
+
+type segmentRecord struct {
+	Number    uint64 `json:"number"`
+	SizeBytes uint64 `json:"size_bytes"`
+	Hash      string `json:"hash"`
+}
+
+//The records live below this directory in the container (or below the
+//object prefix, if any). This cannot collide with file locations since those
+//are hex strings.
+const recordDirectory = "_files"
+
+//recordObjectPath returns where the fileRecord for the file at the given path
+//is stored in Swift.
+func recordObjectPath(prefix, fullPath string) string {
+	return prependPrefix(prefix, recordDirectory+"/"+strings.Trim(fullPath, "/"))
+}
+
+//writeFileRecord stores the fileRecord for the given file in Swift.
+func (p *plusDriver) writeFileRecord(ctx context.Context, fi fileInfo, segments []plusSegment) error {
+	record := fileRecord{
+		Path:       fi.Path(),
+		SizeBytes:  fi.SizeBytes,
+		ModifiedAt: fi.ModifiedAt,
+		Contents:   fi.Contents,
+		Location:   fi.Location,
+	}
+	for _, s := range segments {
+		record.Segments = append(record.Segments, segmentRecord{s.Number, s.SizeBytes, s.Hash})
+	}
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = p.swift.Write(ctx, recordObjectPath(p.swift.ObjectPrefix, fi.Path()), buf)
+	return err
+}
+
+//BackfillFileRecords writes the records that RebuildMetadata relies on for
+//all files in the database. This is only necessary for files that were written
+//before swift-plus started to write these records. The storage is configured
+//by environment variables as for keppel-registry (see IsConfiguredIn).
+//Returns how many records were written.
+func BackfillFileRecords(ctx context.Context, env []string) (int, error) {
+	p, err := newDriverFromEnvironment(env)
+	if err != nil {
+		return 0, err
+	}
+	defer p.db.Close()
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT dirname, basename, size_bytes, mtime, content, location FROM files
+		 WHERE size_bytes >= 0 ORDER BY dirname, basename`)
+	if err != nil {
+		return 0, err
+	}
+	var files []fileInfo
+	for rows.Next() {
+		var fi fileInfo
+		err := rows.Scan(&fi.DirName, &fi.BaseName, &fi.SizeBytes, &fi.ModifiedAt, &fi.Contents, &fi.Location)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files = append(files, fi)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, fi := range files {
+		segments, err := p.readSegmentInfo(ctx, fi.Location)
+		if err == nil {
+			err = p.writeFileRecord(ctx, fi, segments)
+		}
+		if err != nil {
+			return idx, fmt.Errorf("cannot write record for %s: %s", fi.Path(), err.Error())
+		}
+	}
+	return len(files), nil
+}
+
+//RebuildMetadata restores the `files` and `segments` tables from the records
+//in Swift, e.g. after the database was lost. To avoid overwriting newer
+//metadata with older records, the database must be empty. The storage is
+//configured by environment variables as for keppel-registry (see
+//IsConfiguredIn). Returns how many files were restored.
+func RebuildMetadata(ctx context.Context, env []string) (int, error) {
+	p, err := newDriverFromEnvironment(env)
+	if err != nil {
+		return 0, err
+	}
+	defer p.db.Close()
+
+	var fileCount int
+	err = p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files`).Scan(&fileCount)
+	if err != nil {
+		return 0, err
+	}
+	if fileCount > 0 {
+		return 0, fmt.Errorf("cannot rebuild metadata: database contains %d files already", fileCount)
+	}
+
+	iter := p.swift.Container.Objects()
+	iter.Prefix = prependPrefix(p.swift.ObjectPrefix, recordDirectory) + "/"
+	iter.Options = &schwift.RequestOptions{Context: ctx}
+	objects, err := iter.Collect()
+	if err != nil {
+		return 0, err
+	}
+
+	for idx, obj := range objects {
+		err := p.restoreFileRecord(ctx, obj)
+		if err != nil {
+			return idx, fmt.Errorf("cannot restore %s: %s", obj.Name(), err.Error())
+		}
+	}
+	return len(objects), nil
+}
+
+func (p *plusDriver) restoreFileRecord(ctx context.Context, obj *schwift.Object) error {
+	reader, err := obj.Download(&schwift.RequestOptions{Context: ctx}).AsReadCloser()
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	var record fileRecord
+	err = json.Unmarshal(buf, &record)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //no-op if the transaction was committed
+
+	//when a Move() was interrupted, the records of the source and target path
+	//may both refer to the same location
+	for _, s := range record.Segments {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO segments (location, number, size_bytes, hash) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (location, number) DO NOTHING`,
+			record.Location, s.Number, s.SizeBytes, s.Hash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO files (dirname, basename, size_bytes, mtime, content, location) VALUES ($1,$2,$3,$4,$5,$6)`,
+		path.Dir(record.Path), path.Base(record.Path), record.SizeBytes, record.ModifiedAt, record.Contents, record.Location,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	//directories are not recorded since they can be inferred from the files
+	return p.mkdirAll(ctx, path.Dir(record.Path))
+}
+
+//newDriverFromEnvironment is like NewDriver, but takes the parameters from
+//environment variables (see IsConfiguredIn).
+func newDriverFromEnvironment(env []string) (*plusDriver, error) {
+	params, err := parseParameters(parametersFromEnvironment(env))
+	if err != nil {
+		return nil, err
+	}
+	si, err := newSwiftInterface(params)
+	if err != nil {
+		return nil, err
+	}
+	db, err := connectToPostgres(params.PostgresURI)
+	if err != nil {
+		return nil, err
+	}
+	err = initializeSchema(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &plusDriver{si, db}, nil
+}
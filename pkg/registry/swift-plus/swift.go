@@ -180,7 +180,65 @@ func (s *swiftInterface) Write(ctx context.Context, path string, data []byte) (h
 	return hash, s.Container.Object(path).Upload(bytes.NewReader(data), nil, opts)
 }
 
-func (s *swiftInterface) WriteSLO(ctx context.Context, path string, segments []plusSegment) error {
+//WriteSLO writes a static large object consisting of the given segments. If
+//there are more segments than fit into one manifest, intermediate manifests
+//are written for groups of segments (and, if necessary, for groups of
+//intermediate manifests), and the object at `path` refers to these instead.
+func (s *swiftInterface) WriteSLO(ctx context.Context, path, location string, segments []plusSegment) error {
+	entries := make([]sloEntry, len(segments))
+	for idx, segment := range segments {
+		entries[idx] = sloEntry{
+			ObjectPath: segment.ObjectPath(),
+			SizeBytes:  segment.SizeBytes,
+			Etag:       segment.Hash,
+		}
+	}
+
+	for level := 1; len(entries) > maxSegmentsPerManifest; level++ {
+		var nextEntries []sloEntry
+		for idx := 0; idx*maxSegmentsPerManifest < len(entries); idx++ {
+			end := (idx + 1) * maxSegmentsPerManifest
+			if end > len(entries) {
+				end = len(entries)
+			}
+			group := entries[idx*maxSegmentsPerManifest : end]
+
+			subPath := subManifestObjectPath(s.ObjectPrefix, location, level, idx)
+			err := s.writeManifest(ctx, subPath, group)
+			if err != nil {
+				return err
+			}
+			entry := sloEntry{ObjectPath: subPath, Etag: sloEtag(group)}
+			for _, e := range group {
+				entry.SizeBytes += e.SizeBytes
+			}
+			nextEntries = append(nextEntries, entry)
+		}
+		entries = nextEntries
+	}
+
+	return s.writeManifest(ctx, path, entries)
+}
+
+//sloEntry is a segment in an SLO manifest. This can be either a plusSegment
+//or an intermediate manifest.
+type sloEntry struct {
+	ObjectPath string
+	SizeBytes  uint64
+	Etag       string
+}
+
+//sloEtag computes the Etag that Swift reports for a static large object
+//consisting of the given segments.
+func sloEtag(entries []sloEntry) string {
+	h := md5.New()
+	for _, e := range entries {
+		io.WriteString(h, e.Etag)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *swiftInterface) writeManifest(ctx context.Context, path string, entries []sloEntry) error {
 	lo, err := s.Container.Object(path).AsNewLargeObject(
 		schwift.SegmentingOptions{
 			Strategy:         schwift.StaticLargeObject,
@@ -192,11 +250,11 @@ func (s *swiftInterface) WriteSLO(ctx context.Context, path string, segments []p
 		return err
 	}
 
-	for _, segment := range segments {
+	for _, entry := range entries {
 		err := lo.AddSegment(schwift.SegmentInfo{
-			Object:    s.Container.Object(segment.ObjectPath()),
-			SizeBytes: uint64(segment.SizeBytes),
-			Etag:      segment.Hash,
+			Object:    s.Container.Object(entry.ObjectPath),
+			SizeBytes: entry.SizeBytes,
+			Etag:      entry.Etag,
 		})
 		if err != nil {
 			return err
@@ -221,6 +279,24 @@ func (s *swiftInterface) DeleteAll(ctx context.Context, prefix string) error {
 	return err
 }
 
+//BulkDelete deletes the objects with the given names. Objects that do not
+//exist are ignored. Large numbers of objects are split into multiple bulk
+//delete requests as required by the server.
+func (s *swiftInterface) BulkDelete(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	objs := make([]*schwift.Object, len(names))
+	for idx, name := range names {
+		objs[idx] = s.Container.Object(name)
+	}
+
+	_, _, err := s.Container.Account().BulkDelete(objs, nil,
+		&schwift.RequestOptions{Context: ctx},
+	)
+	return err
+}
+
 func (s *swiftInterface) MakeTempURL(ctx context.Context, path string, options map[string]interface{}) (string, error) {
 	if s.TempURLKey == "" {
 		return "", storagedriver.ErrUnsupportedMethod{}
@@ -0,0 +1,346 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+//Package registryclient contains a client for the Registry v2 API of the
+//keppel-registry of a single Keppel account. It is used by keppel-api when it
+//needs to look at the contents of an account by itself, rather than proxying
+//a user's request.
+package registryclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//ManifestMediaTypes lists the manifest formats that we ask for when looking at
+//manifests in the keppel-registry. (If we did not list these, keppel-registry
+//could convert manifests into the deprecated schema1 format.)
+var ManifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+//Client talks to the keppel-registry of a single account. Requests are
+//authenticated with tokens issued by keppel-api itself, so the caller is
+//responsible for checking that the user on whose behalf the client acts is
+//allowed to see the requested data.
+type Client struct {
+	Account keppel.Account
+	//UserName is recorded as the subject of the tokens issued by this client.
+	UserName string
+}
+
+//Error is returned by Client methods when keppel-registry responds with an
+//unexpected status code.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+//Error implements the builtin/error interface.
+func (e Error) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.StatusCode, strings.TrimSpace(e.Message))
+}
+
+//IsNotFound returns true if the given error is a 404 response from
+//keppel-registry.
+func IsNotFound(err error) bool {
+	rerr, ok := err.(Error)
+	return ok && rerr.StatusCode == http.StatusNotFound
+}
+
+//doRequest sends a request to keppel-registry. The response body must be
+//closed by the caller. If the response status differs from the expected
+//status, an Error is returned instead.
+func (c Client) doRequest(method, path string, query url.Values, header http.Header, body io.Reader, scope auth.Scope, expectedStatus int) (*http.Response, error) {
+	token := auth.Token{
+		UserName: c.UserName,
+		Access:   []auth.Scope{scope},
+	}
+	tokenResp, err := token.ToResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenResp.Token)
+
+	//the keppel-registry of an expired or deleted account may have been stopped
+	//already, and must not be started again
+	if !c.Account.IsUsable(time.Now()) {
+		return nil, fmt.Errorf("account %s has expired or is pending deletion", c.Account.Name)
+	}
+	resp, err := keppel.State.OrchestrationDriver.DoHTTPRequest(c.Account, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectedStatus {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, Error{Method: method, Path: path, StatusCode: resp.StatusCode, Message: string(msg)}
+	}
+	return resp, nil
+}
+
+func (c Client) repoScope(repoName string, actions ...string) auth.Scope {
+	return auth.Scope{
+		ResourceType: "repository",
+		ResourceName: c.Account.Name + "/" + repoName,
+		Actions:      actions,
+	}
+}
+
+func (c Client) repoPath(repoName string) string {
+	return "/v2/" + c.Account.Name + "/" + repoName
+}
+
+func decodeJSON(r io.ReadCloser, data interface{}) error {
+	defer r.Close()
+	return json.NewDecoder(r).Decode(data)
+}
+
+//ListRepositories returns the names of all repositories in this account
+//(without the leading account name), in lexicographical order.
+func (c Client) ListRepositories() ([]string, error) {
+	scope := auth.Scope{
+		ResourceType: "registry",
+		ResourceName: "catalog",
+		Actions:      []string{"*"},
+	}
+	prefix := c.Account.Name + "/"
+
+	//the catalog is paginated; keppel-registry indicates that more results are
+	//available by sending a Link header
+	var result []string
+	query := url.Values{}
+	for {
+		resp, err := c.doRequest("GET", "/v2/_catalog", query, nil, nil, scope, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		hasNextPage := resp.Header.Get("Link") != ""
+		var data struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = decodeJSON(resp.Body, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range data.Repositories {
+			result = append(result, strings.TrimPrefix(name, prefix))
+		}
+		if !hasNextPage || len(data.Repositories) == 0 {
+			return result, nil
+		}
+		query.Set("last", data.Repositories[len(data.Repositories)-1])
+	}
+}
+
+//ListTags returns the names of all tags in the given repository.
+func (c Client) ListTags(repoName string) ([]string, error) {
+	resp, err := c.doRequest("GET", c.repoPath(repoName)+"/tags/list", nil, nil, nil, c.repoScope(repoName, "pull"), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Tags []string `json:"tags"`
+	}
+	err = decodeJSON(resp.Body, &data)
+	return data.Tags, err
+}
+
+//Manifest contains information about a manifest that was retrieved from
+//keppel-registry.
+type Manifest struct {
+	Digest    string
+	MediaType string
+	//Contents is the raw manifest.
+	Contents []byte
+	//ConfigDigest identifies the image config blob. It is empty for manifest
+	//lists and image indexes.
+	ConfigDigest string
+	//Size is the total size of the config and layer blobs referenced by this
+	//manifest. It is 0 for manifest lists and image indexes, since their
+	//contents are spread over several manifests.
+	Size uint64
+	//LayerDigests identifies the layer blobs, starting from the base layer. It
+	//is empty for manifest lists and image indexes.
+	LayerDigests []string
+}
+
+//IsList returns true for manifest lists and image indexes.
+func (m Manifest) IsList() bool {
+	return strings.HasSuffix(m.MediaType, ".list.v2+json") || strings.HasSuffix(m.MediaType, ".index.v1+json")
+}
+
+//GetManifest retrieves the manifest identified by the given reference (a tag
+//name or a digest).
+func (c Client) GetManifest(repoName, reference string) (Manifest, error) {
+	header := http.Header{"Accept": {strings.Join(ManifestMediaTypes, ", ")}}
+	resp, err := c.doRequest("GET", c.repoPath(repoName)+"/manifests/"+reference, nil, header, nil, c.repoScope(repoName, "pull"), http.StatusOK)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	m := Manifest{
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		MediaType: resp.Header.Get("Content-Type"),
+		Contents:  contents,
+	}
+	if !m.IsList() {
+		var data struct {
+			Config struct {
+				Digest string `json:"digest"`
+				Size   uint64 `json:"size"`
+			} `json:"config"`
+			Layers []struct {
+				Digest string `json:"digest"`
+				Size   uint64 `json:"size"`
+			} `json:"layers"`
+		}
+		err := json.Unmarshal(contents, &data)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("cannot parse manifest %s: %s", m.Digest, err.Error())
+		}
+		m.ConfigDigest = data.Config.Digest
+		m.Size = data.Config.Size
+		for _, layer := range data.Layers {
+			m.Size += layer.Size
+			m.LayerDigests = append(m.LayerDigests, layer.Digest)
+		}
+	}
+	return m, nil
+}
+
+//ManifestExists checks whether the given reference (a tag name or a digest)
+//exists in the given repository.
+func (c Client) ManifestExists(repoName, reference string) (bool, error) {
+	header := http.Header{"Accept": {strings.Join(ManifestMediaTypes, ", ")}}
+	resp, err := c.doRequest("HEAD", c.repoPath(repoName)+"/manifests/"+reference, nil, header, nil, c.repoScope(repoName, "pull"), http.StatusOK)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, resp.Body.Close()
+}
+
+//GetBlob retrieves the contents of the given blob. This should only be used
+//for small blobs like image configs.
+func (c Client) GetBlob(repoName, digest string) ([]byte, error) {
+	body, err := c.OpenBlob(repoName, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+//OpenBlob retrieves the contents of the given blob as a stream. The caller
+//must close the returned reader.
+func (c Client) OpenBlob(repoName, digest string) (io.ReadCloser, error) {
+	resp, err := c.doRequest("GET", c.repoPath(repoName)+"/blobs/"+digest, nil, nil, nil, c.repoScope(repoName, "pull"), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//UploadBlob uploads the given blob into the given repository, and returns its
+//digest. The blob is uploaded in one piece, so this should only be used for
+//small blobs.
+func (c Client) UploadBlob(repoName string, contents []byte) (string, error) {
+	scope := c.repoScope(repoName, "pull", "push")
+	resp, err := c.doRequest("POST", c.repoPath(repoName)+"/blobs/uploads/", nil, nil, nil, scope, http.StatusAccepted)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	//the upload is completed at the location that keppel-registry gave us
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse upload location: %s", err.Error())
+	}
+	sum := sha256.Sum256(contents)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	query := location.Query()
+	query.Set("digest", digest)
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err = c.doRequest("PUT", location.Path, query, header, bytes.NewReader(contents), scope, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	return digest, resp.Body.Close()
+}
+
+//PutManifest uploads the given manifest into the given repository, and points
+//the given reference to it. If the reference is a tag name, an existing tag
+//with that name is overwritten. The blobs referenced by the manifest must
+//exist in the repository already.
+func (c Client) PutManifest(repoName, reference string, manifest Manifest) error {
+	header := http.Header{"Content-Type": {manifest.MediaType}}
+	resp, err := c.doRequest("PUT", c.repoPath(repoName)+"/manifests/"+reference, nil, header, bytes.NewReader(manifest.Contents), c.repoScope(repoName, "pull", "push"), http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+//DeleteManifest deletes the manifest with the given digest, and all tags
+//pointing to it. This requires storage deletion to be enabled in the
+//keppel-registry configuration.
+func (c Client) DeleteManifest(repoName, digest string) error {
+	//keppel-registry requires the "*" action for deletions (this action is never
+	//granted to users by the auth API)
+	resp, err := c.doRequest("DELETE", c.repoPath(repoName)+"/manifests/"+digest, nil, nil, nil, c.repoScope(repoName, "*"), http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
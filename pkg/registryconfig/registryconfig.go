@@ -0,0 +1,216 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+//Package registryconfig renders the configuration files for keppel-registry
+//processes. It is shared by all orchestration drivers that launch
+//keppel-registry processes themselves.
+package registryconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//The default template for the keppel-registry configuration file, which is
+//used unless the operator configures orchestration.registry_config_template.
+//Settings that keppel requires are added by applyRequiredSettings(), so they
+//do not need to appear here.
+const defaultTemplate = `
+version: 0.1
+log:
+	accesslog:
+		disabled: true
+	level: info
+http:
+	headers:
+		X-Content-Type-Options: [nosniff]
+health:
+	storagedriver:
+		enabled: true
+		interval: 10s
+		threshold: 3
+storage:
+	cache:
+		blobdescriptor: inmemory
+`
+
+//These subsections of the "storage" section may be set by the registry config
+//template. All other subsections configure a storage driver, which is chosen
+//by keppel's storage driver instead.
+var allowedStorageSections = map[string]bool{
+	"cache":       true,
+	"maintenance": true,
+	"redirect":    true,
+}
+
+//Vars contains the variables that can be used in the registry config
+//template.
+type Vars struct {
+	AccountName  string
+	AuthTenantID string
+	Port         uint16
+	//Storage contains the environment variables that the storage driver sets
+	//for keppel-registry, e.g. "REGISTRY_STORAGE_SWIFT-PLUS_CONTAINER".
+	Storage map[string]string
+}
+
+//NewVars prepares the template variables for the given account. The
+//storageEnv is the result of keppel.StorageDriver.GetEnvironment().
+func NewVars(account keppel.Account, port uint16, storageEnv []string) Vars {
+	vars := Vars{
+		AccountName:  account.Name,
+		AuthTenantID: account.AuthTenantID,
+		Port:         port,
+		Storage:      make(map[string]string),
+	}
+	for _, envVar := range storageEnv {
+		fields := strings.SplitN(envVar, "=", 2)
+		if len(fields) == 2 {
+			vars.Storage[fields[0]] = fields[1]
+		}
+	}
+	return vars
+}
+
+//ParseTemplate parses a registry config template. The template is rendered
+//once with example values, so that errors are caught at startup rather than
+//when the first keppel-registry is started.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = render(tmpl, Vars{
+		AccountName:  "example",
+		AuthTenantID: "example",
+		Port:         10000,
+		Storage:      map[string]string{},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry config template %s: %s", name, err.Error())
+	}
+	return tmpl, nil
+}
+
+//LoadTemplate reads the registry config template from the given file. If the
+//path is empty, the default template is returned.
+func LoadTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return ParseTemplate("default", strings.Replace(defaultTemplate, "\t", "    ", -1))
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTemplate(path, string(buf))
+}
+
+//Files contains the paths of the files that the keppel-registry config refers
+//to.
+type Files struct {
+	IssuerCertBundle string
+	//The following paths are only set when keppel-registry shall serve mutual
+	//TLS (see keppel.InternalCA).
+	TLSCertificate string
+	TLSKey         string
+	ClientCABundle string
+}
+
+//Render renders the registry config template, adds the settings that
+//keppel-registry needs to work with keppel-api, and returns the resulting
+//configuration file.
+func Render(tmpl *template.Template, vars Vars, files Files) ([]byte, error) {
+	cfg, err := render(tmpl, vars)
+	if err != nil {
+		return nil, err
+	}
+	applyRequiredSettings(cfg, vars, files)
+	return yaml.Marshal(cfg)
+}
+
+//render renders the registry config template and parses the result, so that
+//the required settings can be merged into it.
+func render(tmpl *template.Template, vars Vars) (map[interface{}]interface{}, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, vars)
+	if err != nil {
+		return nil, err
+	}
+	cfg := make(map[interface{}]interface{})
+	err = yaml.Unmarshal(buf.Bytes(), &cfg)
+	return cfg, err
+}
+
+//applyRequiredSettings adds the settings that keppel-registry needs to work
+//with keppel-api to the rendered registry config. These settings override
+//those from the template.
+func applyRequiredSettings(cfg map[interface{}]interface{}, vars Vars, files Files) {
+	publicURL := keppel.State.Config.APIPublicURL.String()
+	publicHost := keppel.State.Config.APIPublicHostname()
+
+	cfg["version"] = "0.1"
+	subsection(cfg, "http")["addr"] = fmt.Sprintf(":%d", vars.Port)
+	if files.TLSCertificate != "" {
+		//only clients with a certificate from the internal CA (i.e. keppel-api)
+		//may connect
+		subsection(cfg, "http")["tls"] = map[interface{}]interface{}{
+			"certificate": files.TLSCertificate,
+			"key":         files.TLSKey,
+			"clientcas":   []interface{}{files.ClientCABundle},
+		}
+	}
+	//adds the account name to all log messages produced by the keppel-registry
+	//(it is therefore safe to send its log directly to our own stdout)
+	subsection(subsection(cfg, "log"), "fields")["keppel.account"] = vars.AccountName
+	cfg["auth"] = map[interface{}]interface{}{
+		"token": map[interface{}]interface{}{
+			"realm":          publicURL + "/keppel/v1/auth",
+			"service":        publicHost,
+			"issuer":         "keppel-api@" + publicHost,
+			"rootcertbundle": files.IssuerCertBundle,
+		},
+	}
+
+	storage := subsection(cfg, "storage")
+	for key := range storage {
+		if keyStr, ok := key.(string); !ok || !allowedStorageSections[keyStr] {
+			delete(storage, key)
+		}
+	}
+	//required for image expiry; users cannot delete manifests since the auth API
+	//never grants the "*" action that keppel-registry requires for deletion
+	storage["delete"] = map[interface{}]interface{}{"enabled": true}
+}
+
+//subsection returns the section with the given key, creating it if it does
+//not exist yet.
+func subsection(section map[interface{}]interface{}, key string) map[interface{}]interface{} {
+	sub, ok := section[key].(map[interface{}]interface{})
+	if !ok {
+		sub = make(map[interface{}]interface{})
+		section[key] = sub
+	}
+	return sub
+}
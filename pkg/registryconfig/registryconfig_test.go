@@ -0,0 +1,162 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryconfig
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/test"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const testConfigTemplate = `
+version: 0.1
+log:
+  level: debug
+http:
+  addr: :5000
+  debug:
+    addr: :{{ .Port }}1
+notifications:
+  endpoints:
+    - name: audit
+      url: https://audit.example.org/{{ .AccountName }}
+      headers:
+        X-Tenant-ID: [ "{{ .AuthTenantID }}" ]
+redis:
+  addr: redis.example.org:6379
+storage:
+  filesystem:
+    rootdirectory: /var/lib/registry
+  delete:
+    enabled: false
+  redirect:
+    disable: true
+  maintenance:
+    uploadpurging:
+      enabled: false
+  cache:
+    blobdescriptor: redis
+    container: '{{ index .Storage "REGISTRY_STORAGE_SWIFT-PLUS_CONTAINER" }}'
+`
+
+const expectedConfig = `
+version: "0.1"
+log:
+  level: debug
+  fields:
+    keppel.account: first
+http:
+  addr: :10001
+  debug:
+    addr: :100011
+auth:
+  token:
+    realm: https://registry.example.org/keppel/v1/auth
+    service: registry.example.org
+    issuer: keppel-api@registry.example.org
+    rootcertbundle: /run/keppel/issuer-cert-bundle.pem
+notifications:
+  endpoints:
+    - name: audit
+      url: https://audit.example.org/first
+      headers:
+        X-Tenant-ID: [ tenant1 ]
+redis:
+  addr: redis.example.org:6379
+storage:
+  delete:
+    enabled: true
+  redirect:
+    disable: true
+  maintenance:
+    uploadpurging:
+      enabled: false
+  cache:
+    blobdescriptor: redis
+    container: keppel-first
+`
+
+func TestRegistryConfigTemplate(t *testing.T) {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: noop }
+	`)
+
+	tmpl, err := ParseTemplate("test", testConfigTemplate)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vars := Vars{
+		AccountName:  "first",
+		AuthTenantID: "tenant1",
+		Port:         10001,
+		Storage:      map[string]string{"REGISTRY_STORAGE_SWIFT-PLUS_CONTAINER": "keppel-first"},
+	}
+	actual, err := render(tmpl, vars)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	applyRequiredSettings(actual, vars, Files{IssuerCertBundle: "/run/keppel/issuer-cert-bundle.pem"})
+
+	//settings from the template are kept unless keppel requires a different value
+	expected := make(map[interface{}]interface{})
+	err = yaml.Unmarshal([]byte(expectedConfig), &expected)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "rendered config", actual, expected)
+
+	//when mutual TLS is enabled, keppel-registry only accepts clients with a
+	//certificate from the internal CA
+	actual, err = render(tmpl, vars)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	applyRequiredSettings(actual, vars, Files{
+		IssuerCertBundle: "/run/keppel/issuer-cert-bundle.pem",
+		TLSCertificate:   "/run/keppel/registry-first-cert.pem",
+		TLSKey:           "/run/keppel/registry-first-key.pem",
+		ClientCABundle:   "/run/keppel/internal-ca.pem",
+	})
+	expected["http"].(map[interface{}]interface{})["tls"] = map[interface{}]interface{}{
+		"certificate": "/run/keppel/registry-first-cert.pem",
+		"key":         "/run/keppel/registry-first-key.pem",
+		"clientcas":   []interface{}{"/run/keppel/internal-ca.pem"},
+	}
+	assert.DeepEqual(t, "rendered config with TLS", actual, expected)
+
+	//the default template must be valid
+	_, err = LoadTemplate("")
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	//errors in the template are reported at startup
+	for _, text := range []string{"version: {{ .Version }}", "version: {{ 0.1", "version: [0.1"} {
+		_, err := ParseTemplate("test", text)
+		if err == nil {
+			t.Errorf("expected error for template %q, but got none", text)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package sbom
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sapcc/keppel/pkg/keppel"
+	uuid "github.com/satori/go.uuid"
+)
+
+//CycloneDXMediaType is the media type of the documents generated by
+//RenderCycloneDX.
+const CycloneDXMediaType = "application/vnd.cyclonedx+json"
+
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type cdxComponent struct {
+	BOMRef  string `json:"bom-ref,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+//RenderCycloneDX renders the components found by the given scanner as a
+//CycloneDX 1.4 document in JSON format. The image is identified by its full
+//repository name (including the registry hostname) and its manifest digest.
+func RenderCycloneDX(s *Scanner, imageName, digest string, now time.Time) ([]byte, error) {
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + uuid.NewV4().String(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: now.UTC().Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: "keppel", Version: keppel.Version}},
+			Component: cdxComponent{
+				Type:    "container",
+				Name:    imageName,
+				Version: digest,
+			},
+		},
+		//ensure that this serializes as a list, not as null
+		Components: []cdxComponent{},
+	}
+
+	for _, c := range s.Components() {
+		purl := s.PackageURL(c)
+		componentType := "library"
+		if c.IsApplication {
+			componentType = "application"
+		}
+		doc.Components = append(doc.Components, cdxComponent{
+			BOMRef:  purl,
+			Type:    componentType,
+			Name:    c.Name,
+			Version: c.Version,
+			PURL:    purl,
+		})
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,319 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package sbom
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+//goBuildInfo is the subset of the build info embedded in Go binaries that we
+//are interested in. We parse it by hand since package debug/buildinfo is not
+//available in the Go version that we build with.
+type goBuildInfo struct {
+	GoVersion string
+	//Path is the import path of the main package.
+	Path string
+	Main goModule
+	Deps []goModule
+}
+
+type goModule struct {
+	Path    string
+	Version string
+	Replace *goModule
+}
+
+var goBuildInfoMagic = []byte("\xff Go buildinf:")
+
+const (
+	goBuildInfoHeaderSize = 32
+	//scanGoBuildInfo reads executables in chunks of this size
+	goBuildInfoChunkSize = 1 << 20
+	//the strings following the header in the build info of Go 1.18 and newer
+	//are at most this large (the module info of large binaries is a few dozen
+	//KiB)
+	maxGoBuildInfoStringsSize = 1 << 20
+	//flags in the build info header
+	goBuildInfoBigEndian     = 0x1
+	goBuildInfoInlineStrings = 0x2
+)
+
+//readGoBuildInfo looks for the build info in the given executable. Returns nil
+//if the executable is not a Go binary (or was built before Go 1.13).
+func readGoBuildInfo(buf []byte) *goBuildInfo {
+	//the header is 16-byte-aligned in memory, and thus also in the file; the
+	//alignment check also skips over copies of the magic string in string
+	//constants (e.g. in binaries that contain package debug/buildinfo)
+	start := 0
+	for {
+		idx := bytes.Index(buf[start:], goBuildInfoMagic)
+		if idx < 0 {
+			return nil
+		}
+		offset := start + idx
+		start = offset + 1
+		if offset%16 != 0 || len(buf)-offset < goBuildInfoHeaderSize {
+			continue
+		}
+		info := parseGoBuildInfoAt(buf, offset)
+		if info != nil {
+			return info
+		}
+	}
+}
+
+//scanGoBuildInfo is like readGoBuildInfo, but reads the executable from a
+//stream in chunks, so that only a small part of it needs to be in memory at
+//any time. Since this cannot follow pointers into parts of the file that were
+//already discarded, only the build info format of Go 1.18 and newer is
+//recognized, where the strings follow the header directly.
+func scanGoBuildInfo(r io.Reader) (*goBuildInfo, error) {
+	var (
+		window       []byte
+		windowOffset int64 //file offset of window[0]
+		eof          bool
+	)
+	//fill reads from r until the window contains at least n bytes, or until
+	//the end of the file
+	fill := func(n int) error {
+		if len(window) >= n || eof {
+			return nil
+		}
+		if cap(window) < n {
+			grown := make([]byte, len(window), n)
+			copy(grown, window)
+			window = grown
+		}
+		count, err := io.ReadFull(r, window[len(window):n])
+		window = window[:len(window)+count]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
+
+	for {
+		err := fill(goBuildInfoChunkSize)
+		if err != nil {
+			return nil, err
+		}
+
+		start := 0
+		for {
+			idx := bytes.Index(window[start:], goBuildInfoMagic)
+			if idx < 0 {
+				break
+			}
+			offset := start + idx
+			start = offset + 1
+			//same alignment check as in readGoBuildInfo
+			if (windowOffset+int64(offset))%16 != 0 {
+				continue
+			}
+			err := fill(offset + goBuildInfoHeaderSize + maxGoBuildInfoStringsSize)
+			if err != nil {
+				return nil, err
+			}
+			if len(window)-offset < goBuildInfoHeaderSize {
+				continue
+			}
+			flags := window[offset+len(goBuildInfoMagic)+1]
+			if flags&goBuildInfoInlineStrings == 0 {
+				continue
+			}
+			info := parseGoBuildInfoAt(window, offset)
+			if info != nil {
+				return info, nil
+			}
+		}
+		if eof {
+			return nil, nil
+		}
+
+		//keep the end of the window, since it might contain the start of the
+		//magic string
+		discard := len(window) - (len(goBuildInfoMagic) - 1)
+		windowOffset += int64(discard)
+		window = append(window[:0], window[discard:]...)
+	}
+}
+
+func parseGoBuildInfoAt(buf []byte, offset int) *goBuildInfo {
+	hdr := buf[offset : offset+goBuildInfoHeaderSize]
+	ptrSize := int(hdr[len(goBuildInfoMagic)])
+	flags := hdr[len(goBuildInfoMagic)+1]
+
+	var version, modinfo string
+	if flags&goBuildInfoInlineStrings != 0 {
+		//since Go 1.18, both strings follow the header directly
+		rest := buf[offset+goBuildInfoHeaderSize:]
+		var ok bool
+		version, rest, ok = readVarintString(rest)
+		if !ok {
+			return nil
+		}
+		modinfo, _, ok = readVarintString(rest)
+		if !ok {
+			return nil
+		}
+	} else {
+		//before that, the header contains pointers to string headers, so we need
+		//to map memory addresses to file offsets
+		if ptrSize != 4 && ptrSize != 8 {
+			return nil
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if flags&goBuildInfoBigEndian != 0 {
+			order = binary.BigEndian
+		}
+		img := executableImage{buf, ptrSize, order}
+		segments := img.segments()
+		if len(segments) == 0 {
+			return nil
+		}
+		version = img.readString(segments, img.readPtr(hdr[16:]))
+		modinfo = img.readString(segments, img.readPtr(hdr[16+ptrSize:]))
+	}
+
+	if !strings.HasPrefix(version, "go") {
+		return nil
+	}
+	info := &goBuildInfo{GoVersion: version}
+	//the module info is enclosed in 16-byte sentinels
+	if len(modinfo) >= 33 && modinfo[len(modinfo)-17] == '\n' {
+		info.parseModInfo(modinfo[16 : len(modinfo)-16])
+	}
+	return info
+}
+
+func readVarintString(buf []byte) (value string, rest []byte, ok bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return "", nil, false
+	}
+	buf = buf[n:]
+	return string(buf[:length]), buf[length:], true
+}
+
+//parseModInfo parses the module information in the format produced by
+//`go version -m`.
+func (info *goBuildInfo) parseModInfo(modinfo string) {
+	var last *goModule
+	for _, line := range strings.Split(modinfo, "\n") {
+		fields := strings.Split(line, "\t")
+		switch fields[0] {
+		case "path":
+			if len(fields) > 1 {
+				info.Path = fields[1]
+			}
+		case "mod":
+			info.Main = parseGoModule(fields)
+			last = &info.Main
+		case "dep":
+			info.Deps = append(info.Deps, parseGoModule(fields))
+			last = &info.Deps[len(info.Deps)-1]
+		case "=>":
+			//replacements refer to the module on the previous line
+			if last != nil {
+				replace := parseGoModule(fields)
+				last.Replace = &replace
+				last = nil
+			}
+		}
+	}
+}
+
+func parseGoModule(fields []string) goModule {
+	var m goModule
+	if len(fields) > 1 {
+		m.Path = fields[1]
+	}
+	if len(fields) > 2 {
+		m.Version = fields[2]
+	}
+	return m
+}
+
+//executableImage is used to follow pointers in the build info of binaries
+//built before Go 1.18. Only ELF and Mach-O binaries are supported here.
+type executableImage struct {
+	buf     []byte
+	ptrSize int
+	order   binary.ByteOrder
+}
+
+type executableSegment struct {
+	Addr   uint64
+	Offset uint64
+	Size   uint64
+}
+
+func (img executableImage) segments() []executableSegment {
+	var result []executableSegment
+	if f, err := elf.NewFile(bytes.NewReader(img.buf)); err == nil {
+		for _, p := range f.Progs {
+			if p.Type == elf.PT_LOAD {
+				result = append(result, executableSegment{p.Vaddr, p.Off, p.Filesz})
+			}
+		}
+	} else if f, err := macho.NewFile(bytes.NewReader(img.buf)); err == nil {
+		for _, l := range f.Loads {
+			if s, ok := l.(*macho.Segment); ok {
+				result = append(result, executableSegment{s.Addr, s.Offset, s.Filesz})
+			}
+		}
+	}
+	return result
+}
+
+func (img executableImage) readPtr(buf []byte) uint64 {
+	if img.ptrSize == 4 {
+		return uint64(img.order.Uint32(buf))
+	}
+	return img.order.Uint64(buf)
+}
+
+//read returns the given memory range, or nil if it is not backed by the file.
+func (img executableImage) read(segments []executableSegment, addr, size uint64) []byte {
+	for _, s := range segments {
+		if addr < s.Addr || addr-s.Addr > s.Size || size > s.Size-(addr-s.Addr) {
+			continue
+		}
+		offset := s.Offset + (addr - s.Addr)
+		if offset > uint64(len(img.buf)) || size > uint64(len(img.buf))-offset {
+			return nil
+		}
+		return img.buf[offset : offset+size]
+	}
+	return nil
+}
+
+func (img executableImage) readString(segments []executableSegment, addr uint64) string {
+	hdr := img.read(segments, addr, uint64(2*img.ptrSize))
+	if hdr == nil {
+		return ""
+	}
+	return string(img.read(segments, img.readPtr(hdr), img.readPtr(hdr[img.ptrSize:])))
+}
@@ -0,0 +1,241 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package sbom
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+//parser extracts components from a single file in a layer.
+type parser func(filePath string, r io.Reader, size int64) ([]Component, error)
+
+const (
+	//package metadata files are small, so we do not read more than this
+	maxMetadataSize = 64 << 20
+	//binaries up to this size are read into memory completely, so that we can
+	//also find the build info of binaries built before Go 1.18 (see
+	//readGoBuildInfo); larger binaries are scanned in chunks (see
+	//scanGoBuildInfo)
+	maxBufferedExecutableSize = 16 << 20
+)
+
+var (
+	npmPackageRx    = regexp.MustCompile(`/node_modules/(?:@[^/]+/)?[^/]+/package\.json$`)
+	pythonPackageRx = regexp.MustCompile(`\.(?:dist-info/METADATA|egg-info/PKG-INFO)$`)
+)
+
+//findParser returns the parser for the given file, or nil if the file is not
+//interesting.
+func findParser(filePath string, hdr *tar.Header) parser {
+	switch {
+	case filePath == "/var/lib/dpkg/status", strings.HasPrefix(filePath, "/var/lib/dpkg/status.d/"):
+		return parseDpkgStatus
+	case filePath == "/lib/apk/db/installed":
+		return parseApkInstalled
+	case pythonPackageRx.MatchString(filePath):
+		return parsePythonMetadata
+	case npmPackageRx.MatchString(filePath):
+		return parseNpmPackageJSON
+	case hdr.Mode&0111 != 0 && hdr.Size > 0:
+		return parseGoBuildInfo
+	default:
+		return nil
+	}
+}
+
+//parseStanzas parses files consisting of "Key: value" lines, where records are
+//separated by empty lines (like the dpkg status file or Python package
+//metadata). Continuation lines are ignored. The callback is invoked for each
+//record.
+func parseStanzas(r io.Reader, handle func(map[string]string)) error {
+	scanner := bufio.NewScanner(io.LimitReader(r, maxMetadataSize))
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	record := make(map[string]string)
+	flush := func() {
+		if len(record) > 0 {
+			handle(record)
+			record = make(map[string]string)
+		}
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 {
+			key := fields[0]
+			if _, exists := record[key]; !exists {
+				record[key] = strings.TrimSpace(fields[1])
+			}
+		}
+	}
+	flush()
+	return scanner.Err()
+}
+
+func parseDpkgStatus(filePath string, r io.Reader, size int64) ([]Component, error) {
+	var result []Component
+	err := parseStanzas(r, func(record map[string]string) {
+		//packages that were removed, but not purged, remain in the status file
+		if record["Package"] == "" || !strings.HasSuffix(record["Status"], " installed") {
+			return
+		}
+		result = append(result, Component{
+			Ecosystem: "deb",
+			Name:      record["Package"],
+			Version:   record["Version"],
+			Arch:      record["Architecture"],
+		})
+	})
+	return result, err
+}
+
+func parseApkInstalled(filePath string, r io.Reader, size int64) ([]Component, error) {
+	var result []Component
+	err := parseStanzas(r, func(record map[string]string) {
+		if record["P"] == "" {
+			return
+		}
+		result = append(result, Component{
+			Ecosystem: "apk",
+			Name:      record["P"],
+			Version:   record["V"],
+			Arch:      record["A"],
+		})
+	})
+	return result, err
+}
+
+func parsePythonMetadata(filePath string, r io.Reader, size int64) ([]Component, error) {
+	var result []Component
+	//only the header (i.e. the first stanza) contains the fields we need
+	err := parseStanzas(r, func(record map[string]string) {
+		if len(result) > 0 || record["Name"] == "" {
+			return
+		}
+		result = append(result, Component{
+			Ecosystem: "pypi",
+			Name:      strings.ToLower(record["Name"]),
+			Version:   record["Version"],
+		})
+	})
+	return result, err
+}
+
+func parseNpmPackageJSON(filePath string, r io.Reader, size int64) ([]Component, error) {
+	var data struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	err := json.NewDecoder(io.LimitReader(r, maxMetadataSize)).Decode(&data)
+	if err != nil || data.Name == "" {
+		return nil, err
+	}
+	return []Component{{Ecosystem: "npm", Name: data.Name, Version: data.Version}}, nil
+}
+
+var executableMagics = [][]byte{
+	[]byte("\x7FELF"),
+	[]byte("MZ"),               //PE
+	[]byte("\xFE\xED\xFA\xCF"), //Mach-O 64-bit (big endian)
+	[]byte("\xCF\xFA\xED\xFE"), //Mach-O 64-bit (little endian)
+}
+
+func parseGoBuildInfo(filePath string, r io.Reader, size int64) ([]Component, error) {
+	//look at the magic number first to avoid reading scripts etc. into memory
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	isExecutable := false
+	for _, m := range executableMagics {
+		if bytes.HasPrefix(magic, m) {
+			isExecutable = true
+		}
+	}
+	if !isExecutable {
+		return nil, nil
+	}
+
+	var info *goBuildInfo
+	if size <= maxBufferedExecutableSize {
+		buf, err := ioutil.ReadAll(io.LimitReader(br, size))
+		if err != nil {
+			return nil, err
+		}
+		info = readGoBuildInfo(buf)
+	} else {
+		var err error
+		info, err = scanGoBuildInfo(io.LimitReader(br, size))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if info == nil {
+		//not a Go binary
+		return nil, nil
+	}
+
+	//binaries built without modules only report the import path of their main
+	//package, but not its version
+	main := info.Main
+	if main.Path == "" {
+		main.Path = info.Path
+	}
+	var result []Component
+	if main.Path != "" {
+		result = append(result, Component{
+			Ecosystem:     "golang",
+			Name:          main.Path,
+			Version:       main.Version,
+			IsApplication: true,
+		})
+	}
+	//the standard library is compiled into every binary
+	result = append(result, Component{Ecosystem: "golang", Name: "stdlib", Version: info.GoVersion})
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = *dep.Replace
+		}
+		result = append(result, Component{Ecosystem: "golang", Name: dep.Path, Version: dep.Version})
+	}
+	return result, nil
+}
+
+//parseOSReleaseID returns the ID field from an os-release file.
+func parseOSReleaseID(r io.Reader) string {
+	scanner := bufio.NewScanner(io.LimitReader(r, maxMetadataSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "ID="), `"'`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+//Package sbom generates software bills of materials for container images by
+//looking for package databases and other package metadata in the image
+//layers.
+package sbom
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+//Component is a software package that was found in an image.
+type Component struct {
+	//Ecosystem is the package type as used in package URLs, e.g. "deb", "apk",
+	//"golang", "pypi" or "npm".
+	Ecosystem string
+	Name      string
+	Version   string
+	//Arch is only set for OS packages.
+	Arch string
+	//IsApplication is set for the main modules of Go binaries. All other
+	//components are libraries.
+	IsApplication bool
+}
+
+//Scanner collects components from the layers of an image. Layers must be
+//given to ScanLayer in order, starting from the base layer, so that files
+//from lower layers that are deleted in upper layers can be disregarded.
+type Scanner struct {
+	//key = path of the file in which the components were found
+	found map[string][]Component
+	//the ID field from /etc/os-release, which is used as the namespace in
+	//package URLs for OS packages
+	osID string
+}
+
+//NewScanner initializes a Scanner for a new image.
+func NewScanner() *Scanner {
+	return &Scanner{found: make(map[string][]Component)}
+}
+
+//ScanLayer reads the given layer, which must be a tar archive that is
+//optionally gzip-compressed.
+func (s *Scanner) ScanLayer(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	var tr *tar.Reader
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		tr = tar.NewReader(gzr)
+	} else {
+		tr = tar.NewReader(br)
+	}
+
+	//whiteouts and replaced files only affect lower layers, so they are
+	//collected separately and only applied once the layer has been read
+	layerFound := make(map[string][]Component)
+	replacedPaths := make(map[string]bool)
+	var deletedPaths, opaqueDirs []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		filePath := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(filePath)
+		switch {
+		case base == ".wh..wh..opq":
+			opaqueDirs = append(opaqueDirs, dir)
+			continue
+		case strings.HasPrefix(base, ".wh."):
+			deletedPaths = append(deletedPaths, path.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			//directories are merged with those from lower layers
+			continue
+		}
+		replacedPaths[filePath] = true
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if filePath == "/etc/os-release" || filePath == "/usr/lib/os-release" {
+			s.osID = parseOSReleaseID(tr)
+			continue
+		}
+		parse := findParser(filePath, hdr)
+		if parse == nil {
+			continue
+		}
+		//malformed package metadata is not an error for the whole image; it just
+		//does not contribute any components
+		components, err := parse(filePath, tr, hdr.Size)
+		if err == nil && len(components) > 0 {
+			layerFound[filePath] = components
+		}
+	}
+
+	for filePath := range s.found {
+		if replacedPaths[filePath] || isBelowAny(filePath, deletedPaths, opaqueDirs) {
+			delete(s.found, filePath)
+		}
+	}
+	for filePath, components := range layerFound {
+		s.found[filePath] = components
+	}
+	return nil
+}
+
+func isBelowAny(filePath string, deletedPaths, opaqueDirs []string) bool {
+	for _, p := range deletedPaths {
+		if filePath == p || strings.HasPrefix(filePath, p+"/") {
+			return true
+		}
+	}
+	for _, dir := range opaqueDirs {
+		if strings.HasPrefix(filePath, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+//Components returns all components found in the layers scanned so far,
+//without duplicates and sorted by package URL.
+func (s *Scanner) Components() []Component {
+	byPURL := make(map[string]Component)
+	for _, components := range s.found {
+		for _, c := range components {
+			byPURL[s.PackageURL(c)] = c
+		}
+	}
+
+	purls := make([]string, 0, len(byPURL))
+	for purl := range byPURL {
+		purls = append(purls, purl)
+	}
+	sort.Strings(purls)
+	result := make([]Component, len(purls))
+	for idx, purl := range purls {
+		result[idx] = byPURL[purl]
+	}
+	return result
+}
+
+//PackageURL renders the package URL (see <https://github.com/package-url/purl-spec>)
+//for the given component.
+func (s *Scanner) PackageURL(c Component) string {
+	name := escapePURLSegment(c.Name)
+	switch c.Ecosystem {
+	case "deb", "apk":
+		if s.osID != "" {
+			name = escapePURLSegment(s.osID) + "/" + name
+		}
+	case "golang":
+		//Go module paths are split into namespace and name at the slashes
+		segments := strings.Split(c.Name, "/")
+		for idx, segment := range segments {
+			segments[idx] = escapePURLSegment(segment)
+		}
+		name = strings.Join(segments, "/")
+	case "npm":
+		//scoped packages: the scope is the namespace
+		if strings.HasPrefix(c.Name, "@") && strings.Contains(c.Name, "/") {
+			fields := strings.SplitN(c.Name, "/", 2)
+			name = escapePURLSegment(fields[0]) + "/" + escapePURLSegment(fields[1])
+		}
+	}
+
+	purl := "pkg:" + c.Ecosystem + "/" + name
+	if c.Version != "" {
+		purl += "@" + escapePURLSegment(c.Version)
+	}
+	if c.Arch != "" {
+		purl += "?arch=" + escapePURLSegment(c.Arch)
+	}
+	return purl
+}
+
+//escapePURLSegment percent-encodes all characters that are not allowed
+//verbatim in a segment of a package URL.
+func escapePURLSegment(in string) string {
+	var buf strings.Builder
+	for _, b := range []byte(in) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+			buf.WriteByte(b)
+		case b == '.' || b == '-' || b == '_' || b == '~':
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
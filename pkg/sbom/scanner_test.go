@@ -0,0 +1,363 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package sbom
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+const dpkgStatus = `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.28-10
+Description: GNU C Library: Shared libraries
+ Contains the standard libraries that are used by nearly all programs on
+ the system.
+
+Package: removed-package
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: tzdata
+Status: install ok installed
+Architecture: all
+Version: 2021a-0+deb10u1
+`
+
+const apkInstalled = `C:Q1abc=
+P:musl
+V:1.2.2-r3
+A:x86_64
+
+C:Q1def=
+P:busybox
+V:1.33.1-r3
+A:x86_64
+`
+
+func purlsOf(s *Scanner) []string {
+	var result []string
+	for _, c := range s.Components() {
+		result = append(result, s.PackageURL(c))
+	}
+	return result
+}
+
+func TestScanLayers(t *testing.T) {
+	s := NewScanner()
+	layers := [][]byte{
+		test.MakeLayer(
+			test.LayerFile{Path: "etc/os-release", Contents: "NAME=\"Debian GNU/Linux\"\nID=debian\n"},
+			test.LayerFile{Path: "var/lib/dpkg/status", Contents: dpkgStatus},
+			test.LayerFile{Path: "usr/lib/python3/dist-packages/Requests-2.25.1.dist-info/METADATA", Contents: "Metadata-Version: 2.1\nName: Requests\nVersion: 2.25.1\n\nlong description\nName: ignored\n"},
+			test.LayerFile{Path: "app/node_modules/left-pad/package.json", Contents: `{"name":"left-pad","version":"1.3.0"}`},
+			test.LayerFile{Path: "app/node_modules/@types/node/package.json", Contents: `{"name":"@types/node","version":"14.0.0"}`},
+			test.LayerFile{Path: "app/node_modules/broken/package.json", Contents: `{`},
+			test.LayerFile{Path: "app/script.sh", Contents: "#!/bin/sh\necho hello\n", Mode: 0755},
+		),
+		//the second layer deletes left-pad and replaces the dpkg status file
+		test.MakeLayer(
+			test.LayerFile{Path: "app/node_modules/.wh.left-pad"},
+			test.LayerFile{Path: "var/lib/dpkg/status", Contents: strings.Replace(dpkgStatus, "2.28-10", "2.28-10+deb10u1", 1)},
+		),
+	}
+	for _, layer := range layers {
+		err := s.ScanLayer(bytes.NewReader(layer))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	assert.DeepEqual(t, "components", purlsOf(s), []string{
+		"pkg:deb/debian/libc6@2.28-10%2Bdeb10u1?arch=amd64",
+		"pkg:deb/debian/tzdata@2021a-0%2Bdeb10u1?arch=all",
+		"pkg:npm/%40types/node@14.0.0",
+		"pkg:pypi/requests@2.25.1",
+	})
+
+	//opaque whiteouts hide everything in the directory from lower layers
+	err := s.ScanLayer(bytes.NewReader(test.MakeLayer(
+		test.LayerFile{Path: "app/.wh..wh..opq"},
+		test.LayerFile{Path: "app/node_modules/left-pad/package.json", Contents: `{"name":"left-pad","version":"1.3.1"}`},
+	)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "components", purlsOf(s), []string{
+		"pkg:deb/debian/libc6@2.28-10%2Bdeb10u1?arch=amd64",
+		"pkg:deb/debian/tzdata@2021a-0%2Bdeb10u1?arch=all",
+		"pkg:npm/left-pad@1.3.1",
+		"pkg:pypi/requests@2.25.1",
+	})
+}
+
+func TestScanAlpineLayer(t *testing.T) {
+	s := NewScanner()
+	err := s.ScanLayer(bytes.NewReader(test.MakeLayer(
+		test.LayerFile{Path: "lib/apk/db/installed", Contents: apkInstalled},
+	)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//without /etc/os-release, there is no namespace for OS packages
+	assert.DeepEqual(t, "components", purlsOf(s), []string{
+		"pkg:apk/busybox@1.33.1-r3?arch=x86_64",
+		"pkg:apk/musl@1.2.2-r3?arch=x86_64",
+	})
+}
+
+func TestScanGoBinary(t *testing.T) {
+	//the test binary itself is a Go binary with build info
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := NewScanner()
+	err = s.ScanLayer(bytes.NewReader(test.MakeLayer(
+		test.LayerFile{Path: "usr/bin/app", Contents: string(contents), Mode: 0755},
+		//the same binary without executable permission is ignored
+		test.LayerFile{Path: "usr/share/app", Contents: string(contents)},
+	)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	components := s.Components()
+	if len(components) == 0 {
+		t.Fatal("no components found in Go binary")
+	}
+	for _, c := range components {
+		if c.Ecosystem != "golang" {
+			t.Errorf("unexpected component in Go binary: %#v", c)
+		}
+	}
+	if _, exists := s.found["/usr/share/app"]; exists {
+		t.Error("non-executable file was scanned as a Go binary")
+	}
+}
+
+//makeGoBinary builds a minimal ELF file containing Go build info, either in
+//the format used since Go 1.18 (with the strings inline) or in the format used
+//before (with pointers to the strings).
+func makeGoBinary(version, modinfo string, inline bool) []byte {
+	const baseAddr = 0x400000
+	//wrap modinfo in sentinels like the Go linker does
+	modinfo = strings.Repeat("\x00", 16) + modinfo + strings.Repeat("\x00", 16)
+
+	var buf bytes.Buffer
+	must := func(err error) {
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	must(binary.Write(&buf, binary.LittleEndian, elf.Header64{
+		Ident:     [elf.EI_NIDENT]byte{0x7F, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)},
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     64,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     1,
+		Shentsize: 64,
+	}))
+	//the program header is filled in at the end, when the file size is known
+	progOffset := buf.Len()
+	buf.Write(make([]byte, 56+8))
+
+	hdrOffset := buf.Len()
+	buf.Write(goBuildInfoMagic)
+	if inline {
+		buf.Write([]byte{8, goBuildInfoInlineStrings})
+		buf.Write(make([]byte, 16))
+		for _, str := range []string{version, modinfo} {
+			var length [binary.MaxVarintLen64]byte
+			buf.Write(length[:binary.PutUvarint(length[:], uint64(len(str)))])
+			buf.WriteString(str)
+		}
+	} else {
+		//header with pointers to two string headers, followed by the string
+		//headers, followed by the string contents
+		stringHeaderAddr := uint64(baseAddr + hdrOffset + goBuildInfoHeaderSize)
+		stringAddr := stringHeaderAddr + 32
+		buf.Write([]byte{8, 0})
+		must(binary.Write(&buf, binary.LittleEndian, []uint64{
+			stringHeaderAddr, stringHeaderAddr + 16,
+			stringAddr, uint64(len(version)),
+			stringAddr + uint64(len(version)), uint64(len(modinfo)),
+		}))
+		buf.WriteString(version)
+		buf.WriteString(modinfo)
+	}
+
+	result := buf.Bytes()
+	var prog bytes.Buffer
+	must(binary.Write(&prog, binary.LittleEndian, elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R),
+		Vaddr:  baseAddr,
+		Paddr:  baseAddr,
+		Filesz: uint64(len(result)),
+		Memsz:  uint64(len(result)),
+		Align:  0x1000,
+	}))
+	copy(result[progOffset:], prog.Bytes())
+	return result
+}
+
+func TestReadGoBuildInfo(t *testing.T) {
+	modinfo := "path\texample.com/app/cmd/app\n" +
+		"mod\texample.com/app\tv1.2.3\th1:abc=\n" +
+		"dep\texample.com/lib\tv0.1.0\th1:def=\n" +
+		"dep\texample.com/old\tv1.0.0\n" +
+		"=>\texample.com/new\tv1.1.0\th1:ghi=\n" +
+		"build\t-compiler=gc\n"
+
+	for _, inline := range []bool{true, false} {
+		contents := makeGoBinary("go1.16.5", modinfo, inline)
+		s := NewScanner()
+		err := s.ScanLayer(bytes.NewReader(test.MakeLayer(
+			test.LayerFile{Path: "usr/bin/app", Contents: string(contents), Mode: 0755},
+		)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, fmt.Sprintf("components with inline = %t", inline), purlsOf(s), []string{
+			"pkg:golang/example.com/app@v1.2.3",
+			"pkg:golang/example.com/lib@v0.1.0",
+			"pkg:golang/example.com/new@v1.1.0",
+			"pkg:golang/stdlib@go1.16.5",
+		})
+	}
+
+	//a copy of the magic string that is not followed by a valid header is ignored
+	buf := append([]byte("\x7FELF"), make([]byte, 12)...)
+	buf = append(buf, goBuildInfoMagic...)
+	buf = append(buf, make([]byte, 64)...)
+	if info := readGoBuildInfo(buf); info != nil {
+		t.Errorf("expected no build info, but got %#v", info)
+	}
+}
+
+func TestScanGoBuildInfo(t *testing.T) {
+	modinfo := "path\texample.com/app/cmd/app\n" +
+		"mod\texample.com/app\tv1.2.3\th1:abc=\n"
+	expected := &goBuildInfo{
+		GoVersion: "go1.21.0",
+		Path:      "example.com/app/cmd/app",
+		Main:      goModule{Path: "example.com/app", Version: "v1.2.3"},
+	}
+
+	//the build info is at the end of the executable, in various positions
+	//relative to the chunk boundaries
+	contents := makeGoBinary("go1.21.0", modinfo, true)
+	header := contents[:64]
+	buildInfo := contents[64+56+8:]
+	for _, offset := range []int{128, goBuildInfoChunkSize - 16, goBuildInfoChunkSize, 2*goBuildInfoChunkSize + 48} {
+		buf := make([]byte, offset)
+		copy(buf, header)
+		buf = append(buf, buildInfo...)
+		info, err := scanGoBuildInfo(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, fmt.Sprintf("build info at offset %d", offset), info, expected)
+	}
+
+	//build info in the format from before Go 1.18 cannot be read this way, but
+	//does not confuse the scanner either
+	info, err := scanGoBuildInfo(bytes.NewReader(makeGoBinary("go1.16.5", modinfo, false)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info != nil {
+		t.Errorf("expected no build info, but got %#v", info)
+	}
+}
+
+func TestRenderCycloneDX(t *testing.T) {
+	s := NewScanner()
+	err := s.ScanLayer(bytes.NewReader(test.MakeLayer(
+		test.LayerFile{Path: "lib/apk/db/installed", Contents: apkInstalled},
+	)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf, err := RenderCycloneDX(s, "registry.example.org/first/foo", "sha256:abc", time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(buf, &doc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//the serial number is random
+	delete(doc, "serialNumber")
+	assert.DeepEqual(t, "CycloneDX document", doc, map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.4",
+		"version":     1.0,
+		"metadata": map[string]interface{}{
+			"timestamp": "1970-01-01T00:00:00Z",
+			"tools":     []interface{}{map[string]interface{}{"name": "keppel"}},
+			"component": map[string]interface{}{
+				"type":    "container",
+				"name":    "registry.example.org/first/foo",
+				"version": "sha256:abc",
+			},
+		},
+		"components": []interface{}{
+			map[string]interface{}{
+				"bom-ref": "pkg:apk/busybox@1.33.1-r3?arch=x86_64",
+				"type":    "library",
+				"name":    "busybox",
+				"version": "1.33.1-r3",
+				"purl":    "pkg:apk/busybox@1.33.1-r3?arch=x86_64",
+			},
+			map[string]interface{}{
+				"bom-ref": "pkg:apk/musl@1.2.2-r3?arch=x86_64",
+				"type":    "library",
+				"name":    "musl",
+				"version": "1.2.2-r3",
+				"purl":    "pkg:apk/musl@1.2.2-r3?arch=x86_64",
+			},
+		},
+	})
+}
@@ -0,0 +1,48 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"context"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//RunAccessLogCleanup deletes access log entries that have exceeded their
+//retention period, periodically until the given context expires.
+func RunAccessLogCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		count, err := keppel.State.DB.PruneAccessLog(time.Now())
+		if err == nil {
+			logg.Debug("deleted %d expired access log entries", count)
+		} else {
+			logg.Error("access log cleanup failed: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+	swiftplus "github.com/sapcc/keppel/pkg/registry/swift-plus"
+)
+
+//The pseudo-user name that appears in audit events for warnings and deletions
+//performed by the account expiry.
+const accountExpiryUserName = "keppel-account-expiry"
+
+//The pseudo-user name that appears in audit events for deletions performed
+//at the end of the grace period of deleted accounts.
+const accountDeletionUserName = "keppel-account-deletion"
+
+//AccountExpiryWarningPeriod is how long before the expiry of an ephemeral
+//account its owners are warned by an audit event.
+var AccountExpiryWarningPeriod = 24 * time.Hour
+
+//RunAccountExpiry calls ExpireAccounts periodically until the given context
+//expires.
+func RunAccountExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := ExpireAccounts(ctx, time.Now())
+		if err != nil {
+			logg.Error("account expiry failed: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//ExpireAccounts deletes all ephemeral accounts that have expired at the given
+//time, and warns about ephemeral accounts that will expire within
+//AccountExpiryWarningPeriod.
+func ExpireAccounts(ctx context.Context, now time.Time) error {
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts,
+		`SELECT * FROM accounts WHERE expires_at IS NOT NULL ORDER BY name`)
+	if err != nil {
+		return err
+	}
+
+	//a broken account shall not prevent expiry of all other accounts
+	for _, account := range accounts {
+		var err error
+		switch {
+		case account.IsExpired(now):
+			reason := fmt.Sprintf("account expired at %s", account.ExpiresAt.UTC().Format(time.RFC3339))
+			err = DeleteAccount(ctx, account, accountExpiryUserName, reason)
+		case !account.ExpiryWarningSent && account.IsExpired(now.Add(AccountExpiryWarningPeriod)):
+			err = warnAboutAccountExpiry(account)
+		}
+		if err != nil {
+			logg.Error("account expiry failed for account %s: %s", account.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+//RunAccountDeletion calls DeletePendingAccounts periodically until the given
+//context expires.
+func RunAccountDeletion(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := DeletePendingAccounts(ctx, time.Now())
+		if err != nil {
+			logg.Error("account deletion failed: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//DeletePendingAccounts deletes all accounts that are pending deletion and
+//whose grace period has passed at the given time. For accounts that are
+//still in their grace period, it ensures that their keppel-registry is not
+//running.
+func DeletePendingAccounts(ctx context.Context, now time.Time) error {
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts,
+		`SELECT * FROM accounts WHERE deleted_at IS NOT NULL ORDER BY name`)
+	if err != nil {
+		return err
+	}
+
+	//a broken account shall not prevent deletion of all other accounts
+	for _, account := range accounts {
+		var err error
+		if now.Before(account.DeletedAt.Add(keppel.State.Config.AccountDeletionGracePeriod)) {
+			err = stopRegistry(account)
+		} else {
+			reason := fmt.Sprintf("deletion was requested at %s", account.DeletedAt.UTC().Format(time.RFC3339))
+			err = DeleteAccount(ctx, account, accountDeletionUserName, reason)
+		}
+		if err != nil {
+			logg.Error("account deletion failed for account %s: %s", account.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func warnAboutAccountExpiry(account keppel.Account) error {
+	//only one keppel-api shall record the warning
+	result, err := keppel.State.DB.Exec(
+		`UPDATE accounts SET expiry_warning_sent = TRUE WHERE name = $1 AND expiry_warning_sent = FALSE`,
+		account.Name)
+	if err != nil {
+		return err
+	}
+	rowCount, err := result.RowsAffected()
+	if err != nil || rowCount == 0 {
+		return err
+	}
+	return keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+		AccountName: account.Name,
+		Action:      "warn_account_expiry",
+		UserName:    accountExpiryUserName,
+		Details: fmt.Sprintf("account will be deleted at %s unless it is renewed",
+			account.ExpiresAt.UTC().Format(time.RFC3339)),
+	})
+}
+
+//DeleteAccount tears down the given account completely: Its keppel-registry
+//is stopped, its storage and its metadata database are deleted, and finally,
+//the account itself is deleted and its name is released. The account record
+//is deleted last, so that the deletion can be retried if any of the previous
+//steps fails. The deletion is recorded in the audit log with the given user
+//name and reason.
+//
+//The caller must ensure that the keppel-registry of the account is not
+//started again while this runs, i.e. the account must not be usable anymore
+//(see keppel.Account.IsUsable).
+func DeleteAccount(ctx context.Context, account keppel.Account, userName, reason string) error {
+	//legal holds would prevent the deletion of the account record anyway, so
+	//check this before anything is destroyed
+	holdCount, err := keppel.State.DB.SelectInt(
+		`SELECT COUNT(*) FROM legal_holds WHERE account_name = $1`, account.Name)
+	if err != nil {
+		return err
+	}
+	if holdCount > 0 {
+		return errors.New("cannot delete account while it is under legal hold")
+	}
+	if account.ReadOnly {
+		//e.g. a backup is being taken, which shall include this account
+		return errors.New("cannot delete account while it is read-only")
+	}
+
+	err = stopRegistry(account)
+	if err != nil {
+		return err
+	}
+
+	env, err := keppel.State.StorageDriver.GetEnvironment(account, keppel.State.AuthDriver)
+	if err != nil {
+		return err
+	}
+	if swiftplus.IsConfiguredIn(env) {
+		err := swiftplus.DeleteStorage(ctx, env)
+		if err != nil {
+			return fmt.Errorf("cannot delete storage: %s", err.Error())
+		}
+	}
+
+	//the metadata database is always on the same server as our own database
+	//(the orchestration drivers point keppel-registry to it by replacing the
+	//database name in db.url), and keppel-api has checked on startup that it
+	//may drop it
+	if keppel.State.Config.DatabaseURL != nil { //is nil in unit tests
+		err := keppel.State.DB.DropAccountDatabase(account)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = keppel.State.DB.Exec(`DELETE FROM accounts WHERE name = $1`, account.Name)
+	if err != nil {
+		return err
+	}
+	logg.Info("deleted account %s: %s", account.Name, reason)
+	err = keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+		AccountName: account.Name,
+		Action:      "delete_account",
+		UserName:    userName,
+		Details:     reason,
+	})
+	if err != nil {
+		return err
+	}
+	return keppel.State.FederationDriver.ForfeitAccountName(account)
+}
+
+func stopRegistry(account keppel.Account) error {
+	stopper, ok := keppel.State.OrchestrationDriver.(keppel.RegistryStopper)
+	if !ok {
+		return nil
+	}
+	err := stopper.StopRegistry(account)
+	if err != nil {
+		return fmt.Errorf("cannot stop keppel-registry: %s", err.Error())
+	}
+	return nil
+}
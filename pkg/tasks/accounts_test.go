@@ -0,0 +1,128 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestAccountExpiry(t *testing.T) {
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	setupRegistries(t,
+		keppel.Account{Name: "expired", AuthTenantID: "tenant1", ExpiresAt: at(-time.Minute)},
+		keppel.Account{Name: "held", AuthTenantID: "tenant1", ExpiresAt: at(-time.Hour)},
+		keppel.Account{Name: "later", AuthTenantID: "tenant1", ExpiresAt: at(48 * time.Hour)},
+		keppel.Account{Name: "permanent", AuthTenantID: "tenant1"},
+		keppel.Account{Name: "soon", AuthTenantID: "tenant1", ExpiresAt: at(2 * time.Hour)},
+	)
+	err := keppel.State.DB.Insert(&keppel.LegalHold{
+		AccountName: "held",
+		RepoName:    "foo",
+		Reason:      "litigation",
+		CreatedAt:   now,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//running this twice shall not warn twice
+	for i := 0; i < 2; i++ {
+		err := ExpireAccounts(context.Background(), now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	var accountNames []string
+	_, err = keppel.State.DB.Select(&accountNames, `SELECT name FROM accounts ORDER BY name`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//"held" cannot be deleted because of its legal hold
+	assert.DeepEqual(t, "remaining accounts", accountNames, []string{"held", "later", "permanent", "soon"})
+	orch := keppel.State.OrchestrationDriver.(*test.OrchestrationDriver)
+	assert.DeepEqual(t, "stopped registries", orch.StoppedRegistries, []string{"expired"})
+
+	var events []keppel.AuditEvent
+	_, err = keppel.State.DB.Select(&events, `SELECT * FROM audit_events ORDER BY id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	type eventInfo struct {
+		AccountName, Action, UserName, Details string
+	}
+	var actual []eventInfo
+	for _, e := range events {
+		actual = append(actual, eventInfo{e.AccountName, e.Action, e.UserName, e.Details})
+	}
+	assert.DeepEqual(t, "audit events", actual, []eventInfo{
+		{"expired", "delete_account", "keppel-account-expiry", "account expired at 2018-05-31T23:59:00Z"},
+		{"soon", "warn_account_expiry", "keppel-account-expiry", "account will be deleted at 2018-06-01T02:00:00Z unless it is renewed"},
+	})
+}
+
+func TestDeletePendingAccounts(t *testing.T) {
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	setupRegistries(t,
+		keppel.Account{Name: "active", AuthTenantID: "tenant1"},
+		keppel.Account{Name: "old", AuthTenantID: "tenant1", DeletedAt: at(-8 * 24 * time.Hour)},
+		keppel.Account{Name: "recent", AuthTenantID: "tenant1", DeletedAt: at(-24 * time.Hour)},
+	)
+
+	err := DeletePendingAccounts(context.Background(), now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//only "old" has passed the grace period, but the registry of "recent" must
+	//not be running either
+	var accountNames []string
+	_, err = keppel.State.DB.Select(&accountNames, `SELECT name FROM accounts ORDER BY name`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "remaining accounts", accountNames, []string{"active", "recent"})
+	orch := keppel.State.OrchestrationDriver.(*test.OrchestrationDriver)
+	assert.DeepEqual(t, "stopped registries", orch.StoppedRegistries, []string{"old", "recent"})
+
+	var events []keppel.AuditEvent
+	_, err = keppel.State.DB.Select(&events, `SELECT * FROM audit_events ORDER BY id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 audit event, got %d", len(events))
+	}
+	assert.DeepEqual(t, "audit event", []string{events[0].AccountName, events[0].Action, events[0].UserName, events[0].Details},
+		[]string{"old", "delete_account", "keppel-account-deletion", "deletion was requested at 2018-05-24T00:00:00Z"})
+}
@@ -0,0 +1,287 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+//Package tasks contains the background jobs that keppel-api runs alongside
+//its HTTP server.
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryclient"
+)
+
+//The image config labels that are checked for an expiry duration, in order of
+//precedence. The first one is the label name used by Quay.
+var expiryLabelNames = []string{"quay.expires-after", "expires-after"}
+
+//The pseudo-user name that appears in tokens and audit events for deletions
+//performed by the image expiry.
+const expiryUserName = "keppel-image-expiry"
+
+//RunImageExpiry calls ExpireImages periodically until the given context
+//expires.
+func RunImageExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := ExpireImages(time.Now())
+		if err != nil {
+			logg.Error("image expiry failed: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//ExpireImages deletes all images in all accounts that have expired at the
+//given time according to the expiry label in their image config. The expiry
+//label contains a duration like "7d", which is counted from the time when the
+//image was pushed. (The creation timestamp in the image config is not used
+//since reproducible builds set it to a fixed value like the Unix epoch.)
+//
+//Images are not deleted if they are under legal hold, if any of their tags is
+//protected by the "protected_tags" policy, or if their account has the
+//"immutable_tags" policy.
+func ExpireImages(now time.Time) error {
+	var accounts []keppel.Account
+	_, err := keppel.State.DB.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
+	if err != nil {
+		return err
+	}
+
+	//a broken account shall not prevent expiry in all other accounts
+	for _, account := range accounts {
+		err := expireImagesInAccount(account, now)
+		if err != nil {
+			logg.Error("image expiry failed for account %s: %s", account.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func expireImagesInAccount(account keppel.Account, now time.Time) error {
+	if account.ReadOnly {
+		//try again once the account accepts writes again
+		return nil
+	}
+	if !account.IsUsable(now) {
+		//the whole account is about to be deleted
+		return nil
+	}
+	policies, err := keppel.State.DB.GetEffectivePolicies(account)
+	if err != nil {
+		return err
+	}
+	if *policies.ImmutableTags {
+		//deleting manifests is not allowed in this account
+		return nil
+	}
+
+	client := registryclient.Client{Account: account, UserName: expiryUserName}
+	repoNames, err := client.ListRepositories()
+	if err != nil {
+		return err
+	}
+	for _, repoName := range repoNames {
+		err := expireImagesInRepo(client, policies, repoName, now)
+		if err != nil {
+			return fmt.Errorf("in repository %s: %s", repoName, err.Error())
+		}
+	}
+	return nil
+}
+
+func expireImagesInRepo(client registryclient.Client, policies keppel.AccountPolicies, repoName string, now time.Time) error {
+	tagNames, err := client.ListTags(repoName)
+	if err != nil {
+		return err
+	}
+
+	//since deleting a manifest deletes all tags pointing to it, we need to look
+	//at all tags of each manifest together
+	manifests := make(map[string]registryclient.Manifest)
+	tagNamesByDigest := make(map[string][]string)
+	digestsByTagName := make(map[string]string)
+	for _, tagName := range tagNames {
+		manifest, err := client.GetManifest(repoName, tagName)
+		if err != nil {
+			return err
+		}
+		manifests[manifest.Digest] = manifest
+		tagNamesByDigest[manifest.Digest] = append(tagNamesByDigest[manifest.Digest], tagName)
+		digestsByTagName[tagName] = manifest.Digest
+	}
+
+	digests := make([]string, 0, len(manifests))
+	for digest := range manifests {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	for _, digest := range digests {
+		manifest := manifests[digest]
+		if manifest.IsList() {
+			//manifest lists do not have an image config, hence no labels
+			continue
+		}
+		expiresAt, err := getExpiryTime(client, repoName, manifest, now)
+		if err != nil {
+			return err
+		}
+		if expiresAt == nil || now.Before(*expiresAt) {
+			continue
+		}
+
+		isProtected := false
+		for _, tagName := range tagNamesByDigest[digest] {
+			if policies.IsProtectedTag(tagName) {
+				isProtected = true
+			}
+		}
+		if isProtected {
+			logg.Info("not expiring %s/%s@%s: image has protected tags", client.Account.Name, repoName, digest)
+			continue
+		}
+		isHeld, err := keppel.State.DB.IsManifestHeld(client.Account.Name, repoName, digest)
+		if err != nil {
+			return err
+		}
+		if isHeld {
+			logg.Info("not expiring %s/%s@%s: image is under legal hold", client.Account.Name, repoName, digest)
+			continue
+		}
+		isPinned, err := keppel.State.DB.IsManifestPinned(client.Account.Name, repoName, digest)
+		if err != nil {
+			return err
+		}
+		if isPinned {
+			logg.Info("not expiring %s/%s@%s: image is referenced by a tag snapshot", client.Account.Name, repoName, digest)
+			continue
+		}
+
+		err = client.DeleteManifest(repoName, digest)
+		if err != nil {
+			return err
+		}
+		logg.Info("expired %s/%s@%s", client.Account.Name, repoName, digest)
+
+		//the SBOM attached to the image is useless without it
+		if sbomDigest, exists := digestsByTagName[sbomTagName(digest)]; exists {
+			err = client.DeleteManifest(repoName, sbomDigest)
+			if err != nil {
+				return err
+			}
+		}
+		err = keppel.State.DB.RecordAuditEvent(keppel.AuditEvent{
+			AccountName: client.Account.Name,
+			Action:      "expire_manifest",
+			UserName:    expiryUserName,
+			RepoName:    repoName,
+			Digest:      digest,
+			Details: fmt.Sprintf("expired at %s, deleted tags: %s",
+				expiresAt.UTC().Format(time.RFC3339), strings.Join(tagNamesByDigest[digest], ", ")),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//getExpiryTime returns when the given image expires, or nil if it does not
+//have a (valid) expiry label.
+func getExpiryTime(client registryclient.Client, repoName string, manifest registryclient.Manifest, now time.Time) (*time.Time, error) {
+	configBytes, err := client.GetBlob(repoName, manifest.ConfigDigest)
+	if err != nil {
+		return nil, err
+	}
+	var imageConfig struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	err = json.Unmarshal(configBytes, &imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image config %s: %s", manifest.ConfigDigest, err.Error())
+	}
+	for _, labelName := range expiryLabelNames {
+		value, exists := imageConfig.Config.Labels[labelName]
+		if !exists {
+			continue
+		}
+		duration, err := parseExpiryDuration(value)
+		if err != nil {
+			//this is the user's problem, not ours
+			logg.Info("ignoring malformed %s label on %s/%s@%s: %s",
+				labelName, client.Account.Name, repoName, manifest.Digest, err.Error())
+			return nil, nil
+		}
+		pushedAt, err := keppel.State.DB.GetManifestPushTime(client.Account.Name, repoName, manifest.Digest, now)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt := pushedAt.Add(duration)
+		return &expiresAt, nil
+	}
+	return nil, nil
+}
+
+var expiryDurationRx = regexp.MustCompile(`^([0-9]+)([smhdw])$`)
+
+var expiryDurationUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+//parseExpiryDuration parses durations like "7d" or "2w", in the format
+//accepted by Quay for the "quay.expires-after" label.
+func parseExpiryDuration(in string) (time.Duration, error) {
+	match := expiryDurationRx.FindStringSubmatch(strings.TrimSpace(in))
+	if match == nil {
+		return 0, fmt.Errorf("expected a duration like \"7d\", got %q", in)
+	}
+	value, err := strconv.ParseUint(match[1], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	//time.Duration cannot represent more than about 292 years
+	unit := expiryDurationUnits[match[2]]
+	if value > uint64(math.MaxInt64/unit) {
+		return 0, fmt.Errorf("duration %q is too long", in)
+	}
+	return time.Duration(value) * unit, nil
+}
@@ -0,0 +1,210 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tasks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func setupRegistries(t *testing.T, accounts ...keppel.Account) map[string]*test.Registry {
+	test.Setup(t, `
+		api: { public_url: 'https://registry.example.org' }
+		auth: { driver: unittest }
+		orchestration: { driver: unittest }
+		storage: { driver: unittest }
+	`)
+
+	orch := keppel.State.OrchestrationDriver.(*test.OrchestrationDriver)
+	result := make(map[string]*test.Registry)
+	for _, account := range accounts {
+		err := keppel.State.DB.Insert(&account)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result[account.Name] = test.NewRegistry()
+		orch.Registries[account.Name] = result[account.Name]
+	}
+	return result
+}
+
+func imageConfig(created time.Time, labels map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"created": created.Format(time.RFC3339),
+		"config":  map[string]interface{}{"Labels": labels},
+	}
+}
+
+func tagNamesIn(r *test.Registry, repoName string) []string {
+	var result []string
+	for tagName := range r.Repos[repoName].Tags {
+		result = append(result, tagName)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestImageExpiry(t *testing.T) {
+	registries := setupRegistries(t,
+		keppel.Account{Name: "first", AuthTenantID: "tenant1", PoliciesJSON: `{"protected_tags":"v[0-9.]+"}`},
+		keppel.Account{Name: "immutable", AuthTenantID: "tenant1", PoliciesJSON: `{"immutable_tags":true}`},
+	)
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	longAgo := now.Add(-30 * 24 * time.Hour)
+	recently := now.Add(-1 * time.Hour)
+	expiresInAWeek := map[string]string{"quay.expires-after": "1w"}
+
+	first := registries["first"]
+	//the expiry is counted from the push time, not from the creation timestamp
+	//in the image config
+	addImage := func(r *test.Registry, repoName string, config map[string]interface{}, pushedAt time.Time, tagNames ...string) string {
+		t.Helper()
+		digest := r.AddImage(repoName, config, tagNames...)
+		nameParts := strings.SplitN(repoName, "/", 2)
+		err := keppel.State.DB.RecordManifestPush(nameParts[0], nameParts[1], digest, pushedAt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return digest
+	}
+	expiredDigest := addImage(first, "first/foo", imageConfig(longAgo, expiresInAWeek), longAgo, "old", "old-alias")
+	//the SBOM attached to the expired image is deleted along with it
+	first.AddManifest("first/foo", "application/vnd.oci.image.manifest.v1+json", []byte(fmt.Sprintf(
+		`{"schemaVersion":2,"config":{"digest":%q},"layers":[],"subject":{"digest":%q}}`,
+		first.AddBlob([]byte("{}")), expiredDigest,
+	)), sbomTagName(expiredDigest))
+	addImage(first, "first/foo", imageConfig(recently, map[string]string{"expires-after": "7d"}), recently, "new")
+	addImage(first, "first/foo", imageConfig(longAgo, nil), longAgo, "no-label")
+	addImage(first, "first/foo", imageConfig(longAgo, map[string]string{"expires-after": "soon"}), longAgo, "bad-label")
+	addImage(first, "first/foo", imageConfig(longAgo, map[string]string{"expires-after": "300000000w"}), longAgo, "overlong-label")
+	addImage(first, "first/foo", imageConfig(longAgo.Add(time.Second), expiresInAWeek), longAgo, "v1.0", "release")
+	//reproducible builds set the creation timestamp to the Unix epoch
+	addImage(first, "first/foo", imageConfig(time.Unix(0, 0), expiresInAWeek), recently, "reproducible")
+	heldDigest := addImage(first, "first/held", imageConfig(longAgo, expiresInAWeek), longAgo, "latest")
+	addImage(registries["immutable"], "immutable/foo", imageConfig(longAgo, expiresInAWeek), longAgo, "latest")
+	//for images that were pushed before push times were recorded, the expiry
+	//counts from when the image expiry sees them for the first time
+	unrecordedDigest := first.AddImage("first/foo", imageConfig(longAgo.Add(2*time.Second), expiresInAWeek), "unrecorded")
+
+	err := keppel.State.DB.Insert(&keppel.LegalHold{
+		AccountName: "first",
+		RepoName:    "held",
+		Digest:      heldDigest,
+		Reason:      "investigation",
+		Reference:   "CASE-42",
+		CreatedAt:   longAgo,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = ExpireImages(now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//only the expired, unprotected image was deleted (with both its tags)
+	assert.DeepEqual(t, "tags in first/foo",
+		tagNamesIn(first, "first/foo"),
+		[]string{"bad-label", "new", "no-label", "overlong-label", "release", "reproducible", "unrecorded", "v1.0"},
+	)
+	pushedAt, err := keppel.State.DB.GetManifestPushTime("first", "foo", unrecordedDigest, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "push time of unrecorded image", pushedAt.UTC(), now)
+	assert.DeepEqual(t, "tags in first/held", tagNamesIn(first, "first/held"), []string{"latest"})
+	assert.DeepEqual(t, "tags in immutable/foo", tagNamesIn(registries["immutable"], "immutable/foo"), []string{"latest"})
+
+	//the deletion was recorded in the audit trail
+	var events []keppel.AuditEvent
+	_, err = keppel.State.DB.Select(&events, `SELECT * FROM audit_events ORDER BY id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for idx := range events {
+		//the hash covers the timestamp, so it cannot be predicted either
+		events[idx].CreatedAt = time.Time{}
+		events[idx].Hash = ""
+	}
+	assert.DeepEqual(t, "audit events", events, []keppel.AuditEvent{{
+		ID:          1,
+		Sequence:    1,
+		AccountName: "first",
+		Action:      "expire_manifest",
+		UserName:    "keppel-image-expiry",
+		RepoName:    "foo",
+		Digest:      expiredDigest,
+		Details:     "expired at 2018-05-09T00:00:00Z, deleted tags: old, old-alias",
+	}})
+
+	//running again does not find anything else to do
+	err = ExpireImages(now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	count, err := keppel.State.DB.SelectInt(`SELECT COUNT(*) FROM audit_events`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of audit events", count, int64(1))
+
+	//once their durations have passed, the recently pushed images expire as well
+	err = ExpireImages(now.Add(8 * 24 * time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "tags in first/foo",
+		tagNamesIn(first, "first/foo"),
+		[]string{"bad-label", "no-label", "overlong-label", "release", "v1.0"},
+	)
+}
+
+func TestParseExpiryDuration(t *testing.T) {
+	testCases := map[string]time.Duration{
+		"30s": 30 * time.Second,
+		"5m":  5 * time.Minute,
+		"12h": 12 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+	}
+	for input, expected := range testCases {
+		actual, err := parseExpiryDuration(input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", input, err.Error())
+		} else if actual != expected {
+			t.Errorf("expected %q to parse into %s, but got %s", input, expected, actual)
+		}
+	}
+
+	for _, input := range []string{"", "7", "d", "7 days", "-1d", "1y", "300000000w"} {
+		_, err := parseExpiryDuration(input)
+		if err == nil {
+			t.Errorf("expected error for %q, but got none", input)
+		}
+	}
+}
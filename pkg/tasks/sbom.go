@@ -0,0 +1,191 @@
+/******************************************************************************
+*
+*  Copyright 2018 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/registryclient"
+	"github.com/sapcc/keppel/pkg/sbom"
+)
+
+//The pseudo-user name that appears in tokens issued for SBOM generation.
+const sbomUserName = "keppel-sbom-generator"
+
+//errAccountReadOnly is returned by generateSBOM when the SBOM cannot be
+//attached to its manifest because writes to the account are suspended.
+var errAccountReadOnly = errors.New("account is read-only")
+
+//sbomTagName returns the name of the tag pointing to the SBOM artifact
+//attached to the manifest with the given digest. This follows the naming
+//scheme used by cosign, so that clients without support for the referrers API
+//can find the SBOM.
+func sbomTagName(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sbom"
+}
+
+//RunSBOMGeneration calls GenerateSBOMs periodically until the given context
+//expires.
+func RunSBOMGeneration(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := GenerateSBOMs()
+		if err != nil {
+			logg.Error("SBOM generation failed: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//GenerateSBOMs generates SBOMs for all manifests that were enqueued with
+//keppel.DB.EnqueueSBOM(), and attaches each SBOM to its manifest as an OCI
+//artifact. Failure to generate the SBOM for a single manifest is recorded in
+//its SBOM record and does not cause an error to be returned. SBOMs for
+//read-only accounts stay pending until the account becomes writable again.
+func GenerateSBOMs() error {
+	var pending []keppel.SBOM
+	_, err := keppel.State.DB.Select(&pending,
+		`SELECT * FROM sboms WHERE status = $1 ORDER BY updated_at`, keppel.SBOMPending)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range pending {
+		contents, err := generateSBOM(s)
+		if err == errAccountReadOnly {
+			continue
+		}
+		if err == nil {
+			s.Status = keppel.SBOMReady
+			s.Contents = string(contents)
+		} else {
+			logg.Info("cannot generate SBOM for %s/%s@%s: %s", s.AccountName, s.RepoName, s.Digest, err.Error())
+			s.Status = keppel.SBOMFailed
+			s.Message = err.Error()
+		}
+		s.UpdatedAt = time.Now().UTC()
+		_, err = keppel.State.DB.Update(&s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateSBOM(s keppel.SBOM) ([]byte, error) {
+	account, err := keppel.State.DB.FindAccount(s.AccountName)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, errors.New("account does not exist")
+	}
+	if account.ReadOnly {
+		return nil, errAccountReadOnly
+	}
+
+	client := registryclient.Client{Account: *account, UserName: sbomUserName}
+	manifest, err := client.GetManifest(s.RepoName, s.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.IsList() {
+		return nil, errors.New("manifest lists and image indexes do not have layers; see the SBOMs of the manifests referenced by it")
+	}
+
+	scanner := sbom.NewScanner()
+	for _, layerDigest := range manifest.LayerDigests {
+		err := scanLayer(client, scanner, s.RepoName, layerDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	imageName := keppel.State.Config.APIPublicURL.Host + "/" + s.AccountName + "/" + s.RepoName
+	contents, err := sbom.RenderCycloneDX(scanner, imageName, s.Digest, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return contents, attachSBOM(client, s.RepoName, manifest, contents)
+}
+
+//attachSBOM uploads the given SBOM into the registry as an OCI artifact whose
+//subject is the given manifest.
+func attachSBOM(client registryclient.Client, repoName string, manifest registryclient.Manifest, contents []byte) error {
+	const artifactMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+	//the artifact does not have a config, so we use the empty JSON object like
+	//other tools (e.g. cosign) do
+	emptyConfig := []byte("{}")
+	configDigest, err := client.UploadBlob(repoName, emptyConfig)
+	if err != nil {
+		return err
+	}
+	sbomDigest, err := client.UploadBlob(repoName, contents)
+	if err != nil {
+		return err
+	}
+
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int    `json:"size"`
+	}
+	artifactBytes, err := json.Marshal(struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+		Subject       descriptor   `json:"subject"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     artifactMediaType,
+		Config:        descriptor{"application/vnd.oci.image.config.v1+json", configDigest, len(emptyConfig)},
+		Layers:        []descriptor{{sbom.CycloneDXMediaType, sbomDigest, len(contents)}},
+		Subject:       descriptor{manifest.MediaType, manifest.Digest, len(manifest.Contents)},
+	})
+	if err != nil {
+		return err
+	}
+	return client.PutManifest(repoName, sbomTagName(manifest.Digest), registryclient.Manifest{
+		MediaType: artifactMediaType,
+		Contents:  artifactBytes,
+	})
+}
+
+func scanLayer(client registryclient.Client, scanner *sbom.Scanner, repoName, layerDigest string) error {
+	body, err := client.OpenBlob(repoName, layerDigest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return scanner.ScanLayer(body)
+}
@@ -0,0 +1,147 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tasks
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/keppel/pkg/keppel"
+	"github.com/sapcc/keppel/pkg/test"
+)
+
+func TestSBOMGeneration(t *testing.T) {
+	registries := setupRegistries(t, keppel.Account{Name: "first", AuthTenantID: "tenant1"})
+	r := registries["first"]
+
+	imageDigest := r.AddImageWithLayers("first/foo", imageConfig(time.Now(), nil), [][]byte{
+		test.MakeLayer(test.LayerFile{Path: "lib/apk/db/installed", Contents: "P:musl\nV:1.2.2-r3\nA:x86_64\n"}),
+		test.MakeLayer(test.LayerFile{Path: "usr/lib/node_modules/npm/package.json", Contents: `{"name":"npm","version":"7.0.0"}`}),
+	}, "latest")
+	listDigest := r.AddManifest("first/foo", "application/vnd.docker.distribution.manifest.list.v2+json",
+		[]byte(`{"schemaVersion":2,"manifests":[]}`), "multiarch")
+
+	for _, digest := range []string{imageDigest, listDigest, imageDigest} {
+		err := keppel.State.DB.EnqueueSBOM("first", "foo", digest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := GenerateSBOMs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the image has an SBOM with the components from both layers
+	s, err := keppel.State.DB.FindSBOM("first", "foo", imageDigest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "status of image SBOM", s.Status, keppel.SBOMReady)
+	var doc struct {
+		Metadata struct {
+			Component struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"component"`
+		} `json:"metadata"`
+		Components []struct {
+			PURL string `json:"purl"`
+		} `json:"components"`
+	}
+	err = json.Unmarshal([]byte(s.Contents), &doc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "SBOM subject name", doc.Metadata.Component.Name, "registry.example.org/first/foo")
+	assert.DeepEqual(t, "SBOM subject version", doc.Metadata.Component.Version, imageDigest)
+	var purls []string
+	for _, c := range doc.Components {
+		purls = append(purls, c.PURL)
+	}
+	assert.DeepEqual(t, "SBOM components", purls, []string{
+		"pkg:apk/musl@1.2.2-r3?arch=x86_64",
+		"pkg:npm/npm@7.0.0",
+	})
+
+	//the SBOM is attached to the image as an OCI artifact
+	repo := r.Repos["first/foo"]
+	artifact, exists := repo.Manifests[repo.Tags[sbomTagName(imageDigest)]]
+	if !exists {
+		t.Fatal("SBOM artifact was not pushed")
+	}
+	var artifactData struct {
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+		} `json:"layers"`
+		Subject struct {
+			Digest string `json:"digest"`
+		} `json:"subject"`
+	}
+	err = json.Unmarshal(artifact.Contents, &artifactData)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "SBOM artifact subject", artifactData.Subject.Digest, imageDigest)
+	assert.DeepEqual(t, "SBOM artifact layer count", len(artifactData.Layers), 1)
+	assert.DeepEqual(t, "SBOM artifact media type", artifactData.Layers[0].MediaType, "application/vnd.cyclonedx+json")
+	assert.DeepEqual(t, "SBOM artifact contents", string(r.Blobs[artifactData.Layers[0].Digest]), s.Contents)
+
+	//manifest lists do not get an SBOM
+	s, err = keppel.State.DB.FindSBOM("first", "foo", listDigest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "status of manifest list SBOM", s.Status, keppel.SBOMFailed)
+
+	//failed SBOMs are retried when the manifest is pushed again, but ready
+	//SBOMs are not generated again
+	for _, digest := range []string{imageDigest, listDigest} {
+		err := keppel.State.DB.EnqueueSBOM("first", "foo", digest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for digest, expected := range map[string]keppel.SBOMStatus{imageDigest: keppel.SBOMReady, listDigest: keppel.SBOMPending} {
+		s, err := keppel.State.DB.FindSBOM("first", "foo", digest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "status after re-enqueuing "+digest, s.Status, expected)
+	}
+
+	//while the account is read-only, SBOMs cannot be attached, so they stay pending
+	_, err = keppel.State.DB.SetAccountReadOnly("first", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = GenerateSBOMs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err = keppel.State.DB.FindSBOM("first", "foo", listDigest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "status of SBOM in read-only account", s.Status, keppel.SBOMPending)
+}
@@ -0,0 +1,110 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/sapcc/keppel/pkg/agent"
+)
+
+//AgentLauncher is an agent.Launcher for unit tests. Instead of running
+//keppel-registry processes, it starts HTTP servers that respond to each
+//request with a line like "<account> on <launcher name>: <method> <path>".
+//If the RegistrySpec contains TLS settings, the servers require mutual TLS
+//like keppel-registry would.
+type AgentLauncher struct {
+	Name      string
+	mutex     sync.Mutex
+	launches  map[string]int    //key = account name
+	stopFuncs map[string]func() //key = account name
+}
+
+//NewAgentLauncher initializes an AgentLauncher.
+func NewAgentLauncher(name string) *AgentLauncher {
+	return &AgentLauncher{
+		Name:      name,
+		launches:  make(map[string]int),
+		stopFuncs: make(map[string]func()),
+	}
+}
+
+//Launch implements the agent.Launcher interface.
+func (l *AgentLauncher) Launch(accountName string, spec agent.RegistrySpec) (*agent.Process, error) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s on %s: %s %s", accountName, l.Name, r.Method, r.URL.Path)
+	}))
+	if spec.TLS == nil {
+		server.Start()
+	} else {
+		keyPair, err := tls.X509KeyPair([]byte(spec.TLS.CertPEM), []byte(spec.TLS.KeyPEM))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM([]byte(spec.TLS.CACertPEM))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{keyPair},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+		server.StartTLS()
+	}
+	exited := make(chan error, 1)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			server.Close()
+			exited <- nil
+		})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.launches[accountName]++
+	l.stopFuncs[accountName] = stop
+	return &agent.Process{
+		Address: server.Listener.Addr().String(),
+		Exited:  exited,
+		Stop:    stop,
+	}, nil
+}
+
+//Launches returns how often a registry was launched for the given account.
+func (l *AgentLauncher) Launches(accountName string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.launches[accountName]
+}
+
+//Crash simulates an unexpected exit of the registry for the given account.
+func (l *AgentLauncher) Crash(accountName string) {
+	l.mutex.Lock()
+	stop := l.stopFuncs[accountName]
+	l.mutex.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
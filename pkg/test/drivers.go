@@ -23,6 +23,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 
 	"github.com/sapcc/keppel/pkg/keppel"
@@ -63,6 +64,14 @@ func (*noopDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.Authoriz
 	return nil, keppel.ErrUnsupported.With("AuthenticateUserFromRequest not implemented for NoopDriver")
 }
 
+func (*noopDriver) UserIdentity(an keppel.Authorization) (string, string, error) {
+	return "", "", errors.New("UserIdentity not implemented for NoopDriver")
+}
+
+func (*noopDriver) AuthorizeUserIdentity(identity string) (keppel.Authorization, *keppel.RegistryV2Error) {
+	return nil, keppel.ErrUnsupported.With("AuthorizeUserIdentity not implemented for NoopDriver")
+}
+
 func (*noopDriver) GetEnvironment(account keppel.Account, driver keppel.AuthDriver) ([]string, error) {
 	return nil, errors.New("GetEnvironment not implemented for NoopDriver")
 }
@@ -80,10 +89,16 @@ func (*noopDriver) Run(ctx context.Context) (ok bool) {
 //AuthDriver (driver ID "unittest") allows everything, but tracks all calls.
 type AuthDriver struct {
 	AccountsThatWereSetUp []keppel.Account
+	//The current permissions of each user that has authenticated so far, in
+	//the same format as the X-Test-Perms header. Tests can change these to
+	//simulate changes in the auth backend. (key = user name)
+	UserPerms map[string]string
 }
 
 func init() {
-	keppel.RegisterAuthDriver("unittest", func() keppel.AuthDriver { return &AuthDriver{} })
+	keppel.RegisterAuthDriver("unittest", func() keppel.AuthDriver {
+		return &AuthDriver{UserPerms: make(map[string]string)}
+	})
 }
 
 //ReadConfig implements the keppel.AuthDriver interface.
@@ -110,17 +125,51 @@ func (d *AuthDriver) SetupAccount(account keppel.Account, an keppel.Authorizatio
 	return nil
 }
 
-//AuthenticateUser implements the keppel.AuthDriver interface.
+//AuthenticateUser implements the keppel.AuthDriver interface. The password
+//is expected to contain the user's permissions in the same format as the
+//X-Test-Perms header for AuthenticateUserFromRequest.
 func (d *AuthDriver) AuthenticateUser(userName, password string) (keppel.Authorization, *keppel.RegistryV2Error) {
-	return nil, keppel.ErrUnsupported.With("TODO: unimplemented")
+	if password == "" {
+		return nil, keppel.ErrUnauthorized.With("wrong credentials")
+	}
+	d.UserPerms[userName] = password
+	return parsePerms(userName, password), nil
 }
 
-//AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
+//AuthenticateUserFromRequest implements the keppel.AuthDriver interface. The
+//user name can optionally be given in the X-Test-User header.
 func (d *AuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.Authorization, *keppel.RegistryV2Error) {
 	hdr := r.Header.Get("X-Test-Perms")
 	if hdr == "" {
 		return nil, keppel.ErrUnauthorized.With("missing X-Test-Perms header")
 	}
+	userName := r.Header.Get("X-Test-User")
+	if userName != "" {
+		d.UserPerms[userName] = hdr
+	}
+	return parsePerms(userName, hdr), nil
+}
+
+//UserIdentity implements the keppel.AuthDriver interface. The user identity
+//is the user name.
+func (d *AuthDriver) UserIdentity(an keppel.Authorization) (string, string, error) {
+	userName := an.(authorization).userName
+	if userName == "" {
+		return "", "", errors.New("cannot identify user without X-Test-User header")
+	}
+	return userName, userName, nil
+}
+
+//AuthorizeUserIdentity implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthorizeUserIdentity(identity string) (keppel.Authorization, *keppel.RegistryV2Error) {
+	perms, exists := d.UserPerms[identity]
+	if !exists || perms == "" {
+		return nil, keppel.ErrUnauthorized.With("no such user: %s", identity)
+	}
+	return parsePerms(identity, perms), nil
+}
+
+func parsePerms(userName, hdr string) authorization {
 	perms := make(map[string]map[string]bool)
 	for _, field := range strings.Split(hdr, ",") {
 		fields := strings.SplitN(field, ":", 2)
@@ -129,13 +178,129 @@ func (d *AuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.Author
 		}
 		perms[fields[0]][fields[1]] = true
 	}
-	return authorization{perms}, nil
+	return authorization{userName, perms}
 }
 
 type authorization struct {
-	perms map[string]map[string]bool
+	userName string
+	perms    map[string]map[string]bool
 }
 
 func (a authorization) HasPermission(perm keppel.Permission, tenantID string) bool {
 	return a.perms[string(perm)][tenantID]
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+//OrchestrationDriver (driver ID "unittest") forwards requests for an account
+//to a http.Handler that can be supplied by the unit test to simulate the
+//account's keppel-registry (usually a test.Registry).
+type OrchestrationDriver struct {
+	//key = account name
+	Registries map[string]http.Handler
+	//counts calls to TriggerRollingUpgrade
+	RollingUpgrades int
+	//records calls to StopRegistry
+	StoppedRegistries []string
+}
+
+func init() {
+	keppel.RegisterOrchestrationDriver("unittest", func() keppel.OrchestrationDriver {
+		return &OrchestrationDriver{Registries: make(map[string]http.Handler)}
+	})
+}
+
+//ReadConfig implements the keppel.OrchestrationDriver interface.
+func (d *OrchestrationDriver) ReadConfig(unmarshal func(interface{}) error) error {
+	return nil
+}
+
+//TriggerRollingUpgrade implements the keppel.RollingUpgradeTrigger interface.
+func (d *OrchestrationDriver) TriggerRollingUpgrade() error {
+	d.RollingUpgrades++
+	return nil
+}
+
+//StopRegistry implements the keppel.RegistryStopper interface.
+func (d *OrchestrationDriver) StopRegistry(account keppel.Account) error {
+	d.StoppedRegistries = append(d.StoppedRegistries, account.Name)
+	return nil
+}
+
+//DoHTTPRequest implements the keppel.OrchestrationDriver interface.
+func (d *OrchestrationDriver) DoHTTPRequest(account keppel.Account, r *http.Request) (*http.Response, error) {
+	handler := d.Registries[account.Name]
+	if handler == nil {
+		return nil, errors.New("no registry configured for account " + account.Name)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec.Result(), nil
+}
+
+//Run implements the keppel.OrchestrationDriver interface.
+func (d *OrchestrationDriver) Run(ctx context.Context) (ok bool) {
+	<-ctx.Done()
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+//FederationDriver (driver ID "unittest") keeps claims in memory. Unit tests can
+//put claims into ClaimedNames to simulate accounts created by peers.
+type FederationDriver struct {
+	//key = account name, value = auth tenant ID
+	ClaimedNames map[string]string
+}
+
+func init() {
+	keppel.RegisterFederationDriver("unittest", func() keppel.FederationDriver {
+		return &FederationDriver{ClaimedNames: make(map[string]string)}
+	})
+}
+
+//ReadConfig implements the keppel.FederationDriver interface.
+func (d *FederationDriver) ReadConfig(unmarshal func(interface{}) error) error {
+	return nil
+}
+
+//Connect implements the keppel.FederationDriver interface.
+func (d *FederationDriver) Connect() error {
+	return nil
+}
+
+//ClaimAccountName implements the keppel.FederationDriver interface.
+func (d *FederationDriver) ClaimAccountName(account keppel.Account) error {
+	tenantID, exists := d.ClaimedNames[account.Name]
+	if exists && tenantID != account.AuthTenantID {
+		return keppel.ErrAccountNameClaimed
+	}
+	d.ClaimedNames[account.Name] = account.AuthTenantID
+	return nil
+}
+
+//ForfeitAccountName implements the keppel.FederationDriver interface.
+func (d *FederationDriver) ForfeitAccountName(account keppel.Account) error {
+	delete(d.ClaimedNames, account.Name)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+//StorageDriver (driver ID "unittest") sets up keppel-registry processes to
+//store images in memory.
+type StorageDriver struct{}
+
+func init() {
+	keppel.RegisterStorageDriver("unittest", func() keppel.StorageDriver { return &StorageDriver{} })
+}
+
+//ReadConfig implements the keppel.StorageDriver interface.
+func (d *StorageDriver) ReadConfig(unmarshal func(interface{}) error) error {
+	return nil
+}
+
+//GetEnvironment implements the keppel.StorageDriver interface.
+func (d *StorageDriver) GetEnvironment(account keppel.Account, driver keppel.AuthDriver) ([]string, error) {
+	return []string{"REGISTRY_STORAGE=inmemory"}, nil
+}
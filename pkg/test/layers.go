@@ -0,0 +1,68 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+)
+
+//LayerFile is a file in a layer created by MakeLayer.
+type LayerFile struct {
+	Path     string
+	Contents string
+	//Mode defaults to 0644.
+	Mode int64
+}
+
+//MakeLayer builds an image layer (a gzip-compressed tar archive) containing
+//the given files.
+func MakeLayer(files ...LayerFile) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, file := range files {
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.Path,
+			Mode:     mode,
+			Size:     int64(len(file.Contents)),
+		})
+		if err == nil {
+			_, err = tw.Write([]byte(file.Contents))
+		}
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	err := tw.Close()
+	if err == nil {
+		err = gzw.Close()
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	return buf.Bytes()
+}
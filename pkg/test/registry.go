@@ -0,0 +1,341 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/keppel/pkg/auth"
+	"github.com/sapcc/keppel/pkg/keppel"
+)
+
+//Registry is an in-memory implementation of the subset of the Registry v2 API
+//that keppel-api uses when talking to the keppel-registry of an account
+//through package registryclient. It can be put into OrchestrationDriver.Registries.
+type Registry struct {
+	//key = full repository name (including account name)
+	Repos map[string]*Repository
+	//key = digest
+	Blobs map[string][]byte
+
+	uploadCount int
+}
+
+//Repository is a repository in a Registry.
+type Repository struct {
+	//key = tag name, value = digest
+	Tags map[string]string
+	//key = digest
+	Manifests map[string]Manifest
+}
+
+//Manifest is a manifest in a Registry.
+type Manifest struct {
+	MediaType string
+	Contents  []byte
+}
+
+//NewRegistry initializes an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		Repos: make(map[string]*Repository),
+		Blobs: make(map[string][]byte),
+	}
+}
+
+func digestOf(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *Registry) repo(repoName string) *Repository {
+	repo := r.Repos[repoName]
+	if repo == nil {
+		repo = &Repository{
+			Tags:      make(map[string]string),
+			Manifests: make(map[string]Manifest),
+		}
+		r.Repos[repoName] = repo
+	}
+	return repo
+}
+
+//AddBlob stores the given blob and returns its digest.
+func (r *Registry) AddBlob(contents []byte) string {
+	digest := digestOf(contents)
+	r.Blobs[digest] = contents
+	return digest
+}
+
+//AddManifest stores the given manifest in the given repository (given with
+//the leading account name), points the given tags to it, and returns its
+//digest.
+func (r *Registry) AddManifest(repoName, mediaType string, contents []byte, tagNames ...string) string {
+	digest := digestOf(contents)
+	repo := r.repo(repoName)
+	repo.Manifests[digest] = Manifest{MediaType: mediaType, Contents: contents}
+	for _, tagName := range tagNames {
+		repo.Tags[tagName] = digest
+	}
+	return digest
+}
+
+//AddImage is a convenience function that stores an image config with the
+//given contents, and a manifest referencing it (and no layers). Returns the
+//manifest digest.
+func (r *Registry) AddImage(repoName string, config map[string]interface{}, tagNames ...string) string {
+	return r.AddImageWithLayers(repoName, config, nil, tagNames...)
+}
+
+//AddImageWithLayers is like AddImage, but also stores the given layer blobs
+//and references them in the manifest.
+func (r *Registry) AddImageWithLayers(repoName string, config map[string]interface{}, layers [][]byte, tagNames ...string) string {
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	configDigest := r.AddBlob(configBytes)
+	layerDescs := []interface{}{}
+	for _, layer := range layers {
+		layerDescs = append(layerDescs, map[string]interface{}{
+			"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			"digest":    r.AddBlob(layer),
+			"size":      len(layer),
+		})
+	}
+	manifestBytes, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"digest":    configDigest,
+			"size":      len(configBytes),
+		},
+		"layers": layerDescs,
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	return r.AddManifest(repoName, "application/vnd.docker.distribution.manifest.v2+json", manifestBytes, tagNames...)
+}
+
+var registryPathRx = regexp.MustCompile(`^/v2/(.+)/(tags/list|manifests/[^/]+|blobs/uploads/[^/]*|blobs/[^/]+)$`)
+
+//ServeHTTP implements the http.Handler interface.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v2/_catalog" {
+		if req.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkRegistryToken(w, req, "registry", "catalog", "*") {
+			return
+		}
+		var repoNames []string
+		for repoName, repo := range r.Repos {
+			if len(repo.Manifests) > 0 {
+				repoNames = append(repoNames, repoName)
+			}
+		}
+		sort.Strings(repoNames)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"repositories": repoNames})
+		return
+	}
+
+	match := registryPathRx.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		http.NotFound(w, req)
+		return
+	}
+	repoName := match[1]
+	repo := r.Repos[repoName]
+
+	switch req.Method {
+	case "GET", "HEAD":
+		if !checkRegistryToken(w, req, "repository", repoName, "pull") {
+			return
+		}
+	case "POST", "PUT":
+		if !checkRegistryToken(w, req, "repository", repoName, "push") {
+			return
+		}
+	case "DELETE":
+		if !checkRegistryToken(w, req, "repository", repoName, "*") {
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case match[2] == "tags/list" && req.Method == "GET":
+		if repo == nil || len(repo.Manifests) == 0 {
+			keppel.ErrNameUnknown.With("").WriteAsRegistryV2ResponseTo(w)
+			return
+		}
+		var tagNames []string
+		for tagName := range repo.Tags {
+			tagNames = append(tagNames, tagName)
+		}
+		sort.Strings(tagNames)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": repoName, "tags": tagNames})
+
+	case match[2] == "blobs/uploads/" && req.Method == "POST":
+		//uploads are only supported in one piece, so there is no upload state to
+		//keep track of
+		r.uploadCount++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repoName, r.uploadCount))
+		w.WriteHeader(http.StatusAccepted)
+
+	case strings.HasPrefix(match[2], "blobs/uploads/") && req.Method == "PUT":
+		contents, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if digestOf(contents) != req.URL.Query().Get("digest") {
+			keppel.ErrDigestInvalid.With("").WriteAsRegistryV2ResponseTo(w)
+			return
+		}
+		digest := r.AddBlob(contents)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+
+	case strings.HasPrefix(match[2], "blobs/") && req.Method == "GET":
+		contents, exists := r.Blobs[strings.TrimPrefix(match[2], "blobs/")]
+		if !exists {
+			keppel.ErrBlobUnknown.With("").WriteAsRegistryV2ResponseTo(w)
+			return
+		}
+		w.Write(contents)
+
+	case strings.HasPrefix(match[2], "manifests/"):
+		r.serveManifest(w, req, repoName, strings.TrimPrefix(match[2], "manifests/"))
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repoName, reference string) {
+	if req.Method == "PUT" {
+		contents, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var tagNames []string
+		if !strings.Contains(reference, ":") {
+			tagNames = append(tagNames, reference)
+		}
+		digest := r.AddManifest(repoName, req.Header.Get("Content-Type"), contents, tagNames...)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	//resolve reference into digest
+	repo := r.Repos[repoName]
+	digest := reference
+	if repo != nil && !strings.Contains(reference, ":") {
+		digest = repo.Tags[reference]
+	}
+	var (
+		manifest Manifest
+		exists   bool
+	)
+	if repo != nil {
+		manifest, exists = repo.Manifests[digest]
+	}
+	if !exists {
+		keppel.ErrManifestUnknown.With("").WriteAsRegistryV2ResponseTo(w)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", manifest.MediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			w.Write(manifest.Contents)
+		}
+	case "DELETE":
+		//like in keppel-registry, manifests can only be deleted by digest, and
+		//this deletes all tags pointing to the manifest
+		if digest == reference {
+			delete(repo.Manifests, digest)
+			for tagName, tagDigest := range repo.Tags {
+				if tagDigest == digest {
+					delete(repo.Tags, tagName)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			keppel.ErrUnsupported.With("").WriteAsRegistryV2ResponseTo(w)
+		}
+	}
+}
+
+func checkRegistryToken(w http.ResponseWriter, r *http.Request, resourceType, resourceName, action string) bool {
+	token, rerr := auth.ParseTokenFromRequest(r)
+	if rerr == nil && !includesExactAccessTo(token, resourceType, resourceName, action) {
+		rerr = keppel.ErrDenied.With("token does not cover %s:%s:%s", resourceType, resourceName, action)
+	}
+	if rerr != nil {
+		rerr.WriteAsRegistryV2ResponseTo(w)
+		return false
+	}
+	return true
+}
+
+//includesExactAccessTo is like token.IncludesAccessTo, but like in
+//keppel-registry, wildcard scopes are not understood.
+func includesExactAccessTo(token *auth.Token, resourceType, resourceName, action string) bool {
+	for _, scope := range token.Access {
+		if scope.ResourceType == resourceType && scope.ResourceName == resourceName {
+			for _, a := range scope.Actions {
+				if a == action {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		panic(err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf)
+}